@@ -14,11 +14,13 @@ import (
 	"bytes"
 
 	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
 	"github.com/cockroachdb/cockroach/pkg/sql/sem/catid"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlliveness"
 	"github.com/cockroachdb/cockroach/pkg/util/encoding"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/cockroachdb/errors"
 )
@@ -28,61 +30,290 @@ type keyCodec interface {
 	encode(sid sqlliveness.SessionID) (roachpb.Key, error)
 	decode(key roachpb.Key) (sqlliveness.SessionID, error)
 
+	// encodeInto is like encode, but appends the key to buf and returns the
+	// extended buffer, so that a buffer can be reused across the keys of a
+	// batch of sessions. buf is returned unchanged if the session can't be
+	// encoded.
+	encodeInto(buf []byte, sid sqlliveness.SessionID) ([]byte, error)
+
 	// indexPrefix returns the prefix for an encoded key. encode() will return
 	// something with the prefix and decode will expect a key with this prefix.
 	//
 	// indexPrefix() and indexPrefix.PrefixEnd() may be used to scan the
 	// content of the table.
 	indexPrefix() roachpb.Key
+
+	// regionPrefix returns the prefix of the keys of the sessions of the
+	// input region, which must be non-empty and at most 255 bytes long. It's
+	// used by orderedRegionIterator.
+	regionPrefix(region []byte) roachpb.Key
+}
+
+// allSessionsSpan returns the span that contains the key of every session
+// encoded by the codec.
+func allSessionsSpan(c keyCodec) roachpb.Span {
+	prefix := c.indexPrefix()
+	return roachpb.Span{Key: prefix, EndKey: prefix.PrefixEnd()}
+}
+
+// orderedRegionIterator returns the bounds of the span that contains the key of
+// every session of the input region that's encoded by the codec. Scanning the
+// span yields the sessions of the region in increasing order of their uuids,
+// compared as bytes, which is also the order of their string representations.
+// That order is stable, so a scan can be resumed after the key of the last
+// session that was read, for cursor-based pagination.
+//
+// The order follows from the encoding of the keys: the sessions of a region
+// share a prefix, which is followed by the bytes of their uuid, and bytes are
+// encoded by encoding.EncodeBytesAscending, which preserves their order. Since
+// every uuid has the same length, the order of the keys is the order of the
+// uuids. With the regional by table index format, the span can also contain
+// the keys of legacy sessions, which don't include a region, but whose uuid
+// happens to start with the same bytes as the encoding of the region, so the
+// decoded sessions must be checked for their region.
+func orderedRegionIterator(c keyCodec, region []byte) (start, end roachpb.Key, err error) {
+	if len(region) == 0 {
+		return nil, nil, errors.New("session id requires a non-empty region")
+	}
+	if int(uint8(len(region))) != len(region) {
+		return nil, nil, errors.Newf("region is too long: %d", len(region))
+	}
+	prefix := c.regionPrefix(region)
+	return prefix, prefix.PrefixEnd(), nil
+}
+
+// reencode rewrites a session key that was encoded by the src codec into the
+// key of the same session under the dst codec, which can be for a different
+// tenant, table or index, or use a different index format. The key must be a
+// valid key for src, and the session must be encodable by dst: a legacy
+// session, which doesn't include a region, can't be rewritten into the
+// regional by row index format.
+func reencode(src keyCodec, key roachpb.Key, dst keyCodec) (roachpb.Key, error) {
+	id, err := src.decode(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode session key for re-encoding")
+	}
+	ret, err := dst.encode(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to re-encode session key")
+	}
+	return ret, nil
+}
+
+// decodedSessionKey is the result of decoding the key of a row of the
+// sqlliveness table.
+type decodedSessionKey struct {
+	kv kv.KeyValue
+	// id is the session id encoded in the key. It's empty if err is set.
+	id sqlliveness.SessionID
+	// legacy is true if id is in the legacy format, which does not include a
+	// region.
+	legacy bool
+	// err is set if the key could not be decoded.
+	err error
+}
+
+// decodeSessionKeys decodes the session ids from the keys of the input rows
+// of the sqlliveness table, which are returned in the same order. A key that
+// can't be decoded doesn't stop the decoding of the rest of the keys: its
+// error is returned in its decodedSessionKey instead.
+func decodeSessionKeys(c keyCodec, rows []kv.KeyValue) []decodedSessionKey {
+	ret := make([]decodedSessionKey, len(rows))
+	for i := range rows {
+		ret[i].kv = rows[i]
+		ret[i].id, ret[i].err = c.decode(rows[i].Key)
+		if ret[i].err == nil {
+			ret[i].legacy = len(ret[i].id) == legacyLen
+		}
+	}
+	return ret
+}
+
+// isValidKey returns true if the key is a well formed session key for the
+// codec.
+func isValidKey(c keyCodec, key roachpb.Key) bool {
+	_, err := c.decode(key)
+	return err == nil
+}
+
+// decodeSessionKeyPrefix strips the index prefix from the session key. If the
+// key doesn't start with the prefix, the returned error describes which
+// component of the prefix doesn't match: the tenant, the table id, or the
+// index id.
+func decodeSessionKeyPrefix(key, prefix roachpb.Key) (roachpb.Key, error) {
+	if bytes.HasPrefix(key, prefix) {
+		return key[len(prefix):], nil
+	}
+
+	keyRem, keyTenant, err := keys.DecodeTenantPrefixE(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "sqlliveness table key has an invalid tenant prefix: %v", key)
+	}
+	prefixRem, prefixTenant, err := keys.DecodeTenantPrefixE(prefix)
+	if err != nil {
+		return nil, errors.NewAssertionErrorWithWrappedErrf(err, "invalid sqlliveness index prefix: %v", prefix)
+	}
+	if keyTenant != prefixTenant {
+		return nil, errors.Newf("sqlliveness table key has tenant %s, expected tenant %s: %v",
+			keyTenant, prefixTenant, key)
+	}
+
+	_, keyTableID, keyIndexID, err := keys.DecodeTableIDIndexID(keyRem)
+	if err != nil {
+		return nil, errors.Wrapf(err, "sqlliveness table key has an invalid table or index id: %v", key)
+	}
+	_, prefixTableID, prefixIndexID, err := keys.DecodeTableIDIndexID(prefixRem)
+	if err != nil {
+		return nil, errors.NewAssertionErrorWithWrappedErrf(err, "invalid sqlliveness index prefix: %v", prefix)
+	}
+	if keyTableID != prefixTableID {
+		return nil, errors.Newf("sqlliveness table key has table id %d, expected table id %d: %v",
+			keyTableID, prefixTableID, key)
+	}
+	if keyIndexID != prefixIndexID {
+		return nil, errors.Newf("sqlliveness table key has index id %d, expected index id %d: %v",
+			keyIndexID, prefixIndexID, key)
+	}
+	return nil, errors.Newf("sqlliveness table key has an invalid prefix: %v", key)
+}
+
+// decodeSessionKeyFamily validates the remainder of a session key after its
+// columns were decoded, which must be the suffix for column family 0.
+func decodeSessionKeyFamily(rem []byte) error {
+	rem, familyID, err := encoding.DecodeUvarintAscending(rem)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode column family from session key")
+	}
+	if familyID != 0 {
+		return errors.Newf("session key has column family %d, expected column family 0", familyID)
+	}
+	if len(rem) != 0 {
+		return errors.Newf("session key has %d unexpected trailing bytes", len(rem))
+	}
+	return nil
 }
 
 // makeKeyCodec constructs a key codec. It consults the
 // COCKROACH_MR_SYSTEM_DATABASE environment variable to determine if it should
-// use the regional by table or regional by row index format.
-func makeKeyCodec(codec keys.SQLCodec, tableID catid.DescID, rbrIndex catid.IndexID) keyCodec {
+// use the regional by table or regional by row index format. The codec counts
+// the encoding and decoding errors that it encounters in the metrics for its
+// format. The legacy sessions of the regional by table format are counted by
+// the expired session scan instead, since they're valid.
+//
+// Neither format assumes a width for the physical representations of the
+// values of the region enum, which grow as regions are added between existing
+// ones: the regional by row format encodes the region as a column of its own,
+// which is length-delimited by its encoding, and the session ids stored by the
+// regional by table format are prefixed with the length of their region. So
+// the codec doesn't need the region enum's type descriptor, and keys remain
+// valid as the enum grows, for any region of up to 255 bytes.
+func makeKeyCodec(
+	codec keys.SQLCodec, tableID catid.DescID, rbrIndex catid.IndexID, metrics *Metrics,
+) keyCodec {
 	if systemschema.TestSupportMultiRegion() {
-		return &rbrEncoder{codec.IndexPrefix(uint32(tableID), uint32(rbrIndex))}
+		return &rbrEncoder{
+			rbrIndex: codec.IndexPrefix(uint32(tableID), uint32(rbrIndex)),
+			metrics: keyCodecMetrics{
+				legacySessions:        metrics.KeyCodecRBRLegacySessions,
+				encodeErrors:          metrics.KeyCodecRBREncodeErrors,
+				prefixDecodeErrors:    metrics.KeyCodecRBRPrefixDecodeErrors,
+				malformedDecodeErrors: metrics.KeyCodecRBRMalformedDecodeErrors,
+			},
+		}
 	}
 	const rbtIndexID = 1
-	return &rbtEncoder{codec.IndexPrefix(uint32(tableID), rbtIndexID)}
+	return &rbtEncoder{
+		rbtIndex: codec.IndexPrefix(uint32(tableID), rbtIndexID),
+		metrics: keyCodecMetrics{
+			prefixDecodeErrors:    metrics.KeyCodecRBTPrefixDecodeErrors,
+			malformedDecodeErrors: metrics.KeyCodecRBTMalformedDecodeErrors,
+		},
+	}
+}
+
+// keyCodecMetrics are the metrics of a keyCodec, which are the metrics for
+// its index format.
+type keyCodecMetrics struct {
+	// legacySessions counts the legacy session ids, which don't include a
+	// region, that the codec failed to encode. It's nil for codecs that can
+	// encode legacy session ids.
+	legacySessions *metric.Counter
+	// encodeErrors counts the session ids that the codec failed to encode for a
+	// reason other than being legacy session ids. It's nil for codecs that
+	// can't fail to encode.
+	encodeErrors *metric.Counter
+	// prefixDecodeErrors counts the keys that the codec failed to decode
+	// because they don't have its index prefix.
+	prefixDecodeErrors *metric.Counter
+	// malformedDecodeErrors counts the keys that the codec failed to decode
+	// even though they have its index prefix.
+	malformedDecodeErrors *metric.Counter
 }
 
 type rbrEncoder struct {
 	rbrIndex roachpb.Key
+	metrics  keyCodecMetrics
 }
 
 func (e *rbrEncoder) encode(session sqlliveness.SessionID) (roachpb.Key, error) {
+	return e.encodeInto(nil, session)
+}
+
+func (e *rbrEncoder) encodeInto(buf []byte, session sqlliveness.SessionID) ([]byte, error) {
 	region, uuid, err := UnsafeDecodeSessionID(session)
 	if err != nil {
-		return nil, err
+		e.metrics.encodeErrors.Inc(1)
+		return buf, err
 	}
 	if len(region) == 0 {
-		return nil, errors.Newf("legacy session passed to rbr table: '%s'", session.String())
+		e.metrics.legacySessions.Inc(1)
+		return buf, errors.Newf("legacy session passed to rbr table: '%s'", session.String())
 	}
 
 	const columnFamilyID = 0
 
-	key := e.indexPrefix()
+	key := append(buf, e.rbrIndex...)
 	key = encoding.EncodeBytesAscending(key, region)
 	key = encoding.EncodeBytesAscending(key, uuid)
 	return keys.MakeFamilyKey(key, columnFamilyID), nil
 }
 
 func (e *rbrEncoder) decode(key roachpb.Key) (sqlliveness.SessionID, error) {
-	if !bytes.HasPrefix(key, e.rbrIndex) {
-		return "", errors.Newf("sqlliveness table key has an invalid prefix: %v", key)
+	rem, err := decodeSessionKeyPrefix(key, e.rbrIndex)
+	if err != nil {
+		e.metrics.prefixDecodeErrors.Inc(1)
+		return "", err
 	}
-	rem := key[len(e.rbrIndex):]
+	id, err := e.decodeColumns(key, rem)
+	if err != nil {
+		e.metrics.malformedDecodeErrors.Inc(1)
+	}
+	return id, err
+}
 
+// decodeColumns decodes the session id from the remainder of the input key
+// after its index prefix.
+func (e *rbrEncoder) decodeColumns(key, rem roachpb.Key) (sqlliveness.SessionID, error) {
 	rem, region, err := encoding.DecodeBytesAscending(rem, nil)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to decode region from session key")
 	}
+	if len(region) == 0 {
+		return "", errors.Newf("session key has an empty region: %v", key)
+	}
 
 	rem, rawUUID, err := encoding.DecodeBytesAscending(rem, nil)
 	if err != nil {
 		return "", errors.Wrap(err, "failed to decode uuid from session key")
 	}
+	if len(rawUUID) != uuid.Size {
+		return "", errors.Newf("session key has a uuid with length %d, expected length %d: %v",
+			len(rawUUID), uuid.Size, key)
+	}
+
+	if err := decodeSessionKeyFamily(rem); err != nil {
+		return "", err
+	}
 
 	id, err := uuid.FromBytes(rawUUID)
 	if err != nil {
@@ -96,27 +327,54 @@ func (e *rbrEncoder) indexPrefix() roachpb.Key {
 	return e.rbrIndex.Clone()
 }
 
+func (e *rbrEncoder) regionPrefix(region []byte) roachpb.Key {
+	return encoding.EncodeBytesAscending(e.indexPrefix(), region)
+}
+
 type rbtEncoder struct {
 	rbtIndex roachpb.Key
+	metrics  keyCodecMetrics
 }
 
 func (e *rbtEncoder) encode(id sqlliveness.SessionID) (roachpb.Key, error) {
+	return e.encodeInto(nil, id)
+}
+
+func (e *rbtEncoder) encodeInto(buf []byte, id sqlliveness.SessionID) ([]byte, error) {
 	const columnFamilyID = 0
 
-	key := e.indexPrefix()
+	key := append(buf, e.rbtIndex...)
 	key = encoding.EncodeBytesAscending(key, id.UnsafeBytes())
 	return keys.MakeFamilyKey(key, columnFamilyID), nil
 }
 
 func (e *rbtEncoder) decode(key roachpb.Key) (sqlliveness.SessionID, error) {
-	if !bytes.HasPrefix(key, e.rbtIndex) {
-		return "", errors.Newf("sqlliveness table key has an invalid prefix: %v", key)
+	rem, err := decodeSessionKeyPrefix(key, e.rbtIndex)
+	if err != nil {
+		e.metrics.prefixDecodeErrors.Inc(1)
+		return "", err
 	}
-	rem := key[len(e.rbtIndex):]
+	id, err := e.decodeColumns(key, rem)
+	if err != nil {
+		e.metrics.malformedDecodeErrors.Inc(1)
+		return "", err
+	}
+	return id, nil
+}
 
+// decodeColumns decodes the session id from the remainder of the input key
+// after its index prefix.
+func (e *rbtEncoder) decodeColumns(key, rem roachpb.Key) (sqlliveness.SessionID, error) {
 	rem, session, err := encoding.DecodeBytesAscending(rem, nil)
 	if err != nil {
-		return "", errors.Wrap(err, "failed to decode region from session key")
+		return "", errors.Wrap(err, "failed to decode session id from session key")
+	}
+	if _, _, err := UnsafeDecodeSessionID(sqlliveness.SessionID(session)); err != nil {
+		return "", errors.Wrapf(err, "session key contains an invalid session id: %v", key)
+	}
+
+	if err := decodeSessionKeyFamily(rem); err != nil {
+		return "", err
 	}
 
 	return sqlliveness.SessionID(session), nil
@@ -125,3 +383,16 @@ func (e *rbtEncoder) decode(key roachpb.Key) (sqlliveness.SessionID, error) {
 func (e *rbtEncoder) indexPrefix() roachpb.Key {
 	return e.rbtIndex.Clone()
 }
+
+func (e *rbtEncoder) regionPrefix(region []byte) roachpb.Key {
+	// The session id column holds the whole session id, so the prefix is the
+	// encoding of the version and the region without the terminator that
+	// follows the encoded bytes. Bytes are escaped one at a time, so the
+	// escaped prefix of a session id is the prefix of its escaped encoding.
+	sessionPrefix := make([]byte, 0, versionLen+regionLengthLen+len(region))
+	sessionPrefix = append(sessionPrefix, sessionIDVersion, byte(len(region)))
+	sessionPrefix = append(sessionPrefix, region...)
+	key := encoding.EncodeBytesAscending(e.indexPrefix(), sessionPrefix)
+	const terminatorLen = 2
+	return key[:len(key)-terminatorLen]
+}
@@ -12,16 +12,24 @@ package slstorage
 
 import (
 	"bytes"
+	"context"
+	"sort"
 	"testing"
 
 	"github.com/cockroachdb/cockroach/pkg/keys"
+	"github.com/cockroachdb/cockroach/pkg/kv"
 	"github.com/cockroachdb/cockroach/pkg/roachpb"
+	"github.com/cockroachdb/cockroach/pkg/settings/cluster"
 	"github.com/cockroachdb/cockroach/pkg/sql/catalog/systemschema"
 	"github.com/cockroachdb/cockroach/pkg/sql/enum"
+	"github.com/cockroachdb/cockroach/pkg/sql/sem/catid"
 	"github.com/cockroachdb/cockroach/pkg/sql/sqlliveness"
+	"github.com/cockroachdb/cockroach/pkg/util/encoding"
 	"github.com/cockroachdb/cockroach/pkg/util/envutil"
+	"github.com/cockroachdb/cockroach/pkg/util/hlc"
 	"github.com/cockroachdb/cockroach/pkg/util/leaktest"
 	"github.com/cockroachdb/cockroach/pkg/util/log"
+	"github.com/cockroachdb/cockroach/pkg/util/metric"
 	"github.com/cockroachdb/cockroach/pkg/util/uuid"
 	"github.com/stretchr/testify/require"
 )
@@ -40,9 +48,106 @@ func TestKeyEncoder(t *testing.T) {
 	})
 }
 
+func TestReencode(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	metrics := makeMetrics()
+	makeCodec := func(tenantID uint64, tableID catid.DescID, multiRegion bool) keyCodec {
+		env := "0"
+		if multiRegion {
+			env = "1"
+		}
+		defer envutil.TestSetEnv(t, "COCKROACH_MR_SYSTEM_DATABASE", env)()
+		return makeKeyCodec(keys.MakeSQLCodec(roachpb.MakeTenantID(tenantID)), tableID, 2, &metrics)
+	}
+	rbt := makeCodec(1337, 42, false)
+	otherRBT := makeCodec(5, 43, false)
+	rbr := makeCodec(1337, 42, true)
+	otherRBR := makeCodec(5, 43, true)
+
+	id, err := MakeSessionID(enum.One, uuid.MakeV4())
+	require.NoError(t, err)
+	codecs := []keyCodec{rbt, otherRBT, rbr, otherRBR}
+	for _, src := range codecs {
+		key, err := src.encode(id)
+		require.NoError(t, err)
+		for _, dst := range codecs {
+			reencoded, err := reencode(src, key, dst)
+			require.NoError(t, err)
+			expected, err := dst.encode(id)
+			require.NoError(t, err)
+			require.Equal(t, expected, reencoded)
+			decoded, err := dst.decode(reencoded)
+			require.NoError(t, err)
+			require.Equal(t, id, decoded)
+		}
+	}
+
+	// The key must be valid for the source codec.
+	key, err := otherRBT.encode(id)
+	require.NoError(t, err)
+	_, err = reencode(rbt, key, rbr)
+	require.ErrorContains(t, err, "failed to decode session key for re-encoding")
+
+	// Legacy sessions can only be re-encoded into the regional by table format.
+	legacyKey, err := rbt.encode(sqlliveness.SessionID(uuid.MakeV4().GetBytes()))
+	require.NoError(t, err)
+	_, err = reencode(rbt, legacyKey, otherRBT)
+	require.NoError(t, err)
+	_, err = reencode(rbt, legacyKey, rbr)
+	require.ErrorContains(t, err, "failed to re-encode session key")
+}
+
+func TestExpiredSessionIDs(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	ctx := context.Background()
+	settings := cluster.MakeTestingClusterSettings()
+	s := NewTestingStorage(log.MakeTestingAmbientCtxWithNewTracer(), nil /* stopper */, nil, /* clock */
+		nil /* db */, keys.SystemSQLCodec, settings, keys.SqllivenessID, 2, nil /* newTimer */)
+
+	now := hlc.Timestamp{WallTime: 100}
+	row := func(id sqlliveness.SessionID, expiration hlc.Timestamp) kv.KeyValue {
+		key, err := s.keyCodec.encode(id)
+		require.NoError(t, err)
+		v := encodeValue(expiration)
+		return kv.KeyValue{Key: key, Value: &v}
+	}
+	makeID := func() sqlliveness.SessionID {
+		id, err := MakeSessionID(enum.One, uuid.MakeV4())
+		require.NoError(t, err)
+		return id
+	}
+	expired, live := makeID(), makeID()
+	expiredRow := row(expired, now.Add(-1, 0))
+	liveRow := row(live, now.Add(1, 0))
+
+	// Rows whose key or expiration can't be decoded are skipped, without
+	// stopping the scan of the rest of the rows.
+	badKeyRow := row(makeID(), now.Add(-1, 0))
+	badKeyRow.Key = append(s.keyCodec.indexPrefix(), "not a session"...)
+	badValueRow := row(makeID(), now.Add(-1, 0))
+	badValueRow.Value = &roachpb.Value{}
+	badValueRow.Value.SetString("not an expiration")
+
+	rows := []kv.KeyValue{badKeyRow, liveRow, badValueRow, expiredRow}
+	expectedLegacy := 0
+	if !systemschema.TestSupportMultiRegion() {
+		// Legacy sessions are counted whether they're expired or not.
+		rows = append(rows, row(sqlliveness.SessionID(uuid.MakeV4().GetBytes()), now.Add(1, 0)))
+		expectedLegacy = 1
+	}
+	ids, legacy := s.expiredSessionIDs(ctx, rows, now)
+	require.Equal(t, []sqlliveness.SessionID{expired}, ids)
+	require.Equal(t, expectedLegacy, legacy)
+}
+
 func testKeyEncoder(t *testing.T) {
 	codec := keys.MakeSQLCodec(roachpb.MakeTenantID(1337))
-	keyCodec := makeKeyCodec(codec, 42, 2)
+	metrics := makeMetrics()
+	keyCodec := makeKeyCodec(codec, 42, 2, &metrics)
 
 	t.Run("Prefix", func(t *testing.T) {
 		prefix := keyCodec.indexPrefix()
@@ -75,6 +180,325 @@ func testKeyEncoder(t *testing.T) {
 		require.Equal(t, id, decodedID)
 	})
 
+	t.Run("EncodeInto", func(t *testing.T) {
+		var ids []sqlliveness.SessionID
+		for i := 0; i < 10; i++ {
+			id, err := MakeSessionID(enum.One, uuid.MakeV4())
+			require.NoError(t, err)
+			ids = append(ids, id)
+		}
+
+		// A buffer can be reused for every key of a batch.
+		var buf []byte
+		for _, id := range ids {
+			var err error
+			buf, err = keyCodec.encodeInto(buf[:0], id)
+			require.NoError(t, err)
+			expected, err := keyCodec.encode(id)
+			require.NoError(t, err)
+			require.Equal(t, expected, roachpb.Key(buf))
+		}
+
+		// The keys of a batch can also be appended to a single buffer.
+		buf = []byte("prefix")
+		var ends []int
+		for _, id := range ids {
+			var err error
+			buf, err = keyCodec.encodeInto(buf, id)
+			require.NoError(t, err)
+			ends = append(ends, len(buf))
+		}
+		require.Equal(t, "prefix", string(buf[:len("prefix")]))
+		start := len("prefix")
+		for i, end := range ends {
+			decodedID, err := keyCodec.decode(buf[start:end:end])
+			require.NoError(t, err)
+			require.Equal(t, ids[i], decodedID)
+			start = end
+		}
+
+		// The buffer is returned unchanged if the session can't be encoded. Only
+		// the regional by row format rejects session ids.
+		if systemschema.TestSupportMultiRegion() {
+			buf = []byte("prefix")
+			ret, err := keyCodec.encodeInto(buf, sqlliveness.SessionID("invalid"))
+			require.Error(t, err)
+			require.Equal(t, "prefix", string(ret))
+
+			legacyID := sqlliveness.SessionID(uuid.MakeV4().GetBytes())
+			ret, err = keyCodec.encodeInto(buf, legacyID)
+			require.Error(t, err)
+			require.Equal(t, "prefix", string(ret))
+		}
+	})
+
+	t.Run("MultiByteRegions", func(t *testing.T) {
+		// Generate enum values of increasing widths, the way values are
+		// generated for regions that are repeatedly added right after the
+		// first one, along with the longest region a session id can hold.
+		regions := [][]byte{enum.One}
+		for prev := enum.One; len(prev) < 32; {
+			prev = enum.GenByteStringBetween(enum.One, prev, enum.PackedSpacing)
+			if len(prev) > len(regions[len(regions)-1]) {
+				regions = append(regions, prev)
+			}
+		}
+		regions = append(regions, bytes.Repeat([]byte{0x80}, 255))
+
+		keysByRegion := make([]roachpb.Key, len(regions))
+		for i, region := range regions {
+			id, err := MakeSessionIDForRegion(region, uuid.MakeV4())
+			require.NoError(t, err)
+			key, err := keyCodec.encode(id)
+			require.NoError(t, err)
+			decodedID, err := keyCodec.decode(key)
+			require.NoError(t, err)
+			require.Equal(t, id, decodedID)
+			decodedRegion, _, err := UnsafeDecodeSessionID(decodedID)
+			require.NoError(t, err)
+			require.Equal(t, region, decodedRegion)
+			keysByRegion[i] = key
+		}
+
+		// The span of each region only contains the keys of its own sessions,
+		// even though the regions are prefixes of one another.
+		for i, region := range regions {
+			start, end, err := orderedRegionIterator(keyCodec, region)
+			require.NoError(t, err)
+			span := roachpb.Span{Key: start, EndKey: end}
+			for j, key := range keysByRegion {
+				require.Equal(t, i == j, span.ContainsKey(key), "region %v, key of region %v", region, regions[j])
+			}
+		}
+	})
+
+	t.Run("AllSessionsSpan", func(t *testing.T) {
+		span := allSessionsSpan(keyCodec)
+		require.Equal(t, keyCodec.indexPrefix(), span.Key)
+		require.Equal(t, keyCodec.indexPrefix().PrefixEnd(), span.EndKey)
+
+		for i := 0; i < 10; i++ {
+			id, err := MakeSessionID(enum.One, uuid.MakeV4())
+			require.NoError(t, err)
+			key, err := keyCodec.encode(id)
+			require.NoError(t, err)
+			require.True(t, span.ContainsKey(key))
+		}
+
+		// Keys of neighboring indexes are outside of the span.
+		require.False(t, span.ContainsKey(codec.IndexPrefix(42, 3)))
+		require.False(t, span.ContainsKey(codec.IndexPrefix(43, 1)))
+	})
+
+	t.Run("OrderedRegionIterator", func(t *testing.T) {
+		// Regions that are prefixes of each other, and regions that contain
+		// bytes that must be escaped, have disjoint spans.
+		regions := [][]byte{enum.One, {0x80, 0x00}, {0x80}, {0x80, 0x01}, {0x00, 0x01}}
+		spans := make([]roachpb.Span, len(regions))
+		for i, region := range regions {
+			start, end, err := orderedRegionIterator(keyCodec, region)
+			require.NoError(t, err)
+			spans[i] = roachpb.Span{Key: start, EndKey: end}
+			require.True(t, allSessionsSpan(keyCodec).Contains(spans[i]))
+		}
+
+		for i, region := range regions {
+			var uuids []uuid.UUID
+			for j := 0; j < 20; j++ {
+				uuids = append(uuids, uuid.MakeV4())
+			}
+			var maxUUID uuid.UUID
+			for j := range maxUUID {
+				maxUUID[j] = 0xff
+			}
+			uuids = append(uuids, uuid.Nil, maxUUID)
+			keysByUUID := make(map[uuid.UUID]roachpb.Key)
+			var sessionKeys []roachpb.Key
+			for _, u := range uuids {
+				id, err := MakeSessionID(region, u)
+				require.NoError(t, err)
+				key, err := keyCodec.encode(id)
+				require.NoError(t, err)
+				for j := range spans {
+					require.Equal(t, i == j, spans[j].ContainsKey(key), "region %v, span of region %v", region, regions[j])
+				}
+				keysByUUID[u] = key
+				sessionKeys = append(sessionKeys, key)
+			}
+
+			// The keys are ordered like the uuids.
+			sort.Slice(uuids, func(a, b int) bool {
+				return bytes.Compare(uuids[a].GetBytes(), uuids[b].GetBytes()) < 0
+			})
+			sort.Slice(sessionKeys, func(a, b int) bool {
+				return sessionKeys[a].Compare(sessionKeys[b]) < 0
+			})
+			for j, u := range uuids {
+				require.Equal(t, keysByUUID[u], sessionKeys[j])
+				if j > 0 {
+					require.Less(t, uuids[j-1].String(), u.String())
+				}
+			}
+		}
+
+		_, _, err := orderedRegionIterator(keyCodec, nil)
+		require.Error(t, err)
+		_, _, err = orderedRegionIterator(keyCodec, bytes.Repeat([]byte{1}, 256))
+		require.Error(t, err)
+	})
+
+	t.Run("DecodeSessionKeys", func(t *testing.T) {
+		id, err := MakeSessionID(enum.One, uuid.MakeV4())
+		require.NoError(t, err)
+		key, err := keyCodec.encode(id)
+		require.NoError(t, err)
+		rows := []kv.KeyValue{
+			{Key: key},
+			{Key: roachpb.Key("invalid")},
+		}
+		legacyID := sqlliveness.SessionID(uuid.MakeV4().GetBytes())
+		if !systemschema.TestSupportMultiRegion() {
+			legacyKey, err := keyCodec.encode(legacyID)
+			require.NoError(t, err)
+			rows = append(rows, kv.KeyValue{Key: legacyKey})
+		}
+
+		decoded := decodeSessionKeys(keyCodec, rows)
+		require.Len(t, decoded, len(rows))
+		require.NoError(t, decoded[0].err)
+		require.Equal(t, id, decoded[0].id)
+		require.False(t, decoded[0].legacy)
+		require.Error(t, decoded[1].err)
+		require.Empty(t, decoded[1].id)
+		if !systemschema.TestSupportMultiRegion() {
+			require.NoError(t, decoded[2].err)
+			require.Equal(t, legacyID, decoded[2].id)
+			require.True(t, decoded[2].legacy)
+		}
+	})
+
+	t.Run("Corruption", func(t *testing.T) {
+		id, err := MakeSessionID(enum.One, uuid.MakeV4())
+		require.NoError(t, err)
+		validKey, err := keyCodec.encode(id)
+		require.NoError(t, err)
+		require.True(t, isValidKey(keyCodec, validKey))
+
+		// withColumns builds a key with the input index prefix and encoded
+		// columns, followed by the column family suffix.
+		withColumns := func(prefix roachpb.Key, columns ...[]byte) roachpb.Key {
+			key := prefix.Clone()
+			for _, column := range columns {
+				key = encoding.EncodeBytesAscending(key, column)
+			}
+			return keys.MakeFamilyKey(key, 0)
+		}
+		validColumns := [][]byte{id.UnsafeBytes()}
+		if systemschema.TestSupportMultiRegion() {
+			region, rawUUID, err := UnsafeDecodeSessionID(id)
+			require.NoError(t, err)
+			validColumns = [][]byte{region, rawUUID}
+		}
+		indexID := uint32(1)
+		if systemschema.TestSupportMultiRegion() {
+			indexID = 2
+		}
+
+		testCases := []struct {
+			name string
+			key  roachpb.Key
+			err  string
+		}{
+			{
+				name: "wrong_tenant",
+				key:  withColumns(keys.MakeSQLCodec(roachpb.MakeTenantID(7)).IndexPrefix(42, indexID), validColumns...),
+				err:  "sqlliveness table key has tenant 7, expected tenant 1337",
+			},
+			{
+				name: "system_tenant",
+				key:  withColumns(keys.SystemSQLCodec.IndexPrefix(42, indexID), validColumns...),
+				err:  "sqlliveness table key has tenant system, expected tenant 1337",
+			},
+			{
+				name: "wrong_table",
+				key:  withColumns(codec.IndexPrefix(43, indexID), validColumns...),
+				err:  "sqlliveness table key has table id 43, expected table id 42",
+			},
+			{
+				name: "wrong_index",
+				key:  withColumns(codec.IndexPrefix(42, indexID+1), validColumns...),
+				err:  "sqlliveness table key has index id",
+			},
+			{
+				name: "truncated_prefix",
+				key:  codec.TablePrefix(42),
+				err:  "sqlliveness table key has an invalid table or index id",
+			},
+			{
+				name: "missing_family",
+				key:  validKey[:len(validKey)-1],
+				err:  "failed to decode column family from session key",
+			},
+			{
+				name: "wrong_family",
+				key:  keys.MakeFamilyKey(validKey[:len(validKey)-1], 1),
+				err:  "session key has column family 1, expected column family 0",
+			},
+			{
+				name: "trailing_bytes",
+				key:  append(validKey.Clone(), 0x01),
+				err:  "session key has 1 unexpected trailing bytes",
+			},
+		}
+		if systemschema.TestSupportMultiRegion() {
+			testCases = append(testCases, []struct {
+				name string
+				key  roachpb.Key
+				err  string
+			}{
+				{
+					name: "missing_uuid",
+					key:  withColumns(keyCodec.indexPrefix(), enum.One),
+					err:  "failed to decode uuid from session key",
+				},
+				{
+					name: "empty_region",
+					key:  withColumns(keyCodec.indexPrefix(), []byte{}, validColumns[1]),
+					err:  "session key has an empty region",
+				},
+				{
+					name: "short_uuid",
+					key:  withColumns(keyCodec.indexPrefix(), enum.One, validColumns[1][:15]),
+					err:  "session key has a uuid with length 15, expected length 16",
+				},
+			}...)
+		} else {
+			testCases = append(testCases, []struct {
+				name string
+				key  roachpb.Key
+				err  string
+			}{
+				{
+					name: "missing_session",
+					key:  keyCodec.indexPrefix(),
+					err:  "failed to decode session id from session key",
+				},
+				{
+					name: "invalid_session",
+					key:  withColumns(keyCodec.indexPrefix(), validColumns[0][1:]),
+					err:  "session key contains an invalid session id",
+				},
+			}...)
+		}
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				_, err := keyCodec.decode(tc.key)
+				require.ErrorContains(t, err, tc.err)
+				require.False(t, isValidKey(keyCodec, tc.key))
+			})
+		}
+	})
+
 	t.Run("EncodeLegacySession", func(t *testing.T) {
 		id := sqlliveness.SessionID(uuid.MakeV4().GetBytes())
 
@@ -88,4 +512,93 @@ func testKeyEncoder(t *testing.T) {
 			require.Equal(t, id, decodedID)
 		}
 	})
+
+	t.Run("DowngradedSession", func(t *testing.T) {
+		// A downgraded session can be written to the legacy table, and only to
+		// the legacy table.
+		session, err := MakeSessionID(enum.One, uuid.MakeV4())
+		require.NoError(t, err)
+		legacy, err := ToLegacySessionID(session)
+		require.NoError(t, err)
+
+		key, err := keyCodec.encode(legacy)
+		if systemschema.TestSupportMultiRegion() {
+			require.ErrorContains(t, err, "legacy session passed to rbr table")
+			return
+		}
+		require.NoError(t, err)
+		decodedID, err := keyCodec.decode(key)
+		require.NoError(t, err)
+		require.Equal(t, legacy, decodedID)
+		region, _, err := UnsafeDecodeSessionID(decodedID)
+		require.NoError(t, err)
+		require.Empty(t, region)
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		metrics := makeMetrics()
+		keyCodec := makeKeyCodec(codec, 42, 2, &metrics)
+		prefixDecodeErrors := metrics.KeyCodecRBTPrefixDecodeErrors
+		malformedDecodeErrors := metrics.KeyCodecRBTMalformedDecodeErrors
+		unused := []*metric.Counter{
+			metrics.KeyCodecRBRLegacySessions,
+			metrics.KeyCodecRBREncodeErrors,
+			metrics.KeyCodecRBRPrefixDecodeErrors,
+			metrics.KeyCodecRBRMalformedDecodeErrors,
+		}
+		if systemschema.TestSupportMultiRegion() {
+			prefixDecodeErrors = metrics.KeyCodecRBRPrefixDecodeErrors
+			malformedDecodeErrors = metrics.KeyCodecRBRMalformedDecodeErrors
+			unused = []*metric.Counter{
+				metrics.KeyCodecRBTPrefixDecodeErrors,
+				metrics.KeyCodecRBTMalformedDecodeErrors,
+			}
+		}
+
+		// Valid sessions aren't counted.
+		id, err := MakeSessionID(enum.One, uuid.MakeV4())
+		require.NoError(t, err)
+		key, err := keyCodec.encode(id)
+		require.NoError(t, err)
+		_, err = keyCodec.decode(key)
+		require.NoError(t, err)
+		require.Zero(t, metrics.KeyCodecRBRLegacySessions.Count())
+
+		// Legacy sessions are only counted by the codec if the format can't
+		// encode them. Otherwise, they're counted by the expired session scan.
+		legacyID := sqlliveness.SessionID(uuid.MakeV4().GetBytes())
+		legacyKey, err := keyCodec.encode(legacyID)
+		if systemschema.TestSupportMultiRegion() {
+			require.Error(t, err)
+			require.Equal(t, int64(1), metrics.KeyCodecRBRLegacySessions.Count())
+		} else {
+			require.NoError(t, err)
+			_, err = keyCodec.decode(legacyKey)
+			require.NoError(t, err)
+			require.Zero(t, metrics.KeyCodecRBTLegacySessions.Value())
+		}
+
+		// Decoding errors are counted by cause.
+		_, err = keyCodec.decode(codec.IndexPrefix(43, 1))
+		require.Error(t, err)
+		_, err = keyCodec.decode(roachpb.Key("invalid"))
+		require.Error(t, err)
+		require.Equal(t, int64(2), prefixDecodeErrors.Count())
+		require.Zero(t, malformedDecodeErrors.Count())
+		_, err = keyCodec.decode(append(key.Clone(), 0x01))
+		require.Error(t, err)
+		require.Equal(t, int64(2), prefixDecodeErrors.Count())
+		require.Equal(t, int64(1), malformedDecodeErrors.Count())
+
+		if systemschema.TestSupportMultiRegion() {
+			_, err = keyCodec.encode(sqlliveness.SessionID("invalid"))
+			require.Error(t, err)
+			require.Equal(t, int64(1), metrics.KeyCodecRBREncodeErrors.Count())
+		}
+
+		// The metrics of the other format are left alone.
+		for _, c := range unused {
+			require.Zero(t, c.Count())
+		}
+	})
 }
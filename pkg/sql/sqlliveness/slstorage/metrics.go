@@ -44,6 +44,55 @@ var (
 		Unit:        metric.Unit_COUNT,
 		MetricType:  io_prometheus_client.MetricType_COUNTER,
 	}
+	metaKeyCodecRBRLegacySessions = metric.Metadata{
+		Name:        "sqlliveness.key_codec.rbr.legacy_sessions",
+		Help:        "Number of legacy session ids, which have no region, that could not be encoded as regional by row session keys",
+		Measurement: "Sessions",
+		Unit:        metric.Unit_COUNT,
+		MetricType:  io_prometheus_client.MetricType_COUNTER,
+	}
+	metaKeyCodecRBREncodeErrors = metric.Metadata{
+		Name:        "sqlliveness.key_codec.rbr.encode_errors",
+		Help:        "Number of invalid session ids that could not be encoded as regional by row session keys",
+		Measurement: "Sessions",
+		Unit:        metric.Unit_COUNT,
+		MetricType:  io_prometheus_client.MetricType_COUNTER,
+	}
+	metaKeyCodecRBRPrefixDecodeErrors = metric.Metadata{
+		Name:        "sqlliveness.key_codec.rbr.decode_errors.prefix",
+		Help:        "Number of regional by row session keys that could not be decoded because of their tenant, table or index prefix",
+		Measurement: "Keys",
+		Unit:        metric.Unit_COUNT,
+		MetricType:  io_prometheus_client.MetricType_COUNTER,
+	}
+	metaKeyCodecRBRMalformedDecodeErrors = metric.Metadata{
+		Name:        "sqlliveness.key_codec.rbr.decode_errors.malformed",
+		Help:        "Number of regional by row session keys that could not be decoded because of their columns",
+		Measurement: "Keys",
+		Unit:        metric.Unit_COUNT,
+		MetricType:  io_prometheus_client.MetricType_COUNTER,
+	}
+	metaKeyCodecRBTLegacySessions = metric.Metadata{
+		Name:        "sqlliveness.key_codec.rbt.legacy_sessions",
+		Help:        "Number of legacy sessions, which have no region, that were found in the regional by table index by the last expired session scan",
+		Measurement: "Sessions",
+		Unit:        metric.Unit_COUNT,
+		MetricType:  io_prometheus_client.MetricType_GAUGE,
+	}
+	metaKeyCodecRBTPrefixDecodeErrors = metric.Metadata{
+		Name:        "sqlliveness.key_codec.rbt.decode_errors.prefix",
+		Help:        "Number of regional by table session keys that could not be decoded because of their tenant, table or index prefix",
+		Measurement: "Keys",
+		Unit:        metric.Unit_COUNT,
+		MetricType:  io_prometheus_client.MetricType_COUNTER,
+	}
+	metaKeyCodecRBTMalformedDecodeErrors = metric.Metadata{
+		Name:        "sqlliveness.key_codec.rbt.decode_errors.malformed",
+		Help:        "Number of regional by table session keys that could not be decoded because of their columns",
+		Measurement: "Keys",
+		Unit:        metric.Unit_COUNT,
+		MetricType:  io_prometheus_client.MetricType_COUNTER,
+	}
 	metaWriteSuccesses = metric.Metadata{
 		Name:        "sqlliveness.write_successes",
 		Help:        "Number of update or insert calls successfully performed",
@@ -62,12 +111,19 @@ var (
 
 // Metrics is a metric.Struct which holds metrics for slstorage.
 type Metrics struct {
-	IsAliveCacheHits     *metric.Counter
-	IsAliveCacheMisses   *metric.Counter
-	SessionsDeleted      *metric.Counter
-	SessionDeletionsRuns *metric.Counter
-	WriteSuccesses       *metric.Counter
-	WriteFailures        *metric.Counter
+	IsAliveCacheHits                 *metric.Counter
+	IsAliveCacheMisses               *metric.Counter
+	KeyCodecRBRLegacySessions        *metric.Counter
+	KeyCodecRBREncodeErrors          *metric.Counter
+	KeyCodecRBRPrefixDecodeErrors    *metric.Counter
+	KeyCodecRBRMalformedDecodeErrors *metric.Counter
+	KeyCodecRBTLegacySessions        *metric.Gauge
+	KeyCodecRBTPrefixDecodeErrors    *metric.Counter
+	KeyCodecRBTMalformedDecodeErrors *metric.Counter
+	SessionsDeleted                  *metric.Counter
+	SessionDeletionsRuns             *metric.Counter
+	WriteSuccesses                   *metric.Counter
+	WriteFailures                    *metric.Counter
 }
 
 // MetricStruct make Metrics a metric.Struct.
@@ -77,11 +133,18 @@ var _ metric.Struct = (*Metrics)(nil)
 
 func makeMetrics() Metrics {
 	return Metrics{
-		IsAliveCacheHits:     metric.NewCounter(metaIsAliveCacheHits),
-		IsAliveCacheMisses:   metric.NewCounter(metaIsAliveCacheMisses),
-		SessionsDeleted:      metric.NewCounter(metaSessionsDeleted),
-		SessionDeletionsRuns: metric.NewCounter(metaSessionDeletionRuns),
-		WriteSuccesses:       metric.NewCounter(metaWriteSuccesses),
-		WriteFailures:        metric.NewCounter(metaWriteFailures),
+		IsAliveCacheHits:                 metric.NewCounter(metaIsAliveCacheHits),
+		IsAliveCacheMisses:               metric.NewCounter(metaIsAliveCacheMisses),
+		KeyCodecRBRLegacySessions:        metric.NewCounter(metaKeyCodecRBRLegacySessions),
+		KeyCodecRBREncodeErrors:          metric.NewCounter(metaKeyCodecRBREncodeErrors),
+		KeyCodecRBRPrefixDecodeErrors:    metric.NewCounter(metaKeyCodecRBRPrefixDecodeErrors),
+		KeyCodecRBRMalformedDecodeErrors: metric.NewCounter(metaKeyCodecRBRMalformedDecodeErrors),
+		KeyCodecRBTLegacySessions:        metric.NewGauge(metaKeyCodecRBTLegacySessions),
+		KeyCodecRBTPrefixDecodeErrors:    metric.NewCounter(metaKeyCodecRBTPrefixDecodeErrors),
+		KeyCodecRBTMalformedDecodeErrors: metric.NewCounter(metaKeyCodecRBTMalformedDecodeErrors),
+		SessionsDeleted:                  metric.NewCounter(metaSessionsDeleted),
+		SessionDeletionsRuns:             metric.NewCounter(metaSessionDeletionRuns),
+		WriteSuccesses:                   metric.NewCounter(metaWriteSuccesses),
+		WriteFailures:                    metric.NewCounter(metaWriteFailures),
 	}
 }
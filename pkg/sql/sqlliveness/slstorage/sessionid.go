@@ -62,6 +62,65 @@ func MakeSessionID(region []byte, id uuid.UUID) (sqlliveness.SessionID, error) {
 	return sqlliveness.SessionID(b), nil
 }
 
+// MakeSessionIDForRegion is like MakeSessionID, but also validates that the
+// region is the physical representation of a value of a region enum. Callers
+// that construct sessions for a specific region, rather than for a region
+// that was read from an existing session, should prefer it over
+// MakeSessionID.
+func MakeSessionIDForRegion(region []byte, id uuid.UUID) (sqlliveness.SessionID, error) {
+	if err := validateRegionEnumValue(region); err != nil {
+		return sqlliveness.SessionID(""), err
+	}
+	return MakeSessionID(region, id)
+}
+
+// validateRegionEnumValue returns an error if the region is not a legal
+// physical representation of an enum value. Enum values are generated by
+// enum.GenByteStringBetween, which never produces empty values or values that
+// end with a zero byte.
+func validateRegionEnumValue(region []byte) error {
+	if len(region) == 0 {
+		return errors.New("session id requires a non-empty region")
+	}
+	if region[len(region)-1] == 0 {
+		return errors.Newf("region %x is not a valid enum value", region)
+	}
+	return nil
+}
+
+// ParseSessionID validates that b is a valid encoding of a session id and
+// returns the session id. The returned session id does not share memory with
+// b. Both legacy session ids, which are just a uuid, and session ids that
+// include a region are accepted. ParseSessionID round trips with
+// MakeSessionIDForRegion: the region of a parsed session id that includes a
+// region must be a valid enum value.
+func ParseSessionID(b []byte) (sqlliveness.SessionID, error) {
+	session := sqlliveness.SessionID(b)
+	region, _, err := UnsafeDecodeSessionID(session)
+	if err != nil {
+		return sqlliveness.SessionID(""), err
+	}
+	if region != nil {
+		if err := validateRegionEnumValue(region); err != nil {
+			return sqlliveness.SessionID(""), err
+		}
+	}
+	return session, nil
+}
+
+// ToLegacySessionID returns the legacy encoding of the session id, which is
+// just its uuid, without its region. It's meant for writing sessions to the
+// legacy regional by table sqlliveness table, such as when rolling back from
+// the regional by row table. Legacy session ids are returned as is. The
+// returned session id does not share memory with the input.
+func ToLegacySessionID(session sqlliveness.SessionID) (sqlliveness.SessionID, error) {
+	_, id, err := UnsafeDecodeSessionID(session)
+	if err != nil {
+		return sqlliveness.SessionID(""), err
+	}
+	return sqlliveness.SessionID(id), nil
+}
+
 // UnsafeDecodeSessionID decodes the region and id from the SessionID. The
 // function is unsafe, because the byte slices index into the session and must
 // not be mutated.
@@ -64,6 +64,108 @@ func TestMakeSessionIDValidation(t *testing.T) {
 	require.ErrorContains(t, err, "region is too long")
 }
 
+func TestMakeSessionIDForRegion(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	id := uuid.MakeV4()
+	regions := [][]byte{
+		enum.One,
+		enum.GenByteStringBetween(enum.One, nil, enum.PackedSpacing),
+		enum.GenByteStringBetween(nil, enum.One, enum.SpreadSpacing),
+		enum.GenByteStringBetween([]byte{0x01}, []byte{0x01, 0x01}, enum.PackedSpacing),
+	}
+	for _, region := range regions {
+		session, err := slstorage.MakeSessionIDForRegion(region, id)
+		require.NoError(t, err)
+
+		parsed, err := slstorage.ParseSessionID([]byte(session))
+		require.NoError(t, err)
+		require.Equal(t, session, parsed)
+
+		decodedRegion, decodedID, err := slstorage.UnsafeDecodeSessionID(parsed)
+		require.NoError(t, err)
+		require.Equal(t, region, decodedRegion)
+		require.Equal(t, id.GetBytes(), decodedID)
+	}
+
+	_, err := slstorage.MakeSessionIDForRegion(nil, id)
+	require.ErrorContains(t, err, "session id requires a non-empty region")
+	_, err = slstorage.MakeSessionIDForRegion([]byte{0x80, 0x00}, id)
+	require.ErrorContains(t, err, "is not a valid enum value")
+	_, err = slstorage.MakeSessionIDForRegion(append(make([]byte, 255), 0x80), id)
+	require.ErrorContains(t, err, "region is too long")
+}
+
+func TestParseSessionID(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	id := uuid.MakeV4()
+
+	// Legacy session ids are accepted.
+	parsed, err := slstorage.ParseSessionID(id.GetBytes())
+	require.NoError(t, err)
+	require.Equal(t, sqlliveness.SessionID(id.GetBytes()), parsed)
+
+	// The parsed session does not share memory with the input.
+	session, err := slstorage.MakeSessionIDForRegion(enum.One, id)
+	require.NoError(t, err)
+	b := []byte(session)
+	parsed, err = slstorage.ParseSessionID(b)
+	require.NoError(t, err)
+	b[0] = 0
+	require.Equal(t, session, parsed)
+
+	// Malformed session ids and regions that are not enum values are rejected.
+	_, err = slstorage.ParseSessionID(nil)
+	require.ErrorContains(t, err, "session id is too short")
+	_, err = slstorage.ParseSessionID(b)
+	require.ErrorContains(t, err, "invalid session id version: 0")
+	session, err = slstorage.MakeSessionID([]byte{0x80, 0x00}, id)
+	require.NoError(t, err)
+	_, err = slstorage.ParseSessionID([]byte(session))
+	require.ErrorContains(t, err, "is not a valid enum value")
+}
+
+func TestToLegacySessionID(t *testing.T) {
+	defer leaktest.AfterTest(t)()
+	defer log.Scope(t).Close(t)
+
+	id := uuid.MakeV4()
+	for _, region := range [][]byte{enum.One, make([]byte, 255)} {
+		session, err := slstorage.MakeSessionID(region, id)
+		require.NoError(t, err)
+
+		legacy, err := slstorage.ToLegacySessionID(session)
+		require.NoError(t, err)
+		require.Equal(t, sqlliveness.SessionID(id.GetBytes()), legacy)
+		decodedRegion, decodedID, err := slstorage.UnsafeDecodeSessionID(legacy)
+		require.NoError(t, err)
+		require.Empty(t, decodedRegion)
+		require.Equal(t, id.GetBytes(), decodedID)
+
+		// The session can be rebuilt from its legacy encoding and its region.
+		rebuilt, err := slstorage.MakeSessionID(region, uuid.FromBytesOrNil([]byte(legacy)))
+		require.NoError(t, err)
+		require.Equal(t, session, rebuilt)
+
+		// Downgrading a legacy session id doesn't change it.
+		again, err := slstorage.ToLegacySessionID(legacy)
+		require.NoError(t, err)
+		require.Equal(t, legacy, again)
+	}
+
+	_, err := slstorage.ToLegacySessionID("")
+	require.ErrorContains(t, err, "session id is too short")
+	session, err := slstorage.MakeSessionID(enum.One, id)
+	require.NoError(t, err)
+	b := []byte(session)
+	b[0] = 2
+	_, err = slstorage.ToLegacySessionID(sqlliveness.SessionID(b))
+	require.ErrorContains(t, err, "invalid session id version: 2")
+}
+
 func TestSessionIDEncoding(t *testing.T) {
 	defer leaktest.AfterTest(t)()
 	defer log.Scope(t).Close(t)
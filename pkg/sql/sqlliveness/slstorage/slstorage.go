@@ -91,6 +91,10 @@ type Storage struct {
 	newTimer   func() timeutil.TimerI
 	keyCodec   keyCodec
 
+	// decodeErrorLogLimiter rate limits the warnings about the rows of the
+	// sqlliveness table that the expired session scan can't decode.
+	decodeErrorLogLimiter log.EveryN
+
 	mu struct {
 		syncutil.Mutex
 
@@ -131,7 +135,6 @@ func NewTestingStorage(
 		clock:    clock,
 		db:       db,
 		codec:    codec,
-		keyCodec: makeKeyCodec(codec, sqllivenessTableID, rbrIndexID),
 		newTimer: newTimer,
 		gcInterval: func() time.Duration {
 			baseInterval := GCInterval.Get(&settings.SV)
@@ -139,7 +142,8 @@ func NewTestingStorage(
 			frac := 1 + (2*rand.Float64()-1)*jitter
 			return time.Duration(frac * float64(baseInterval.Nanoseconds()))
 		},
-		metrics: makeMetrics(),
+		metrics:               makeMetrics(),
+		decodeErrorLogLimiter: log.Every(10 * time.Second),
 	}
 	cacheConfig := cache.Config{
 		Policy: cache.CacheLRU,
@@ -147,6 +151,7 @@ func NewTestingStorage(
 			return size > int(CacheSize.Get(&settings.SV))
 		},
 	}
+	s.keyCodec = makeKeyCodec(codec, sqllivenessTableID, rbrIndexID, &s.metrics)
 	s.mu.liveSessions = cache.NewUnorderedCache(cacheConfig)
 	s.mu.deadSessions = cache.NewUnorderedCache(cacheConfig)
 	return s
@@ -412,10 +417,12 @@ func (s *Storage) deleteExpiredSessions(ctx context.Context) {
 
 func (s *Storage) fetchExpiredSessionIDs(ctx context.Context) ([]sqlliveness.SessionID, error) {
 	var toCheck []sqlliveness.SessionID
+	var legacySessions int64
 	if err := s.db.Txn(ctx, func(ctx context.Context, txn *kv.Txn) error {
-		toCheck = nil // reset for restarts
-		start := s.keyCodec.indexPrefix()
-		end := start.PrefixEnd()
+		// reset for restarts
+		toCheck, legacySessions = nil, 0
+		span := allSessionsSpan(s.keyCodec)
+		start, end := span.Key, span.EndKey
 		now := s.clock.Now()
 		const maxRows = 1024 // arbitrary but plenty
 		for {
@@ -426,20 +433,9 @@ func (s *Storage) fetchExpiredSessionIDs(ctx context.Context) ([]sqlliveness.Ses
 			if len(rows) == 0 {
 				return nil
 			}
-			for i := range rows {
-				exp, err := decodeValue(rows[i])
-				if err != nil {
-					log.Warningf(ctx, "failed to decode row %s expiration: %v", rows[i].Key.String(), err)
-					continue
-				}
-				if exp.Less(now) {
-					id, err := s.keyCodec.decode(rows[i].Key)
-					if err != nil {
-						log.Warningf(ctx, "failed to decode row %s session: %v", rows[i].Key.String(), err)
-					}
-					toCheck = append(toCheck, id)
-				}
-			}
+			ids, legacy := s.expiredSessionIDs(ctx, rows, now)
+			toCheck = append(toCheck, ids...)
+			legacySessions += int64(legacy)
 			if len(rows) < maxRows {
 				return nil
 			}
@@ -448,9 +444,51 @@ func (s *Storage) fetchExpiredSessionIDs(ctx context.Context) ([]sqlliveness.Ses
 	}); err != nil {
 		return nil, err
 	}
+	s.metrics.KeyCodecRBTLegacySessions.Update(legacySessions)
 	return toCheck, nil
 }
 
+// expiredSessionIDs returns the ids of the sessions of the input rows of the
+// sqlliveness table that expired before now. Rows whose expiration or key
+// can't be decoded are skipped, so that a corrupt row doesn't stop the expired
+// sessions of the other rows from being deleted, and a rate limited warning is
+// logged for them. It also returns the number of rows of legacy sessions,
+// which don't include a region.
+func (s *Storage) expiredSessionIDs(
+	ctx context.Context, rows []kv.KeyValue, now hlc.Timestamp,
+) (ids []sqlliveness.SessionID, legacy int) {
+	// Every key is decoded, rather than only the keys of the expired sessions,
+	// so that the legacy sessions can be counted.
+	var decodable []kv.KeyValue
+	var expired []bool
+	for i := range rows {
+		exp, err := decodeValue(rows[i])
+		if err != nil {
+			if s.decodeErrorLogLimiter.ShouldLog() {
+				log.Warningf(ctx, "failed to decode row %s expiration: %v", rows[i].Key.String(), err)
+			}
+			continue
+		}
+		decodable = append(decodable, rows[i])
+		expired = append(expired, exp.Less(now))
+	}
+	for i, session := range decodeSessionKeys(s.keyCodec, decodable) {
+		if session.err != nil {
+			if s.decodeErrorLogLimiter.ShouldLog() {
+				log.Warningf(ctx, "failed to decode row %s session: %v", session.kv.Key.String(), session.err)
+			}
+			continue
+		}
+		if session.legacy {
+			legacy++
+		}
+		if expired[i] {
+			ids = append(ids, session.id)
+		}
+	}
+	return ids, legacy
+}
+
 // Insert inserts the input Session in table `system.sqlliveness`.
 // A client must never call this method with a session which was previously
 // used! The contract of IsAlive is that once a session becomes not alive, it
@@ -2213,6 +2213,28 @@ var charts = []sectionDescription{
 					"sqlliveness.is_alive.cache_misses",
 				},
 			},
+			{
+				Title: "Legacy sessions (RBR encodes)",
+				Metrics: []string{
+					"sqlliveness.key_codec.rbr.legacy_sessions",
+				},
+			},
+			{
+				Title: "Legacy sessions in RBT index",
+				Metrics: []string{
+					"sqlliveness.key_codec.rbt.legacy_sessions",
+				},
+			},
+			{
+				Title: "Session key errors",
+				Metrics: []string{
+					"sqlliveness.key_codec.rbr.encode_errors",
+					"sqlliveness.key_codec.rbr.decode_errors.prefix",
+					"sqlliveness.key_codec.rbr.decode_errors.malformed",
+					"sqlliveness.key_codec.rbt.decode_errors.prefix",
+					"sqlliveness.key_codec.rbt.decode_errors.malformed",
+				},
+			},
 			{
 				Title: "Session deletion",
 				Metrics: []string{
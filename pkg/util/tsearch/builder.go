@@ -0,0 +1,376 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/errors"
+)
+
+// This file contains an API for building and inspecting TSQuery trees
+// directly, without going through their text representation. It's meant for
+// translation layers that convert between TSQueries and other query
+// representations.
+
+// maxPhraseDistance is the largest distance that a followed by operator may
+// have, like in Postgres.
+const maxPhraseDistance = 1 << 14
+
+// NewTermQuery returns a TSQuery that consists of a single lexeme. If prefix is
+// true, the query matches any lexeme that begins with the input lexeme. The
+// weights string holds the weight labels (A, B, C or D, in either case) that
+// the query is restricted to; if it's empty, the query matches lexemes of any
+// weight.
+func NewTermQuery(lexeme string, prefix bool, weights string) (TSQuery, error) {
+	if lexeme == "" {
+		return TSQuery{}, pgerror.New(pgcode.InvalidParameterValue, "lexeme must not be empty")
+	}
+	if len(lexeme) > MaxLexemeLen {
+		return TSQuery{}, pgerror.Newf(pgcode.ProgramLimitExceeded,
+			"word is too long (%d bytes, max %d bytes)", len(lexeme), MaxLexemeLen)
+	}
+	var w tsWeight
+	if prefix {
+		w |= weightStar
+	}
+	for i := 0; i < len(weights); i++ {
+		weight, err := tsWeightFromByte(weights[i])
+		if err != nil {
+			return TSQuery{}, err
+		}
+		w |= weight
+	}
+	n := &tsNode{term: tsTerm{lexeme: lexeme}}
+	if w != 0 {
+		n.term.positions = []tsPosition{{weight: w}}
+	}
+	return TSQuery{root: n}, nil
+}
+
+// NewAndQuery returns a TSQuery that matches documents that are matched by
+// both of the input queries. If one of the inputs is empty, the other one is
+// returned.
+func NewAndQuery(l, r TSQuery) TSQuery {
+	return newBinaryQuery(and, 0 /* followedN */, l, r)
+}
+
+// NewOrQuery returns a TSQuery that matches documents that are matched by
+// either of the input queries. If one of the inputs is empty, the other one is
+// returned.
+func NewOrQuery(l, r TSQuery) TSQuery {
+	return newBinaryQuery(or, 0 /* followedN */, l, r)
+}
+
+// AndAll returns a TSQuery that matches documents that are matched by all of
+// the input queries. Empty inputs are skipped, and the result is empty if all
+// of the inputs are. The queries are combined into a balanced tree of and
+// operators, rather than the left-deep tree that repeated calls to NewAndQuery
+// build, so the depth of the result only grows logarithmically with the number
+// of inputs.
+func AndAll(queries ...TSQuery) TSQuery {
+	return newBalancedQuery(and, queries)
+}
+
+// OrAll returns a TSQuery that matches documents that are matched by any of
+// the input queries. Like AndAll, it skips empty inputs and builds a balanced
+// tree.
+func OrAll(queries ...TSQuery) TSQuery {
+	return newBalancedQuery(or, queries)
+}
+
+// newBalancedQuery combines the non-empty input queries with the input
+// operator into a balanced tree, whose operands are in the order of the
+// inputs. The operator must be commutative, since the grouping of the
+// operands differs from the one that repeated binary operators would produce.
+func newBalancedQuery(op tsOperator, queries []TSQuery) TSQuery {
+	if !op.commutative() {
+		panic(errors.AssertionFailedf("can't regroup the operands of operator %d", op))
+	}
+	nonEmpty := make([]TSQuery, 0, len(queries))
+	for _, q := range queries {
+		if q.root != nil {
+			nonEmpty = append(nonEmpty, q)
+		}
+	}
+	var build func(queries []TSQuery) TSQuery
+	build = func(queries []TSQuery) TSQuery {
+		switch len(queries) {
+		case 0:
+			return TSQuery{}
+		case 1:
+			return queries[0]
+		}
+		mid := len(queries) / 2
+		return newBinaryQuery(op, 0 /* followedN */, build(queries[:mid]), build(queries[mid:]))
+	}
+	return build(nonEmpty)
+}
+
+// NewPhraseQuery returns a TSQuery that matches documents in which a match of
+// the left query is followed by a match of the right query, distance positions
+// later. If one of the inputs is empty, the other one is returned.
+func NewPhraseQuery(l, r TSQuery, distance int) (TSQuery, error) {
+	if distance < 0 || distance > maxPhraseDistance {
+		return TSQuery{}, pgerror.Newf(pgcode.InvalidParameterValue,
+			"distance in phrase operator must be an integer value between zero and %d inclusive",
+			maxPhraseDistance)
+	}
+	return newBinaryQuery(followedby, distance, l, r), nil
+}
+
+// NewPhraseNotQuery returns a TSQuery that matches documents in which there's
+// a match of the left query that isn't followed by a match of the right query,
+// distance positions later: for example, a match of cat that isn't immediately
+// followed by dog, for a distance of 1. A document matches as long as one of
+// the matches of the left query qualifies, even if others are followed by the
+// right query, and regardless of where else the right query matches. A match
+// of the left query that's too close to the end of the document for anything
+// to follow it at the distance qualifies.
+//
+// The result is the phrase operator with a negated right operand, l <N> !r,
+// which has exactly these semantics, so it's an ordinary TSQuery that can be
+// printed, parsed back and sent to Postgres like any other. Note that it's
+// different from l & !(l <N> r), which requires that no match of the left
+// query is followed by the right query. If the right input is empty, the left
+// one is returned, and if the left input is empty, so is the result.
+func NewPhraseNotQuery(l, r TSQuery, distance int) (TSQuery, error) {
+	if l.root == nil {
+		return l, nil
+	}
+	return NewPhraseQuery(l, NewNotQuery(r), distance)
+}
+
+// NewNotQuery returns a TSQuery that matches documents that aren't matched by
+// the input query. If the input is empty, so is the result.
+func NewNotQuery(q TSQuery) TSQuery {
+	if q.root == nil {
+		return q
+	}
+	return TSQuery{root: &tsNode{op: not, l: q.root}}
+}
+
+// NewBoostQuery returns a copy of the input query in which the boost of every
+// term is multiplied by the input boost, which must be positive. The boosts of
+// the terms multiply their contributions to the rank. If the input is empty,
+// so is the result.
+func NewBoostQuery(q TSQuery, boost float64) (TSQuery, error) {
+	if !(boost > 0) || math.IsInf(boost, 1) {
+		return TSQuery{}, pgerror.Newf(pgcode.InvalidParameterValue,
+			"boost must be a positive number: %g", boost)
+	}
+	var rewrite func(n *tsNode) *tsNode
+	rewrite = func(n *tsNode) *tsNode {
+		if n == nil {
+			return nil
+		}
+		if n.op == invalid {
+			ret := &tsNode{term: n.term}
+			ret.term.boost = TSQueryNode{n: n}.Boost() * boost
+			return ret
+		}
+		return &tsNode{op: n.op, followedN: n.followedN, l: rewrite(n.l), r: rewrite(n.r)}
+	}
+	return TSQuery{root: rewrite(q.root)}, nil
+}
+
+func newBinaryQuery(op tsOperator, followedN int, l, r TSQuery) TSQuery {
+	if l.root == nil {
+		return r
+	}
+	if r.root == nil {
+		return l
+	}
+	return TSQuery{root: &tsNode{op: op, followedN: followedN, l: l.root, r: r.root}}
+}
+
+// TSQueryOp is the kind of a TSQueryNode.
+type TSQueryOp int
+
+const (
+	// TSQueryOpTerm is a lexeme.
+	TSQueryOpTerm TSQueryOp = iota
+	// TSQueryOpAnd is the & operator.
+	TSQueryOpAnd
+	// TSQueryOpOr is the | operator.
+	TSQueryOpOr
+	// TSQueryOpNot is the ! operator.
+	TSQueryOpNot
+	// TSQueryOpPhrase is the followed by operator, <-> or <n>.
+	TSQueryOpPhrase
+)
+
+// TSQueryNode is a read-only view of a node in the tree of a TSQuery. The
+// zero value represents the missing root of an empty query.
+type TSQueryNode struct {
+	n *tsNode
+}
+
+// Root returns the root node of the receiver, and false if the receiver is
+// empty.
+func (q TSQuery) Root() (TSQueryNode, bool) {
+	return TSQueryNode{n: q.root}, q.root != nil
+}
+
+// Query returns the subtree rooted at the receiver as a TSQuery.
+func (n TSQueryNode) Query() TSQuery {
+	return TSQuery{root: n.n}
+}
+
+// Op returns the kind of the receiver.
+func (n TSQueryNode) Op() TSQueryOp {
+	switch n.n.op {
+	case invalid:
+		return TSQueryOpTerm
+	case and:
+		return TSQueryOpAnd
+	case or:
+		return TSQueryOpOr
+	case not:
+		return TSQueryOpNot
+	case followedby:
+		return TSQueryOpPhrase
+	}
+	panic(errors.AssertionFailedf("invalid operator %d", n.n.op))
+}
+
+// Lexeme returns the lexeme of a TSQueryOpTerm node.
+func (n TSQueryNode) Lexeme() string {
+	return n.n.term.lexeme
+}
+
+// Prefix returns whether a TSQueryOpTerm node is a prefix match.
+func (n TSQueryNode) Prefix() bool {
+	return n.termWeight()&weightStar != 0
+}
+
+// Weights returns the weight labels that a TSQueryOpTerm node is restricted
+// to, in the order A, B, C, D. It's empty if the node matches lexemes of any
+// weight.
+func (n TSQueryNode) Weights() string {
+	return (n.termWeight() &^ weightStar).String()
+}
+
+func (n TSQueryNode) termWeight() tsWeight {
+	if len(n.n.term.positions) == 0 {
+		return 0
+	}
+	return n.n.term.positions[0].weight
+}
+
+// Boost returns the boost of a TSQueryOpTerm node, which is 1 if the node
+// isn't boosted.
+func (n TSQueryNode) Boost() float64 {
+	if n.n.term.boost == 0 {
+		return 1
+	}
+	return n.n.term.boost
+}
+
+// Distance returns the distance of a TSQueryOpPhrase node.
+func (n TSQueryNode) Distance() int {
+	return n.n.followedN
+}
+
+// Left returns the left operand of a binary operator node, or the only
+// operand of a TSQueryOpNot node.
+func (n TSQueryNode) Left() TSQueryNode {
+	return TSQueryNode{n: n.n.l}
+}
+
+// Right returns the right operand of a binary operator node.
+func (n TSQueryNode) Right() TSQueryNode {
+	return TSQueryNode{n: n.n.r}
+}
+
+// ClauseKind is the kind of a Clause.
+type ClauseKind int
+
+const (
+	// ClausePositive is a lexeme that documents must contain.
+	ClausePositive ClauseKind = iota
+	// ClauseNegative is a lexeme that documents must not contain.
+	ClauseNegative
+	// ClausePhrase is a phrase of lexemes that documents must contain.
+	ClausePhrase
+)
+
+// Clause is one of the constraints of a query that ToClauses flattens.
+type Clause struct {
+	Kind ClauseKind
+	// Query is the clause as a TSQuery: a single lexeme for ClausePositive,
+	// a negated lexeme for ClauseNegative, and a tree of followed by
+	// operators over lexemes for ClausePhrase.
+	Query TSQuery
+}
+
+// ToClauses flattens the receiver, which must be a conjunction of lexemes,
+// negated lexemes and phrases of lexemes, like cat & !dog & (fat <-> rat),
+// into the list of those clauses, in order. It's meant for editors that
+// represent simple queries as a list of constraints. It's the inverse of
+// AndAll: the result of AndAll on the queries of the clauses matches the same
+// documents as the receiver. An error is returned if the receiver can't be
+// represented as a list of clauses, such as if it contains an or operator, or
+// a not operator that isn't directly applied to a lexeme. The result is empty
+// if the receiver is.
+func (q TSQuery) ToClauses() ([]Clause, error) {
+	var ret []Clause
+	addClause := func(n *tsNode) error {
+		switch n.op {
+		case invalid:
+			ret = append(ret, Clause{Kind: ClausePositive, Query: TSQuery{root: n}})
+			return nil
+		case not:
+			if n.l.op != invalid {
+				return pgerror.Newf(pgcode.InvalidParameterValue,
+					"tsquery can't be flattened into clauses: %s negates more than a lexeme", n)
+			}
+			ret = append(ret, Clause{Kind: ClauseNegative, Query: TSQuery{root: n}})
+			return nil
+		case followedby:
+			if !isSimplePhrase(n) {
+				return pgerror.Newf(pgcode.InvalidParameterValue,
+					"tsquery can't be flattened into clauses: %s isn't a phrase of lexemes", n)
+			}
+			ret = append(ret, Clause{Kind: ClausePhrase, Query: TSQuery{root: n}})
+			return nil
+		case or:
+			return pgerror.Newf(pgcode.InvalidParameterValue,
+				"tsquery can't be flattened into clauses: %s contains an or operator", n)
+		}
+		return errors.AssertionFailedf("invalid operator %d", n.op)
+	}
+	if q.root == nil {
+		return nil, nil
+	}
+	// Only the chain of and operators is flattened. Phrases are kept whole, so
+	// the order of their operands is preserved.
+	for _, n := range flattenTSNode(q.root, and, nil) {
+		if err := addClause(n); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// isSimplePhrase returns whether the input node is a lexeme, or a tree of
+// followed by operators whose operands are lexemes.
+func isSimplePhrase(n *tsNode) bool {
+	switch n.op {
+	case invalid:
+		return true
+	case followedby:
+		return isSimplePhrase(n.l) && isSimplePhrase(n.r)
+	}
+	return false
+}
@@ -0,0 +1,324 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rebuild converts the input query into a new query using only the public
+// inspection and builder APIs, the way a translation layer would.
+func rebuild(t *testing.T, n TSQueryNode) TSQuery {
+	switch n.Op() {
+	case TSQueryOpTerm:
+		q, err := NewTermQuery(n.Lexeme(), n.Prefix(), n.Weights())
+		require.NoError(t, err)
+		return q
+	case TSQueryOpAnd:
+		return NewAndQuery(rebuild(t, n.Left()), rebuild(t, n.Right()))
+	case TSQueryOpOr:
+		return NewOrQuery(rebuild(t, n.Left()), rebuild(t, n.Right()))
+	case TSQueryOpNot:
+		return NewNotQuery(rebuild(t, n.Left()))
+	case TSQueryOpPhrase:
+		q, err := NewPhraseQuery(rebuild(t, n.Left()), rebuild(t, n.Right()), n.Distance())
+		require.NoError(t, err)
+		return q
+	}
+	t.Fatalf("unexpected op %d", n.Op())
+	return TSQuery{}
+}
+
+func TestTSQueryBuilderRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		`a`,
+		`a:*`,
+		`a:AB`,
+		`'foo bar':*cd`,
+		`!a`,
+		`a & b | !c`,
+		`(a | b) & c`,
+		`a <-> b <0> c <10> d`,
+		`(a <2> b) <-> c`,
+		`!(a:* & b:D) | c <-> !d`,
+	} {
+		t.Log(input)
+		q, err := ParseTSQuery(input)
+		require.NoError(t, err)
+		root, ok := q.Root()
+		require.True(t, ok)
+		actual := rebuild(t, root)
+		assert.Equal(t, q.String(), actual.String())
+		assert.Equal(t, q.root.UnambiguousString(), actual.root.UnambiguousString())
+		match, err := EvalTSQuery(actual, TSVector{{lexeme: "a", positions: []tsPosition{{position: 1}}}})
+		require.NoError(t, err)
+		expected, err := EvalTSQuery(q, TSVector{{lexeme: "a", positions: []tsPosition{{position: 1}}}})
+		require.NoError(t, err)
+		assert.Equal(t, expected, match)
+	}
+}
+
+func TestTSQueryBuilder(t *testing.T) {
+	term := func(lexeme string) TSQuery {
+		q, err := NewTermQuery(lexeme, false /* prefix */, "")
+		require.NoError(t, err)
+		return q
+	}
+
+	t.Run("Term", func(t *testing.T) {
+		q, err := NewTermQuery("foo", true /* prefix */, "ca")
+		require.NoError(t, err)
+		assert.Equal(t, `'foo':*AC`, q.String())
+		root, ok := q.Root()
+		require.True(t, ok)
+		assert.Equal(t, TSQueryOpTerm, root.Op())
+		assert.Equal(t, "foo", root.Lexeme())
+		assert.True(t, root.Prefix())
+		assert.Equal(t, "AC", root.Weights())
+
+		_, err = NewTermQuery("", false /* prefix */, "")
+		assert.Error(t, err)
+		_, err = NewTermQuery("foo", false /* prefix */, "E")
+		assert.Error(t, err)
+	})
+
+	t.Run("Operators", func(t *testing.T) {
+		phrase, err := NewPhraseQuery(term("a"), term("b"), 1)
+		require.NoError(t, err)
+		q := NewOrQuery(NewAndQuery(phrase, NewNotQuery(term("c"))), term("d"))
+		assert.Equal(t, `'a' <-> 'b' & !'c' | 'd'`, q.String())
+
+		root, ok := q.Root()
+		require.True(t, ok)
+		assert.Equal(t, TSQueryOpOr, root.Op())
+		assert.Equal(t, TSQueryOpAnd, root.Left().Op())
+		assert.Equal(t, "d", root.Right().Lexeme())
+		assert.Equal(t, TSQueryOpPhrase, root.Left().Left().Op())
+		assert.Equal(t, 1, root.Left().Left().Distance())
+		assert.Equal(t, TSQueryOpNot, root.Left().Right().Op())
+		assert.Equal(t, `!'c'`, root.Left().Right().Query().String())
+
+		_, err = NewPhraseQuery(term("a"), term("b"), -1)
+		assert.Error(t, err)
+		_, err = NewPhraseQuery(term("a"), term("b"), maxPhraseDistance+1)
+		assert.Error(t, err)
+	})
+
+	t.Run("PhraseNot", func(t *testing.T) {
+		q, err := NewPhraseNotQuery(term("cat"), term("dog"), 1)
+		require.NoError(t, err)
+		assert.Equal(t, `'cat' <-> !'dog'`, q.String())
+		phrase, err := NewPhraseQuery(term("dog"), term("bird"), 1)
+		require.NoError(t, err)
+		q2, err := NewPhraseNotQuery(term("cat"), phrase, 2)
+		require.NoError(t, err)
+		assert.Equal(t, `'cat' <2> !( 'dog' <-> 'bird' )`, q2.String())
+
+		for _, tc := range []struct {
+			doc          string
+			expected     bool
+			expectedNot2 bool
+		}{
+			{`cat`, true, true},
+			{`dog`, false, false},
+			{`cat dog`, false, true},
+			{`cat bird`, true, true},
+			{`dog cat`, true, true},
+			{`cat dog cat`, true, true},
+			{`cat dog cat dog`, false, true},
+			{`cat bird dog`, true, true},
+			{`cat x dog bird`, true, false},
+			{`cat x dog fish`, true, true},
+			{`cat x dog bird cat`, true, true},
+		} {
+			t.Log(tc.doc)
+			v, err := DocumentToTSVector("simple", tc.doc)
+			require.NoError(t, err)
+			actual, err := EvalTSQuery(q, v)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+			actual, err = EvalTSQuery(q2, v)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedNot2, actual)
+		}
+
+		_, err = NewPhraseNotQuery(term("a"), term("b"), -1)
+		assert.Error(t, err)
+		q, err = NewPhraseNotQuery(term("a"), TSQuery{}, 1)
+		require.NoError(t, err)
+		assert.Equal(t, `'a'`, q.String())
+		q, err = NewPhraseNotQuery(TSQuery{}, term("b"), 1)
+		require.NoError(t, err)
+		assert.Equal(t, ``, q.String())
+	})
+
+	t.Run("Boost", func(t *testing.T) {
+		q, err := NewBoostQuery(NewAndQuery(term("a"), term("b")), 2)
+		require.NoError(t, err)
+		assert.Equal(t, `'a'^2 & 'b'^2`, q.String())
+		q, err = NewBoostQuery(NewOrQuery(q, term("c")), 1.5)
+		require.NoError(t, err)
+		assert.Equal(t, `'a'^3 & 'b'^3 | 'c'^1.5`, q.String())
+		root, ok := q.Root()
+		require.True(t, ok)
+		assert.Equal(t, 1.5, root.Right().Boost())
+
+		for _, boost := range []float64{0, -1, math.Inf(1), math.NaN()} {
+			_, err = NewBoostQuery(term("a"), boost)
+			assert.Error(t, err)
+		}
+	})
+
+	t.Run("All", func(t *testing.T) {
+		var depth func(n TSQueryNode) int
+		depth = func(n TSQueryNode) int {
+			if n.Op() == TSQueryOpTerm {
+				return 1
+			}
+			d := depth(n.Left())
+			if n.Op() != TSQueryOpNot {
+				if r := depth(n.Right()); r > d {
+					d = r
+				}
+			}
+			return d + 1
+		}
+
+		assert.Equal(t, `'a'`, AndAll(term("a")).String())
+		assert.Equal(t, `'a' & 'b'`, AndAll(term("a"), TSQuery{}, term("b")).String())
+		assert.Equal(t, `'a' | 'b' | 'c'`, OrAll(term("a"), term("b"), term("c")).String())
+		assert.Equal(t, `( 'a' | 'b' ) & 'c'`, AndAll(OrAll(term("a"), term("b")), term("c")).String())
+		assert.Equal(t, ``, AndAll().String())
+		assert.Equal(t, ``, OrAll(TSQuery{}, TSQuery{}).String())
+
+		var queries []TSQuery
+		var expected []string
+		for i := 0; i < 1000; i++ {
+			lexeme := fmt.Sprintf("t%d", i)
+			queries = append(queries, term(lexeme))
+			expected = append(expected, fmt.Sprintf("'%s'", lexeme))
+		}
+		for _, tc := range []struct {
+			q  TSQuery
+			op string
+		}{
+			{AndAll(queries...), " & "},
+			{OrAll(queries...), " | "},
+		} {
+			// The operands are kept in order, and the tree is balanced.
+			assert.Equal(t, strings.Join(expected, tc.op), tc.q.String())
+			root, ok := tc.q.Root()
+			require.True(t, ok)
+			assert.Equal(t, 11, depth(root))
+		}
+
+		v, err := ParseTSVector(`t1 t500 t999`)
+		require.NoError(t, err)
+		matches, err := EvalTSQuery(AndAll(queries...), v)
+		require.NoError(t, err)
+		assert.False(t, matches)
+		matches, err = EvalTSQuery(OrAll(queries...), v)
+		require.NoError(t, err)
+		assert.True(t, matches)
+		matches, err = EvalTSQuery(AndAll(queries[1], queries[500], queries[999]), v)
+		require.NoError(t, err)
+		assert.True(t, matches)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		_, ok := TSQuery{}.Root()
+		assert.False(t, ok)
+		assert.Equal(t, `'a'`, NewAndQuery(TSQuery{}, term("a")).String())
+		assert.Equal(t, `'a'`, NewOrQuery(term("a"), TSQuery{}).String())
+		assert.Equal(t, ``, NewNotQuery(TSQuery{}).String())
+		q, err := NewPhraseQuery(TSQuery{}, TSQuery{}, 1)
+		require.NoError(t, err)
+		assert.Equal(t, ``, q.String())
+	})
+}
+
+func TestTSQueryToClauses(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected []string
+		kinds    []ClauseKind
+	}{
+		{`a`, []string{`'a'`}, []ClauseKind{ClausePositive}},
+		{`a:*AB`, []string{`'a':*AB`}, []ClauseKind{ClausePositive}},
+		{`!a`, []string{`!'a'`}, []ClauseKind{ClauseNegative}},
+		{`a <-> b`, []string{`'a' <-> 'b'`}, []ClauseKind{ClausePhrase}},
+		{
+			`a & !b & (c <2> d:* <-> e) & f`,
+			[]string{`'a'`, `!'b'`, `'c' <2> 'd':* <-> 'e'`, `'f'`},
+			[]ClauseKind{ClausePositive, ClauseNegative, ClausePhrase, ClausePositive},
+		},
+		{
+			`(a & b) & (c & (d & !e))`,
+			[]string{`'a'`, `'b'`, `'c'`, `'d'`, `!'e'`},
+			[]ClauseKind{ClausePositive, ClausePositive, ClausePositive, ClausePositive, ClauseNegative},
+		},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		clauses, err := q.ToClauses()
+		require.NoError(t, err)
+		var actual []string
+		var kinds []ClauseKind
+		queries := make([]TSQuery, len(clauses))
+		for i, c := range clauses {
+			actual = append(actual, c.Query.String())
+			kinds = append(kinds, c.Kind)
+			queries[i] = c.Query
+		}
+		assert.Equal(t, tc.expected, actual)
+		assert.Equal(t, tc.kinds, kinds)
+
+		// AndAll is the inverse of ToClauses.
+		roundTrip, err := AndAll(queries...).ToClauses()
+		require.NoError(t, err)
+		assert.Equal(t, clauses, roundTrip)
+	}
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, input := range []string{
+			`a | b`,
+			`a & (b | c)`,
+			`!(a & b)`,
+			`!(a <-> b)`,
+			`!(!a)`,
+			`a & (b <-> !c)`,
+			`a <-> (b | c)`,
+			`(a & b) <-> c`,
+		} {
+			t.Log(input)
+			q, err := ParseTSQuery(input)
+			require.NoError(t, err)
+			_, err = q.ToClauses()
+			require.Error(t, err)
+			assert.Equal(t, pgcode.InvalidParameterValue, pgerror.GetPGCode(err))
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		clauses, err := TSQuery{}.ToClauses()
+		require.NoError(t, err)
+		assert.Empty(t, clauses)
+	})
+}
@@ -0,0 +1,671 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+)
+
+// maxStrLen is Postgres's MAXSTRLEN. Postgres rejects lexemes whose length is
+// at least MAXSTRLEN bytes.
+const maxStrLen = 1<<11 - 1
+
+// MaxLexemeLen is the maximum length of a lexeme in bytes. It matches the
+// limit that Postgres places on lexemes (MAXSTRLEN - 1).
+const MaxLexemeLen = maxStrLen - 1
+
+// MaxPositionsPerLexeme is the maximum number of positions that a lexeme of a
+// TSVector keeps when vectors are concatenated or merged. It matches the limit
+// that Postgres places on positions (MAXNUMPOS).
+const MaxPositionsPerLexeme = 256
+
+// maxDocumentPositionsPerLexeme is the maximum number of positions that a
+// lexeme of a TSVector constructed from a document keeps by default. Postgres's
+// to_tsvector stops adding positions to a lexeme one short of MAXNUMPOS.
+const maxDocumentPositionsPerLexeme = MaxPositionsPerLexeme - 1
+
+// OversizeLexemePolicy controls what happens when a lexeme longer than the
+// configured maximum lexeme length is encountered while constructing a
+// TSVector.
+type OversizeLexemePolicy int
+
+const (
+	// OversizeLexemeError returns an error when an oversize lexeme is found.
+	// This is the default, and matches the behavior of Postgres's tsvector
+	// input function.
+	OversizeLexemeError OversizeLexemePolicy = iota
+	// OversizeLexemeSkip silently drops oversize lexemes.
+	OversizeLexemeSkip
+	// OversizeLexemeTruncate silently truncates oversize lexemes to the
+	// maximum lexeme length. Truncation never splits a multibyte rune, so the
+	// truncated lexeme may be a few bytes shorter than the maximum.
+	OversizeLexemeTruncate
+)
+
+// Config holds the options that control how TSVectors and TSQueries are
+// constructed. The zero value is the default configuration, which matches
+// Postgres.
+type Config struct {
+	// OversizeLexeme is the policy for lexemes that are longer than
+	// MaxLexemeLen.
+	OversizeLexeme OversizeLexemePolicy
+	// MaxLexemeLen is the maximum length of a lexeme in bytes. If it's zero or
+	// larger than the package-level MaxLexemeLen, MaxLexemeLen is used.
+	MaxLexemeLen int
+	// MaxLexemes is the maximum number of distinct lexemes in a TSVector. If
+	// it's zero, the number of lexemes isn't limited.
+	MaxLexemes int
+	// MaxQueryNodes is the maximum number of nodes in a TSQuery, counting both
+	// operands and operators, like Postgres's numnode. If it's zero, the size
+	// of the query isn't limited.
+	MaxQueryNodes int
+	// TermBoosts, if set, allows the operands of a TSQuery to end with a ^n
+	// boost suffix, like title^3 or 'fat cat':A^0.5, which multiplies the
+	// contribution of the operand to the rank by n. Queries with boosts aren't
+	// valid Postgres queries, and EncodePostgresTSQuery drops their boosts.
+	TermBoosts bool
+	// Interner, if set, is used to share the lexeme strings of the constructed
+	// or decoded TSVectors with other TSVectors that are constructed or
+	// decoded with the same interner.
+	Interner *LexemeInterner
+	// MaxFreeTextLexemes is the maximum number of lexemes that
+	// PlainToTSQueryWithConfig and PhraseToTSQueryWithConfig take from their
+	// input text. If it's zero, the number of lexemes isn't limited, like in
+	// Postgres.
+	MaxFreeTextLexemes int
+	// TruncateFreeText, if set, makes PlainToTSQueryWithConfig and
+	// PhraseToTSQueryWithConfig ignore the lexemes past MaxFreeTextLexemes,
+	// instead of returning an error.
+	TruncateFreeText bool
+	// WordSeparators and WordChars override how DocumentToTSVectorWithConfig,
+	// PlainToTSQueryWithConfig and PhraseToTSQueryWithConfig split text into
+	// words. By default, every maximal run of letters and numbers is a word,
+	// and every other rune is a separator. The runes in WordSeparators are
+	// separators even if they're letters or numbers, and the runes in
+	// WordChars are part of words even if they're punctuation, so that with a
+	// WordChars of "/", "see /usr/local" is split into "see" and "/usr/local".
+	// A rune that's in both is a separator. Queries only match documents
+	// whose words were split the same way, so the same options must be used
+	// for both.
+	WordSeparators string
+	WordChars      string
+	// MaxPrefixMatches is the maximum number of lexemes of a TSVector that a
+	// single prefix lexeme of a TSQuery, like cat:*, may match when the query
+	// is evaluated by EvalTSQueryWithConfig. Evaluating a query with a prefix
+	// that matches more lexemes returns an error. If it's zero, the number of
+	// matches isn't limited.
+	MaxPrefixMatches int
+	// MaxPositionsPerLexeme is the maximum number of positions that a lexeme
+	// of a constructed TSVector keeps. Only the lowest positions are kept, and
+	// the rest are dropped, so phrases can't match past them. If it's larger
+	// than the package-level MaxPositionsPerLexeme, MaxPositionsPerLexeme is
+	// used. If it's zero, DocumentToTSVectorWithConfig keeps 255 positions,
+	// like to_tsvector in Postgres, and ParseTSVectorWithConfig keeps all of
+	// them.
+	MaxPositionsPerLexeme int
+	// PhraseTolerance is the number of positions by which the distance between
+	// the operands of a followed by operator may differ from the operator's
+	// distance when a query is evaluated by EvalTSQueryWithConfig, for
+	// documents whose tokenization inserts spurious positions: with a
+	// tolerance of 1, a <-> b matches documents in which b is at the same
+	// position as a, or one or two positions after it. The operands of a
+	// phrase are never matched in the reverse order. Every followed by
+	// operator of a nested phrase applies the tolerance on its own, to the
+	// distance between the last lexemes of its operands: a <-> b <-> c, which
+	// is a <-> (b <-> c), requires b and c to be 1 position apart, and a and
+	// c to be 2 positions apart, give or take the tolerance. If it's zero or
+	// less, phrases only match at their exact distances, like in Postgres.
+	PhraseTolerance int
+	// StartPosition is the position of the first word of the TSVectors that
+	// DocumentToTSVectorWithConfig constructs, so that the vector of a
+	// fragment of a document can continue the positions of the vector of the
+	// previous fragment, like Concat would. Positions past the largest
+	// position that a TSVector can store are clamped to it, like the
+	// positions of long documents. If it's zero or less, the first word is at
+	// position 1.
+	StartPosition int
+}
+
+func (c Config) maxLexemeLen() int {
+	if c.MaxLexemeLen <= 0 || c.MaxLexemeLen > MaxLexemeLen {
+		return MaxLexemeLen
+	}
+	return c.MaxLexemeLen
+}
+
+func (c Config) startPosition() int {
+	if c.StartPosition <= 0 {
+		return 1
+	}
+	return c.StartPosition
+}
+
+// maxPositionsPerLexeme returns the configured maximum number of positions per
+// lexeme, or the input default if it isn't configured. A default of 0 means
+// that the number of positions isn't limited.
+func (c Config) maxPositionsPerLexeme(def int) int {
+	if c.MaxPositionsPerLexeme <= 0 {
+		return def
+	}
+	if c.MaxPositionsPerLexeme > MaxPositionsPerLexeme {
+		return MaxPositionsPerLexeme
+	}
+	return c.MaxPositionsPerLexeme
+}
+
+// applyPositionLimit drops the positions of every lexeme of the input TSVector
+// past the configured maximum number of positions, or the input default if it
+// isn't configured, like Postgres does. The input must be normalized, so that
+// the lowest positions are kept, and is modified in place.
+func (c Config) applyPositionLimit(v TSVector, def int) {
+	limitPositionsPerLexeme(v, c.maxPositionsPerLexeme(def))
+}
+
+// limitPositionsPerLexeme drops the positions of every lexeme of the input
+// TSVector past the input maximum, unless it's 0. The input must be
+// normalized, and is modified in place.
+func limitPositionsPerLexeme(v TSVector, maxPositions int) {
+	if maxPositions <= 0 {
+		return
+	}
+	for i := range v {
+		if len(v[i].positions) > maxPositions {
+			v[i].positions = v[i].positions[:maxPositions:maxPositions]
+		}
+	}
+}
+
+// applyLexemeLimit enforces the configured maximum lexeme length on the terms
+// of the input TSVector, according to the configured OversizeLexemePolicy. The
+// input is modified in place.
+func (c Config) applyLexemeLimit(v TSVector) (TSVector, error) {
+	maxLen := c.maxLexemeLen()
+	ret := v[:0]
+	for _, t := range v {
+		if len(t.lexeme) > maxLen {
+			switch c.OversizeLexeme {
+			case OversizeLexemeSkip:
+				continue
+			case OversizeLexemeTruncate:
+				t.lexeme = truncateLexeme(t.lexeme, maxLen)
+				if t.lexeme == "" {
+					// This can only happen for tiny maximum lengths that can't fit
+					// even the first rune of the lexeme.
+					continue
+				}
+			default:
+				return nil, pgerror.Newf(pgcode.ProgramLimitExceeded,
+					"word is too long (%d bytes, max %d bytes)", len(t.lexeme), maxLen)
+			}
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+// checkTSVectorSize returns an error if the input TSVector has more lexemes
+// than the configured maximum. The input must be normalized, so that duplicate
+// lexemes aren't counted more than once.
+func (c Config) checkTSVectorSize(v TSVector) error {
+	if c.MaxLexemes > 0 && len(v) > c.MaxLexemes {
+		return pgerror.Newf(pgcode.ProgramLimitExceeded,
+			"tsvector has too many lexemes (%d lexemes, max %d lexemes)", len(v), c.MaxLexemes)
+	}
+	return nil
+}
+
+// checkTSQuerySize returns an error if the TSQuery that will be built from the
+// input lexed terms has more nodes than the configured maximum. Every term
+// other than a parenthesis becomes exactly one node of the query tree, so the
+// check can be done before the tree is built.
+func (c Config) checkTSQuerySize(terms TSVector) error {
+	if c.MaxQueryNodes <= 0 {
+		return nil
+	}
+	var n int
+	for i := range terms {
+		if op := terms[i].operator; op != lparen && op != rparen {
+			n++
+		}
+	}
+	if n > c.MaxQueryNodes {
+		return pgerror.Newf(pgcode.ProgramLimitExceeded,
+			"tsquery is too complex (%d nodes, max %d nodes)", n, c.MaxQueryNodes)
+	}
+	return nil
+}
+
+// applyFreeTextLimit enforces the configured maximum number of lexemes on the
+// input tokens of free text, either by truncating them or by returning an
+// error.
+func (c Config) applyFreeTextLimit(tokens []string) ([]string, error) {
+	if c.MaxFreeTextLexemes <= 0 || len(tokens) <= c.MaxFreeTextLexemes {
+		return tokens, nil
+	}
+	if c.TruncateFreeText {
+		return tokens[:c.MaxFreeTextLexemes], nil
+	}
+	return nil, pgerror.Newf(pgcode.ProgramLimitExceeded,
+		"text-search query has too many words (%d words, max %d words)",
+		len(tokens), c.MaxFreeTextLexemes)
+}
+
+// truncateLexeme returns the longest prefix of the input that is at most
+// maxLen bytes long and doesn't split a multibyte rune.
+func truncateLexeme(lexeme string, maxLen int) string {
+	if len(lexeme) <= maxLen {
+		return lexeme
+	}
+	n := maxLen
+	for n > 0 && !utf8.RuneStart(lexeme[n]) {
+		n--
+	}
+	return lexeme[:n]
+}
+
+// simpleConfig is the name of the "simple" text search configuration, which
+// lowercases every token and doesn't remove any stop words. It's the only
+// text search configuration that's currently supported.
+const simpleConfig = "simple"
+
+// validateTextSearchConfig returns an error if the input text search
+// configuration name doesn't exist.
+func validateTextSearchConfig(config string) error {
+	if config != simpleConfig {
+		return pgerror.Newf(pgcode.UndefinedObject,
+			"text search configuration %q does not exist", config)
+	}
+	return nil
+}
+
+// tsParse splits the input document into tokens. Every maximal run of letters
+// and numbers is a token, and everything else is a separator.
+func tsParse(input string) []string {
+	return strings.FieldsFunc(input, isTSSeparator)
+}
+
+// isTSSeparator returns true if the input rune separates the tokens of a
+// document.
+func isTSSeparator(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+}
+
+// tsParse is like the tsParse function, but respects the configured
+// WordSeparators and WordChars.
+func (c Config) tsParse(input string) []string {
+	if c.WordSeparators == "" && c.WordChars == "" {
+		return tsParse(input)
+	}
+	return strings.FieldsFunc(input, c.isTSSeparator)
+}
+
+// isTSSeparator is like the isTSSeparator function, but respects the
+// configured WordSeparators and WordChars.
+func (c Config) isTSSeparator(r rune) bool {
+	if strings.ContainsRune(c.WordSeparators, r) {
+		return true
+	}
+	if strings.ContainsRune(c.WordChars, r) {
+		return false
+	}
+	return isTSSeparator(r)
+}
+
+// normalizeLexeme returns the lexeme for the input token. The simple
+// configuration just lowercases the token, like Postgres's str_tolower.
+//
+// Every place that turns text into lexemes, whether from documents or from
+// queries, must use this function, so that lexemes always compare equal when
+// their source text does. In particular, prefix matching compares the
+// normalized forms of query and document lexemes byte by byte, so a query
+// prefix that was folded differently than the document wouldn't match.
+func normalizeLexeme(token string) string {
+	return strings.ToLower(token)
+}
+
+// VectorsComparable returns whether both input vectors could have been
+// produced by DocumentToTSVector with the text search configuration passed by
+// name, so that comparing them, or matching them against queries produced by
+// the same configuration, is meaningful. It returns false if the configuration
+// doesn't exist, or if either vector holds a lexeme that the configuration
+// can't produce, like a lexeme with uppercase letters or with whitespace for
+// the simple configuration, which is a sign that the vector was produced by a
+// different configuration or parsed from a literal.
+//
+// Since vectors don't record the configuration that produced them, this is a
+// heuristic: a vector whose lexemes could have been produced by several
+// configurations, like 'run', is comparable under each of them.
+func VectorsComparable(config string, a, b TSVector) bool {
+	if err := validateTextSearchConfig(config); err != nil {
+		return false
+	}
+	return configCanProduce(a) && configCanProduce(b)
+}
+
+// configCanProduce returns whether every lexeme of the input vector can be
+// produced by the simple configuration from some document: every lexeme must
+// be normalized, and must be a single token.
+func configCanProduce(v TSVector) bool {
+	for i := range v {
+		lexeme := v[i].lexeme
+		if normalizeLexeme(lexeme) != lexeme {
+			return false
+		}
+		if tokens := tsParse(lexeme); len(tokens) != 1 || tokens[0] != lexeme {
+			return false
+		}
+	}
+	return true
+}
+
+// DocumentToTSVector parses an input document into lexemes using the text
+// search configuration passed by name, and returns a TSVector annotated with
+// the lexeme positions, like Postgres's to_tsvector. As in Postgres, lexemes
+// that are longer than MaxLexemeLen are skipped.
+func DocumentToTSVector(config string, input string) (TSVector, error) {
+	return DocumentToTSVectorWithConfig(config, input, Config{OversizeLexeme: OversizeLexemeSkip})
+}
+
+// DocumentToTSVectorWithConfig is like DocumentToTSVector, but uses the input
+// Config to control how the TSVector is constructed.
+func DocumentToTSVectorWithConfig(config string, input string, cfg Config) (TSVector, error) {
+	if err := validateTextSearchConfig(config); err != nil {
+		return nil, err
+	}
+	tokens := cfg.tsParse(input)
+	ret := make(TSVector, 0, len(tokens))
+	start := cfg.startPosition()
+	for i, token := range tokens {
+		pos := start + i
+		if pos > maxTSVectorPosition || pos < start {
+			pos = maxTSVectorPosition
+		}
+		ret = append(ret, tsTerm{
+			lexeme:    normalizeLexeme(token),
+			positions: []tsPosition{{position: pos}},
+		})
+	}
+	ret, err := cfg.applyLexemeLimit(ret)
+	if err != nil {
+		return nil, err
+	}
+	ret = normalizeTSVector(ret)
+	cfg.applyPositionLimit(ret, maxDocumentPositionsPerLexeme)
+	if err := cfg.checkTSVectorSize(ret); err != nil {
+		return nil, err
+	}
+	cfg.internLexemes(ret)
+	return ret, nil
+}
+
+// Chunk is a piece of a document that SplitForTokenization returns.
+type Chunk struct {
+	Text string
+	// StartPosition is the position that the first word of Text has in the
+	// whole document.
+	StartPosition int
+}
+
+// SplitForTokenization splits the input text into at most the input number of
+// chunks of roughly equal size, so that they can be tokenized in parallel.
+// The text is only split at whitespace, so no word is split across chunks,
+// and the concatenation of the texts of the chunks is the input text. A chunk
+// can be longer than the others if the text has no whitespace near where it
+// would otherwise end. The result is empty if the text is, and has a single
+// chunk if chunks is less than 2.
+//
+// Each chunk records the position of its first word in the whole text, with
+// the default word splitting of DocumentToTSVector. A chunk tokenized by
+// DocumentToTSVectorWithConfig with that StartPosition has the positions that
+// its words have in the vector of the whole text, so the union of the vectors
+// of the chunks, as normalized by Normalize, is that vector. Alternatively,
+// the chunks can be tokenized from position 1, with DocumentToTSVector, and
+// merged with MergeTSVectors with a baseGap of 0, which is the same unless the
+// last word of a chunk is skipped for being longer than MaxLexemeLen, since
+// MergeTSVectors shifts the positions of each vector by the largest positions
+// of the vectors before it.
+func SplitForTokenization(text string, chunks int) []Chunk {
+	if text == "" {
+		return nil
+	}
+	if chunks < 1 {
+		chunks = 1
+	}
+	size := len(text) / chunks
+	if size < 1 {
+		size = 1
+	}
+	var ret []Chunk
+	start, pos := 0, 1
+	for start < len(text) {
+		end := len(text)
+		if len(ret) < chunks-1 && start+size < len(text) {
+			// Extend the chunk up to the next whitespace, which is never part of
+			// a word.
+			if i := strings.IndexFunc(text[start+size:], unicode.IsSpace); i >= 0 {
+				end = start + size + i
+			}
+		}
+		ret = append(ret, Chunk{Text: text[start:end], StartPosition: pos})
+		pos += countTokens(text[start:end])
+		start = end
+	}
+	return ret
+}
+
+// countTokens returns the number of tokens that tsParse returns for the input
+// text, without allocating them.
+func countTokens(text string) int {
+	var ret int
+	inToken := false
+	for _, r := range text {
+		if isTSSeparator(r) {
+			inToken = false
+		} else if !inToken {
+			inToken = true
+			ret++
+		}
+	}
+	return ret
+}
+
+// ToTSQuery parses the input into a TSQuery, normalizing each of its operands
+// using the text search configuration passed by name, like Postgres's
+// to_tsquery. Unlike ParseTSQuery, which keeps the operands as they are,
+// the operands are normalized the same way as the lexemes of
+// DocumentToTSVector, so that ToTSQuery(config, `Über:*`) matches a document
+// that contains "übersicht".
+//
+// An operand that normalizes to several lexemes, like foo-bar, is replaced by
+// the phrase of those lexemes, foo <-> bar, each of which keeps the weights of
+// the operand. Operands that don't contain any lexemes are removed from the
+// query, which can leave the query empty.
+func ToTSQuery(config string, input string) (TSQuery, error) {
+	if err := validateTextSearchConfig(config); err != nil {
+		return TSQuery{}, err
+	}
+	q, err := ParseTSQuery(input)
+	if err != nil {
+		return TSQuery{}, err
+	}
+	return TSQuery{root: normalizeTSNode(q.root)}, nil
+}
+
+// PlainToTSQuery returns a TSQuery that matches documents that contain every
+// lexeme of the input text, using the text search configuration passed by
+// name, like Postgres's plainto_tsquery. The text is parsed like a document,
+// so operators and other punctuation are ignored: PlainToTSQuery("simple",
+// "The Fat & Cats") returns 'the' & 'fat' & 'cats'. The query is empty if the
+// text doesn't contain any lexemes.
+func PlainToTSQuery(config string, input string) (TSQuery, error) {
+	return PlainToTSQueryWithConfig(config, input, Config{})
+}
+
+// PlainToTSQueryWithConfig is like PlainToTSQuery, but uses the input Config
+// to limit the number of lexemes of the query.
+func PlainToTSQueryWithConfig(config string, input string, cfg Config) (TSQuery, error) {
+	return freeTextToTSQuery(config, input, cfg, and, 0 /* followedN */)
+}
+
+// MatchMode controls how ParsePlainTSQuery combines the lexemes of its input.
+type MatchMode int
+
+const (
+	// MatchAll matches documents that contain every lexeme, like
+	// plainto_tsquery.
+	MatchAll MatchMode = iota
+	// MatchAny matches documents that contain any of the lexemes.
+	MatchAny
+)
+
+// ParsePlainTSQuery returns a TSQuery for the lexemes of the input text, which
+// is parsed like a document with the simple text search configuration. With
+// MatchAll, the result is the same as PlainToTSQuery's. With MatchAny, the
+// lexemes are combined with or operators instead, in a balanced tree, so that
+// the depth of the query only grows logarithmically with the number of
+// lexemes: ParsePlainTSQuery("The Fat Cats", MatchAny) returns
+// 'the' | 'fat' | 'cats'. The query is empty if the text doesn't contain any
+// lexemes.
+func ParsePlainTSQuery(input string, mode MatchMode) (TSQuery, error) {
+	switch mode {
+	case MatchAll:
+		return PlainToTSQuery(simpleConfig, input)
+	case MatchAny:
+		tokens := tsParse(input)
+		queries := make([]TSQuery, len(tokens))
+		for i, token := range tokens {
+			queries[i] = TSQuery{root: &tsNode{term: tsTerm{lexeme: normalizeLexeme(token)}}}
+		}
+		return OrAll(queries...), nil
+	}
+	return TSQuery{}, pgerror.Newf(pgcode.InvalidParameterValue, "unknown match mode: %d", mode)
+}
+
+// PhraseToTSQuery returns a TSQuery that matches documents that contain the
+// lexemes of the input text as a phrase, using the text search configuration
+// passed by name, like Postgres's phraseto_tsquery: PhraseToTSQuery("simple",
+// "The Fat Cats") returns 'the' <-> 'fat' <-> 'cats'. The query is empty if
+// the text doesn't contain any lexemes.
+func PhraseToTSQuery(config string, input string) (TSQuery, error) {
+	return PhraseToTSQueryWithConfig(config, input, Config{})
+}
+
+// PhraseToTSQueryWithConfig is like PhraseToTSQuery, but uses the input Config
+// to limit the number of lexemes of the query.
+func PhraseToTSQueryWithConfig(config string, input string, cfg Config) (TSQuery, error) {
+	return freeTextToTSQuery(config, input, cfg, followedby, 1 /* followedN */)
+}
+
+// freeTextToTSQuery returns the TSQuery that combines the lexemes of the input
+// text from left to right with the input operator.
+func freeTextToTSQuery(
+	config string, input string, cfg Config, op tsOperator, followedN int,
+) (TSQuery, error) {
+	if err := validateTextSearchConfig(config); err != nil {
+		return TSQuery{}, err
+	}
+	tokens, err := cfg.applyFreeTextLimit(cfg.tsParse(input))
+	if err != nil {
+		return TSQuery{}, err
+	}
+	var root *tsNode
+	for _, token := range tokens {
+		leaf := &tsNode{term: tsTerm{lexeme: normalizeLexeme(token)}}
+		if root == nil {
+			root = leaf
+		} else {
+			root = &tsNode{op: op, followedN: followedN, l: root, r: leaf}
+		}
+	}
+	return TSQuery{root: root}, nil
+}
+
+// normalizeTSNode returns a copy of the input query tree with normalized
+// operands. It returns nil if none of the operands contain any lexemes.
+//
+// Operands without any lexemes are removed like Postgres removes stop words
+// in clean_stopwords: a removed operand of a followed by operator still takes
+// up a position, so its width is added to the distance of the closest
+// enclosing followed by operator that's kept. For example, a <-> ('--' <-> b)
+// becomes a <2> b. Like in Postgres, an and or an or operator whose operands
+// are all removed takes up no positions, so a <-> (('--' <-> '--') & '--')
+// <-> b becomes a <2> b.
+func normalizeTSNode(n *tsNode) *tsNode {
+	if n == nil {
+		return nil
+	}
+	ret, _, _ := normalizeTSNodeWithWidths(n)
+	return ret
+}
+
+// normalizeTSNodeWithWidths is like normalizeTSNode, but it also returns the
+// number of positions taken up by removed operands at the left and right
+// edges of the returned subtree.
+func normalizeTSNodeWithWidths(n *tsNode) (ret *tsNode, ladd, radd int) {
+	switch n.op {
+	case invalid:
+		return normalizedPhrase(n.term.lexeme, n.term.positions), 0, 0
+	case not:
+		l, ladd, radd := normalizeTSNodeWithWidths(n.l)
+		if l == nil {
+			return nil, ladd, radd
+		}
+		return &tsNode{op: not, l: l}, ladd, radd
+	}
+	l, lladd, lradd := normalizeTSNodeWithWidths(n.l)
+	r, rladd, rradd := normalizeTSNodeWithWidths(n.r)
+	isPhrase := n.op == followedby
+	switch {
+	case l == nil && r == nil:
+		if isPhrase {
+			width := lladd + n.followedN + rradd
+			return nil, width, width
+		}
+		return nil, 0, 0
+	case l == nil:
+		if isPhrase {
+			return r, lladd + n.followedN + rladd, rradd
+		}
+		return r, rladd, rradd
+	case r == nil:
+		if isPhrase {
+			return l, lladd, lradd + n.followedN + rradd
+		}
+		return l, lladd, lradd
+	case isPhrase:
+		return &tsNode{op: n.op, followedN: n.followedN + lradd + rladd, l: l, r: r}, lladd, rradd
+	}
+	return &tsNode{op: n.op, l: l, r: r}, 0, 0
+}
+
+// normalizedPhrase returns the phrase of the lexemes of the input text, each of
+// which gets a copy of the input positions. It returns nil if the text doesn't
+// contain any lexemes.
+func normalizedPhrase(text string, positions []tsPosition) *tsNode {
+	var ret *tsNode
+	for _, token := range tsParse(text) {
+		leaf := &tsNode{term: tsTerm{
+			lexeme:    normalizeLexeme(token),
+			positions: copyTSPositions(positions),
+		}}
+		if ret == nil {
+			ret = leaf
+		} else {
+			ret = &tsNode{op: followedby, followedN: 1, l: ret, r: leaf}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,657 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"context"
+	"math"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOversizeLexemePolicy(t *testing.T) {
+	long := strings.Repeat("a", MaxLexemeLen+1)
+	maxLen := strings.Repeat("a", MaxLexemeLen)
+
+	t.Run("Default", func(t *testing.T) {
+		_, err := ParseTSVector(long + ` foo`)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "word is too long (2047 bytes, max 2046 bytes)")
+
+		v, err := ParseTSVector(maxLen)
+		require.NoError(t, err)
+		assert.Len(t, v, 1)
+	})
+
+	t.Run("Boundary", func(t *testing.T) {
+		// Like in Postgres, the longest lexeme is 2046 bytes long.
+		assert.Equal(t, 2046, MaxLexemeLen)
+		v, err := ParseTSVector(strings.Repeat("a", 2046))
+		require.NoError(t, err)
+		assert.Len(t, v, 1)
+		_, err = ParseTSVector(strings.Repeat("a", 2047))
+		require.Error(t, err)
+
+		v, err = DocumentToTSVector("simple", strings.Repeat("a", 2046)+" "+strings.Repeat("b", 2047))
+		require.NoError(t, err)
+		require.Len(t, v, 1)
+		assert.Len(t, v[0].lexeme, 2046)
+	})
+
+	t.Run("Skip", func(t *testing.T) {
+		v, err := ParseTSVectorWithConfig(long+` foo:1`, Config{OversizeLexeme: OversizeLexemeSkip})
+		require.NoError(t, err)
+		assert.Equal(t, `'foo':1`, v.String())
+	})
+
+	t.Run("Truncate", func(t *testing.T) {
+		v, err := ParseTSVectorWithConfig(long+`:3 foo:1`, Config{OversizeLexeme: OversizeLexemeTruncate})
+		require.NoError(t, err)
+		require.Len(t, v, 2)
+		assert.Equal(t, maxLen, v[0].lexeme)
+		assert.Equal(t, `'foo':1`, v[1].String())
+	})
+
+	t.Run("TruncateMerges", func(t *testing.T) {
+		// Lexemes that are identical after truncation are merged.
+		v, err := ParseTSVectorWithConfig(`abcd:1 abce:2 abc:3`, Config{
+			OversizeLexeme: OversizeLexemeTruncate,
+			MaxLexemeLen:   3,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, `'abc':1,2,3`, v.String())
+	})
+
+	t.Run("MaxLexemeLen", func(t *testing.T) {
+		_, err := ParseTSVectorWithConfig(`abcd`, Config{MaxLexemeLen: 3})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "word is too long (4 bytes, max 3 bytes)")
+
+		// A maximum that's larger than the package maximum is capped.
+		_, err = ParseTSVectorWithConfig(long, Config{MaxLexemeLen: 2 * MaxLexemeLen})
+		require.Error(t, err)
+	})
+}
+
+func TestSizeLimits(t *testing.T) {
+	t.Run("MaxLexemes", func(t *testing.T) {
+		cfg := Config{MaxLexemes: 3}
+		// Duplicate lexemes are only counted once.
+		v, err := ParseTSVectorWithConfig(`a:1 b:2 c:3 a:4 b:5`, cfg)
+		require.NoError(t, err)
+		assert.Len(t, v, 3)
+
+		_, err = ParseTSVectorWithConfig(`a b c d`, cfg)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "tsvector has too many lexemes (4 lexemes, max 3 lexemes)")
+
+		v, err = DocumentToTSVectorWithConfig("simple", `the cat and the hat`, Config{MaxLexemes: 4})
+		require.NoError(t, err)
+		assert.Len(t, v, 4)
+
+		_, err = DocumentToTSVectorWithConfig("simple", `the cat and the hat`, cfg)
+		require.Error(t, err)
+	})
+
+	t.Run("MaxQueryNodes", func(t *testing.T) {
+		cfg := Config{MaxQueryNodes: 5}
+		for _, tc := range []struct {
+			input string
+			nodes int
+		}{
+			{`a`, 1},
+			{`!a`, 2},
+			{`a & b`, 3},
+			{`a & !b | c`, 6},
+			{`((((a & b))))`, 3},
+			{`a <-> b <-> c`, 5},
+			{`(a | b) & (c | d)`, 7},
+		} {
+			t.Log(tc.input)
+			_, err := ParseTSQueryWithConfig(tc.input, cfg)
+			if tc.nodes > cfg.MaxQueryNodes {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "tsquery is too complex")
+			} else {
+				require.NoError(t, err)
+			}
+		}
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		_, err := ParseTSVectorWithConfig(strings.Repeat("a ", 1000)+"b", Config{})
+		require.NoError(t, err)
+		_, err = ParseTSQueryWithConfig(strings.Repeat("a & ", 1000)+"b", Config{})
+		require.NoError(t, err)
+	})
+}
+
+func TestTruncateLexeme(t *testing.T) {
+	for _, tc := range []struct {
+		lexeme   string
+		maxLen   int
+		expected string
+	}{
+		{`abc`, 3, `abc`},
+		{`abc`, 5, `abc`},
+		{`abcd`, 3, `abc`},
+		// é is 2 bytes, so it doesn't fit after "ab" with a 3 byte limit.
+		{`abé`, 3, `ab`},
+		{`abé`, 4, `abé`},
+		// 𝄞 is 4 bytes.
+		{`𝄞𝄞`, 7, `𝄞`},
+		{`𝄞𝄞`, 8, `𝄞𝄞`},
+		{`𝄞`, 3, ``},
+		{`日本語`, 8, `日本`},
+	} {
+		actual := truncateLexeme(tc.lexeme, tc.maxLen)
+		assert.Equal(t, tc.expected, actual, "truncating %q to %d bytes", tc.lexeme, tc.maxLen)
+		assert.True(t, utf8.ValidString(actual))
+	}
+}
+
+func TestDocumentToTSVector(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{``, ``},
+		{`   `, ``},
+		{`foo`, `'foo':1`},
+		{`Foo BAR`, `'bar':2 'foo':1`},
+		{`the cat and the hat`, `'and':3 'cat':2 'hat':5 'the':1,4`},
+		{`it's a dog-eat-dog world!`, `'a':3 'dog':4,6 'eat':5 'it':1 's':2 'world':7`},
+		{`Über élan 42`, `'42':3 'élan':2 'über':1`},
+	} {
+		t.Log(tc.input)
+		v, err := DocumentToTSVector("simple", tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, v.String())
+	}
+
+	t.Run("UnknownConfig", func(t *testing.T) {
+		_, err := DocumentToTSVector("klingon", "foo")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `text search configuration "klingon" does not exist`)
+	})
+
+	t.Run("OversizeLexeme", func(t *testing.T) {
+		input := `foo ` + strings.Repeat("a", MaxLexemeLen+1) + ` bar`
+		// Oversize words are skipped by default, but still take up a position.
+		v, err := DocumentToTSVector("simple", input)
+		require.NoError(t, err)
+		assert.Equal(t, `'bar':3 'foo':1`, v.String())
+
+		_, err = DocumentToTSVectorWithConfig("simple", input, Config{})
+		require.Error(t, err)
+	})
+
+	t.Run("ClampPositions", func(t *testing.T) {
+		input := strings.Repeat("a ", maxTSVectorPosition) + "b c"
+		v, err := DocumentToTSVector("simple", input)
+		require.NoError(t, err)
+		require.Len(t, v, 3)
+		assert.Equal(t, `'b':16383`, v[1].String())
+		assert.Equal(t, `'c':16383`, v[2].String())
+	})
+
+	t.Run("StartPosition", func(t *testing.T) {
+		for _, tc := range []struct {
+			start    int
+			expected string
+		}{
+			{-1, `'cat':2 'hat':5 'sat':3 'the':1,4`},
+			{0, `'cat':2 'hat':5 'sat':3 'the':1,4`},
+			{1, `'cat':2 'hat':5 'sat':3 'the':1,4`},
+			{10, `'cat':11 'hat':14 'sat':12 'the':10,13`},
+			{maxTSVectorPosition - 2, `'cat':16382 'hat':16383 'sat':16383 'the':16381,16383`},
+			{maxTSVectorPosition + 10, `'cat':16383 'hat':16383 'sat':16383 'the':16383`},
+			{math.MaxInt, `'cat':16383 'hat':16383 'sat':16383 'the':16383`},
+		} {
+			t.Log(tc)
+			v, err := DocumentToTSVectorWithConfig("simple", "the cat sat the hat", Config{StartPosition: tc.start})
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, v.String())
+		}
+
+		// The vectors of consecutive fragments of a document can be combined
+		// into the vector of the whole document without shifting them.
+		whole, err := DocumentToTSVector("simple", "the fat cat sat on the mat")
+		require.NoError(t, err)
+		first, err := DocumentToTSVector("simple", "the fat cat")
+		require.NoError(t, err)
+		second, err := DocumentToTSVectorWithConfig(
+			"simple", "sat on the mat", Config{OversizeLexeme: OversizeLexemeSkip, StartPosition: 4},
+		)
+		require.NoError(t, err)
+		assert.Equal(t, `'mat':7 'on':5 'sat':4 'the':6`, second.String())
+		assert.True(t, whole.Equal(append(first, second...)))
+	})
+}
+
+func TestSplitForTokenization(t *testing.T) {
+	for _, tc := range []struct {
+		text     string
+		chunks   int
+		expected []Chunk
+	}{
+		{``, 3, nil},
+		{`the cat`, 0, []Chunk{{`the cat`, 1}}},
+		{`the cat`, 1, []Chunk{{`the cat`, 1}}},
+		{`the cat sat on the mat`, 2, []Chunk{{`the cat sat`, 1}, {` on the mat`, 4}}},
+		{`the cat sat on the mat`, 3, []Chunk{{`the cat`, 1}, {` sat on`, 3}, {` the mat`, 5}}},
+		{`a b c`, 10, []Chunk{{`a`, 1}, {` b`, 2}, {` c`, 3}}},
+		{`supercalifragilistic a b`, 3, []Chunk{{`supercalifragilistic`, 1}, {` a b`, 2}}},
+		{`abc`, 2, []Chunk{{`abc`, 1}}},
+		// Separators other than whitespace are kept within the chunks.
+		{`it's a dog-eat-dog world`, 3, []Chunk{{`it's a dog-eat-dog`, 1}, {` world`, 7}}},
+		{`über élan 42 x`, 2, []Chunk{{`über élan`, 1}, {` 42 x`, 3}}},
+	} {
+		t.Log(tc)
+		actual := SplitForTokenization(tc.text, tc.chunks)
+		assert.Equal(t, tc.expected, actual)
+	}
+
+	t.Run("Tokenize", func(t *testing.T) {
+		// Tokenizing the chunks in parallel gives the same vector as tokenizing
+		// the whole text.
+		rng, _ := randutil.NewTestRand()
+		words := []string{"a", "b", "cat", "dog-eat-dog", "élan", "42", "", "\n", "  ", "!"}
+		for i := 0; i < 100; i++ {
+			var doc strings.Builder
+			for j := rng.Intn(50); j > 0; j-- {
+				doc.WriteString(words[rng.Intn(len(words))])
+				doc.WriteString(" ")
+			}
+			text := doc.String()
+			expected, err := DocumentToTSVector("simple", text)
+			require.NoError(t, err)
+			chunks := SplitForTokenization(text, 1+rng.Intn(8))
+			var joined strings.Builder
+			var union, shifted []TSVector
+			for _, c := range chunks {
+				joined.WriteString(c.Text)
+				v, err := DocumentToTSVectorWithConfig("simple", c.Text, Config{
+					OversizeLexeme: OversizeLexemeSkip,
+					StartPosition:  c.StartPosition,
+				})
+				require.NoError(t, err)
+				union = append(union, v)
+				v, err = DocumentToTSVector("simple", c.Text)
+				require.NoError(t, err)
+				shifted = append(shifted, v)
+			}
+			require.Equal(t, text, joined.String())
+			var all TSVector
+			for _, v := range union {
+				all = append(all, v...)
+			}
+			assert.Equal(t, expected.String(), all.Normalize().String(), text)
+			assert.Equal(t, expected.String(), MergeTSVectors(shifted, 0).String(), text)
+		}
+	})
+}
+
+func TestMaxPositionsPerLexeme(t *testing.T) {
+	input := strings.Repeat("a b ", MaxPositionsPerLexeme+10) + "c"
+	// oddPositions returns the first n odd positions, which are the positions of
+	// a in the input.
+	oddPositions := func(n int) []int {
+		var ret []int
+		for i := 0; i < n; i++ {
+			ret = append(ret, 2*i+1)
+		}
+		return ret
+	}
+	expected := oddPositions(maxDocumentPositionsPerLexeme)
+	positions := func(v TSVector, lexeme string) []int {
+		var ret []int
+		for _, term := range v {
+			if term.lexeme == lexeme {
+				for _, pos := range term.positions {
+					ret = append(ret, pos.position)
+				}
+			}
+		}
+		return ret
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		// Like to_tsvector in Postgres, only the first 255 positions of a lexeme
+		// are kept.
+		v, err := DocumentToTSVector("simple", input)
+		require.NoError(t, err)
+		assert.Equal(t, expected, positions(v, "a"))
+		assert.Len(t, positions(v, "b"), 255)
+		assert.Equal(t, []int{2*(MaxPositionsPerLexeme+10) + 1}, positions(v, "c"))
+
+		// A lexeme with exactly 255 positions keeps all of them.
+		v, err = DocumentToTSVector("simple", strings.Repeat("a ", 255))
+		require.NoError(t, err)
+		assert.Len(t, positions(v, "a"), 255)
+
+		// Parsed TSVectors keep all of their positions.
+		v, err = ParseTSVector(v.String() + " a:1000,2000")
+		require.NoError(t, err)
+		assert.Len(t, positions(v, "a"), 257)
+		v, err = DocumentToTSVector("simple", input)
+		require.NoError(t, err)
+
+		// Phrases still match the positions that are kept, but not past them.
+		q, err := ParseTSQuery(`a <-> b`)
+		require.NoError(t, err)
+		matches, err := q.MatchesInPositionRange(v, 1, 2)
+		require.NoError(t, err)
+		assert.True(t, matches)
+		matches, err = q.MatchesInPositionRange(v, 2*MaxPositionsPerLexeme+1, 2*MaxPositionsPerLexeme+2)
+		require.NoError(t, err)
+		assert.False(t, matches)
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		cfg := Config{MaxPositionsPerLexeme: 3}
+		v, err := DocumentToTSVectorWithConfig("simple", input, cfg)
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 3, 5}, positions(v, "a"))
+		assert.Equal(t, []int{2, 4, 6}, positions(v, "b"))
+
+		v, err = ParseTSVectorWithConfig(`a:5,4A,3,2B,1 b`, cfg)
+		require.NoError(t, err)
+		assert.Equal(t, `'a':1,2B,3 'b'`, v.String())
+
+		// Limits that are larger than Postgres's are clamped to it.
+		v, err = DocumentToTSVectorWithConfig("simple", input, Config{MaxPositionsPerLexeme: 1000})
+		require.NoError(t, err)
+		assert.Equal(t, oddPositions(MaxPositionsPerLexeme), positions(v, "a"))
+		v, err = ParseTSVectorWithConfig(v.String()+" a:1000", Config{MaxPositionsPerLexeme: 1000})
+		require.NoError(t, err)
+		assert.Equal(t, oddPositions(MaxPositionsPerLexeme), positions(v, "a"))
+	})
+
+	t.Run("Concat", func(t *testing.T) {
+		// Like the Postgres tsvector || operator, concatenating and merging
+		// vectors keeps the first 256 positions of a lexeme.
+		l, err := DocumentToTSVector("simple", strings.Repeat("a ", 200))
+		require.NoError(t, err)
+		r, err := DocumentToTSVector("simple", strings.Repeat("a ", 100))
+		require.NoError(t, err)
+		for _, v := range []TSVector{Concat(l, r), MergeTSVectors([]TSVector{l, r}, 0)} {
+			actual := positions(v, "a")
+			require.Len(t, actual, MaxPositionsPerLexeme)
+			assert.Equal(t, 1, actual[0])
+			assert.Equal(t, MaxPositionsPerLexeme, actual[MaxPositionsPerLexeme-1])
+		}
+
+		// A lexeme with exactly 256 positions keeps all of them.
+		r, err = DocumentToTSVector("simple", strings.Repeat("a ", 56))
+		require.NoError(t, err)
+		assert.Len(t, positions(Concat(l, r), "a"), MaxPositionsPerLexeme)
+		assert.Len(t, positions(MergeTSVectors([]TSVector{l, r}, 0), "a"), MaxPositionsPerLexeme)
+	})
+}
+
+func TestWordSeparators(t *testing.T) {
+	for _, tc := range []struct {
+		cfg      Config
+		input    string
+		expected string
+	}{
+		{Config{}, `see /usr/local`, `'local':3 'see':1 'usr':2`},
+		{Config{WordChars: "/"}, `see /usr/local`, `'/usr/local':2 'see':1`},
+		{Config{WordChars: "_-"}, `snake_case and kebab-case`, `'and':2 'kebab-case':3 'snake_case':1`},
+		// Letters and numbers can be made separators too.
+		{Config{WordSeparators: "x"}, `0x1f box`, `'0':1 '1f':2 'bo':3`},
+		// A rune that's in both is a separator.
+		{Config{WordChars: "/", WordSeparators: "/"}, `a/b`, `'a':1 'b':2`},
+	} {
+		t.Log(tc.input)
+		v, err := DocumentToTSVectorWithConfig("simple", tc.input, tc.cfg)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, v.String())
+	}
+
+	cfg := Config{WordChars: "/"}
+	v, err := DocumentToTSVectorWithConfig("simple", `see /usr/local/bin`, cfg)
+	require.NoError(t, err)
+	q, err := PlainToTSQueryWithConfig("simple", `/USR/local/bin`, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, `'/usr/local/bin'`, q.String())
+	matches, err := EvalTSQuery(q, v)
+	require.NoError(t, err)
+	assert.True(t, matches)
+	q, err = PhraseToTSQueryWithConfig("simple", `see /usr/local/bin`, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, `'see' <-> '/usr/local/bin'`, q.String())
+}
+
+func TestVectorsComparable(t *testing.T) {
+	doc, err := DocumentToTSVector("simple", `The Quick brown fox`)
+	require.NoError(t, err)
+	other, err := DocumentToTSVector("simple", `Über élan 42`)
+	require.NoError(t, err)
+	assert.True(t, VectorsComparable("simple", doc, other))
+	assert.True(t, VectorsComparable("simple", doc, TSVector{}))
+	assert.False(t, VectorsComparable("english", doc, other))
+
+	for _, literal := range []string{`'Quick'`, `'two words'`, `'dog-eat-dog'`, `'!!'`} {
+		t.Log(literal)
+		v, err := ParseTSVector(literal)
+		require.NoError(t, err)
+		assert.False(t, VectorsComparable("simple", doc, v))
+		assert.False(t, VectorsComparable("simple", v, doc))
+	}
+	v, err := ParseTSVector(`brown:3 fox:4 quick:2 the:1`)
+	require.NoError(t, err)
+	assert.True(t, VectorsComparable("simple", doc, v))
+}
+
+func TestToTSQuery(t *testing.T) {
+	tcs := []struct {
+		input    string
+		expected string
+	}{
+		{`foo`, `'foo'`},
+		{`Foo & BAR`, `'foo' & 'bar'`},
+		{`Über:*`, `'über':*`},
+		{`'ÉLAN':*A`, `'élan':*A`},
+		{`foo-bar`, `'foo' <-> 'bar'`},
+		{`'Foo Bar':*B & baz`, `'foo':*B <-> 'bar':*B & 'baz'`},
+		{`foo & '!!'`, `'foo'`},
+		{`!'--' | foo`, `'foo'`},
+		{`'--' <-> '..'`, ``},
+		{`a <-> '--' <-> b`, `'a' <2> 'b'`},
+		{`(a <-> '--') <-> b`, `'a' <2> 'b'`},
+		{`a <3> ('--' <2> b)`, `'a' <5> 'b'`},
+		{`a <-> ('--' & '..') <-> b`, `'a' <2> 'b'`},
+		{`a <-> ('--' <-> '..') <-> b`, `'a' <3> 'b'`},
+		{`'--' <-> b`, `'b'`},
+		{`a <-> ('--' | b)`, `'a' <-> 'b'`},
+		// Removed operands of and and or operators take up no positions.
+		{`a <-> (('--' <-> '--') & '--') <-> b`, `'a' <2> 'b'`},
+		{`a <-> (('--' <2> '--') | '..') <-> b`, `'a' <2> 'b'`},
+	}
+	for _, tc := range tcs {
+		t.Log(tc.input)
+		q, err := ToTSQuery("simple", tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.String())
+	}
+
+	t.Run("UnknownConfig", func(t *testing.T) {
+		_, err := ToTSQuery("klingon", "foo")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `text search configuration "klingon" does not exist`)
+	})
+
+	t.Run("ComparePG", func(t *testing.T) {
+		// This test can be manually run by pointing it to a local Postgres. There
+		// are no requirements for the contents of the local Postgres - it just runs
+		// expressions. The test validates that all of the test cases in this test
+		// file work the same in Postgres as they do this package.
+		skip.IgnoreLint(t, "need to manually enable")
+		conn, err := pgx.Connect(context.Background(), "postgresql://jordan@localhost:5432")
+		require.NoError(t, err)
+		for _, tc := range tcs {
+			t.Log(tc)
+
+			var actual string
+			row := conn.QueryRow(context.Background(), "SELECT to_tsquery('simple', $1)::TEXT", tc.input)
+			require.NoError(t, row.Scan(&actual))
+			assert.Equal(t, tc.expected, actual)
+		}
+	})
+}
+
+func TestFreeTextToTSQuery(t *testing.T) {
+	for _, tc := range []struct {
+		input  string
+		plain  string
+		phrase string
+	}{
+		{``, ``, ``},
+		{`!!`, ``, ``},
+		{`Cat`, `'cat'`, `'cat'`},
+		{`The Fat & Cats`, `'the' & 'fat' & 'cats'`, `'the' <-> 'fat' <-> 'cats'`},
+		{`fat:* | !cat`, `'fat' & 'cat'`, `'fat' <-> 'cat'`},
+		{`'Über' (élan)`, `'über' & 'élan'`, `'über' <-> 'élan'`},
+	} {
+		t.Log(tc.input)
+		q, err := PlainToTSQuery("simple", tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.plain, q.String())
+		q, err = PhraseToTSQuery("simple", tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.phrase, q.String())
+	}
+
+	t.Run("MaxFreeTextLexemes", func(t *testing.T) {
+		input := strings.Repeat("word ", 1000)
+		// There's no limit by default, like in Postgres.
+		q, err := PlainToTSQuery("simple", input)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("'word' & ", 999)+"'word'", q.String())
+
+		cfg := Config{MaxFreeTextLexemes: 3}
+		_, err = PlainToTSQueryWithConfig("simple", input, cfg)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "text-search query has too many words (1000 words, max 3 words)")
+		_, err = PhraseToTSQueryWithConfig("simple", input, cfg)
+		require.Error(t, err)
+		q, err = PlainToTSQueryWithConfig("simple", "a b c", cfg)
+		require.NoError(t, err)
+		assert.Equal(t, `'a' & 'b' & 'c'`, q.String())
+
+		cfg.TruncateFreeText = true
+		q, err = PlainToTSQueryWithConfig("simple", "a b c d e", cfg)
+		require.NoError(t, err)
+		assert.Equal(t, `'a' & 'b' & 'c'`, q.String())
+		q, err = PhraseToTSQueryWithConfig("simple", "a b c d e", cfg)
+		require.NoError(t, err)
+		assert.Equal(t, `'a' <-> 'b' <-> 'c'`, q.String())
+	})
+
+	t.Run("MatchMode", func(t *testing.T) {
+		for _, tc := range []struct {
+			input string
+			all   string
+			any   string
+		}{
+			{``, ``, ``},
+			{`!!`, ``, ``},
+			{`Cat`, `'cat'`, `'cat'`},
+			{`The Fat & Cats`, `'the' & 'fat' & 'cats'`, `'the' | 'fat' | 'cats'`},
+			{`fat:* | !cat`, `'fat' & 'cat'`, `'fat' | 'cat'`},
+		} {
+			t.Log(tc.input)
+			q, err := ParsePlainTSQuery(tc.input, MatchAll)
+			require.NoError(t, err)
+			assert.Equal(t, tc.all, q.String())
+			q, err = ParsePlainTSQuery(tc.input, MatchAny)
+			require.NoError(t, err)
+			assert.Equal(t, tc.any, q.String())
+		}
+
+		// The or operators form a balanced tree.
+		q, err := ParsePlainTSQuery(strings.Repeat("word ", 1024), MatchAny)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Repeat("'word' | ", 1023)+"'word'", q.String())
+		var depth func(n *tsNode) int
+		depth = func(n *tsNode) int {
+			if n == nil {
+				return 0
+			}
+			l, r := depth(n.l), depth(n.r)
+			if l > r {
+				return l + 1
+			}
+			return r + 1
+		}
+		assert.Equal(t, 11, depth(q.root))
+
+		v, err := ParseTSVector(`cat:3 mat:7`)
+		require.NoError(t, err)
+		q, err = ParsePlainTSQuery(`the cat sat`, MatchAny)
+		require.NoError(t, err)
+		matches, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		assert.True(t, matches)
+		q, err = ParsePlainTSQuery(`the cat sat`, MatchAll)
+		require.NoError(t, err)
+		matches, err = EvalTSQuery(q, v)
+		require.NoError(t, err)
+		assert.False(t, matches)
+
+		_, err = ParsePlainTSQuery(`cat`, MatchMode(-1))
+		require.Error(t, err)
+	})
+
+	t.Run("UnknownConfig", func(t *testing.T) {
+		_, err := PlainToTSQuery("klingon", "foo")
+		require.Error(t, err)
+		_, err = PhraseToTSQuery("klingon", "foo")
+		require.Error(t, err)
+	})
+}
+
+func TestUnicodePrefixMatch(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		document string
+		expected bool
+	}{
+		{`Über:*`, `Übersicht`, true},
+		{`über:*`, `ÜBERSICHT`, true},
+		{`ÜBER:*`, `übersicht`, true},
+		{`Über:*`, `Uber`, false},
+		{`ÉL:*`, `élan vital`, true},
+		{`Ωμ:*`, `ΩΜΕΓΑ`, true},
+		{`СЛОВ:*`, `словарь`, true},
+		{`straẞ:*`, `STRAẞE`, true},
+		{`Über:* & !élan:*`, `Übersicht Élan`, false},
+		{`Über:* <-> élan:*`, `Übersicht Élan`, true},
+	} {
+		t.Log(tc)
+		q, err := ToTSQuery("simple", tc.query)
+		require.NoError(t, err)
+		v, err := DocumentToTSVector("simple", tc.document)
+		require.NoError(t, err)
+		actual, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/errors"
+)
+
+// This file implements the Postgres binary wire format for TSQuery, as
+// produced by tsquerysend and consumed by tsqueryrecv.
+//
+// The format is a 4-byte big-endian count of query items, followed by each
+// item of the query tree in prefix order. Postgres stores the right operand of
+// a binary operator directly after the operator, and the left operand after
+// the entire right subtree, so that's the order we emit and expect.
+//
+// Each item begins with a 1-byte item type. Operand items continue with a
+// 1-byte weight bitmap, a 1-byte prefix flag and a NUL-terminated lexeme.
+// Operator items continue with a 1-byte operator code, and followed-by
+// operators additionally have a 2-byte big-endian distance.
+
+const (
+	// pgTSQueryItemVal and pgTSQueryItemOpr are the item types in the
+	// Postgres binary format, named QI_VAL and QI_OPR in Postgres.
+	pgTSQueryItemVal byte = 1
+	pgTSQueryItemOpr byte = 2
+
+	// The operator codes in the Postgres binary format, named OP_NOT, OP_AND,
+	// OP_OR and OP_PHRASE in Postgres.
+	pgTSQueryOpNot    byte = 1
+	pgTSQueryOpAnd    byte = 2
+	pgTSQueryOpOr     byte = 3
+	pgTSQueryOpPhrase byte = 4
+
+	// pgTSQueryWeightMask is the mask of the valid weight bits for an operand
+	// in the Postgres binary format. The bits line up with our tsWeight values
+	// for weights A through D.
+	pgTSQueryWeightMask = weightA | weightB | weightC | weightD
+)
+
+// EncodePostgresTSQuery appends the Postgres binary wire format encoding of
+// the input TSQuery to appendTo, matching Postgres's tsquerysend.
+func EncodePostgresTSQuery(appendTo []byte, q TSQuery) ([]byte, error) {
+	countIdx := len(appendTo)
+	appendTo = append(appendTo, 0, 0, 0, 0)
+	if q.root == nil {
+		return appendTo, nil
+	}
+	var count int
+	var err error
+	appendTo, err = encodePostgresTSNode(appendTo, q.root, &count)
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(appendTo[countIdx:], uint32(count))
+	return appendTo, nil
+}
+
+func encodePostgresTSNode(appendTo []byte, n *tsNode, count *int) ([]byte, error) {
+	*count++
+	switch n.op {
+	case invalid:
+		if bytes.IndexByte([]byte(n.term.lexeme), 0) != -1 {
+			return nil, pgerror.Newf(pgcode.InvalidParameterValue,
+				"text-search lexeme cannot contain a NUL byte: %s", n.term.lexeme)
+		}
+		var weight tsWeight
+		if len(n.term.positions) > 0 {
+			weight = n.term.positions[0].weight
+		}
+		var prefix byte
+		if weight&weightStar != 0 {
+			prefix = 1
+		}
+		appendTo = append(appendTo, pgTSQueryItemVal, byte(weight&pgTSQueryWeightMask), prefix)
+		appendTo = append(appendTo, n.term.lexeme...)
+		return append(appendTo, 0), nil
+	case not:
+		appendTo = append(appendTo, pgTSQueryItemOpr, pgTSQueryOpNot)
+		return encodePostgresTSNode(appendTo, n.l, count)
+	case and:
+		appendTo = append(appendTo, pgTSQueryItemOpr, pgTSQueryOpAnd)
+	case or:
+		appendTo = append(appendTo, pgTSQueryItemOpr, pgTSQueryOpOr)
+	case followedby:
+		if n.followedN < 0 || n.followedN > math.MaxInt16 {
+			return nil, pgerror.Newf(pgcode.ProgramLimitExceeded,
+				"distance in phrase operator is out of range: %d", n.followedN)
+		}
+		appendTo = append(appendTo, pgTSQueryItemOpr, pgTSQueryOpPhrase, 0, 0)
+		binary.BigEndian.PutUint16(appendTo[len(appendTo)-2:], uint16(n.followedN))
+	default:
+		return nil, errors.AssertionFailedf("invalid operator %d", n.op)
+	}
+	// Postgres expects the right operand before the left one.
+	appendTo, err := encodePostgresTSNode(appendTo, n.r, count)
+	if err != nil {
+		return nil, err
+	}
+	return encodePostgresTSNode(appendTo, n.l, count)
+}
+
+// DecodePostgresTSQuery decodes a TSQuery from the Postgres binary wire
+// format, matching Postgres's tsqueryrecv.
+func DecodePostgresTSQuery(b []byte) (TSQuery, error) {
+	if len(b) < 4 {
+		return TSQuery{}, invalidPostgresTSQueryError("insufficient data")
+	}
+	count := binary.BigEndian.Uint32(b)
+	d := pgTSQueryDecoder{b: b[4:]}
+	if count == 0 {
+		if len(d.b) > 0 {
+			return TSQuery{}, invalidPostgresTSQueryError("unexpected trailing data")
+		}
+		return TSQuery{}, nil
+	}
+	// Every item takes up at least 2 bytes, so we can reject absurd counts
+	// before doing any work.
+	if uint64(count)*2 > uint64(len(d.b)) {
+		return TSQuery{}, invalidPostgresTSQueryError("item count exceeds data length")
+	}
+	d.remaining = int(count)
+	root, err := d.decodeNode()
+	if err != nil {
+		return TSQuery{}, err
+	}
+	if d.remaining != 0 {
+		return TSQuery{}, invalidPostgresTSQueryError("item count does not match query tree")
+	}
+	if len(d.b) > 0 {
+		return TSQuery{}, invalidPostgresTSQueryError("unexpected trailing data")
+	}
+	return TSQuery{root: root}, nil
+}
+
+// pgTSQueryDecoder holds the state for decoding a TSQuery from the Postgres
+// binary wire format.
+type pgTSQueryDecoder struct {
+	b []byte
+	// remaining is the number of items that are left to be decoded.
+	remaining int
+}
+
+func (d *pgTSQueryDecoder) readByte() (byte, error) {
+	if len(d.b) < 1 {
+		return 0, invalidPostgresTSQueryError("insufficient data")
+	}
+	ret := d.b[0]
+	d.b = d.b[1:]
+	return ret, nil
+}
+
+func (d *pgTSQueryDecoder) decodeNode() (*tsNode, error) {
+	if d.remaining <= 0 {
+		return nil, invalidPostgresTSQueryError("item count does not match query tree")
+	}
+	d.remaining--
+	typ, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case pgTSQueryItemVal:
+		weight, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		if tsWeight(weight)&^pgTSQueryWeightMask != 0 {
+			return nil, invalidPostgresTSQueryError("invalid weight bitmap")
+		}
+		prefix, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		end := bytes.IndexByte(d.b, 0)
+		if end == -1 {
+			return nil, invalidPostgresTSQueryError("NUL terminator not found")
+		}
+		node := &tsNode{term: tsTerm{lexeme: string(d.b[:end])}}
+		d.b = d.b[end+1:]
+		w := tsWeight(weight)
+		if prefix != 0 {
+			w |= weightStar
+		}
+		if w != 0 {
+			node.term.positions = []tsPosition{{weight: w}}
+		}
+		return node, nil
+	case pgTSQueryItemOpr:
+		oper, err := d.readByte()
+		if err != nil {
+			return nil, err
+		}
+		node := &tsNode{}
+		switch oper {
+		case pgTSQueryOpNot:
+			node.op = not
+			if node.l, err = d.decodeNode(); err != nil {
+				return nil, err
+			}
+			return node, nil
+		case pgTSQueryOpAnd:
+			node.op = and
+		case pgTSQueryOpOr:
+			node.op = or
+		case pgTSQueryOpPhrase:
+			if len(d.b) < 2 {
+				return nil, invalidPostgresTSQueryError("insufficient data")
+			}
+			node.op = followedby
+			node.followedN = int(int16(binary.BigEndian.Uint16(d.b)))
+			d.b = d.b[2:]
+			if node.followedN < 0 {
+				return nil, invalidPostgresTSQueryError("negative phrase distance")
+			}
+		default:
+			return nil, invalidPostgresTSQueryError("unrecognized operator type")
+		}
+		// The right operand comes first in the Postgres format.
+		if node.r, err = d.decodeNode(); err != nil {
+			return nil, err
+		}
+		if node.l, err = d.decodeNode(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+	return nil, invalidPostgresTSQueryError("unrecognized item type")
+}
+
+func invalidPostgresTSQueryError(reason string) error {
+	return pgerror.Newf(pgcode.InvalidBinaryRepresentation, "invalid tsquery: %s", reason)
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPostgresTSQueryEncoding(t *testing.T) {
+	// The expected encodings are hex strings in the format produced by
+	// Postgres's tsquerysend. The ComparePG subtest below verifies them
+	// against a real Postgres server.
+	tcs := []struct {
+		input    string
+		expected string
+	}{
+		{`foo`,
+			`00000001` + `01` + `00` + `00` + `666f6f00`},
+		{`foo:*`,
+			`00000001` + `01` + `00` + `01` + `666f6f00`},
+		{`foo:a`,
+			`00000001` + `01` + `08` + `00` + `666f6f00`},
+		{`foo:*BD`,
+			`00000001` + `01` + `05` + `01` + `666f6f00`},
+		{`!foo`,
+			`00000002` + `0201` + `010000666f6f00`},
+		{`a & b`,
+			`00000003` + `0202` + `0100006200` + `0100006100`},
+		{`a | b`,
+			`00000003` + `0203` + `0100006200` + `0100006100`},
+		{`a <-> b`,
+			`00000003` + `02040001` + `0100006200` + `0100006100`},
+		{`a <0> b:*`,
+			`00000003` + `02040000` + `0100016200` + `0100006100`},
+		{`a <300> b`,
+			`00000003` + `0204012c` + `0100006200` + `0100006100`},
+		{`a & b | !c`,
+			`00000006` + `0203` + `0201` + `0100006300` + `0202` + `0100006200` + `0100006100`},
+		{`(a | b) <-> c`,
+			`00000005` + `02040001` + `0100006300` + `0203` + `0100006200` + `0100006100`},
+		{`'bla h' & 'é'`,
+			`00000003` + `0202` + `010000c3a900` + `010000626c61206800`},
+	}
+	for _, tc := range tcs {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		encoded, err := EncodePostgresTSQuery(nil, q)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, hex.EncodeToString(encoded))
+
+		expected, err := hex.DecodeString(tc.expected)
+		require.NoError(t, err)
+		decoded, err := DecodePostgresTSQuery(expected)
+		require.NoError(t, err)
+		assert.Equal(t, q.String(), decoded.String())
+		assert.Equal(t, q.root.UnambiguousString(), decoded.root.UnambiguousString())
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		encoded, err := EncodePostgresTSQuery(nil, TSQuery{})
+		require.NoError(t, err)
+		assert.Equal(t, `00000000`, hex.EncodeToString(encoded))
+		decoded, err := DecodePostgresTSQuery(encoded)
+		require.NoError(t, err)
+		assert.Equal(t, ``, decoded.String())
+	})
+
+	t.Run("AppendTo", func(t *testing.T) {
+		q, err := ParseTSQuery(`foo`)
+		require.NoError(t, err)
+		encoded, err := EncodePostgresTSQuery([]byte{0xff}, q)
+		require.NoError(t, err)
+		assert.Equal(t, `ff`+`00000001`+`010000666f6f00`, hex.EncodeToString(encoded))
+	})
+
+	t.Run("ComparePG", func(t *testing.T) {
+		// This test can be manually run by pointing it to a local Postgres. There
+		// are no requirements for the contents of the local Postgres - it just runs
+		// expressions. The test validates that all of the test cases in this test
+		// file work the same in Postgres as they do this package.
+		skip.IgnoreLint(t, "need to manually enable")
+		conn, err := pgx.Connect(context.Background(), "postgresql://jordan@localhost:5432")
+		require.NoError(t, err)
+		for _, tc := range tcs {
+			t.Log(tc)
+
+			var actual []byte
+			row := conn.QueryRow(context.Background(), "SELECT tsquerysend($1::TSQuery)", tc.input)
+			require.NoError(t, row.Scan(&actual))
+			assert.Equal(t, tc.expected, hex.EncodeToString(actual))
+		}
+	})
+}
+
+func TestDecodePostgresTSQueryError(t *testing.T) {
+	for _, tc := range []string{
+		``,
+		`000000`,
+		// Trailing data after an empty query.
+		`0000000001`,
+		// Count that's too large for the data.
+		`000000ff` + `010000666f6f00`,
+		// Count that's too small for the tree.
+		`00000001` + `0202` + `0100006200` + `0100006100`,
+		// Count that's too large for the tree.
+		`00000003` + `010000666f6f00` + `0000`,
+		// Missing NUL terminator.
+		`00000001` + `010000666f6f`,
+		// Invalid weight bitmap.
+		`00000001` + `011000666f6f00`,
+		// Unknown item type.
+		`00000001` + `030000666f6f00`,
+		// Unknown operator.
+		`00000003` + `0205` + `0100006200` + `0100006100`,
+		// Truncated phrase distance.
+		`00000001` + `020400`,
+		// Negative phrase distance.
+		`00000003` + `0204ffff` + `0100006200` + `0100006100`,
+		// Missing operand.
+		`00000002` + `0202` + `0100006200`,
+		// Trailing data after the tree.
+		`00000001` + `010000666f6f00` + `00`,
+	} {
+		t.Log(tc)
+		b, err := hex.DecodeString(tc)
+		require.NoError(t, err)
+		_, err = DecodePostgresTSQuery(b)
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/cockroachdb/errors"
+	"github.com/cockroachdb/errors/errorspb"
+	"github.com/gogo/protobuf/proto"
+)
+
+// ParseError is the error that's returned for a TSQuery or TSVector input
+// that can't be parsed, such as by ParseTSQuery, ToTSQuery or ParseTSVector.
+// It records where in the input parsing failed, so that callers can point at
+// the offending part of the input without inspecting the error message. It
+// wraps an error with the pgcode.Syntax code, so pgerror.GetPGCode returns the
+// same code as it does for any other syntax error. Use errors.As to retrieve
+// it from an error. It survives errors.EncodeError and errors.DecodeError, so
+// it can be retrieved from errors that were sent between nodes too.
+type ParseError struct {
+	cause error
+	// Position is the byte offset into the input of the token at which
+	// parsing failed, or the length of the input if the input ended before a
+	// complete query or vector.
+	Position int
+	// Token is the text of the token at which parsing failed, as it appears in
+	// the input. It's empty if the input ended before a complete query or
+	// vector.
+	Token string
+}
+
+var _ error = (*ParseError)(nil)
+var _ fmt.Formatter = (*ParseError)(nil)
+var _ errors.Formatter = (*ParseError)(nil)
+
+// newParseError wraps the input error, which must have the pgcode.Syntax
+// code, in a ParseError for the input position and token.
+func newParseError(err error, position int, token string) error {
+	return &ParseError{cause: err, Position: position, Token: token}
+}
+
+// Error implements error.
+func (e *ParseError) Error() string { return fmt.Sprintf("%v", e) }
+
+// Cause implements causer.
+func (e *ParseError) Cause() error { return e.cause }
+
+// Unwrap implements the Go 1.13 unwrapping interface.
+func (e *ParseError) Unwrap() error { return e.cause }
+
+// Format implements fmt.Formatter.
+func (e *ParseError) Format(s fmt.State, verb rune) { errors.FormatError(e, s, verb) }
+
+// FormatError implements errors.Formatter. The message is the message of the
+// wrapped error, and the position and token are only printed as details.
+func (e *ParseError) FormatError(p errors.Printer) error {
+	if p.Detail() {
+		p.Printf("tsearch parse error at position %d: %q", e.Position, e.Token)
+	}
+	return e.cause
+}
+
+func encodeParseError(_ context.Context, err error) (string, []string, proto.Message) {
+	e := err.(*ParseError)
+	return "", nil, &errorspb.StringsPayload{Details: []string{strconv.Itoa(e.Position), e.Token}}
+}
+
+// decodeParseError is a custom decoder that will be used when decoding
+// ParseError objects.
+func decodeParseError(
+	_ context.Context, cause error, _ string, _ []string, payload proto.Message,
+) error {
+	m, ok := payload.(*errorspb.StringsPayload)
+	if !ok || len(m.Details) != 2 {
+		// If this ever happens, this means some version of this package changed
+		// the payload, and we're receiving it here. In this case, give up and
+		// let DecodeError use the opaque type.
+		return nil
+	}
+	position, err := strconv.Atoi(m.Details[0])
+	if err != nil {
+		return nil
+	}
+	return &ParseError{cause: cause, Position: position, Token: m.Details[1]}
+}
+
+func init() {
+	key := errors.GetTypeKey((*ParseError)(nil))
+	errors.RegisterWrapperEncoder(key, encodeParseError)
+	errors.RegisterWrapperDecoder(key, decodeParseError)
+}
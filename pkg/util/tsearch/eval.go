@@ -14,7 +14,11 @@ import (
 	"math"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/errors"
 )
 
@@ -28,9 +32,514 @@ func EvalTSQuery(q TSQuery, v TSVector) (bool, error) {
 	return evaluator.eval()
 }
 
+// EvalTSQueryWithConfig is like EvalTSQuery, but uses the input Config to
+// limit the number of lexemes that a prefix may match, and to widen the
+// distances at which phrases match.
+func EvalTSQueryWithConfig(q TSQuery, v TSVector, cfg Config) (bool, error) {
+	evaluator := tsEvaluator{
+		v:                v,
+		q:                q,
+		maxPrefixMatches: cfg.MaxPrefixMatches,
+		phraseTolerance:  cfg.PhraseTolerance,
+	}
+	return evaluator.eval()
+}
+
+// MatchCount returns the number of occurrences of the receiver's positive
+// operands in the input vector, which can be used as a term frequency for
+// custom scoring. It returns 0 if the query doesn't match the vector at all.
+// Otherwise, the count is the sum of the counts of every operand of the query
+// that isn't nested within a not operator, where:
+//   - A lexeme counts the number of positions of the vector's matching lexeme
+//     that have one of the weights that the lexeme is restricted to, if any.
+//     A prefix lexeme counts the positions of every vector lexeme that it's a
+//     prefix of. A vector lexeme without positions counts as one occurrence of
+//     weight D.
+//   - A followed by operator counts the number of positions at which the
+//     whole phrase matches, and its operands aren't counted separately. A
+//     phrase that only matches by the absence of its operands, like
+//     !a <-> !b, counts as zero.
+//   - An and or or operator counts the sum of the counts of its operands, so
+//     an operand that appears twice in the query is counted twice.
+//   - A not operator counts as zero.
+func (q TSQuery) MatchCount(v TSVector) (int, error) {
+	if q.root == nil {
+		return 0, nil
+	}
+	evaluator := tsEvaluator{v: v, q: q}
+	matches, err := evaluator.eval()
+	if err != nil || !matches {
+		return 0, err
+	}
+	return evaluator.countNode(q.root)
+}
+
+// countNode returns the number of occurrences of the input node's positive
+// operands in the evaluator's vector. See MatchCount for the details.
+func (e *tsEvaluator) countNode(node *tsNode) (int, error) {
+	switch node.op {
+	case invalid:
+		var count int
+		for _, t := range findMatchingTerms(e.v, &node.term) {
+			positions := t.positions
+			if len(positions) == 0 {
+				positions = []tsPosition{{}}
+			}
+			count += len(filterPositionsByWeight(&node.term, positions))
+		}
+		return count, nil
+	case not:
+		return 0, nil
+	case and, or:
+		l, err := e.countNode(node.l)
+		if err != nil {
+			return 0, err
+		}
+		r, err := e.countNode(node.r)
+		return l + r, err
+	case followedby:
+		positions, err := e.evalWithinFollowedBy(node)
+		if err != nil || positions.invert {
+			return 0, err
+		}
+		return len(positions.positions), nil
+	}
+	return 0, errors.AssertionFailedf("invalid operator %d", node.op)
+}
+
+// matchBatchChunkSize is the number of vectors that a MatchBatch worker claims
+// at a time. Claiming chunks rather than single vectors keeps the workers from
+// contending on the shared counter when the vectors are small.
+const matchBatchChunkSize = 64
+
+// MatchBatch evaluates the receiver against each of the input vectors,
+// returning a slice whose ith entry is whether the query matches the ith
+// vector. If parallelism is greater than 1, up to that many goroutines are
+// used to evaluate the vectors concurrently. The query and vectors are only
+// read, so the caller may share them with other readers while MatchBatch
+// runs.
+func (q TSQuery) MatchBatch(vectors []TSVector, parallelism int) ([]bool, error) {
+	ret := make([]bool, len(vectors))
+	if parallelism > (len(vectors)+matchBatchChunkSize-1)/matchBatchChunkSize {
+		parallelism = (len(vectors) + matchBatchChunkSize - 1) / matchBatchChunkSize
+	}
+	if parallelism <= 1 {
+		return ret, q.matchRange(vectors, ret)
+	}
+
+	var next int64
+	var wg sync.WaitGroup
+	errs := make([]error, parallelism)
+	wg.Add(parallelism)
+	for w := 0; w < parallelism; w++ {
+		go func(w int) {
+			defer wg.Done()
+			for {
+				start := int(atomic.AddInt64(&next, matchBatchChunkSize)) - matchBatchChunkSize
+				if start >= len(vectors) {
+					return
+				}
+				end := start + matchBatchChunkSize
+				if end > len(vectors) {
+					end = len(vectors)
+				}
+				if err := q.matchRange(vectors[start:end], ret[start:end]); err != nil {
+					errs[w] = err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// matchRange evaluates the receiver against each of the input vectors, storing
+// the results into the corresponding entries of out.
+func (q TSQuery) matchRange(vectors []TSVector, out []bool) error {
+	evaluator := tsEvaluator{q: q}
+	for i := range vectors {
+		evaluator.v = vectors[i]
+		var err error
+		out[i], err = evaluator.eval()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MatchExplain runs the receiver against the input vector like EvalTSQuery,
+// and also reports which of the query's top-level or branches matched. The
+// top-level branches are the operands of the chain of or operators at the
+// root of the query, numbered from 0 in the order in which they appear in the
+// query text: a | b & c | !d has the branches a, b & c and !d. A query whose
+// root isn't an or operator has a single branch, the whole query. Unlike
+// EvalTSQuery, every branch is evaluated, even after one of them matched.
+func (q TSQuery) MatchExplain(v TSVector) (matched bool, branches []int, err error) {
+	if q.root == nil {
+		return false, nil, nil
+	}
+	evaluator := tsEvaluator{v: v, q: q}
+	for i, branch := range topLevelOrBranches(q.root, nil) {
+		ok, err := evaluator.evalNode(branch)
+		if err != nil {
+			return false, nil, err
+		}
+		if ok {
+			branches = append(branches, i)
+		}
+	}
+	return len(branches) > 0, branches, nil
+}
+
+// topLevelOrBranches appends the operands of the chain of or operators rooted
+// at the input node to appendTo, in query text order.
+func topLevelOrBranches(n *tsNode, appendTo []*tsNode) []*tsNode {
+	if n.op != or {
+		return append(appendTo, n)
+	}
+	appendTo = topLevelOrBranches(n.l, appendTo)
+	return topLevelOrBranches(n.r, appendTo)
+}
+
+// MatchesAny runs the receiver against the input vectors, which represent
+// separately stored fields of a single document, without concatenating them.
+// A lexeme is present in the document if it's present in any of the vectors,
+// and the and, or and not operators combine these results as usual. A phrase,
+// however, must be matched within a single vector: since the positions of
+// different vectors aren't comparable, cat <-> dog doesn't match a document
+// that only contains cat at the end of one vector and dog at the start of
+// another. Everything nested within a followed by operator, including
+// negations, is evaluated against one vector at a time. With no vectors, the
+// result is the same as matching an empty vector.
+func (q TSQuery) MatchesAny(vectors ...TSVector) (bool, error) {
+	if q.root == nil {
+		return false, nil
+	}
+	evaluators := make([]tsEvaluator, len(vectors))
+	for i := range vectors {
+		evaluators[i] = tsEvaluator{v: vectors[i], q: q}
+	}
+	return matchesAnyNode(q.root, evaluators)
+}
+
+// matchesAnyNode evaluates the input node against the vectors of the input
+// evaluators. See MatchesAny for the details.
+func matchesAnyNode(node *tsNode, evaluators []tsEvaluator) (bool, error) {
+	switch node.op {
+	case invalid, followedby:
+		for i := range evaluators {
+			if ok, err := evaluators[i].evalNode(node); err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case and:
+		l, err := matchesAnyNode(node.l, evaluators)
+		if err != nil || !l {
+			return false, err
+		}
+		return matchesAnyNode(node.r, evaluators)
+	case or:
+		l, err := matchesAnyNode(node.l, evaluators)
+		if err != nil || l {
+			return l, err
+		}
+		return matchesAnyNode(node.r, evaluators)
+	case not:
+		ret, err := matchesAnyNode(node.l, evaluators)
+		return !ret, err
+	}
+	return false, errors.AssertionFailedf("invalid operator %d", node.op)
+}
+
+// MatchesInPositionRange runs the receiver against the part of the input
+// vector whose positions are between lo and hi, inclusive, as if the rest of
+// the document didn't exist. For example, cat matches the first 100 positions
+// of a document if cat occurs at a position between 1 and 100. Lexemes without
+// positions are never in the range, so they don't match anything.
+//
+// The distances of phrases are still relative to the positions of their
+// operands, not to lo, and every operand of a phrase must match within the
+// range: cat <-> dog doesn't match if cat is at position hi and dog at hi+1.
+// Likewise, a lexeme that only occurs outside of the range is absent, so
+// !dog and cat <-> !dog are satisfied by an occurrence of dog outside of the
+// range. An error is returned if lo is larger than hi.
+func (q TSQuery) MatchesInPositionRange(v TSVector, lo, hi int) (bool, error) {
+	if lo > hi {
+		return false, pgerror.Newf(pgcode.InvalidParameterValue,
+			"invalid position range: %d is larger than %d", lo, hi)
+	}
+	return EvalTSQuery(q, v.positionRange(lo, hi))
+}
+
+// positionRange returns the part of the receiver whose positions are between
+// lo and hi, inclusive. Lexemes without positions in the range are omitted.
+func (t TSVector) positionRange(lo, hi int) TSVector {
+	ret := TSVector{}
+	for i := range t {
+		positions := t[i].positions
+		start := sort.Search(len(positions), func(j int) bool {
+			return positions[j].position >= lo
+		})
+		end := sort.Search(len(positions), func(j int) bool {
+			return positions[j].position > hi
+		})
+		if start < end {
+			ret = append(ret, tsTerm{lexeme: t[i].lexeme, positions: positions[start:end]})
+		}
+	}
+	return ret
+}
+
+// PostingSource provides the posting lists of a document's lexemes, for
+// matching queries against documents whose TSVector isn't materialized, such
+// as very large documents that are stored out of line. See MatchesSource.
+type PostingSource interface {
+	// Positions returns the positions of the input lexeme in the document, in
+	// increasing order, and whether the lexeme is present in the document at
+	// all. A lexeme can be present without positions.
+	Positions(lexeme string) ([]int, bool)
+	// HasPrefix returns whether any lexeme of the document starts with the
+	// input prefix.
+	HasPrefix(prefix string) bool
+}
+
+// MatchesSource runs the receiver against the document whose posting lists are
+// provided by the input source, returning whether or not the query matches
+// it. The result is the same as running EvalTSQuery against the document's
+// TSVector. Posting lists are only fetched for the lexemes that the query
+// needs, and and and or operators that aren't nested within a followed by
+// operator short circuit.
+//
+// A PostingSource doesn't provide the weights of the document's positions, so
+// an error is returned if any term of the query is restricted to weights,
+// like 'fox':A, rather than matching it as if it weren't. Since a
+// PostingSource can't enumerate the lexemes that start with a prefix, an
+// error is also returned if a prefix lexeme is nested within a followed by
+// operator, which needs its positions.
+func (q TSQuery) MatchesSource(src PostingSource) (bool, error) {
+	if q.root == nil {
+		return false, nil
+	}
+	if t := firstWeightedTerm(q.root); t != nil {
+		return false, pgerror.Newf(pgcode.FeatureNotSupported,
+			"weights of %q can't be matched against a posting source", t.lexeme)
+	}
+	evaluator := tsEvaluator{q: q, src: src}
+	return evaluator.eval()
+}
+
+// firstWeightedTerm returns the first term of the input query node that's
+// restricted to weights, or nil if there is none.
+func firstWeightedTerm(n *tsNode) *tsTerm {
+	if n == nil {
+		return nil
+	}
+	if n.op == invalid {
+		if _, mask := queryTermWeights(&n.term); mask != 0 {
+			return &n.term
+		}
+		return nil
+	}
+	if t := firstWeightedTerm(n.l); t != nil {
+		return t
+	}
+	return firstWeightedTerm(n.r)
+}
+
+// MightMatch returns false if the receiver can't match a document, according
+// to the input function, which reports whether the document contains a lexeme,
+// such as a bloom filter or a bitmap of the document's lexemes. It's a cheap
+// pre-filter for skipping documents before evaluating the query against their
+// TSVectors: if it returns true, the query may or may not match, but if it
+// returns false, the query doesn't match. The function may report lexemes
+// that the document doesn't contain, like a bloom filter does, but it must
+// never miss one that the document contains.
+//
+// Only the presence of lexemes is considered: followed by operators are
+// treated like and operators, and weight restrictions are ignored. Since
+// the function can't prove that a lexeme is absent, negations might always
+// match, and since it can't enumerate lexemes, neither can prefix lexemes.
+// An empty query never matches.
+func (q TSQuery) MightMatch(contains func(lexeme string) bool) bool {
+	if q.root == nil {
+		return false
+	}
+	return mightMatchNode(q.root, contains)
+}
+
+func mightMatchNode(n *tsNode, contains func(lexeme string) bool) bool {
+	switch n.op {
+	case invalid:
+		if len(n.term.positions) > 0 && n.term.positions[0].weight&weightStar != 0 {
+			return true
+		}
+		return contains(n.term.lexeme)
+	case not:
+		return true
+	case and, followedby:
+		return mightMatchNode(n.l, contains) && mightMatchNode(n.r, contains)
+	case or:
+		return mightMatchNode(n.l, contains) || mightMatchNode(n.r, contains)
+	}
+	panic(errors.AssertionFailedf("unknown operator %d", n.op))
+}
+
 type tsEvaluator struct {
 	v TSVector
 	q TSQuery
+	// src, if set, provides the posting lists of the document instead of v.
+	src PostingSource
+	// maxPrefixMatches is Config.MaxPrefixMatches. It's ignored if src is set.
+	maxPrefixMatches int
+	// phraseTolerance is Config.PhraseTolerance.
+	phraseTolerance int
+}
+
+// prefixRange returns the index of the first lexeme of the evaluator's vector
+// that starts with the input prefix, and the index after the last one. The
+// lexemes are sorted, so the lexemes that start with the prefix are contiguous,
+// and only they are scanned. An error is returned if there are more of them
+// than maxPrefixMatches.
+func (e *tsEvaluator) prefixRange(prefix string) (start, end int, err error) {
+	start = sort.Search(len(e.v), func(i int) bool {
+		return e.v[i].lexeme >= prefix
+	})
+	for end = start; end < len(e.v) && strings.HasPrefix(e.v[end].lexeme, prefix); end++ {
+		if e.maxPrefixMatches > 0 && end-start >= e.maxPrefixMatches {
+			return 0, 0, pgerror.Newf(pgcode.ProgramLimitExceeded,
+				"prefix %q matches too many lexemes (more than %d lexemes)", prefix, e.maxPrefixMatches)
+		}
+	}
+	return start, end, nil
+}
+
+// queryTermWeights returns whether the input query term is a prefix, along
+// with the mask of the weights that it's restricted to, which is 0 if it isn't
+// restricted to any weights.
+func queryTermWeights(term *tsTerm) (prefixMatch bool, mask tsWeight) {
+	if len(term.positions) == 0 {
+		return false, 0
+	}
+	w := term.positions[0].weight
+	return w&weightStar != 0, w &^ weightStar
+}
+
+// hasWeight returns whether the input vector term has a position with one of
+// the weights in the input mask. Positions without a weight have weight D. Like
+// in Postgres, a term without any positions satisfies every weight
+// restriction.
+func hasWeight(t *tsTerm, mask tsWeight) bool {
+	if mask == 0 || len(t.positions) == 0 {
+		return true
+	}
+	for _, pos := range t.positions {
+		w := pos.weight
+		if w == 0 {
+			w = weightD
+		}
+		if w&mask != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// termMatches returns whether the input term is present in the evaluator's
+// document, with one of the weights that it's restricted to, if any. If the
+// evaluator's document is a PostingSource, the term must not be restricted to
+// weights, which MatchesSource checks.
+func (e *tsEvaluator) termMatches(term *tsTerm) (bool, error) {
+	prefixMatch, mask := queryTermWeights(term)
+	target := term.lexeme
+	if e.src != nil {
+		if prefixMatch {
+			return e.src.HasPrefix(target), nil
+		}
+		_, ok := e.src.Positions(target)
+		return ok, nil
+	}
+
+	if prefixMatch && (e.maxPrefixMatches > 0 || mask != 0) {
+		// The range must be scanned to enforce the limit, but no further than
+		// the limit, or to find a lexeme with one of the term's weights.
+		start, end, err := e.prefixRange(target)
+		if err != nil {
+			return false, err
+		}
+		for j := start; j < end; j++ {
+			if hasWeight(&e.v[j], mask) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	// To evaluate a term, we search the vector for a match.
+	i := sort.Search(len(e.v), func(i int) bool {
+		return e.v[i].lexeme >= target
+	})
+	if i < len(e.v) {
+		t := &e.v[i]
+		if prefixMatch {
+			return strings.HasPrefix(t.lexeme, target), nil
+		}
+		return t.lexeme == target && hasWeight(t, mask), nil
+	}
+	return false, nil
+}
+
+// termPositions returns the positions at which the input term is present in
+// the evaluator's document, in increasing order. Only the positions with one
+// of the weights that the term is restricted to, if any, are returned. If the
+// evaluator's document is a PostingSource, the term must not be restricted to
+// weights, which MatchesSource checks.
+func (e *tsEvaluator) termPositions(term *tsTerm) ([]tsPosition, error) {
+	prefixMatch, _ := queryTermWeights(term)
+	target := term.lexeme
+	if e.src != nil {
+		if prefixMatch {
+			return nil, pgerror.Newf(pgcode.FeatureNotSupported,
+				"prefix %q can't be matched within a phrase against a posting source", target)
+		}
+		positions, _ := e.src.Positions(target)
+		if len(positions) == 0 {
+			return nil, nil
+		}
+		ret := make([]tsPosition, len(positions))
+		for i, pos := range positions {
+			ret[i].position = pos
+		}
+		return ret, nil
+	}
+
+	if prefixMatch {
+		start, end, err := e.prefixRange(target)
+		if err != nil {
+			return nil, err
+		}
+		var ret []tsPosition
+		for j := start; j < end; j++ {
+			ret = append(ret, filterPositionsByWeight(term, e.v[j].positions)...)
+		}
+		return sortAndUniqTSPositions(ret), nil
+	}
+	// To evaluate a term, we search the vector for a match.
+	i := sort.Search(len(e.v), func(i int) bool {
+		return e.v[i].lexeme >= target
+	})
+	if i >= len(e.v) || e.v[i].lexeme != target {
+		// No match.
+		return nil, nil
+	}
+	// Return all of the positions at which the term is present.
+	return filterPositionsByWeight(term, e.v[i].positions), nil
 }
 
 func (e *tsEvaluator) eval() (bool, error) {
@@ -42,25 +551,7 @@ func (e *tsEvaluator) eval() (bool, error) {
 func (e *tsEvaluator) evalNode(node *tsNode) (bool, error) {
 	switch node.op {
 	case invalid:
-		// If there's no operator we're evaluating a leaf term.
-		prefixMatch := false
-		if len(node.term.positions) > 0 && node.term.positions[0].weight == weightStar {
-			prefixMatch = true
-		}
-
-		// To evaluate a term, we search the vector for a match.
-		target := node.term.lexeme
-		i := sort.Search(len(e.v), func(i int) bool {
-			return e.v[i].lexeme >= target
-		})
-		if i < len(e.v) {
-			t := e.v[i]
-			if prefixMatch {
-				return strings.HasPrefix(t.lexeme, target), nil
-			}
-			return t.lexeme == target, nil
-		}
-		return false, nil
+		return e.termMatches(&node.term)
 	case and:
 		// Match if both operands are true.
 		l, err := e.evalNode(node.l)
@@ -194,6 +685,50 @@ func (e *tsEvaluator) evalFollowedBy(
 	return ret, nil
 }
 
+// evalFollowedByWithTolerance is like evalFollowedBy, but lets the position of
+// a match of the right arm, adjusted by rOffset, differ from the position of a
+// match of the left arm, adjusted by lOffset, by up to tolerance positions in
+// either direction, as long as it's at least minDiff. A match is emitted at the
+// position of the right arm. The output positions are sorted and unique.
+func (e *tsEvaluator) evalFollowedByWithTolerance(
+	lPositions, rPositions tsPositionSet,
+	lOffset, rOffset, tolerance, minDiff int,
+	emitMode emitMode,
+) (tsPositionSet, error) {
+	lo := -tolerance
+	if lo < minDiff {
+		lo = minDiff
+	}
+	// hasMatchBetween returns whether any of the input positions, adjusted by
+	// the input offset, is in the range [from, to].
+	hasMatchBetween := func(positions []tsPosition, offset, from, to int) bool {
+		i := sort.Search(len(positions), func(i int) bool {
+			return positions[i].position+offset >= from
+		})
+		return i < len(positions) && positions[i].position+offset <= to
+	}
+	var ret tsPositionSet
+	if emitMode&(emitMatches|emitRightUnmatched) != 0 {
+		for _, pos := range rPositions.positions {
+			rPos := pos.position + rOffset
+			matched := hasMatchBetween(lPositions.positions, lOffset, rPos-tolerance, rPos-lo)
+			if (matched && emitMode&emitMatches != 0) || (!matched && emitMode&emitRightUnmatched != 0) {
+				ret.positions = append(ret.positions, tsPosition{position: rPos})
+			}
+		}
+	}
+	if emitMode&emitLeftUnmatched != 0 {
+		for _, pos := range lPositions.positions {
+			lPos := pos.position + lOffset
+			if !hasMatchBetween(rPositions.positions, rOffset, lPos+lo, lPos+tolerance) {
+				ret.positions = append(ret.positions, tsPosition{position: lPos})
+			}
+		}
+	}
+	ret.positions = sortAndUniqTSPositions(ret.positions)
+	return ret, nil
+}
+
 // evalWithinFollowedBy is the evaluator for subexpressions of a followed by
 // operator. Instead of just returning true or false, and possibly short
 // circuiting on boolean ops, we need to return all of the tspositions at which
@@ -202,37 +737,8 @@ func (e *tsEvaluator) evalWithinFollowedBy(node *tsNode) (tsPositionSet, error)
 	switch node.op {
 	case invalid:
 		// We're evaluating a leaf (a term).
-		prefixMatch := false
-		if len(node.term.positions) > 0 && node.term.positions[0].weight == weightStar {
-			prefixMatch = true
-		}
-
-		// To evaluate a term, we search the vector for a match.
-		target := node.term.lexeme
-		i := sort.Search(len(e.v), func(i int) bool {
-			return e.v[i].lexeme >= target
-		})
-		if i >= len(e.v) {
-			// No match.
-			return tsPositionSet{}, nil
-		}
-		var ret []tsPosition
-		if prefixMatch {
-			for j := i; j < len(e.v); j++ {
-				t := e.v[j]
-				if !strings.HasPrefix(t.lexeme, target) {
-					break
-				}
-				ret = append(ret, t.positions...)
-			}
-			ret = sortAndUniqTSPositions(ret)
-			return tsPositionSet{positions: ret}, nil
-		} else if e.v[i].lexeme != target {
-			// No match.
-			return tsPositionSet{}, nil
-		}
-		// Return all of the positions at which the term is present.
-		return tsPositionSet{positions: e.v[i].positions}, nil
+		positions, err := e.termPositions(&node.term)
+		return tsPositionSet{positions: positions}, err
 	case or:
 		var lOffset, rOffset, width int
 
@@ -315,7 +821,15 @@ func (e *tsEvaluator) evalWithinFollowedBy(node *tsNode) (tsPositionSet, error)
 		case rPositions.invert:
 			mode = emitLeftUnmatched
 		}
-		ret, err := e.evalFollowedBy(lPositions, rPositions, lOffset, rOffset, mode)
+		var ret tsPositionSet
+		if node.op == followedby && e.phraseTolerance > 0 {
+			// The distance between the operands can't become negative.
+			ret, err = e.evalFollowedByWithTolerance(
+				lPositions, rPositions, lOffset, rOffset, e.phraseTolerance, -node.followedN, mode,
+			)
+		} else {
+			ret, err = e.evalFollowedBy(lPositions, rPositions, lOffset, rOffset, mode)
+		}
 		if invertResults {
 			ret.invert = true
 		}
@@ -326,7 +840,8 @@ func (e *tsEvaluator) evalWithinFollowedBy(node *tsNode) (tsPositionSet, error)
 }
 
 // sortAndUniqTSPositions sorts and uniquifies the input tsPosition list by
-// their position attributes.
+// their position attributes. When several entries share a position, the
+// highest of their weights is kept.
 func sortAndUniqTSPositions(pos []tsPosition) []tsPosition {
 	if len(pos) <= 1 {
 		return pos
@@ -343,6 +858,8 @@ func sortAndUniqTSPositions(pos []tsPosition) []tsPosition {
 			// entry, and bump lastUniqueIdx for the next loop iteration.
 			lastUniqueIdx++
 			pos[lastUniqueIdx] = pos[j]
+		} else if pos[j].weight > pos[lastUniqueIdx].weight {
+			pos[lastUniqueIdx].weight = pos[j].weight
 		}
 	}
 	pos = pos[:lastUniqueIdx+1]
@@ -12,8 +12,13 @@ package tsearch
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/assert"
@@ -52,6 +57,32 @@ func TestEval(t *testing.T) {
 		{`a:* & ar:*`, `ar:10`, true},
 		{`a:* & ar:* & arg:*`, `ar:10`, false},
 
+		// Tests for weight restrictions. Positions without a weight have weight
+		// D, and lexemes without positions satisfy every restriction.
+		{`a:A`, `a:1A`, true},
+		{`a:A`, `a:1`, false},
+		{`a:D`, `a:1`, true},
+		{`a:AB`, `a:1C,2B`, true},
+		{`a:AB`, `a:1C,2D`, false},
+		{`a:A`, `a`, true},
+		{`!a:A`, `a:1`, true},
+		{`!a:A`, `a:1A`, false},
+		{`a:A & b:B`, `a:1A b:2B`, true},
+		{`a:A & b:B`, `a:1 b:2B`, false},
+		{`a:A & b:B`, `a:1A b:2`, false},
+		{`a:A & b:B`, `a:1A,3 b:2C,4`, false},
+		{`a:A | b:B`, `a:1 b:2B`, true},
+		{`a:A | b:B`, `a:1 b:2`, false},
+		{`a:*A`, `ab:1 abc:2A`, true},
+		{`a:*A`, `ab:1 abc:2`, false},
+		{`a:*A & b`, `a:1A b:2`, true},
+		{`a:A <-> b`, `a:1,3A b:2,4`, true},
+		{`a:A <-> b`, `a:1A,3 b:4`, false},
+		{`a <-> b:B`, `a:1 b:2B`, true},
+		{`a <-> b:B`, `a:1 b:2C`, false},
+		{`a:*B <-> c`, `ab:1 abc:2B c:3`, true},
+		{`a:*B <-> c`, `ab:1B abc:2 c:3`, false},
+
 		// Tests for followed-by.
 		{`a <-> b`, `a:1 b:2`, true},
 		{`a <-> b`, `a:2 b:1`, false},
@@ -143,3 +174,502 @@ func TestEval(t *testing.T) {
 		}
 	})
 }
+
+func TestEvalMaxPrefixMatches(t *testing.T) {
+	v, err := ParseTSVector(`ca:1 cab:2 cat:3 cats:4 dog:5 dot:6`)
+	require.NoError(t, err)
+	cfg := Config{MaxPrefixMatches: 3}
+	for _, tc := range []struct {
+		query    string
+		expected bool
+		err      bool
+	}{
+		{`do:*`, true, false},
+		{`ca:*`, false, true},
+		{`cat:*`, true, false},
+		{`x:*`, false, false},
+		{`ca:* <-> dog`, false, true},
+		{`cat:* <-> dog`, true, false},
+		{`do:* & !ca:*`, false, true},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		actual, err := EvalTSQueryWithConfig(q, v, cfg)
+		if tc.err {
+			require.Error(t, err)
+			assert.Equal(t, pgcode.ProgramLimitExceeded, pgerror.GetPGCode(err))
+			assert.Contains(t, err.Error(), `matches too many lexemes (more than 3 lexemes)`)
+			continue
+		}
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual)
+
+		// Without a limit, the result is the same as EvalTSQuery's.
+		expected, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		actual, err = EvalTSQueryWithConfig(q, v, Config{})
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestEvalPhraseTolerance(t *testing.T) {
+	for _, tc := range []struct {
+		query     string
+		vector    string
+		tolerance int
+		expected  bool
+	}{
+		{`a <-> b`, `a:1 b:2`, 1, true},
+		{`a <-> b`, `a:1 b:3`, 1, true},
+		{`a <-> b`, `a:1 b:1`, 1, true},
+		{`a <-> b`, `a:1 b:4`, 1, false},
+		{`a <-> b`, `a:1 b:4`, 2, true},
+		{`a <-> b`, `a:1 b:5`, 2, false},
+		{`a <-> b`, `a:2 b:1`, 1, false},
+		{`a <-> b`, `a:2 b:1`, 5, false},
+		{`a <-> b`, `a:1,7 b:9`, 1, true},
+		{`a <-> b`, `a:1,5 b:9`, 2, false},
+		{`a <0> b`, `a:1 b:2`, 1, true},
+		{`a <0> b`, `a:2 b:1`, 1, false},
+		{`a <3> b`, `a:1 b:3`, 1, true},
+		{`a <3> b`, `a:1 b:2`, 1, false},
+		{`a <3> b`, `a:1 b:5`, 1, true},
+		{`a <3> b`, `a:1 b:6`, 1, false},
+		// Every phrase operator applies the tolerance to the distance between
+		// the last lexemes of its operands. a <-> b <-> c is a <-> (b <-> c),
+		// so the distance from a to c must be within the tolerance of 2.
+		{`a <-> b <-> c`, `a:1 b:3 c:4`, 1, true},
+		{`a <-> b <-> c`, `a:1 b:2 c:4`, 1, true},
+		{`a <-> b <-> c`, `a:1 b:3 c:5`, 1, false},
+		{`a <-> b <-> c`, `a:1 b:4 c:5`, 1, false},
+		{`a <-> b <-> c`, `a:1 b:3 c:5`, 2, true},
+		{`(a <-> b) <-> c`, `a:1 b:3 c:5`, 1, true},
+		{`(a <-> b) <-> c`, `a:1 b:3 c:6`, 1, false},
+		{`a <-> (b | c)`, `a:1 c:3`, 1, true},
+		{`(a | b) <-> c`, `b:1 c:3`, 1, true},
+		{`a <-> (b & c)`, `a:1 b:3 c:3`, 1, true},
+		{`a <-> b:*`, `a:1 bc:3`, 1, true},
+		// A negated operand must not match anywhere within the tolerance.
+		{`a <-> !b`, `a:1 b:2`, 1, false},
+		{`a <-> !b`, `a:1 b:3`, 1, false},
+		{`a <-> !b`, `a:1 b:4`, 1, true},
+		{`a <-> !b`, `a:1,5 b:3`, 1, true},
+		{`!a <-> b`, `a:1 b:3`, 1, false},
+		{`!a <-> b`, `a:1 b:4`, 1, true},
+		{`!a <-> !b`, `a:1 b:3`, 1, true},
+		{`!(a <-> b)`, `a:1 b:3`, 1, false},
+		{`!(a <-> b)`, `a:1 b:4`, 1, true},
+		// Operators other than followed by are unaffected.
+		{`a & b`, `a:1 b:9`, 1, true},
+		{`a | c`, `a:1 b:9`, 1, true},
+		{`a & !b`, `a:1 b:9`, 1, false},
+	} {
+		t.Log(tc)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		v, err := ParseTSVector(tc.vector)
+		require.NoError(t, err)
+		actual, err := EvalTSQueryWithConfig(q, v, Config{PhraseTolerance: tc.tolerance})
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual)
+
+		// Without a tolerance, the result is the same as EvalTSQuery's.
+		expected, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		for _, tolerance := range []int{0, -1} {
+			actual, err = EvalTSQueryWithConfig(q, v, Config{PhraseTolerance: tolerance})
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual)
+		}
+	}
+}
+
+func TestMatchBatch(t *testing.T) {
+	q, err := ParseTSQuery(`(cat | dog) & !bird`)
+	require.NoError(t, err)
+	inputs := []string{`cat:1`, `dog:1 bird:2`, `fish:1`, `cat:1 dog:2`, ``, `bird:1`}
+	vectors := make([]TSVector, 1000)
+	expected := make([]bool, len(vectors))
+	for i := range vectors {
+		vectors[i], err = ParseTSVector(inputs[i%len(inputs)])
+		require.NoError(t, err)
+		expected[i], err = EvalTSQuery(q, vectors[i])
+		require.NoError(t, err)
+	}
+
+	for _, parallelism := range []int{-1, 0, 1, 2, 3, 8, 100} {
+		t.Run(fmt.Sprintf("parallelism=%d", parallelism), func(t *testing.T) {
+			actual, err := q.MatchBatch(vectors, parallelism)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual)
+
+			actual, err = q.MatchBatch(vectors[:5], parallelism)
+			require.NoError(t, err)
+			assert.Equal(t, expected[:5], actual)
+
+			actual, err = q.MatchBatch(nil, parallelism)
+			require.NoError(t, err)
+			assert.Empty(t, actual)
+		})
+	}
+}
+
+func TestMatchCount(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		vector   string
+		expected int
+	}{
+		{`a`, `a:1`, 1},
+		{`a`, `a:1,5,9`, 3},
+		{`a`, `a`, 1},
+		{`a`, `b:1`, 0},
+		{`!a`, `b:1`, 0},
+		{`a:*`, `a:1 ab:2,3 abc:4 b:5`, 4},
+		{`ab:*`, `a:1 ab:2,3 abc:4 b:5`, 3},
+		{`a:A`, `a:1A,2,3B`, 1},
+		{`a:AB`, `a:1A,2,3B`, 2},
+		{`a:D`, `a:1A,2,3B`, 1},
+		{`a:A`, `a`, 0},
+		{`a & b`, `a:1,2 b:3`, 3},
+		{`a & b`, `a:1,2`, 0},
+		{`a | b`, `a:1,2`, 2},
+		{`a & a`, `a:1,2`, 4},
+		{`a & !b`, `a:1,2 c:3`, 2},
+		{`a & !b`, `a:1,2 b:3`, 0},
+		{`a <-> b`, `a:1,3,7 b:2,4,9`, 2},
+		{`a <-> b`, `a:1,3,7 b:5,9`, 0},
+		{`a <-> b | c`, `a:1,3,7 b:5,9 c:10`, 1},
+		{`a <-> b & c`, `a:1,3 b:2,4 c:10,11`, 4},
+		{`a <-> !b`, `a:1,3 b:2 c:4`, 1},
+		{`!a <-> !b`, `c:1`, 0},
+		{`!(a <-> b) & c`, `a:1 b:3 c:5`, 1},
+	} {
+		t.Log(tc)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		v, err := ParseTSVector(tc.vector)
+		require.NoError(t, err)
+		actual, err := q.MatchCount(v)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual)
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		actual, err := TSQuery{}.MatchCount(TSVector{})
+		require.NoError(t, err)
+		assert.Zero(t, actual)
+	})
+}
+
+func TestMatchesAny(t *testing.T) {
+	title, err := DocumentToTSVector("simple", `the fat cat`)
+	require.NoError(t, err)
+	body, err := DocumentToTSVector("simple", `dog chased a rat`)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		query    string
+		expected bool
+	}{
+		{`cat`, true},
+		{`dog`, true},
+		{`bird`, false},
+		{`cat & dog`, true},
+		{`cat & bird`, false},
+		{`bird | rat`, true},
+		{`cat & !dog`, false},
+		{`cat & !bird`, true},
+		{`fat <-> cat`, true},
+		{`chased <2> rat`, true},
+		// The phrase would match the concatenation of the vectors, but phrases
+		// must match within a single vector.
+		{`cat <-> dog`, false},
+		{`cat <-> !dog`, true},
+		{`(fat <-> cat) & (dog <-> chased)`, true},
+		{`fat:* <-> ca:*`, true},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		actual, err := q.MatchesAny(title, body)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual)
+
+		// With a single vector, MatchesAny is the same as EvalTSQuery.
+		for _, v := range []TSVector{title, body} {
+			expected, err := EvalTSQuery(q, v)
+			require.NoError(t, err)
+			actual, err := q.MatchesAny(v)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual)
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		q, err := ParseTSQuery(`!cat`)
+		require.NoError(t, err)
+		actual, err := q.MatchesAny()
+		require.NoError(t, err)
+		assert.True(t, actual)
+		actual, err = TSQuery{}.MatchesAny(title)
+		require.NoError(t, err)
+		assert.False(t, actual)
+	})
+}
+
+func TestMatchExplain(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		vector   string
+		expected []int
+	}{
+		{`a`, `a:1`, []int{0}},
+		{`a`, `b:1`, nil},
+		{`a & b`, `a:1 b:2`, []int{0}},
+		{`a | b`, `a:1 b:2`, []int{0, 1}},
+		{`a | b`, `b:2`, []int{1}},
+		{`a | b | c`, `c:2`, []int{2}},
+		{`a | (b | c)`, `c:2`, []int{2}},
+		{`a | b & c | !d`, `b:1 c:2`, []int{1, 2}},
+		{`a | b & c | !d`, `a:1 d:2`, []int{0}},
+		{`a <-> b | b <-> a`, `b:1 a:2`, []int{1}},
+		{`!(a | b)`, `c:1`, []int{0}},
+		{`(a | b) & c`, `a:1 c:2`, []int{0}},
+	} {
+		t.Log(tc)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		v, err := ParseTSVector(tc.vector)
+		require.NoError(t, err)
+		matched, branches, err := q.MatchExplain(v)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, branches)
+		assert.Equal(t, len(tc.expected) > 0, matched)
+
+		expected, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		assert.Equal(t, expected, matched)
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		matched, branches, err := TSQuery{}.MatchExplain(TSVector{})
+		require.NoError(t, err)
+		assert.False(t, matched)
+		assert.Nil(t, branches)
+	})
+}
+
+func TestMatchesInPositionRange(t *testing.T) {
+	v, err := DocumentToTSVector("simple", `the quick fox saw the lazy dog and the cat`)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		query    string
+		lo, hi   int
+		expected bool
+	}{
+		{`fox`, 1, 3, true},
+		{`fox`, 1, 2, false},
+		{`fox`, 3, 3, true},
+		{`dog`, 1, 5, false},
+		{`dog`, 6, 100, true},
+		{`the`, 6, 8, false},
+		{`fox & dog`, 1, 7, true},
+		{`fox & dog`, 1, 6, false},
+		{`fox | dog`, 1, 6, true},
+		{`fox & !dog`, 1, 6, true},
+		{`fox & !dog`, 1, 7, false},
+		{`lazy <-> dog`, 6, 7, true},
+		// Both operands of a phrase must be in the range.
+		{`lazy <-> dog`, 1, 6, false},
+		{`lazy <-> !dog`, 1, 6, true},
+		{`the <-> lazy`, 6, 10, false},
+		{`the <-> cat`, 6, 10, true},
+		{`the:* <-> c:*`, 1, 10, true},
+		{`the:* <-> c:*`, 1, 9, false},
+	} {
+		t.Log(tc.query, tc.lo, tc.hi)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		actual, err := q.MatchesInPositionRange(v, tc.lo, tc.hi)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual)
+	}
+
+	// Lexemes without positions are never in the range.
+	v, err = ParseTSVector(`cat dog:1`)
+	require.NoError(t, err)
+	q, err := ParseTSQuery(`cat | dog`)
+	require.NoError(t, err)
+	actual, err := q.MatchesInPositionRange(v, 1, 1)
+	require.NoError(t, err)
+	assert.True(t, actual)
+	q, err = ParseTSQuery(`cat`)
+	require.NoError(t, err)
+	actual, err = q.MatchesInPositionRange(v, 1, maxTSVectorPosition)
+	require.NoError(t, err)
+	assert.False(t, actual)
+
+	_, err = q.MatchesInPositionRange(v, 2, 1)
+	require.Error(t, err)
+}
+
+// vectorPostingSource is a PostingSource backed by a TSVector, which counts
+// the posting lists that are fetched.
+type vectorPostingSource struct {
+	v       TSVector
+	fetched int
+}
+
+func (s *vectorPostingSource) Positions(lexeme string) ([]int, bool) {
+	s.fetched++
+	i := sort.Search(len(s.v), func(i int) bool {
+		return s.v[i].lexeme >= lexeme
+	})
+	if i >= len(s.v) || s.v[i].lexeme != lexeme {
+		return nil, false
+	}
+	positions := s.v[i].positions
+	ret := make([]int, len(positions))
+	for j := range positions {
+		ret[j] = positions[j].position
+	}
+	return ret, true
+}
+
+func (s *vectorPostingSource) HasPrefix(prefix string) bool {
+	s.fetched++
+	i := sort.Search(len(s.v), func(i int) bool {
+		return s.v[i].lexeme >= prefix
+	})
+	return i < len(s.v) && strings.HasPrefix(s.v[i].lexeme, prefix)
+}
+
+func TestMightMatch(t *testing.T) {
+	v, err := DocumentToTSVector("simple", `the quick fox saw the lazy dog`)
+	require.NoError(t, err)
+	contains := func(lexeme string) bool {
+		_, ok := v.LexemeWeights(lexeme)
+		return ok
+	}
+	for _, tc := range []struct {
+		query    string
+		expected bool
+	}{
+		{`fox`, true},
+		{`cat`, false},
+		{`fox & dog`, true},
+		{`fox & cat`, false},
+		{`cat | lazy`, true},
+		{`cat | bird`, false},
+		{`!fox`, true},
+		{`!cat & bird`, false},
+		{`ca:*`, true},
+		{`ca:* & bird`, false},
+		{`fox:A`, true},
+		// Phrases are only checked for the presence of their operands.
+		{`fox <-> quick`, true},
+		{`fox <-> cat`, false},
+		{`!cat <-> !bird`, true},
+		{`(cat | quick) <-> (bird | fox)`, true},
+		{`(cat | quick) <-> (bird | owl)`, false},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		actual := q.MightMatch(contains)
+		assert.Equal(t, tc.expected, actual)
+		// There are no false negatives.
+		matches, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		if matches {
+			assert.True(t, actual)
+		}
+	}
+
+	assert.False(t, TSQuery{}.MightMatch(contains))
+}
+
+func TestMatchesSource(t *testing.T) {
+	v, err := DocumentToTSVector("simple", `the quick fox saw the lazy dog`)
+	require.NoError(t, err)
+	for _, query := range []string{
+		`fox`,
+		`cat`,
+		`fox & dog`,
+		`fox & !dog`,
+		`cat | lazy`,
+		`qu:*`,
+		`qu:* & !la:*`,
+		`quick <-> fox`,
+		`fox <-> quick`,
+		`the <2> fox`,
+		`lazy <-> !cat`,
+		`!lazy <-> dog`,
+		`the <-> (quick | lazy) <-> (fox | dog)`,
+		`(quick <-> fox) & !(lazy <-> cat)`,
+	} {
+		t.Log(query)
+		q, err := ParseTSQuery(query)
+		require.NoError(t, err)
+		expected, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		actual, err := q.MatchesSource(&vectorPostingSource{v: v})
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	t.Run("LexemeWithoutPositions", func(t *testing.T) {
+		v, err := ParseTSVector(`cat dog:1`)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(`cat & dog`)
+		require.NoError(t, err)
+		actual, err := q.MatchesSource(&vectorPostingSource{v: v})
+		require.NoError(t, err)
+		assert.True(t, actual)
+		q, err = ParseTSQuery(`dog <-> cat`)
+		require.NoError(t, err)
+		actual, err = q.MatchesSource(&vectorPostingSource{v: v})
+		require.NoError(t, err)
+		assert.False(t, actual)
+	})
+
+	t.Run("ShortCircuit", func(t *testing.T) {
+		q, err := ParseTSQuery(`cat & (fox | dog | lazy)`)
+		require.NoError(t, err)
+		src := &vectorPostingSource{v: v}
+		actual, err := q.MatchesSource(src)
+		require.NoError(t, err)
+		assert.False(t, actual)
+		assert.Equal(t, 1, src.fetched)
+	})
+
+	t.Run("PrefixWithinPhrase", func(t *testing.T) {
+		q, err := ParseTSQuery(`quick <-> f:*`)
+		require.NoError(t, err)
+		_, err = q.MatchesSource(&vectorPostingSource{v: v})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `prefix "f" can't be matched within a phrase`)
+	})
+
+	t.Run("Weights", func(t *testing.T) {
+		// The weights are rejected even if the term wouldn't be evaluated.
+		for _, query := range []string{`fox:A`, `cat & fox:AB`, `quick <-> fox:*A`} {
+			t.Log(query)
+			q, err := ParseTSQuery(query)
+			require.NoError(t, err)
+			src := &vectorPostingSource{v: v}
+			_, err = q.MatchesSource(src)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), `can't be matched against a posting source`)
+			assert.Zero(t, src.fetched)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		actual, err := TSQuery{}.MatchesSource(&vectorPostingSource{v: v})
+		require.NoError(t, err)
+		assert.False(t, actual)
+	})
+}
@@ -0,0 +1,193 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Explain returns a description of the receiver in plain English, for users
+// who aren't familiar with the tsquery syntax, such as:
+//
+//	must contain 'cat' AND 'dog', must NOT contain 'bird', with 'quick'
+//	immediately followed by 'fox'
+//
+// The description is made up of requirements, which are phrased as follows:
+//   - A lexeme is quoted like in the query. A prefix lexeme is "a word starting
+//     with 'cat'", and the weights and boost of a lexeme follow it in
+//     parentheses, as in 'cat' (weight A or B, boost 2).
+//   - A lexeme on its own is "must contain 'cat'", and a negated lexeme is
+//     "must NOT contain 'cat'". Any other negation is
+//     "must NOT match (...)".
+//   - The operands of an and operator are separate requirements, separated by
+//     commas, except that the lexemes among them are combined, as in
+//     "must contain 'cat' AND 'dog'". A phrase among them is introduced with
+//     "with".
+//   - The operands of an or operator are combined with OR, as in
+//     "must contain 'cat' OR 'dog'" if they're all lexemes, and as in
+//     "either (...) OR (...)" otherwise.
+//   - A phrase is "must contain" followed by its operands, which are separated
+//     by a description of their distance: "at the same position as" for <0>,
+//     "immediately followed by" for <->, and "followed 3 words later by" for
+//     <3>. Within a phrase, operands that are combined with and or or are
+//     grouped in parentheses, as in ('fox' or 'dog'), and a negated operand
+//     is "a word other than 'cat'".
+//
+// An empty query is described as "matches nothing".
+func (q TSQuery) Explain() string {
+	if q.root == nil {
+		return "matches nothing"
+	}
+	var buf strings.Builder
+	explainRequirement(&buf, q.root)
+	return buf.String()
+}
+
+// explainRequirement writes the description of the input node as a
+// requirement to the input buffer.
+func explainRequirement(buf *strings.Builder, n *tsNode) {
+	switch n.op {
+	case invalid:
+		buf.WriteString("must contain ")
+		explainTerm(buf, &n.term)
+	case not:
+		if n.l.op == invalid {
+			buf.WriteString("must NOT contain ")
+			explainTerm(buf, &n.l.term)
+			return
+		}
+		buf.WriteString("must NOT match (")
+		explainRequirement(buf, n.l)
+		buf.WriteByte(')')
+	case followedby:
+		buf.WriteString("must contain ")
+		explainPhrase(buf, n)
+	case and:
+		operands := flattenTSNode(n, and, nil)
+		for i, operand := range operands {
+			if operand.op == invalid && i > 0 && operands[i-1].op == invalid {
+				// The lexeme is combined with the previous one.
+				buf.WriteString(" AND ")
+				explainTerm(buf, &operand.term)
+				continue
+			}
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			if operand.op == followedby {
+				buf.WriteString("with ")
+				explainPhrase(buf, operand)
+				continue
+			}
+			explainRequirement(buf, operand)
+		}
+	case or:
+		operands := flattenTSNode(n, or, nil)
+		allTerms := true
+		for _, operand := range operands {
+			allTerms = allTerms && operand.op == invalid
+		}
+		if allTerms {
+			buf.WriteString("must contain ")
+			for i, operand := range operands {
+				if i > 0 {
+					buf.WriteString(" OR ")
+				}
+				explainTerm(buf, &operand.term)
+			}
+			return
+		}
+		buf.WriteString("either ")
+		for i, operand := range operands {
+			if i > 0 {
+				buf.WriteString(" OR ")
+			}
+			buf.WriteByte('(')
+			explainRequirement(buf, operand)
+			buf.WriteByte(')')
+		}
+	}
+}
+
+// explainPhrase writes the description of the input node, which is nested
+// within a phrase, to the input buffer.
+func explainPhrase(buf *strings.Builder, n *tsNode) {
+	switch n.op {
+	case invalid:
+		explainTerm(buf, &n.term)
+	case not:
+		buf.WriteString("a word other than ")
+		explainPhrase(buf, n.l)
+	case followedby:
+		explainPhrase(buf, n.l)
+		switch n.followedN {
+		case 0:
+			buf.WriteString(" at the same position as ")
+		case 1:
+			buf.WriteString(" immediately followed by ")
+		default:
+			fmt.Fprintf(buf, " followed %d words later by ", n.followedN)
+		}
+		explainPhrase(buf, n.r)
+	case and, or:
+		sep := " and "
+		if n.op == or {
+			sep = " or "
+		}
+		buf.WriteByte('(')
+		for i, operand := range flattenTSNode(n, n.op, nil) {
+			if i > 0 {
+				buf.WriteString(sep)
+			}
+			explainPhrase(buf, operand)
+		}
+		buf.WriteByte(')')
+	}
+}
+
+// explainTerm writes the description of the input lexeme to the input buffer.
+func explainTerm(buf *strings.Builder, t *tsTerm) {
+	var w tsWeight
+	if len(t.positions) > 0 {
+		w = t.positions[0].weight
+	}
+	if w&weightStar != 0 {
+		buf.WriteString("a word starting with ")
+	}
+	writeQuotedLexeme(buf, t.lexeme)
+	var details []string
+	if weights := (w &^ weightStar).String(); weights != "" {
+		details = append(details, "weight "+strings.Join(strings.Split(weights, ""), " or "))
+	}
+	if t.boost != 0 {
+		details = append(details, "boost "+strconv.FormatFloat(t.boost, 'g', -1, 64))
+	}
+	if len(details) > 0 {
+		buf.WriteString(" (")
+		buf.WriteString(strings.Join(details, ", "))
+		buf.WriteByte(')')
+	}
+}
+
+// flattenTSNode appends the operands of the chain of op operators that's
+// rooted at the input node to the input slice, in order. Only chains of
+// commutative operators are flattened: a node of any other operator, like a
+// phrase, is appended as a single operand, since regrouping its operands
+// could change its meaning.
+func flattenTSNode(n *tsNode, op tsOperator, appendTo []*tsNode) []*tsNode {
+	if n.op != op || !op.commutative() {
+		return append(appendTo, n)
+	}
+	appendTo = flattenTSNode(n.l, op, appendTo)
+	return flattenTSNode(n.r, op, appendTo)
+}
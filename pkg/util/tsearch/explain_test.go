@@ -0,0 +1,69 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTSQueryExplain(t *testing.T) {
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{`cat`, `must contain 'cat'`},
+		{`cat:*`, `must contain a word starting with 'cat'`},
+		{`cat:AB`, `must contain 'cat' (weight A or B)`},
+		{`cat:*C^2`, `must contain a word starting with 'cat' (weight C, boost 2)`},
+		{`'it''s'`, `must contain 'it''s'`},
+		{`!cat`, `must NOT contain 'cat'`},
+		{`!(!cat)`, `must NOT match (must NOT contain 'cat')`},
+		{`!(cat | dog)`, `must NOT match (must contain 'cat' OR 'dog')`},
+		{`cat & dog`, `must contain 'cat' AND 'dog'`},
+		{`cat & dog & bird`, `must contain 'cat' AND 'dog' AND 'bird'`},
+		{
+			`cat & dog & !bird & quick <-> fox`,
+			`must contain 'cat' AND 'dog', must NOT contain 'bird', with 'quick' immediately followed by 'fox'`,
+		},
+		{`!bird & cat`, `must NOT contain 'bird', must contain 'cat'`},
+		{`cat | dog | bird`, `must contain 'cat' OR 'dog' OR 'bird'`},
+		{`cat | !dog`, `either (must contain 'cat') OR (must NOT contain 'dog')`},
+		{`cat & dog | bird`, `either (must contain 'cat' AND 'dog') OR (must contain 'bird')`},
+		{`cat & (dog | bird)`, `must contain 'cat', must contain 'dog' OR 'bird'`},
+		{`quick <-> fox`, `must contain 'quick' immediately followed by 'fox'`},
+		{`quick <0> fox`, `must contain 'quick' at the same position as 'fox'`},
+		{`quick <3> fox`, `must contain 'quick' followed 3 words later by 'fox'`},
+		{
+			`the <-> quick <2> fox`,
+			`must contain 'the' immediately followed by 'quick' followed 2 words later by 'fox'`,
+		},
+		{
+			`quick <-> (fox | dog)`,
+			`must contain 'quick' immediately followed by ('fox' or 'dog')`,
+		},
+		{
+			`(quick & fast) <-> fox:*`,
+			`must contain ('quick' and 'fast') immediately followed by a word starting with 'fox'`,
+		},
+		{`quick <-> !fox`, `must contain 'quick' immediately followed by a word other than 'fox'`},
+		{`!(quick <-> fox)`, `must NOT match (must contain 'quick' immediately followed by 'fox')`},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQueryWithConfig(tc.query, Config{TermBoosts: true})
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.Explain())
+	}
+
+	assert.Equal(t, `matches nothing`, TSQuery{}.Explain())
+}
@@ -0,0 +1,261 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"sort"
+	"strings"
+)
+
+// TokenWithOffset is a token of a document, along with the location of the
+// text it was produced from. A document's tokens can be computed once with
+// TokenizeWithOffsets and then highlighted against any number of queries with
+// HighlightRanges, without re-tokenizing the document for each query.
+type TokenWithOffset struct {
+	// Lexeme is the normalized form of the token, as it would appear in the
+	// document's TSVector.
+	Lexeme string
+	// Position is the position of the token in the document, as it would
+	// appear in the document's TSVector.
+	Position int
+	// Start and End are the byte offsets of the token's text in the document.
+	// The text is document[Start:End].
+	Start, End int
+}
+
+// TokenizeWithOffsets splits the input document into tokens using the text
+// search configuration passed by name, like DocumentToTSVector, and returns
+// them in document order along with their byte offsets.
+func TokenizeWithOffsets(config string, input string) ([]TokenWithOffset, error) {
+	if err := validateTextSearchConfig(config); err != nil {
+		return nil, err
+	}
+	var ret []TokenWithOffset
+	start := -1
+	for i, r := range input {
+		if isTSSeparator(r) {
+			if start >= 0 {
+				ret = appendTokenWithOffset(ret, input, start, i)
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		ret = appendTokenWithOffset(ret, input, start, len(input))
+	}
+	return ret, nil
+}
+
+func appendTokenWithOffset(
+	appendTo []TokenWithOffset, input string, start, end int,
+) []TokenWithOffset {
+	pos := len(appendTo) + 1
+	if pos > maxTSVectorPosition {
+		pos = maxTSVectorPosition
+	}
+	return append(appendTo, TokenWithOffset{
+		Lexeme:   normalizeLexeme(input[start:end]),
+		Position: pos,
+		Start:    start,
+		End:      end,
+	})
+}
+
+// HighlightRanges returns the byte ranges of the input tokens that match one
+// of the lexemes of the input query, in the order of the tokens. Each range is
+// a [start, end) pair of byte offsets into the document that the tokens were
+// produced from. Lexemes that only appear negated in the query are not
+// highlighted, since they can't contribute to a match. Like ts_headline, the
+// weights of the query's lexemes are ignored.
+//
+// The lexemes of a phrase are only highlighted where the whole phrase
+// matches: for quick <-> fox, the tokens of every occurrence of "quick fox"
+// are highlighted, but a fox elsewhere in the document isn't. Within a phrase,
+// only the tokens that take part in a match are highlighted, so for
+// quick <-> (fox | dog), "quick fox" is highlighted as a whole, but a dog that
+// doesn't follow quick isn't.
+func HighlightRanges(tokens []TokenWithOffset, q TSQuery) [][2]int {
+	terms, phrases := positiveQueryTermsAndPhrases(q)
+	if len(terms) == 0 && len(phrases) == 0 {
+		return nil
+	}
+	phrasePositions := phraseMatchPositions(tokens, phrases)
+	var ret [][2]int
+	for i := range tokens {
+		highlight := phrasePositions[tokens[i].Position]
+		for _, term := range terms {
+			if highlight {
+				break
+			}
+			highlight = term.matchesLexeme(tokens[i].Lexeme)
+		}
+		if highlight {
+			ret = append(ret, [2]int{tokens[i].Start, tokens[i].End})
+		}
+	}
+	return ret
+}
+
+// positiveQueryTermsAndPhrases returns the terms of the leaves of the input
+// query that aren't nested within a not or a followed by operator, and the
+// outermost followed by operators that aren't nested within a not operator.
+func positiveQueryTermsAndPhrases(q TSQuery) (terms []*tsTerm, phrases []*tsNode) {
+	var collect func(n *tsNode)
+	collect = func(n *tsNode) {
+		if n == nil {
+			return
+		}
+		switch n.op {
+		case invalid:
+			terms = append(terms, &n.term)
+		case not:
+		case followedby:
+			phrases = append(phrases, n)
+		default:
+			collect(n.l)
+			collect(n.r)
+		}
+	}
+	collect(q.root)
+	return terms, phrases
+}
+
+// phraseMatchPositions returns the set of positions of the input tokens that
+// take part in a match of one of the input followed by operators.
+func phraseMatchPositions(tokens []TokenWithOffset, phrases []*tsNode) map[int]bool {
+	if len(phrases) == 0 {
+		return nil
+	}
+	v := make(TSVector, len(tokens))
+	for i := range tokens {
+		v[i] = tsTerm{lexeme: tokens[i].Lexeme, positions: []tsPosition{{position: tokens[i].Position}}}
+	}
+	p := phraseMatcher{
+		e:       tsEvaluator{v: normalizeTSVector(v)},
+		matches: make(map[*tsNode]tsPositionSet),
+		ret:     make(map[int]bool),
+	}
+	for _, phrase := range phrases {
+		matches := p.nodeMatches(phrase)
+		if matches.invert {
+			// The phrase only matches by the absence of its operands, so no
+			// tokens take part in its matches.
+			continue
+		}
+		for _, pos := range matches.positions {
+			p.addMatch(phrase, pos.position)
+		}
+	}
+	return p.ret
+}
+
+// phraseMatcher finds the positions of a vector that take part in the matches
+// of followed by operators.
+type phraseMatcher struct {
+	e tsEvaluator
+	// matches caches the result of evalWithinFollowedBy for every node that's
+	// been evaluated.
+	matches map[*tsNode]tsPositionSet
+	// ret is the set of positions that take part in a match.
+	ret map[int]bool
+}
+
+func (p *phraseMatcher) nodeMatches(n *tsNode) tsPositionSet {
+	if ret, ok := p.matches[n]; ok {
+		return ret
+	}
+	// The only errors that evalWithinFollowedBy returns are assertion failures
+	// for invalid trees, which can't be built by the parser, so a failure just
+	// means that nothing is highlighted.
+	ret, _ := p.e.evalWithinFollowedBy(n)
+	p.matches[n] = ret
+	return ret
+}
+
+// addMatch adds the positions of the leaves that take part in the match of the
+// input node at the input position to the result. As in evalWithinFollowedBy,
+// the position of a match of a followed by operator is the position of the
+// match of its right operand, and the left operand's match is the distance of
+// the operator plus the width of the right operand before it. The operands of
+// an and or or operator are aligned on the start of their matches instead.
+// Negated operands, which match by the absence of lexemes, don't add anything.
+func (p *phraseMatcher) addMatch(n *tsNode, pos int) {
+	var lPos, rPos int
+	switch n.op {
+	case invalid:
+		p.ret[pos] = true
+		return
+	case not:
+		return
+	case followedby:
+		rPos = pos
+		lPos = pos - n.followedN - p.nodeMatches(n.r).width
+	default:
+		l, r := p.nodeMatches(n.l), p.nodeMatches(n.r)
+		width := l.width
+		if r.width > width {
+			width = r.width
+		}
+		lPos = pos - (width - l.width)
+		rPos = pos - (width - r.width)
+	}
+	p.addOperandMatch(n.l, lPos)
+	p.addOperandMatch(n.r, rPos)
+}
+
+// addOperandMatch adds the positions of the leaves that take part in the
+// match of the input operand at the input position, if it matches there.
+func (p *phraseMatcher) addOperandMatch(n *tsNode, pos int) {
+	matches := p.nodeMatches(n)
+	if matches.invert {
+		return
+	}
+	i := sort.Search(len(matches.positions), func(i int) bool {
+		return matches.positions[i].position >= pos
+	})
+	if i < len(matches.positions) && matches.positions[i].position == pos {
+		p.addMatch(n, pos)
+	}
+}
+
+// positiveQueryTerms returns the terms of the leaves of the input query that
+// aren't nested within a not operator.
+func positiveQueryTerms(q TSQuery) []*tsTerm {
+	var terms []*tsTerm
+	var collect func(n *tsNode)
+	collect = func(n *tsNode) {
+		if n == nil {
+			return
+		}
+		switch n.op {
+		case invalid:
+			terms = append(terms, &n.term)
+		case not:
+		default:
+			collect(n.l)
+			collect(n.r)
+		}
+	}
+	collect(q.root)
+	return terms
+}
+
+// matchesLexeme returns true if the receiver, which must be a query term,
+// matches the input lexeme, either exactly or as a prefix if the receiver is a
+// prefix term.
+func (t *tsTerm) matchesLexeme(lexeme string) bool {
+	if len(t.positions) > 0 && t.positions[0].weight&weightStar != 0 {
+		return strings.HasPrefix(lexeme, t.lexeme)
+	}
+	return lexeme == t.lexeme
+}
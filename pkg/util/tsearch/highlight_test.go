@@ -0,0 +1,93 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenizeWithOffsets(t *testing.T) {
+	for _, input := range []string{
+		``,
+		`foo`,
+		`Foo BAR`,
+		`  the cat, and the hat!  `,
+		`it's a dog-eat-dog world`,
+		`Über élan 42`,
+	} {
+		t.Log(input)
+		tokens, err := TokenizeWithOffsets("simple", input)
+		require.NoError(t, err)
+
+		// The tokens must agree with the TSVector of the document.
+		v, err := DocumentToTSVector("simple", input)
+		require.NoError(t, err)
+		var terms TSVector
+		for _, tok := range tokens {
+			assert.Equal(t, tok.Lexeme, strings.ToLower(input[tok.Start:tok.End]))
+			terms = append(terms, tsTerm{lexeme: tok.Lexeme, positions: []tsPosition{{position: tok.Position}}})
+		}
+		assert.Equal(t, v.String(), normalizeTSVector(terms).String())
+	}
+
+	t.Run("UnknownConfig", func(t *testing.T) {
+		_, err := TokenizeWithOffsets("klingon", "foo")
+		require.Error(t, err)
+	})
+}
+
+func TestHighlightRanges(t *testing.T) {
+	const doc = `The cat sat on the Catalog, and the dog didn't.`
+	tokens, err := TokenizeWithOffsets("simple", doc)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		query    string
+		expected []string
+	}{
+		{`cat`, []string{`cat`}},
+		{`cat:*`, []string{`cat`, `Catalog`}},
+		{`the`, []string{`The`, `the`, `the`}},
+		{`cat & dog`, []string{`cat`, `dog`}},
+		{`cat <-> sat`, []string{`cat`, `sat`}},
+		// Only the tokens of the phrase's matches are highlighted.
+		{`the <-> cat`, []string{`The`, `cat`}},
+		{`the <-> dog`, []string{`the`, `dog`}},
+		{`the <-> (cat | dog)`, []string{`The`, `cat`, `the`, `dog`}},
+		{`the <-> (cat | bird)`, []string{`The`, `cat`}},
+		{`(the <-> cat:*) | dog`, []string{`The`, `cat`, `the`, `Catalog`, `dog`}},
+		{`the <2> sat`, []string{`The`, `sat`}},
+		{`the <-> cat <-> sat <-> on`, []string{`The`, `cat`, `sat`, `on`}},
+		{`(the <-> cat) <2> (on <-> the)`, []string{`The`, `cat`, `on`, `the`}},
+		{`the <-> cat & !dog`, []string{`The`, `cat`}},
+		{`the <-> !cat`, []string{`the`, `the`}},
+		{`(the & cat:*) <-> sat`, nil},
+		{`!the <-> cat`, nil},
+		{`cat <-> dog`, nil},
+		{`cat:A | bird`, []string{`cat`}},
+		{`cat & !dog`, []string{`cat`}},
+		{`!(cat | dog)`, nil},
+		{`bird`, nil},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		var actual []string
+		for _, r := range HighlightRanges(tokens, q) {
+			actual = append(actual, doc[r[0]:r[1]])
+		}
+		assert.Equal(t, tc.expected, actual)
+	}
+}
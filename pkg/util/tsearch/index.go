@@ -0,0 +1,149 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"sort"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/errors"
+)
+
+// IndexKey is a key that an inverted index scan for a TSQuery should probe:
+// either a single lexeme, or if Prefix is set, the range of every lexeme that
+// begins with Lexeme.
+type IndexKey struct {
+	Lexeme string
+	Prefix bool
+}
+
+// End returns the exclusive end of the range of lexemes that the receiver
+// matches, which starts at Lexeme. It's empty if the range is unbounded, which
+// can only happen for a prefix that consists of 0xff bytes.
+func (k IndexKey) End() string {
+	if !k.Prefix {
+		return k.Lexeme + "\x00"
+	}
+	end := []byte(k.Lexeme)
+	for i := len(end) - 1; i >= 0; i-- {
+		end[i]++
+		if end[i] != 0 {
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// IndexKeyMode is the way in which an inverted index scan should combine the
+// documents that it finds for each of the keys returned by TSQuery.IndexKeys.
+type IndexKeyMode int
+
+const (
+	// IndexKeysAll means that the scan should return the documents that
+	// contain every key, which is the intersection of the documents of the
+	// keys.
+	IndexKeysAll IndexKeyMode = iota
+	// IndexKeysAny means that the scan should return the documents that
+	// contain any of the keys, which is the union of the documents of the
+	// keys.
+	IndexKeysAny
+)
+
+// IndexKeys returns the keys that an inverted index scan should probe to find
+// the candidate documents for the receiver, and how the scan should combine
+// their documents. The candidates are a superset of the matching documents:
+// weights, phrase distances and negations aren't taken into account, so every
+// candidate must still be checked against the query.
+//
+// If some lexemes are required by every match of the query, such as cat and
+// dog in cat & dog & !bird, only those are returned, with IndexKeysAll.
+// Otherwise, the returned keys cover every match with IndexKeysAny: for
+// example, cat | dog returns both lexemes, and (cat | dog) & (bird | fish)
+// returns the keys of one of its operands. The keys are sorted and don't
+// contain duplicates.
+//
+// An error is returned if the query isn't indexable; see IsIndexable.
+func (q TSQuery) IndexKeys() ([]IndexKey, IndexKeyMode, error) {
+	if !q.IsIndexable() {
+		return nil, 0, pgerror.Newf(pgcode.FeatureNotSupported,
+			"tsquery %s can't be evaluated using an inverted index", q)
+	}
+	if keys := q.root.requiredIndexKeys(nil); len(keys) > 0 {
+		return sortAndUniqIndexKeys(keys), IndexKeysAll, nil
+	}
+	return sortAndUniqIndexKeys(q.root.coveringIndexKeys(nil)), IndexKeysAny, nil
+}
+
+// indexKey returns the index key for the receiver, which must be a term.
+func (n *tsNode) indexKey() IndexKey {
+	prefix := len(n.term.positions) > 0 && n.term.positions[0].weight&weightStar != 0
+	return IndexKey{Lexeme: n.term.lexeme, Prefix: prefix}
+}
+
+// requiredIndexKeys appends the keys of the terms that every document matched
+// by the receiver must contain to appendTo.
+func (n *tsNode) requiredIndexKeys(appendTo []IndexKey) []IndexKey {
+	switch n.op {
+	case invalid:
+		return append(appendTo, n.indexKey())
+	case and, followedby:
+		return n.r.requiredIndexKeys(n.l.requiredIndexKeys(appendTo))
+	}
+	// Neither operand of an or is required, and negations don't require
+	// anything.
+	return appendTo
+}
+
+// coveringIndexKeys appends keys to appendTo such that every document matched
+// by the receiver contains at least one of them. The receiver must require a
+// match.
+func (n *tsNode) coveringIndexKeys(appendTo []IndexKey) []IndexKey {
+	switch n.op {
+	case invalid:
+		return append(appendTo, n.indexKey())
+	case or:
+		return n.r.coveringIndexKeys(n.l.coveringIndexKeys(appendTo))
+	case and, followedby:
+		// Every match matches both operands, so it's enough to cover one of
+		// them. Pick the one that needs fewer keys.
+		if !n.r.requiresMatch() {
+			return n.l.coveringIndexKeys(appendTo)
+		}
+		if !n.l.requiresMatch() {
+			return n.r.coveringIndexKeys(appendTo)
+		}
+		l, r := n.l.coveringIndexKeys(nil), n.r.coveringIndexKeys(nil)
+		if len(r) < len(l) {
+			l = r
+		}
+		return append(appendTo, l...)
+	}
+	panic(errors.AssertionFailedf("operator %d doesn't require a match", n.op))
+}
+
+// sortAndUniqIndexKeys sorts the input keys by lexeme, with exact keys before
+// prefix keys, and removes duplicates. The input is modified.
+func sortAndUniqIndexKeys(keys []IndexKey) []IndexKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Lexeme != keys[j].Lexeme {
+			return keys[i].Lexeme < keys[j].Lexeme
+		}
+		return !keys[i].Prefix && keys[j].Prefix
+	})
+	ret := keys[:0]
+	for i := range keys {
+		if i == 0 || keys[i] != keys[i-1] {
+			ret = append(ret, keys[i])
+		}
+	}
+	return ret
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTSQueryIndexKeys(t *testing.T) {
+	exact := func(lexeme string) IndexKey { return IndexKey{Lexeme: lexeme} }
+	prefix := func(lexeme string) IndexKey { return IndexKey{Lexeme: lexeme, Prefix: true} }
+	for _, tc := range []struct {
+		query string
+		keys  []IndexKey
+		mode  IndexKeyMode
+	}{
+		{`cat`, []IndexKey{exact("cat")}, IndexKeysAll},
+		{`cat:*`, []IndexKey{prefix("cat")}, IndexKeysAll},
+		{`cat:A`, []IndexKey{exact("cat")}, IndexKeysAll},
+		{`dog & cat`, []IndexKey{exact("cat"), exact("dog")}, IndexKeysAll},
+		{`cat <-> dog`, []IndexKey{exact("cat"), exact("dog")}, IndexKeysAll},
+		{`cat & dog & !bird`, []IndexKey{exact("cat"), exact("dog")}, IndexKeysAll},
+		{`cat & (dog | bird)`, []IndexKey{exact("cat")}, IndexKeysAll},
+		{`cat & cat:* & cat`, []IndexKey{exact("cat"), prefix("cat")}, IndexKeysAll},
+		{`cat | dog`, []IndexKey{exact("cat"), exact("dog")}, IndexKeysAny},
+		{`cat | dog:* | cat`, []IndexKey{exact("cat"), prefix("dog")}, IndexKeysAny},
+		{`(cat | dog) & (bird | fish | cow)`, []IndexKey{exact("cat"), exact("dog")}, IndexKeysAny},
+		{`(cat | dog | cow) & (bird | fish)`, []IndexKey{exact("bird"), exact("fish")}, IndexKeysAny},
+		{`(cat | dog) & !bird`, []IndexKey{exact("cat"), exact("dog")}, IndexKeysAny},
+		{`(cat & !dog) | bird`, []IndexKey{exact("bird"), exact("cat")}, IndexKeysAny},
+		{`((cat | dog) <-> bird) | fish`, []IndexKey{exact("bird"), exact("fish")}, IndexKeysAny},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		keys, mode, err := q.IndexKeys()
+		require.NoError(t, err)
+		assert.Equal(t, tc.keys, keys)
+		assert.Equal(t, tc.mode, mode)
+	}
+
+	t.Run("NotIndexable", func(t *testing.T) {
+		for _, query := range []string{`!cat`, `cat | !dog`, `!(cat & dog)`} {
+			q, err := ParseTSQuery(query)
+			require.NoError(t, err)
+			_, _, err = q.IndexKeys()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "can't be evaluated using an inverted index")
+		}
+		_, _, err := TSQuery{}.IndexKeys()
+		require.Error(t, err)
+	})
+
+	t.Run("End", func(t *testing.T) {
+		assert.Equal(t, "cat\x00", exact("cat").End())
+		assert.Equal(t, "cau", prefix("cat").End())
+		assert.Equal(t, "d", prefix("c\xff").End())
+		assert.Equal(t, "", prefix("\xff\xff").End())
+	})
+}
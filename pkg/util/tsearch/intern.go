@@ -0,0 +1,67 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import "sync"
+
+// LexemeInterner deduplicates the lexemes of the TSVectors that are built or
+// decoded with it (see Config.Interner), so that every TSVector that contains a lexeme
+// shares a single copy of its string. This reduces the memory used by
+// workloads that keep many TSVectors with overlapping lexemes in memory at
+// once. It also means that the lexemes of a TSVector built from a document
+// don't keep the whole document alive, which they otherwise do, since they're
+// substrings of it.
+//
+// An interner never forgets a lexeme, so it should only live as long as the
+// TSVectors that use it. It's safe for concurrent use.
+type LexemeInterner struct {
+	mu      sync.Mutex
+	lexemes map[string]string
+}
+
+// NewLexemeInterner returns a new, empty LexemeInterner.
+func NewLexemeInterner() *LexemeInterner {
+	return &LexemeInterner{lexemes: make(map[string]string)}
+}
+
+// Intern returns a string that's equal to the input lexeme, and that's the
+// same string for every equal lexeme that's passed to the receiver.
+func (i *LexemeInterner) Intern(lexeme string) string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if ret, ok := i.lexemes[lexeme]; ok {
+		return ret
+	}
+	// Copy the lexeme, so that the interner doesn't keep alive the larger
+	// string that it might be a substring of.
+	ret := string(append([]byte(nil), lexeme...))
+	i.lexemes[ret] = ret
+	return ret
+}
+
+// Len returns the number of distinct lexemes in the receiver.
+func (i *LexemeInterner) Len() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return len(i.lexemes)
+}
+
+// internLexemes replaces the lexemes of the input TSVector with their interned
+// copies, if the configuration has an interner. The input is modified in
+// place.
+func (c Config) internLexemes(v TSVector) {
+	if c.Interner == nil {
+		return
+	}
+	for i := range v {
+		v[i].lexeme = c.Interner.Intern(v[i].lexeme)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stringData returns the address of the bytes of the input string.
+func stringData(s string) uintptr {
+	return (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+}
+
+func TestLexemeInterner(t *testing.T) {
+	interner := NewLexemeInterner()
+	cfg := Config{Interner: interner}
+	a, err := ParseTSVectorWithConfig(`cat:1 dog:2`, cfg)
+	require.NoError(t, err)
+	b, err := ParseTSVectorWithConfig(`bird:3 cat:4`, cfg)
+	require.NoError(t, err)
+	c, err := DocumentToTSVectorWithConfig("simple", `Bird DOG`, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, `'cat':1 'dog':2`, a.String())
+	assert.Equal(t, `'bird':3 'cat':4`, b.String())
+	assert.Equal(t, `'bird':1 'dog':2`, c.String())
+	assert.Equal(t, 3, interner.Len())
+
+	// Equal lexemes share their bytes.
+	assert.Equal(t, stringData(a[0].lexeme), stringData(b[1].lexeme))
+	assert.Equal(t, stringData(a[1].lexeme), stringData(c[1].lexeme))
+	assert.Equal(t, stringData(b[0].lexeme), stringData(c[0].lexeme))
+
+	// Interned lexemes don't point into the strings they came from.
+	doc := `cat fish`
+	v, err := DocumentToTSVectorWithConfig("simple", doc, cfg)
+	require.NoError(t, err)
+	assert.NotEqual(t, stringData(doc)+4, stringData(v[1].lexeme))
+	assert.Equal(t, 4, interner.Len())
+
+	// Decoded vectors share their lexemes too.
+	p := TSVectorProto{Terms: []TSVectorProto_Term{
+		{Lexeme: "cat"}, {Lexeme: "fox", Positions: []uint32{1}},
+	}}
+	d, err := TSVectorFromProtoWithConfig(p, cfg)
+	require.NoError(t, err)
+	assert.Equal(t, `'cat' 'fox':1`, d.String())
+	assert.Equal(t, stringData(a[0].lexeme), stringData(d[0].lexeme))
+	assert.Equal(t, 5, interner.Len())
+
+	// Without an interner, equal lexemes don't share their bytes.
+	a, err = ParseTSVector(`cat`)
+	require.NoError(t, err)
+	b, err = ParseTSVector(`cat`)
+	require.NoError(t, err)
+	assert.NotEqual(t, stringData(a[0].lexeme), stringData(b[0].lexeme))
+}
+
+// BenchmarkLexemeInterner measures the memory that's retained by a set of
+// TSVectors with highly overlapping lexemes, with and without interning, when
+// they're parsed and when they're decoded from their protobuf encodings. The
+// retained-B/op metric is the heap size of the vectors of a single iteration.
+func BenchmarkLexemeInterner(b *testing.B) {
+	const numVectors = 1000
+	const numWords = 50
+	rng := rand.New(rand.NewSource(0))
+	vocabulary := make([]string, 200)
+	for i := range vocabulary {
+		vocabulary[i] = fmt.Sprintf("internationalization%d", i)
+	}
+	corpus := make([]string, numVectors)
+	for i := range corpus {
+		words := make([]string, numWords)
+		for j := range words {
+			words[j] = fmt.Sprintf("%s:%d", vocabulary[rng.Intn(len(vocabulary))], j+1)
+		}
+		corpus[i] = strings.Join(words, " ")
+	}
+	encoded := make([][]byte, len(corpus))
+	for i := range corpus {
+		v, err := ParseTSVector(corpus[i])
+		if err != nil {
+			b.Fatal(err)
+		}
+		p := v.ToProto()
+		if encoded[i], err = p.Marshal(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	build := map[string]func(i int, cfg Config) (TSVector, error){
+		"parse": func(i int, cfg Config) (TSVector, error) {
+			return ParseTSVectorWithConfig(corpus[i], cfg)
+		},
+		"proto": func(i int, cfg Config) (TSVector, error) {
+			var p TSVectorProto
+			if err := p.Unmarshal(encoded[i]); err != nil {
+				return nil, err
+			}
+			return TSVectorFromProtoWithConfig(p, cfg)
+		},
+	}
+
+	for _, source := range []string{"parse", "proto"} {
+		for _, interning := range []bool{false, true} {
+			b.Run(fmt.Sprintf("source=%s/interning=%t", source, interning), func(b *testing.B) {
+				b.ReportAllocs()
+				var retained uint64
+				var before, after runtime.MemStats
+				for i := 0; i < b.N; i++ {
+					var cfg Config
+					if interning {
+						cfg.Interner = NewLexemeInterner()
+					}
+					b.StopTimer()
+					runtime.GC()
+					runtime.ReadMemStats(&before)
+					b.StartTimer()
+
+					vectors := make([]TSVector, len(corpus))
+					for j := range corpus {
+						var err error
+						if vectors[j], err = build[source](j, cfg); err != nil {
+							b.Fatal(err)
+						}
+					}
+
+					b.StopTimer()
+					runtime.GC()
+					runtime.ReadMemStats(&after)
+					retained += after.HeapAlloc - before.HeapAlloc
+					runtime.KeepAlive(vectors)
+					runtime.KeepAlive(cfg.Interner)
+					b.StartTimer()
+				}
+				b.ReportMetric(float64(retained)/float64(b.N), "retained-B/op")
+			})
+		}
+	}
+}
@@ -47,6 +47,15 @@ type tsVectorLexer struct {
 
 	// If true, we're in "TSQuery lexing mode"
 	tsQuery bool
+	// If true, TSQuery terms may be followed by a ^n boost suffix.
+	boosts bool
+
+	// offsets holds the byte offset into the input of each of the lexed
+	// terms and operators, which is used to report the position of TSQuery
+	// syntax errors.
+	offsets []int
+	// tokenStart is the byte offset of the current term or operator.
+	tokenStart int
 }
 
 func (p *tsVectorLexer) back() {
@@ -78,6 +87,8 @@ func (p *tsVectorLexer) advance() rune {
 // All other characters are treated as literals. Backlashes can be used to
 // escape single quotes, and are otherwise skipped, allowing the following
 // character to be included as a literal (such as the backslash character itself).
+// A doubled single quote is also an escaped single quote, which is how String()
+// escapes them.
 //
 // If a word is not single-quote wrapped, the next term will begin if there is
 // whitespace after the word. Whitespace and colons may be entered by escaping
@@ -94,21 +105,28 @@ func (p *tsVectorLexer) advance() rune {
 //   - Terms may be surrounded by the ( ) grouping tokens.
 //   - Terms cannot include multiple positions.
 //   - Terms can include more than one "strength", as well as the * prefix search
-//     operator. For example, foo:3AC*
+//     operator. For example, foo:AC* or 'foo bar':*B. The strengths and prefix
+//     operator may directly precede the next operator. Like in Postgres, they
+//     may appear in any order and in either case, and may be repeated, so
+//     foo:b*A and foo:*AB are the same term, which is printed as foo:*AB.
+//   - If boosts are enabled, terms may end with a ^ followed by a positive
+//     number, which is the boost of the term. For example, foo^2 or foo:A^0.5.
 //
 // See examples in tsvector_test.go and tsquery_test.go, and see the
 // documentation in tsvector.go for more information and a link to the Postgres
 // documentation that is the spec for all of this behavior.
-func (p tsVectorLexer) lex() (TSVector, error) {
+func (p *tsVectorLexer) lex() (TSVector, error) {
 	// termBuf will be reused as a temporary buffer to assemble each term before
 	// copying into the vector.
 	termBuf := make([]rune, 0, 32)
 	ret := TSVector{}
 
 	for p.pos < len(p.input) {
+		p.recordOffsets(ret)
 		r := p.advance()
 		switch p.state {
 		case expectingTerm:
+			p.tokenStart = p.pos - p.lastLen
 			// Expect either a single quote, a whitespace, or anything else.
 			if r == '\'' {
 				p.state = insideQuoteTerm
@@ -174,6 +192,12 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 				termBuf = append(termBuf, r)
 				continue
 			case '\'':
+				if p.pos < len(p.input) && p.input[p.pos] == '\'' {
+					// A doubled single quote is an escaped single quote.
+					p.advance()
+					termBuf = append(termBuf, r)
+					continue
+				}
 				ret = append(ret, tsTerm{lexeme: string(termBuf)})
 				termBuf = termBuf[:0]
 				p.state = finishedQuoteTerm
@@ -183,6 +207,11 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 		case finishedQuoteTerm:
 			if unicode.IsSpace(r) {
 				p.state = expectingTerm
+			} else if p.boosts && r == '^' {
+				if !p.lexBoost(&ret[len(ret)-1]) {
+					return p.syntaxError()
+				}
+				p.state = expectingTerm
 			} else if r == ':' {
 				lastTerm := &ret[len(ret)-1]
 				lastTerm.positions = append(lastTerm.positions, tsPosition{})
@@ -199,6 +228,18 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 				continue
 			}
 
+			if p.boosts && r == '^' {
+				if len(termBuf) == 0 {
+					return p.syntaxError()
+				}
+				ret = append(ret, tsTerm{lexeme: string(termBuf)})
+				termBuf = termBuf[:0]
+				if !p.lexBoost(&ret[len(ret)-1]) {
+					return p.syntaxError()
+				}
+				p.state = expectingTerm
+				continue
+			}
 			if p.tsQuery {
 				switch r {
 				case '&', '!', '|', '<', '(', ')':
@@ -251,7 +292,7 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 					return p.syntaxError()
 				}
 				if pos == 0 {
-					return ret, pgerror.Newf(pgcode.Syntax, "wrong position info in TSVector", p.input)
+					return ret, p.parseError(pgerror.Newf(pgcode.Syntax, "wrong position info in TSVector", p.input))
 				}
 				termBuf = termBuf[:0]
 			}
@@ -263,11 +304,27 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 				p.state = expectingTerm
 				continue
 			}
+			if p.boosts && r == '^' {
+				if !p.lexBoost(lastTerm) {
+					return p.syntaxError()
+				}
+				p.state = expectingTerm
+				continue
+			}
+			if p.tsQuery {
+				switch r {
+				case '&', '!', '|', '<', '(', ')':
+					// An operator ends the weight list of a TSQuery term.
+					p.state = expectingTerm
+					p.back()
+					continue
+				}
+			}
 			switch r {
 			case ',':
 				if p.tsQuery {
 					// Not valid! No , allowed in position lists in tsqueries.
-					return ret, pgerror.Newf(pgcode.Syntax, "syntax error in TSVector: %s", p.input)
+					return ret, p.parseError(pgerror.Newf(pgcode.Syntax, "syntax error in TSVector: %s", p.input))
 				}
 				lastTerm.positions = append(lastTerm.positions, tsPosition{})
 				// Expecting another number next.
@@ -321,7 +378,9 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 			panic("invalid TSVector lex state")
 		}
 	}
-	// Reached the end of the string.
+	// Reached the end of the string. Errors from here on are at the end of the
+	// input, rather than at the last rune.
+	p.lastLen = 0
 	switch p.state {
 	case insideQuoteTerm:
 		// Unfinished quote term.
@@ -340,7 +399,7 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 				return p.syntaxError()
 			}
 			if pos == 0 {
-				return ret, pgerror.Newf(pgcode.Syntax, "wrong position info in TSVector", p.input)
+				return ret, p.parseError(pgerror.Newf(pgcode.Syntax, "wrong position info in TSVector", p.input))
 			}
 			lastTerm := &ret[len(ret)-1]
 			lastTerm.positions[len(lastTerm.positions)-1].position = pos
@@ -352,6 +411,7 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 	default:
 		panic("invalid TSVector lex state")
 	}
+	p.recordOffsets(ret)
 	for _, t := range ret {
 		sort.Slice(t.positions, func(i, j int) bool {
 			return t.positions[i].position < t.positions[j].position
@@ -360,10 +420,52 @@ func (p tsVectorLexer) lex() (TSVector, error) {
 	return ret, nil
 }
 
+// lexBoost lexes the number that follows the ^ of a boost suffix, and sets it
+// as the boost of the input term. It returns false if the boost isn't a
+// positive number.
+func (p *tsVectorLexer) lexBoost(term *tsTerm) bool {
+	start := p.pos
+	for p.pos < len(p.input) && (p.input[p.pos] >= '0' && p.input[p.pos] <= '9' || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	p.lastLen = 0
+	boost, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil || boost <= 0 {
+		return false
+	}
+	term.boost = boost
+	return true
+}
+
+// recordOffsets records the offset of the current token for each term or
+// operator that's been added to the input since the last call, if the
+// receiver is lexing a TSQuery.
+func (p *tsVectorLexer) recordOffsets(terms TSVector) {
+	if !p.tsQuery {
+		return
+	}
+	for len(p.offsets) < len(terms) {
+		p.offsets = append(p.offsets, p.tokenStart)
+	}
+}
+
 func (p *tsVectorLexer) syntaxError() (TSVector, error) {
 	typ := "TSVector"
 	if p.tsQuery {
 		typ = "TSQuery"
 	}
-	return TSVector{}, pgerror.Newf(pgcode.Syntax, "syntax error in %s: %s", typ, p.input)
+	return TSVector{}, p.parseError(pgerror.Newf(pgcode.Syntax, "syntax error in %s: %s", typ, p.input))
+}
+
+// parseError wraps the input error in a ParseError for the last rune that was
+// read, or for the next rune if the last one was given back or consumed
+// without being read, or for the end of the input if there's no next rune.
+func (p *tsVectorLexer) parseError(err error) error {
+	start := p.pos - p.lastLen
+	end := p.pos
+	if p.lastLen == 0 && p.pos < len(p.input) {
+		_, n := utf8.DecodeRuneInString(p.input[p.pos:])
+		end += n
+	}
+	return newParseError(err, start, p.input[start:end])
 }
@@ -0,0 +1,213 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"math"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/errors"
+)
+
+// protoPositionBits is the number of bits of a TSVectorProto position entry
+// that hold the position. The weight is stored in the 2 bits above them.
+const protoPositionBits = 14
+
+// ToProto returns the protobuf representation of the receiver.
+func (t TSVector) ToProto() TSVectorProto {
+	ret := TSVectorProto{Terms: make([]TSVectorProto_Term, len(t))}
+	for i := range t {
+		ret.Terms[i].Lexeme = t[i].lexeme
+		if len(t[i].positions) == 0 {
+			continue
+		}
+		positions := make([]uint32, len(t[i].positions))
+		for j, pos := range t[i].positions {
+			positions[j] = uint32(weightIdx(pos))<<protoPositionBits | uint32(pos.position)
+		}
+		ret.Terms[i].Positions = positions
+	}
+	return ret
+}
+
+// TSVectorFromProto returns the TSVector represented by the input protobuf
+// message, which is the inverse of TSVector.ToProto. An error is returned if
+// the message doesn't represent a valid TSVector.
+func TSVectorFromProto(p TSVectorProto) (TSVector, error) {
+	return TSVectorFromProtoWithConfig(p, Config{})
+}
+
+// TSVectorFromProtoWithConfig is like TSVectorFromProto, but shares the
+// lexeme strings of the TSVector through the interner of the input Config, if
+// it has one, so that many decoded TSVectors can be kept in memory at once
+// without duplicating their lexemes. The other fields of the Config are
+// ignored, since the message is already a valid TSVector.
+func TSVectorFromProtoWithConfig(p TSVectorProto, cfg Config) (TSVector, error) {
+	ret := make(TSVector, len(p.Terms))
+	for i := range p.Terms {
+		term := &p.Terms[i]
+		if term.Lexeme == "" {
+			return nil, invalidTSVectorProtoError("empty lexeme")
+		}
+		if i > 0 && term.Lexeme <= p.Terms[i-1].Lexeme {
+			return nil, invalidTSVectorProtoError("lexemes are not sorted")
+		}
+		ret[i].lexeme = term.Lexeme
+		if len(term.Positions) == 0 {
+			continue
+		}
+		ret[i].positions = make([]tsPosition, len(term.Positions))
+		for j, entry := range term.Positions {
+			if entry>>(protoPositionBits+2) != 0 {
+				return nil, invalidTSVectorProtoError("position entry out of range")
+			}
+			pos := tsPosition{position: int(entry & (1<<protoPositionBits - 1))}
+			switch entry >> protoPositionBits {
+			case 1:
+				pos.weight = weightC
+			case 2:
+				pos.weight = weightB
+			case 3:
+				pos.weight = weightA
+			}
+			if pos.position == 0 {
+				return nil, invalidTSVectorProtoError("invalid position 0")
+			}
+			if j > 0 && pos.position <= ret[i].positions[j-1].position {
+				return nil, invalidTSVectorProtoError("positions are not sorted")
+			}
+			ret[i].positions[j] = pos
+		}
+	}
+	cfg.internLexemes(ret)
+	return ret, nil
+}
+
+func invalidTSVectorProtoError(reason string) error {
+	return pgerror.Newf(pgcode.InvalidBinaryRepresentation, "invalid tsvector: %s", reason)
+}
+
+// ToProto returns the protobuf representation of the receiver.
+func (q TSQuery) ToProto() TSQueryProto {
+	return TSQueryProto{Root: q.root.toProto()}
+}
+
+func (n *tsNode) toProto() *TSQueryProto_Node {
+	if n == nil {
+		return nil
+	}
+	ret := &TSQueryProto_Node{}
+	switch n.op {
+	case invalid:
+		ret.Op = TSQueryProto_TERM
+		ret.Lexeme = n.term.lexeme
+		ret.Boost = n.term.boost
+		if len(n.term.positions) > 0 {
+			w := n.term.positions[0].weight
+			ret.Weights = uint32(w &^ weightStar)
+			ret.Prefix = w&weightStar != 0
+		}
+		return ret
+	case and:
+		ret.Op = TSQueryProto_AND
+	case or:
+		ret.Op = TSQueryProto_OR
+	case not:
+		ret.Op = TSQueryProto_NOT
+	case followedby:
+		ret.Op = TSQueryProto_PHRASE
+		ret.Distance = int32(n.followedN)
+	default:
+		panic(errors.AssertionFailedf("invalid operator %d", n.op))
+	}
+	ret.Left = n.l.toProto()
+	ret.Right = n.r.toProto()
+	return ret
+}
+
+// TSQueryFromProto returns the TSQuery represented by the input protobuf
+// message, which is the inverse of TSQuery.ToProto. An error is returned if
+// the message doesn't represent a valid TSQuery.
+func TSQueryFromProto(p TSQueryProto) (TSQuery, error) {
+	if p.Root == nil {
+		return TSQuery{}, nil
+	}
+	root, err := tsNodeFromProto(p.Root)
+	if err != nil {
+		return TSQuery{}, err
+	}
+	return TSQuery{root: root}, nil
+}
+
+func tsNodeFromProto(p *TSQueryProto_Node) (*tsNode, error) {
+	if p == nil {
+		return nil, invalidTSQueryProtoError("missing operand")
+	}
+	ret := &tsNode{}
+	switch p.Op {
+	case TSQueryProto_TERM:
+		if p.Lexeme == "" {
+			return nil, invalidTSQueryProtoError("empty lexeme")
+		}
+		if p.Weights&^uint32(weightA|weightB|weightC|weightD) != 0 {
+			return nil, invalidTSQueryProtoError("invalid weights")
+		}
+		if p.Boost < 0 || math.IsInf(p.Boost, 0) || math.IsNaN(p.Boost) {
+			return nil, invalidTSQueryProtoError("invalid boost")
+		}
+		if p.Left != nil || p.Right != nil {
+			return nil, invalidTSQueryProtoError("lexeme with operands")
+		}
+		ret.term.lexeme = p.Lexeme
+		ret.term.boost = p.Boost
+		w := tsWeight(p.Weights)
+		if p.Prefix {
+			w |= weightStar
+		}
+		if w != 0 {
+			ret.term.positions = []tsPosition{{weight: w}}
+		}
+		return ret, nil
+	case TSQueryProto_AND:
+		ret.op = and
+	case TSQueryProto_OR:
+		ret.op = or
+	case TSQueryProto_NOT:
+		ret.op = not
+	case TSQueryProto_PHRASE:
+		if p.Distance < 0 || p.Distance > maxPhraseDistance {
+			return nil, invalidTSQueryProtoError("phrase distance out of range")
+		}
+		ret.op = followedby
+		ret.followedN = int(p.Distance)
+	default:
+		return nil, invalidTSQueryProtoError("unknown operator")
+	}
+	var err error
+	if ret.l, err = tsNodeFromProto(p.Left); err != nil {
+		return nil, err
+	}
+	if ret.op == not {
+		if p.Right != nil {
+			return nil, invalidTSQueryProtoError("not with two operands")
+		}
+		return ret, nil
+	}
+	if ret.r, err = tsNodeFromProto(p.Right); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func invalidTSQueryProtoError(reason string) error {
+	return pgerror.Newf(pgcode.InvalidBinaryRepresentation, "invalid tsquery: %s", reason)
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTSVectorProtoRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		``,
+		`foo`,
+		`foo bar baz`,
+		`foo:1 bar:2,3`,
+		`foo:1A,2B,3C,4D bar:16383A`,
+		`'a b':1 'it''s':2`,
+	} {
+		t.Log(input)
+		v, err := ParseTSVector(input)
+		require.NoError(t, err)
+		actual, err := TSVectorFromProto(v.ToProto())
+		require.NoError(t, err)
+		assert.Equal(t, v, actual)
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		term := func(lexeme string, positions ...uint32) TSVectorProto_Term {
+			return TSVectorProto_Term{Lexeme: lexeme, Positions: positions}
+		}
+		for _, tc := range []struct {
+			terms    []TSVectorProto_Term
+			expected string
+		}{
+			{[]TSVectorProto_Term{term("")}, "empty lexeme"},
+			{[]TSVectorProto_Term{term("b"), term("a")}, "lexemes are not sorted"},
+			{[]TSVectorProto_Term{term("a"), term("a")}, "lexemes are not sorted"},
+			{[]TSVectorProto_Term{term("a", 2, 1)}, "positions are not sorted"},
+			{[]TSVectorProto_Term{term("a", 1, 1|3<<14)}, "positions are not sorted"},
+			{[]TSVectorProto_Term{term("a", 0)}, "invalid position 0"},
+			{[]TSVectorProto_Term{term("a", 3<<14)}, "invalid position 0"},
+			{[]TSVectorProto_Term{term("a", 1, 3<<14)}, "invalid position 0"},
+			{[]TSVectorProto_Term{term("a", 1<<16)}, "position entry out of range"},
+		} {
+			_, err := TSVectorFromProto(TSVectorProto{Terms: tc.terms})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expected)
+		}
+	})
+}
+
+func TestTSQueryProtoRoundTrip(t *testing.T) {
+	for _, input := range []string{
+		`foo`,
+		`foo:*`,
+		`foo:AB`,
+		`foo:*AD`,
+		`foo & bar`,
+		`foo | bar & !baz`,
+		`!(foo | bar)`,
+		`foo <-> bar <3> baz`,
+		`foo <0> bar:* <16384> !baz`,
+		`(foo | bar) <-> (baz & !qux)`,
+		`foo^2 & bar:A^0.5 | baz:*^10`,
+	} {
+		t.Log(input)
+		q, err := ParseTSQueryWithConfig(input, Config{TermBoosts: true})
+		require.NoError(t, err)
+		actual, err := TSQueryFromProto(q.ToProto())
+		require.NoError(t, err)
+		assert.Equal(t, q.String(), actual.String())
+	}
+	q, err := TSQueryFromProto(TSQuery{}.ToProto())
+	require.NoError(t, err)
+	assert.Nil(t, q.root)
+
+	t.Run("Proto", func(t *testing.T) {
+		q, err := ParseTSQuery(`foo:*B <2> !bar`)
+		require.NoError(t, err)
+		assert.Equal(t, TSQueryProto{Root: &TSQueryProto_Node{
+			Op:       TSQueryProto_PHRASE,
+			Distance: 2,
+			Left:     &TSQueryProto_Node{Op: TSQueryProto_TERM, Lexeme: "foo", Weights: 4, Prefix: true},
+			Right: &TSQueryProto_Node{
+				Op:   TSQueryProto_NOT,
+				Left: &TSQueryProto_Node{Op: TSQueryProto_TERM, Lexeme: "bar"},
+			},
+		}}, q.ToProto())
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		term := &TSQueryProto_Node{Op: TSQueryProto_TERM, Lexeme: "foo"}
+		for _, tc := range []struct {
+			root     *TSQueryProto_Node
+			expected string
+		}{
+			{&TSQueryProto_Node{Op: TSQueryProto_TERM}, "empty lexeme"},
+			{&TSQueryProto_Node{Op: TSQueryProto_TERM, Lexeme: "foo", Weights: 16}, "invalid weights"},
+			{&TSQueryProto_Node{Op: TSQueryProto_TERM, Lexeme: "foo", Boost: -1}, "invalid boost"},
+			{&TSQueryProto_Node{Op: TSQueryProto_TERM, Lexeme: "foo", Boost: math.NaN()}, "invalid boost"},
+			{&TSQueryProto_Node{Op: TSQueryProto_TERM, Lexeme: "foo", Left: term}, "lexeme with operands"},
+			{&TSQueryProto_Node{Op: TSQueryProto_AND, Left: term}, "missing operand"},
+			{&TSQueryProto_Node{Op: TSQueryProto_NOT}, "missing operand"},
+			{&TSQueryProto_Node{Op: TSQueryProto_NOT, Left: term, Right: term}, "not with two operands"},
+			{&TSQueryProto_Node{Op: TSQueryProto_PHRASE, Distance: -1, Left: term, Right: term}, "phrase distance out of range"},
+			{&TSQueryProto_Node{Op: 10, Left: term, Right: term}, "unknown operator"},
+		} {
+			_, err := TSQueryFromProto(TSQueryProto{Root: tc.root})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expected)
+		}
+	})
+}
@@ -0,0 +1,544 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+)
+
+// This file implements ts_rank, which ranks how well a TSVector matches a
+// TSQuery. It's a port of Postgres's tsrank.c, and is intended to produce the
+// same results, with one exception: query terms that are restricted to some
+// weights, like cat:A, only count the positions with those weights, whereas
+// Postgres's ts_rank ignores the weight restrictions of the query.
+//
+// Query terms may also carry a boost, which Postgres doesn't support (see
+// Config.TermBoosts and NewBoostQuery). The contribution of a boosted term to
+// the rank is multiplied by its boost. A query term that occurs more than once
+// uses the boost of its first occurrence.
+
+// These are the bits of the normalization bitmask that can be passed to the
+// ranking functions. Each of them controls whether and how the rank is scaled
+// by the length of the document.
+const (
+	// RankNormLogLength divides the rank by 1 + the logarithm of the document
+	// length.
+	RankNormLogLength = 1 << iota
+	// RankNormLength divides the rank by the document length.
+	RankNormLength
+	// RankNormExtDist divides the rank by the mean harmonic distance between
+	// extents. It's only used by ts_rank_cd, and is ignored by ts_rank.
+	RankNormExtDist
+	// RankNormUniq divides the rank by the number of unique words in the
+	// document.
+	RankNormUniq
+	// RankNormLogUniq divides the rank by 1 + the logarithm of the number of
+	// unique words in the document.
+	RankNormLogUniq
+	// RankNormRDivRPlus1 divides the rank by itself + 1.
+	RankNormRDivRPlus1
+)
+
+// DefaultRankWeights are the default weights used for ranking, which are the
+// same as Postgres's. Like the weights array that's passed to ts_rank, they
+// are in order of the weight labels D, C, B and A.
+var DefaultRankWeights = [4]float32{0.1, 0.2, 0.4, 1.0}
+
+// Rank implements ts_rank, returning the rank of the input TSVector against the
+// input TSQuery. The weights array holds the weights for the weight labels D,
+// C, B and A, in that order. Negative weights are replaced by the matching
+// entry of DefaultRankWeights. The normalization parameter is a bitmask of the
+// RankNorm constants.
+func Rank(weights [4]float32, v TSVector, q TSQuery, normalization int) (float32, error) {
+	return rank(weights, v, q, normalization, v.cntLength(), RankOptions{})
+}
+
+// RankWithLength is like Rank, but uses the input document length for the
+// RankNormLogLength and RankNormLength normalizations instead of deriving it
+// from the TSVector. That's useful for callers that keep track of the number
+// of words in the original document, since the TSVector might not represent
+// all of them (for example, if stop words were removed).
+func RankWithLength(
+	weights [4]float32, v TSVector, q TSQuery, normalization int, docLength int,
+) (float32, error) {
+	if docLength < 0 {
+		return 0, pgerror.Newf(pgcode.InvalidParameterValue,
+			"document length must be non-negative: %d", docLength)
+	}
+	return rank(weights, v, q, normalization, docLength, RankOptions{})
+}
+
+// RankOptions holds CockroachDB-specific extensions of ts_rank, which have no
+// equivalent in Postgres. The zero value disables all of them.
+type RankOptions struct {
+	// PositionDecay, if positive, reduces the contribution of each matching
+	// position to the rank according to how far into the document it is: the
+	// weight of a match at position p is multiplied by
+	// 1 / (1 + PositionDecay * (p - 1)). Matches at position 1 keep their full
+	// weight. This is useful for documents in which earlier content is more
+	// relevant, such as documents that put their newest content first. Lexemes
+	// without positions aren't affected.
+	PositionDecay float64
+}
+
+// RankWithOptions is like Rank, but also applies the input RankOptions. Its
+// results only match Postgres's ts_rank if the options are the zero value.
+func RankWithOptions(
+	weights [4]float32, v TSVector, q TSQuery, normalization int, opts RankOptions,
+) (float32, error) {
+	if opts.PositionDecay < 0 {
+		return 0, pgerror.Newf(pgcode.InvalidParameterValue,
+			"position decay must be non-negative: %g", opts.PositionDecay)
+	}
+	return rank(weights, v, q, normalization, v.cntLength(), opts)
+}
+
+// RankLexemeWeights is like Rank, but ranks the lexemes and weights that
+// StripPositionsKeepWeights returns, as if they were a TSVector without
+// positions whose lexemes have the input weights. The lexemes must be sorted
+// and unique, like the lexemes of a TSVector.
+func RankLexemeWeights(
+	weights [4]float32, lw []LexemeWeight, q TSQuery, normalization int,
+) (float32, error) {
+	w, err := validateRankWeights(weights)
+	if err != nil {
+		return 0, err
+	}
+	v := make(TSVector, len(lw))
+	p := rankParams{w: w, nullWeights: make(map[string]tsWeight)}
+	for i := range lw {
+		if i > 0 && lw[i].Lexeme <= lw[i-1].Lexeme {
+			return 0, pgerror.Newf(pgcode.InvalidParameterValue,
+				"lexemes must be sorted and unique: %q follows %q", lw[i].Lexeme, lw[i-1].Lexeme)
+		}
+		v[i].lexeme = lw[i].Lexeme
+		if lw[i].Weight != WeightD {
+			p.nullWeights[lw[i].Lexeme] = tsWeight(lw[i].Weight)
+		}
+	}
+	if len(v) == 0 || q.root == nil {
+		return 0, nil
+	}
+	return normalizeRank(calcRank(p, v, q), len(v), normalization, v.cntLength()), nil
+}
+
+// RankByWeight returns a breakdown of the rank of the input TSVector against
+// the input TSQuery by weight label, so that callers can combine the relevance
+// of differently weighted fields, such as titles and bodies, with their own
+// coefficients. Like the weights array of Rank, the result is in order of the
+// weight labels D, C, B and A. Each entry is the rank that Rank returns with a
+// weight of 1 for its label and 0 for the others, which only counts the
+// matches of positions with that label. The normalization parameter is a
+// bitmask of the RankNorm constants, which is applied to each entry.
+//
+// Since ts_rank doesn't combine the contributions of matches linearly (the
+// matches of an and operator are combined pairwise, for example), the rank
+// with some weights isn't in general the weighted sum of the entries.
+func RankByWeight(v TSVector, q TSQuery, normalization int) ([4]float32, error) {
+	var ret [4]float32
+	for i := range ret {
+		var weights [4]float32
+		weights[i] = 1
+		r, err := Rank(weights, v, q, normalization)
+		if err != nil {
+			return [4]float32{}, err
+		}
+		ret[i] = r
+	}
+	return ret, nil
+}
+
+// RankKey is the rank of a document along with the tie-breakers that make
+// ordering by rank deterministic. It's returned by RankWithTieBreak.
+type RankKey struct {
+	// Rank is the rank of the document, as returned by RankWithOptions.
+	Rank float32
+	// MatchCount is the number of occurrences of the query's operands in the
+	// document, as returned by TSQuery.MatchCount.
+	MatchCount int
+	// FirstMatch is the lowest position of the document at which one of the
+	// query's operands that isn't nested within a not operator occurs. It's
+	// zero if the query doesn't match the document, and larger than every
+	// valid position if the only occurrences are of lexemes without positions.
+	FirstMatch int
+}
+
+// Compare returns -1 if the receiver should be ordered before the input key,
+// 1 if it should be ordered after it, and 0 if they tie. Keys are ordered by
+// descending rank, then by descending match count, and then by ascending first
+// match, so that among documents with the same rank, those that contain more
+// and earlier matches come first. Documents that still tie, such as identical
+// documents, must be ordered by the caller, for example by primary key.
+func (k RankKey) Compare(o RankKey) int {
+	switch {
+	case k.Rank != o.Rank:
+		if k.Rank > o.Rank {
+			return -1
+		}
+		return 1
+	case k.MatchCount != o.MatchCount:
+		if k.MatchCount > o.MatchCount {
+			return -1
+		}
+		return 1
+	case k.FirstMatch != o.FirstMatch:
+		if k.FirstMatch < o.FirstMatch {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+// RankWithTieBreak is like RankWithOptions, but returns a RankKey, which
+// breaks ties between documents with the same rank. Sorting documents by
+// RankKey.Compare gives the same order every time, which isn't the case for
+// ranks alone, since documents with equal ranks can be returned in any order.
+func RankWithTieBreak(
+	weights [4]float32, v TSVector, q TSQuery, normalization int, opts RankOptions,
+) (RankKey, error) {
+	r, err := RankWithOptions(weights, v, q, normalization, opts)
+	if err != nil {
+		return RankKey{}, err
+	}
+	count, err := q.MatchCount(v)
+	if err != nil {
+		return RankKey{}, err
+	}
+	ret := RankKey{Rank: r, MatchCount: count}
+	if count == 0 {
+		return ret, nil
+	}
+	for _, term := range positiveQueryTerms(q) {
+		for _, t := range findMatchingTerms(v, term) {
+			positions := t.positions
+			if len(positions) == 0 {
+				positions = []tsPosition{{position: maxTSVectorPosition + 1}}
+			}
+			positions = filterPositionsByWeight(term, positions)
+			if len(positions) > 0 && (ret.FirstMatch == 0 || positions[0].position < ret.FirstMatch) {
+				ret.FirstMatch = positions[0].position
+			}
+		}
+	}
+	return ret, nil
+}
+
+// cntLength returns the length of the document represented by the receiver,
+// which is the total number of positions of all lexemes. Lexemes without
+// positions count as a single word.
+func (t TSVector) cntLength() int {
+	var ret int
+	for i := range t {
+		if len(t[i].positions) == 0 {
+			ret++
+		} else {
+			ret += len(t[i].positions)
+		}
+	}
+	return ret
+}
+
+func rank(
+	weights [4]float32, v TSVector, q TSQuery, normalization int, docLength int, opts RankOptions,
+) (float32, error) {
+	w, err := validateRankWeights(weights)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) == 0 || q.root == nil {
+		return 0, nil
+	}
+	p := rankParams{w: w, positionDecay: opts.PositionDecay}
+	return normalizeRank(calcRank(p, v, q), len(v), normalization, docLength), nil
+}
+
+// calcRank computes the rank of the input vector against the input query,
+// before normalization. The vector and the query must not be empty.
+func calcRank(p rankParams, v TSVector, q TSQuery) float32 {
+	var res float32
+	if q.root.op == and || q.root.op == followedby {
+		res = calcRankAnd(p, v, q)
+	} else {
+		res = calcRankOr(p, v, q)
+	}
+	if res < 0 {
+		res = 1e-20
+	}
+	return res
+}
+
+// normalizeRank scales the input rank according to the normalization bitmask.
+func normalizeRank(res float32, numLexemes int, normalization int, docLength int) float32 {
+	if normalization&RankNormLogLength != 0 && docLength > 0 {
+		res = float32(float64(res) / (math.Log(float64(docLength+1)) / math.Log(2.0)))
+	}
+	if normalization&RankNormLength != 0 && docLength > 0 {
+		res /= float32(docLength)
+	}
+	// RankNormExtDist isn't applicable to ts_rank.
+	if normalization&RankNormUniq != 0 && numLexemes > 0 {
+		res /= float32(numLexemes)
+	}
+	if normalization&RankNormLogUniq != 0 && numLexemes > 0 {
+		res = float32(float64(res) / (math.Log(float64(numLexemes+1)) / math.Log(2.0)))
+	}
+	if normalization&RankNormRDivRPlus1 != 0 {
+		res /= res + 1
+	}
+	return res
+}
+
+// validateRankWeights replaces negative weights with their defaults, and
+// returns an error if any weight is out of range.
+func validateRankWeights(weights [4]float32) ([4]float32, error) {
+	for i := range weights {
+		if weights[i] < 0 {
+			weights[i] = DefaultRankWeights[i]
+		}
+		if weights[i] > 1.0 {
+			return weights, pgerror.New(pgcode.InvalidParameterValue, "weight out of range")
+		}
+	}
+	return weights, nil
+}
+
+// rankParams holds the parameters that determine the contribution of each
+// matching position to the rank.
+type rankParams struct {
+	// w holds the weights for the weight labels D, C, B and A.
+	w [4]float32
+	// positionDecay is RankOptions.PositionDecay.
+	positionDecay float64
+	// nullWeights maps the lexemes without positions to their weights, as
+	// kept by StripPositionsKeepWeights. Lexemes that are missing have the
+	// default weight D. It's nil when ranking a TSVector.
+	nullWeights map[string]tsWeight
+}
+
+// posWeight returns the weight of a match at the input position. isNull is
+// true if the position is a placeholder for a lexeme without positions.
+func (p rankParams) posWeight(pos tsPosition, isNull bool) float32 {
+	w := p.w[weightIdx(pos)]
+	if p.positionDecay > 0 && !isNull && pos.position > 1 {
+		w = float32(float64(w) / (1 + p.positionDecay*float64(pos.position-1)))
+	}
+	return w
+}
+
+// weightIdx returns the index into the ranking weights array for the weight
+// of the input position.
+func weightIdx(pos tsPosition) int {
+	switch {
+	case pos.weight&weightA != 0:
+		return 3
+	case pos.weight&weightB != 0:
+		return 2
+	case pos.weight&weightC != 0:
+		return 1
+	}
+	return 0
+}
+
+// filterPositionsByWeight returns the positions of the input that are allowed
+// by the weight restriction of the input query term. Positions without a
+// weight have weight D. The input is returned as is if the term isn't
+// restricted to any weights.
+func filterPositionsByWeight(term *tsTerm, positions []tsPosition) []tsPosition {
+	if len(term.positions) == 0 {
+		return positions
+	}
+	mask := term.positions[0].weight &^ weightStar
+	if mask == 0 {
+		return positions
+	}
+	var ret []tsPosition
+	for _, pos := range positions {
+		w := pos.weight
+		if w == 0 {
+			w = weightD
+		}
+		if w&mask != 0 {
+			ret = append(ret, pos)
+		}
+	}
+	return ret
+}
+
+// wordDistance returns the weight of a collocation of two words that are the
+// input distance apart.
+func wordDistance(dist int) float32 {
+	if dist > 100 {
+		return 1e-30
+	}
+	return float32(1.0 / (1.005 + 0.05*math.Exp(float64(float32(dist))/1.5-2)))
+}
+
+// sortAndUniqQueryTerms returns the terms of all of the leaves of the input
+// query, including negated ones, sorted and de-duplicated by lexeme.
+func sortAndUniqQueryTerms(q TSQuery) []*tsTerm {
+	var terms []*tsTerm
+	var collect func(n *tsNode)
+	collect = func(n *tsNode) {
+		if n == nil {
+			return
+		}
+		if n.op == invalid {
+			terms = append(terms, &n.term)
+			return
+		}
+		collect(n.l)
+		collect(n.r)
+	}
+	collect(q.root)
+	sort.SliceStable(terms, func(i, j int) bool {
+		return terms[i].lexeme < terms[j].lexeme
+	})
+	ret := terms[:0]
+	for i := range terms {
+		if i == 0 || terms[i].lexeme != terms[i-1].lexeme {
+			ret = append(ret, terms[i])
+		}
+	}
+	return ret
+}
+
+// findMatchingTerms returns the terms of the input vector that match the
+// input query term: either the single term with the same lexeme, or every term
+// that begins with the query term's lexeme if it's a prefix term.
+func findMatchingTerms(v TSVector, term *tsTerm) TSVector {
+	target := term.lexeme
+	i := sort.Search(len(v), func(i int) bool {
+		return v[i].lexeme >= target
+	})
+	if len(term.positions) > 0 && term.positions[0].weight&weightStar != 0 {
+		j := i
+		for j < len(v) && strings.HasPrefix(v[j].lexeme, target) {
+			j++
+		}
+		return v[i:j]
+	}
+	if i < len(v) && v[i].lexeme == target {
+		return v[i : i+1]
+	}
+	return nil
+}
+
+// calcRankOr computes the rank for queries whose root isn't an and or a
+// followed by operator.
+func calcRankOr(p rankParams, v TSVector, q TSQuery) float32 {
+	terms := sortAndUniqQueryTerms(q)
+	var res float32
+	for _, term := range terms {
+		for _, t := range findMatchingTerms(v, term) {
+			positions := t.positions
+			isNull := len(positions) == 0
+			if isNull {
+				// Use a dummy position for lexemes without positions, with the
+				// weight that was kept for the lexeme by
+				// StripPositionsKeepWeights, if any.
+				positions = []tsPosition{{weight: p.nullWeights[t.lexeme]}}
+			}
+			positions = filterPositionsByWeight(term, positions)
+			if len(positions) == 0 {
+				continue
+			}
+			var resj float32
+			wjm := float32(-1)
+			jm := 0
+			for j, pos := range positions {
+				wpos := p.posWeight(pos, isNull)
+				resj += wpos / float32((j+1)*(j+1))
+				if wpos > wjm {
+					wjm = wpos
+					jm = j
+				}
+			}
+			// Limit (sum(1/i^2),i=1,inf) = pi^2/6
+			// resj = sum(wi/i^2),i=1,noccurence,
+			// wi should be sorted desc, but instead we just choose the maximum
+			// weight, like Postgres.
+			res = float32(float64(res) + float64(term.boostFactor()*(wjm+resj-wjm/float32((jm+1)*(jm+1))))/1.64493406685)
+		}
+	}
+	if len(terms) > 0 {
+		res /= float32(len(terms))
+	}
+	return res
+}
+
+// calcRankAnd computes the rank for queries whose root is an and or a
+// followed by operator. It returns a negative number if there were no
+// pairs of matching terms.
+func calcRankAnd(p rankParams, v TSVector, q TSQuery) float32 {
+	terms := sortAndUniqQueryTerms(q)
+	if len(terms) < 2 {
+		return calcRankOr(p, v, q)
+	}
+	pos := make([][]tsPosition, len(terms))
+	posIsNull := make([]bool, len(terms))
+	res := float32(-1)
+	for i, term := range terms {
+		for _, t := range findMatchingTerms(v, term) {
+			positions := t.positions
+			isNull := len(positions) == 0
+			if isNull {
+				// Use a dummy position for lexemes without positions, with the
+				// weight that was kept for the lexeme by
+				// StripPositionsKeepWeights, if any.
+				positions = []tsPosition{{position: maxTSVectorPosition, weight: p.nullWeights[t.lexeme]}}
+			}
+			positions = filterPositionsByWeight(term, positions)
+			if len(positions) == 0 {
+				continue
+			}
+			pos[i] = positions
+			posIsNull[i] = isNull
+			for k := 0; k < i; k++ {
+				if pos[k] == nil {
+					continue
+				}
+				for _, l := range pos[i] {
+					for _, m := range pos[k] {
+						dist := l.position - m.position
+						if dist < 0 {
+							dist = -dist
+						}
+						if dist != 0 || posIsNull[i] || posIsNull[k] {
+							if dist == 0 {
+								dist = maxTSVectorPosition + 1
+							}
+							curw := float32(math.Sqrt(float64(
+								p.posWeight(l, posIsNull[i]) * p.posWeight(m, posIsNull[k]) * wordDistance(dist) *
+									term.boostFactor() * terms[k].boostFactor())))
+							if curw > 1 {
+								// Only boosts can make the weight of a pair larger than 1,
+								// which would break the probabilistic combination below.
+								curw = 1
+							}
+							if res < 0 {
+								res = curw
+							} else {
+								res = float32(1.0 - (1.0-float64(res))*(1.0-float64(curw)))
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return res
+}
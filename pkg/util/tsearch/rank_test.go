@@ -0,0 +1,372 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRank(t *testing.T) {
+	tcs := []struct {
+		vector        string
+		query         string
+		normalization int
+		expected      float32
+	}{
+		{`a:1`, `a`, 0, 0.0607927},
+		{`a:1A`, `a`, 0, 0.6079271},
+		{`a:1`, `b`, 0, 0},
+		{``, `a`, 0, 0},
+		{`a`, `a`, 0, 0.0607927},
+		{`a:1,2,3`, `a`, 0, 0.0827456},
+		{`a:1 b:2`, `a | b`, 0, 0.0607927},
+		{`a:1 b:2`, `a | c`, 0, 0.0303964},
+		{`a:1 b:2`, `a & b`, 0, 0.0991032},
+		{`a:1 b:2`, `a <-> b`, 0, 0.0991032},
+		{`a:1 b:3`, `a & b`, 0, 0.0985009},
+		{`a:1A b:2B`, `a & b`, 0, 0.6267838},
+		{`a:1 c:2`, `a & b`, 0, 1e-20},
+		{`a:1 b:2`, `a & !b`, 0, 0.0991032},
+		{`abc:1 abd:2`, `ab:* & abc`, 0, 0.0991032},
+		{`a b`, `a & b`, 0, 1e-16},
+		{`a:1 b:2 c:3`, `a & b`, RankNormLogLength, 0.0495516},
+		{`a:1 b:2 c:3`, `a & b`, RankNormLength, 0.0330344},
+		{`a:1 b:2 c:3`, `a & b`, RankNormUniq, 0.0330344},
+		{`a:1 b:2 c:3,4,5`, `a & b`, RankNormLogUniq, 0.0495516},
+		{`a:1 b:2 c:3`, `a & b`, RankNormRDivRPlus1, 0.0901673},
+		{`a:1 b:2 c:3`, `a & b`, RankNormLength | RankNormRDivRPlus1, 0.0319780},
+		// RankNormExtDist is ignored by ts_rank.
+		{`a:1 b:2 c:3`, `a & b`, RankNormExtDist, 0.0991032},
+	}
+	for _, tc := range tcs {
+		t.Log(tc)
+		v, err := ParseTSVector(tc.vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		actual, err := Rank(DefaultRankWeights, v, q, tc.normalization)
+		require.NoError(t, err)
+		assertRankEqual(t, tc.expected, actual)
+	}
+
+	t.Run("Weights", func(t *testing.T) {
+		v, err := ParseTSVector(`a:1A b:2`)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(`a`)
+		require.NoError(t, err)
+		actual, err := Rank([4]float32{0.1, 0.2, 0.4, 0.5}, v, q, 0)
+		require.NoError(t, err)
+		assert.InEpsilon(t, 0.3039636, actual, 0.0001)
+
+		// Negative weights are replaced with the defaults.
+		actual, err = Rank([4]float32{-1, -1, -1, -1}, v, q, 0)
+		require.NoError(t, err)
+		assert.InEpsilon(t, 0.6079271, actual, 0.0001)
+
+		_, err = Rank([4]float32{0.1, 0.2, 0.4, 1.1}, v, q, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("ComparePG", func(t *testing.T) {
+		// This test can be manually run by pointing it to a local Postgres. There
+		// are no requirements for the contents of the local Postgres - it just runs
+		// expressions. The test validates that all of the test cases in this test
+		// file work the same in Postgres as they do this package.
+		skip.IgnoreLint(t, "need to manually enable")
+		conn, err := pgx.Connect(context.Background(), "postgresql://jordan@localhost:5432")
+		require.NoError(t, err)
+		for _, tc := range tcs {
+			t.Log(tc)
+
+			var actual float32
+			row := conn.QueryRow(context.Background(), "SELECT ts_rank($1::TSVector, $2::TSQuery, $3)",
+				tc.vector, tc.query, tc.normalization,
+			)
+			require.NoError(t, row.Scan(&actual))
+			assertRankEqual(t, tc.expected, actual)
+		}
+	})
+}
+
+func TestRankWeightRestrictions(t *testing.T) {
+	// Postgres's ts_rank ignores the weight restrictions of the query, so these
+	// test cases can't be compared against Postgres.
+	for _, tc := range []struct {
+		vector   string
+		query    string
+		expected float32
+	}{
+		{`a:1A`, `a:A`, 0.6079271},
+		{`a:1A`, `a:AB`, 0.6079271},
+		{`a:1A`, `a:B`, 0},
+		{`a:1A`, `a:*B`, 0},
+		{`a:1`, `a:D`, 0.0607927},
+		{`a`, `a:D`, 0.0607927},
+		{`a`, `a:A`, 0},
+		{`a:1A,2B`, `a`, 0.6687185},
+		{`a:1A,2B`, `a:B`, 0.2431708},
+		{`a:1A b:2B`, `a:A | b:A`, 0.3039636},
+		{`a:1A b:2B`, `a:A & b`, 0.6267838},
+		{`a:1A b:2B`, `a:A & b:A`, 1e-20},
+		{`a:1A,3 b:2B`, `a & b`, 0.7007584},
+		{`a:1A,3 b:2B`, `a:D & b`, 0.1982069},
+	} {
+		t.Log(tc)
+		v, err := ParseTSVector(tc.vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		actual, err := Rank(DefaultRankWeights, v, q, 0)
+		require.NoError(t, err)
+		assertRankEqual(t, tc.expected, actual)
+	}
+}
+
+func TestRankBoosts(t *testing.T) {
+	rank := func(vector, query string) float32 {
+		v, err := ParseTSVector(vector)
+		require.NoError(t, err)
+		q, err := ParseTSQueryWithConfig(query, Config{TermBoosts: true})
+		require.NoError(t, err)
+		ret, err := Rank(DefaultRankWeights, v, q, 0)
+		require.NoError(t, err)
+		return ret
+	}
+
+	for _, tc := range []struct {
+		vector   string
+		query    string
+		expected float32
+	}{
+		// A boost of 1 is the same as no boost.
+		{`a:1`, `a^1`, 0.0607927},
+		{`a:1`, `a^2`, 0.1215854},
+		{`a:1 b:2`, `a^2 | b`, 0.0911891},
+		{`a:1 b:2`, `a^2 | c`, 0.0607927},
+		{`a:1 b:2`, `a^2 & b`, 0.1401536},
+		{`a:1 b:2`, `a^2 & b^2`, 0.1982064},
+		{`a:1 b:2`, `a^0.5 & b^0.5`, 0.0495516},
+		// The weight of a pair is capped at 1.
+		{`a:1A b:2A`, `a^10 & b^10`, 1},
+	} {
+		t.Log(tc)
+		assertRankEqual(t, tc.expected, rank(tc.vector, tc.query))
+	}
+
+	// A boosted query built programmatically ranks the same as a parsed one.
+	v, err := ParseTSVector(`a:1 b:2`)
+	require.NoError(t, err)
+	q, err := ParseTSQuery(`a & b`)
+	require.NoError(t, err)
+	q, err = NewBoostQuery(q, 2)
+	require.NoError(t, err)
+	actual, err := Rank(DefaultRankWeights, v, q, 0)
+	require.NoError(t, err)
+	assert.Equal(t, rank(`a:1 b:2`, `a^2 & b^2`), actual)
+}
+
+func TestRankWithTieBreak(t *testing.T) {
+	key := func(vector, query string) RankKey {
+		v, err := ParseTSVector(vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(query)
+		require.NoError(t, err)
+		ret, err := RankWithTieBreak(DefaultRankWeights, v, q, 0, RankOptions{})
+		require.NoError(t, err)
+		expected, err := Rank(DefaultRankWeights, v, q, 0)
+		require.NoError(t, err)
+		assert.Equal(t, expected, ret.Rank)
+		return ret
+	}
+
+	for _, tc := range []struct {
+		vector, query string
+		matchCount    int
+		firstMatch    int
+	}{
+		{`a:1`, `b`, 0, 0},
+		{`a:3 b:5`, `a | b`, 2, 3},
+		{`b:1 a:3,7`, `a & !c`, 2, 3},
+		{`a:3 c:1`, `a & !c`, 0, 0},
+		{`a:3A,4`, `a:D`, 1, 4},
+		{`a`, `a`, 1, maxTSVectorPosition + 1},
+	} {
+		t.Log(tc)
+		actual := key(tc.vector, tc.query)
+		assert.Equal(t, tc.matchCount, actual.MatchCount)
+		assert.Equal(t, tc.firstMatch, actual.FirstMatch)
+	}
+
+	// Documents with equal ranks are ordered by match count, then by first
+	// match.
+	ordered := []RankKey{
+		key(`a:1A`, `a | b`),
+		key(`a:1 b:2`, `a | b`),
+		key(`a:3 b:5`, `a | b`),
+		key(`a:2 c:3`, `a | b`),
+		key(`a:6 c:3`, `a | b`),
+		key(`c:1`, `a | b`),
+	}
+	for i := range ordered {
+		assert.Equal(t, 0, ordered[i].Compare(ordered[i]))
+		for j := i + 1; j < len(ordered); j++ {
+			assert.Equal(t, -1, ordered[i].Compare(ordered[j]), "%d, %d", i, j)
+			assert.Equal(t, 1, ordered[j].Compare(ordered[i]), "%d, %d", j, i)
+		}
+	}
+}
+
+func TestRankWithLength(t *testing.T) {
+	v, err := ParseTSVector(`a:1 b:2 c:3`)
+	require.NoError(t, err)
+	q, err := ParseTSQuery(`a & b`)
+	require.NoError(t, err)
+
+	// With the vector's own length, RankWithLength is the same as Rank.
+	for _, normalization := range []int{0, RankNormLogLength, RankNormLength, RankNormUniq} {
+		expected, err := Rank(DefaultRankWeights, v, q, normalization)
+		require.NoError(t, err)
+		actual, err := RankWithLength(DefaultRankWeights, v, q, normalization, v.cntLength())
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+
+	// The supplied length is used for the length normalizations.
+	actual, err := RankWithLength(DefaultRankWeights, v, q, RankNormLength, 10)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 0.00991032, actual, 0.0001)
+	actual, err = RankWithLength(DefaultRankWeights, v, q, RankNormLogLength, 7)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 0.0330344, actual, 0.0001)
+
+	// But not for the unique word normalizations.
+	actual, err = RankWithLength(DefaultRankWeights, v, q, RankNormUniq, 10)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 0.0330344, actual, 0.0001)
+
+	// A zero length disables the length normalizations.
+	actual, err = RankWithLength(DefaultRankWeights, v, q, RankNormLength|RankNormLogLength, 0)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 0.0991032, actual, 0.0001)
+
+	_, err = RankWithLength(DefaultRankWeights, v, q, 0, -1)
+	assert.Error(t, err)
+}
+
+func TestRankPositionDecay(t *testing.T) {
+	rank := func(vector, query string, decay float64) float32 {
+		v, err := ParseTSVector(vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(query)
+		require.NoError(t, err)
+		ret, err := RankWithOptions(DefaultRankWeights, v, q, 0, RankOptions{PositionDecay: decay})
+		require.NoError(t, err)
+		return ret
+	}
+
+	// Without decay, the results are the same as Rank's.
+	for _, tc := range []struct {
+		vector, query string
+	}{
+		{`a:1`, `a`},
+		{`a:5,10`, `a`},
+		{`a:1 b:3`, `a & b`},
+		{`a b`, `a & b`},
+	} {
+		v, err := ParseTSVector(tc.vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		expected, err := Rank(DefaultRankWeights, v, q, 0)
+		require.NoError(t, err)
+		assert.Equal(t, expected, rank(tc.vector, tc.query, 0))
+	}
+
+	// Matches at position 1 and lexemes without positions aren't affected.
+	assert.Equal(t, rank(`a:1`, `a`, 0), rank(`a:1`, `a`, 0.5))
+	assert.Equal(t, rank(`a`, `a`, 0), rank(`a`, `a`, 0.5))
+
+	// A match at position 3 with a decay of 0.5 has half of its weight.
+	assertRankEqual(t, rank(`a:1`, `a`, 0)/2, rank(`a:3`, `a`, 0.5))
+	assertRankEqual(t, 0.0809175, rank(`a:1 b:2`, `a & b`, 0.5))
+
+	// Earlier matches rank higher, and more decay lowers the rank further.
+	assert.Greater(t, rank(`a:2 b:3`, `a & b`, 0.1), rank(`a:20 b:21`, `a & b`, 0.1))
+	assert.Greater(t, rank(`a:20 b:21`, `a & b`, 0.1), rank(`a:20 b:21`, `a & b`, 1))
+	assert.Greater(t, rank(`a:2 b:30`, `a | b`, 0.1), rank(`a:30 b:40`, `a | b`, 0.1))
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, err := RankWithOptions(DefaultRankWeights, TSVector{}, TSQuery{}, 0, RankOptions{PositionDecay: -1})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "position decay must be non-negative")
+	})
+}
+
+// assertRankEqual asserts that two ranks are equal, up to the precision that
+// Postgres displays them with.
+func assertRankEqual(t *testing.T, expected, actual float32) {
+	t.Helper()
+	if expected == 0 {
+		assert.Zero(t, actual)
+		return
+	}
+	assert.InEpsilon(t, expected, actual, 0.0001)
+}
+
+func TestRankByWeight(t *testing.T) {
+	rankByWeight := func(vector, query string, normalization int) [4]float32 {
+		v, err := ParseTSVector(vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(query)
+		require.NoError(t, err)
+		ret, err := RankByWeight(v, q, normalization)
+		require.NoError(t, err)
+		return ret
+	}
+
+	// Each entry only counts the matches with its weight label.
+	actual := rankByWeight(`cat:1A dog:2`, `cat | dog | bird`, 0)
+	assert.Zero(t, actual[1])
+	assert.Zero(t, actual[2])
+	assertRankEqual(t, actual[0], actual[3])
+	assert.Greater(t, actual[3], float32(0))
+	assert.Equal(t, [4]float32{}, rankByWeight(`cat:1A dog:2`, `bird`, 0))
+
+	// Matches of a single position per lexeme contribute linearly to the rank
+	// of an or, so the weighted sum of the entries is the rank.
+	for _, vector := range []string{`cat:1A dog:2`, `cat:1B dog:5C bird:3`} {
+		v, err := ParseTSVector(vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(`cat | dog | bird`)
+		require.NoError(t, err)
+		expected, err := Rank(DefaultRankWeights, v, q, RankNormLength)
+		require.NoError(t, err)
+		byWeight := rankByWeight(vector, `cat | dog | bird`, RankNormLength)
+		var sum float32
+		for i := range byWeight {
+			sum += DefaultRankWeights[i] * byWeight[i]
+		}
+		assertRankEqual(t, expected, sum)
+	}
+
+	// The pairs of an and only count if both of their positions have the
+	// label.
+	assert.Equal(t, [4]float32{}, rankByWeight(`cat:1A dog:2`, `cat & dog`, 0))
+	actual = rankByWeight(`cat:1A dog:2A`, `cat & dog`, 0)
+	assert.Equal(t, [3]float32{}, [3]float32{actual[0], actual[1], actual[2]})
+	assert.Greater(t, actual[3], float32(0))
+}
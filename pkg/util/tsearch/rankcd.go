@@ -0,0 +1,308 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// This file implements ts_rank_cd, which ranks how well a TSVector matches a
+// TSQuery by the density of its covers: the minimal extents of the document
+// that satisfy the query. It's a port of calc_rank_cd in Postgres's tsrank.c.
+//
+// Like Postgres, the positions that can form a cover are restricted by the
+// weights of the query terms that they match: the positions of cat that don't
+// have weight A can't be part of a cover of cat:A & dog, even if the vector
+// contains them, so a cover of cat:A & dog is only found where a cat of
+// weight A occurs.
+//
+// Boosts, which Postgres doesn't support, are applied like in Rank: the weight
+// of a position of a cover is multiplied by the boost of the query term that
+// it matches, or by the largest boost if it matches several terms. So a cover
+// that matches boosted terms is denser than the same cover without boosts.
+
+// RankCD implements ts_rank_cd, returning the cover density rank of the input
+// TSVector against the input TSQuery. The weights array holds the weights for
+// the weight labels D, C, B and A, in that order. Negative weights are
+// replaced by the matching entry of DefaultRankWeights. The normalization
+// parameter is a bitmask of the RankNorm constants.
+func RankCD(weights [4]float32, v TSVector, q TSQuery, normalization int) (float32, error) {
+	w, err := validateRankWeights(weights)
+	if err != nil {
+		return 0, err
+	}
+	if len(v) == 0 || q.root == nil {
+		return 0, nil
+	}
+	var invWeights [4]float64
+	for i := range w {
+		invWeights[i] = 1 / float64(w[i])
+	}
+
+	c := newCoverFinder(v, q)
+	var res, sumDist, prevExtPos float64
+	var nExtent int
+	for {
+		begin, end, ok, err := c.next()
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			break
+		}
+		var invSum float64
+		for i := begin; i <= end; i++ {
+			invSum += invWeights[weightIdx(c.doc[i].pos)] / c.doc[i].boost
+		}
+		cpos := float64(end-begin+1) / invSum
+		// The noise of a cover is the number of positions within it that don't
+		// match any query term.
+		p, q := c.doc[begin].pos.position, c.doc[end].pos.position
+		nNoise := (q - p) - (end - begin)
+		if nNoise < 0 {
+			nNoise = (end - begin) / 2
+		}
+		res += cpos / float64(1+nNoise)
+
+		curExtPos := float64(p+q) / 2
+		// Covers of lexemes at the same position have the same center, so they
+		// don't contribute to the distance between extents.
+		if nExtent > 0 && curExtPos > prevExtPos {
+			sumDist += 1 / (curExtPos - prevExtPos)
+		}
+		prevExtPos = curExtPos
+		nExtent++
+	}
+
+	if normalization&RankNormLogLength != 0 {
+		// Unlike ts_rank, Postgres's ts_rank_cd uses the natural logarithm.
+		res /= math.Log(float64(v.cntLength() + 1))
+	}
+	if normalization&RankNormLength != 0 {
+		if docLength := v.cntLength(); docLength > 0 {
+			res /= float64(docLength)
+		}
+	}
+	if normalization&RankNormExtDist != 0 && nExtent > 0 && sumDist > 0 {
+		res /= float64(nExtent) / sumDist
+	}
+	if normalization&RankNormUniq != 0 {
+		res /= float64(len(v))
+	}
+	if normalization&RankNormLogUniq != 0 {
+		res /= math.Log(float64(len(v)+1)) / math.Log(2.0)
+	}
+	if normalization&RankNormRDivRPlus1 != 0 {
+		res /= res + 1
+	}
+	return float32(res), nil
+}
+
+// coverEntry is a position of the document that matches at least one of the
+// terms of the query, along with the indexes of those terms.
+type coverEntry struct {
+	pos    tsPosition
+	leaves []int
+	// boost is the largest boost of the terms that the position matches.
+	boost float64
+}
+
+// coverFinder finds the covers of a query in a document, in increasing order of
+// position. It's a port of Cover in Postgres's tsrank.c: the window of the
+// document that's searched for a cover is extended one entry at a time, and
+// the positions of each entry are added to the posting lists of the window,
+// against which the query is evaluated, so the window is never rebuilt.
+type coverFinder struct {
+	// doc holds the positions of the document that match a query term, in
+	// increasing order. Only positions with one of the weights that the
+	// matching term is restricted to are included. Lexemes without positions
+	// are represented by position 0.
+	doc []coverEntry
+	// q is a copy of the query whose terms are replaced by names, which are
+	// looked up in the window by the evaluator.
+	q TSQuery
+	// window holds the posting lists of the entries of doc that are in the
+	// current window.
+	window coverWindow
+	// pos is the index into doc at which the search for the next cover starts.
+	pos int
+}
+
+func newCoverFinder(v TSVector, q TSQuery) *coverFinder {
+	c := &coverFinder{}
+	var rewrite func(n *tsNode) *tsNode
+	rewrite = func(n *tsNode) *tsNode {
+		if n == nil {
+			return nil
+		}
+		if n.op != invalid {
+			return &tsNode{op: n.op, followedN: n.followedN, l: rewrite(n.l), r: rewrite(n.r)}
+		}
+		idx := len(c.window.names)
+		c.window.names = append(c.window.names, fmt.Sprintf("%010d", idx))
+		boost := float64(n.term.boostFactor())
+		for _, t := range findMatchingTerms(v, &n.term) {
+			positions := t.positions
+			if len(positions) == 0 {
+				positions = []tsPosition{{}}
+			}
+			for _, pos := range filterPositionsByWeight(&n.term, positions) {
+				c.doc = append(c.doc, coverEntry{pos: pos, leaves: []int{idx}, boost: boost})
+			}
+		}
+		return &tsNode{term: tsTerm{lexeme: c.window.names[idx]}}
+	}
+	c.q = TSQuery{root: rewrite(q.root)}
+	c.window.positions = make([][]int, len(c.window.names))
+
+	// Merge the entries at the same position, keeping the lowest weight like
+	// Postgres does.
+	sort.SliceStable(c.doc, func(i, j int) bool {
+		if c.doc[i].pos.position != c.doc[j].pos.position {
+			return c.doc[i].pos.position < c.doc[j].pos.position
+		}
+		return weightIdx(c.doc[i].pos) < weightIdx(c.doc[j].pos)
+	})
+	merged := c.doc[:0]
+	for _, e := range c.doc {
+		if n := len(merged); n > 0 && merged[n-1].pos.position == e.pos.position {
+			last := &merged[n-1]
+			for _, l := range e.leaves {
+				if !containsInt(last.leaves, l) {
+					last.leaves = append(last.leaves, l)
+				}
+			}
+			if e.boost > last.boost {
+				last.boost = e.boost
+			}
+			continue
+		}
+		merged = append(merged, e)
+	}
+	c.doc = merged
+	return c
+}
+
+func containsInt(s []int, x int) bool {
+	for _, y := range s {
+		if y == x {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the indexes into doc of the first and last entries of the next
+// cover, and false if there are no more covers. Like in Postgres, the upper
+// bound of a cover is found by extending the window from the current position
+// until the query is satisfied, and then the lower bound is found by
+// extending a new window down from the upper bound until the query is
+// satisfied again.
+func (c *coverFinder) next() (begin, end int, ok bool, err error) {
+	c.window.reset(false /* descending */)
+	end = -1
+	for i := c.pos; i < len(c.doc); i++ {
+		c.window.add(&c.doc[i])
+		ok, err := c.window.satisfies(c.q)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if ok {
+			end = i
+			break
+		}
+	}
+	// Like in Postgres, a cover must end at a real position, so lexemes without
+	// positions can't form one.
+	if end < 0 || c.doc[end].pos.position == 0 {
+		return 0, 0, false, nil
+	}
+	c.window.reset(true /* descending */)
+	for begin = end; begin > c.pos; begin-- {
+		c.window.add(&c.doc[begin])
+		ok, err := c.window.satisfies(c.q)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		if ok {
+			break
+		}
+	}
+	c.pos = begin + 1
+	return begin, end, true, nil
+}
+
+// coverWindow is the PostingSource of a window of the entries of a
+// coverFinder's document, whose lexemes are the names of the terms of the
+// coverFinder's query.
+type coverWindow struct {
+	// names holds the lexemes of the terms of the query, in order of their
+	// indexes. They sort in that order too.
+	names []string
+	// positions holds the positions of the window's entries that match each
+	// term of the query, in order of the terms' indexes.
+	positions [][]int
+	// descending is true if the window is extended downwards, so positions
+	// are added in decreasing order.
+	descending bool
+	// scratch is used to return the positions in increasing order when the
+	// window is extended downwards.
+	scratch []int
+}
+
+var _ PostingSource = &coverWindow{}
+
+// reset empties the window, which is then extended upwards, or downwards if
+// descending is set.
+func (w *coverWindow) reset(descending bool) {
+	for i := range w.positions {
+		w.positions[i] = w.positions[i][:0]
+	}
+	w.descending = descending
+}
+
+// add extends the window by the input entry.
+func (w *coverWindow) add(e *coverEntry) {
+	for _, l := range e.leaves {
+		w.positions[l] = append(w.positions[l], e.pos.position)
+	}
+}
+
+// satisfies returns whether the input query is satisfied by the window, as if
+// the rest of the document didn't exist.
+func (w *coverWindow) satisfies(q TSQuery) (bool, error) {
+	evaluator := tsEvaluator{q: q, src: w}
+	return evaluator.eval()
+}
+
+// Positions implements the PostingSource interface.
+func (w *coverWindow) Positions(lexeme string) ([]int, bool) {
+	i := sort.SearchStrings(w.names, lexeme)
+	if i >= len(w.names) || w.names[i] != lexeme || len(w.positions[i]) == 0 {
+		return nil, false
+	}
+	if !w.descending {
+		return w.positions[i], true
+	}
+	w.scratch = w.scratch[:0]
+	for j := len(w.positions[i]) - 1; j >= 0; j-- {
+		w.scratch = append(w.scratch, w.positions[i][j])
+	}
+	return w.scratch, true
+}
+
+// HasPrefix implements the PostingSource interface. The terms of the query
+// that's evaluated against the window aren't prefixes, so it's never called.
+func (w *coverWindow) HasPrefix(prefix string) bool {
+	return false
+}
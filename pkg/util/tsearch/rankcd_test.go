@@ -0,0 +1,141 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRankCD(t *testing.T) {
+	tcs := []struct {
+		vector        string
+		query         string
+		normalization int
+		expected      float32
+	}{
+		{`a:1 b:2`, `a & b`, 0, 0.1},
+		{`a:1 b:3`, `a & b`, 0, 0.05},
+		{`a:1 b:2`, `a | b`, 0, 0.2},
+		{`a:1 b:2`, `c`, 0, 0},
+		{``, `a`, 0, 0},
+		{`a:1A b:2A`, `a & b`, 0, 1},
+		{`a:1 b:2 c:3`, `a & !b`, 0, 0.1},
+		{`a:1 b:2`, `a <-> b`, 0, 0.1},
+		{`a:1 b:2`, `b <-> a`, 0, 0},
+		{`a:1,3 b:2`, `a & b`, 0, 0.2},
+		{`abc:1 abd:2`, `ab:*`, 0, 0.2},
+		{`a b`, `a & b`, 0, 0},
+		{`a:1 b:3 c:5`, `a & b`, RankNormLogLength, 0.0360674},
+		{`a:1 b:3 c:5`, `a & b`, RankNormLength, 0.0166667},
+		{`a:1 b:3`, `a | b`, RankNormExtDist, 0.05},
+		{`a:1 b:3 c:5`, `a & b`, RankNormUniq, 0.0166667},
+		{`a:1 b:3 c:5,6`, `a & b`, RankNormLogUniq, 0.025},
+		{`a:1 b:3 c:5`, `a & b`, RankNormRDivRPlus1, 0.0476190},
+
+		// Only the positions with the weights that a query term is restricted to
+		// can be part of its covers.
+		{`a:1A,4 b:5B`, `a & b`, 0, 0.16},
+		{`a:1A,4 b:5B`, `a:A & b`, 0, 0.1428571},
+		{`a:1A,4 b:5B`, `a:A & b:A`, 0, 0},
+		{`a:1A,2 b:3`, `a <-> b`, 0, 0.1},
+		{`a:1A,2 b:3`, `a:A <-> b`, 0, 0},
+		{`a:1A,3C b:2B,4`, `a & b`, 0, 0.9714286},
+		{`a:1A,3C b:2B,4`, `a:AC & b:BD`, 0, 0.9714286},
+		{`a:1A,3C b:2B,4`, `a:C & b:D`, 0, 0.1333333},
+		{`a:1A,3C b:2B,4`, `a:A & b:BD`, 0, 0.5714286},
+		{`a:1A,3C b:2B,4`, `a:B | b:C`, 0, 0},
+	}
+	for _, tc := range tcs {
+		t.Log(tc)
+		v, err := ParseTSVector(tc.vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		actual, err := RankCD(DefaultRankWeights, v, q, tc.normalization)
+		require.NoError(t, err)
+		assertRankEqual(t, tc.expected, actual)
+	}
+
+	t.Run("Weights", func(t *testing.T) {
+		v, err := ParseTSVector(`a:1 b:2`)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(`a & b`)
+		require.NoError(t, err)
+		actual, err := RankCD([4]float32{1, 1, 1, 1}, v, q, 0)
+		require.NoError(t, err)
+		assert.InEpsilon(t, 1, actual, 0.0001)
+
+		// A weight of 0 makes the covers of its positions worthless.
+		actual, err = RankCD([4]float32{0, 0.2, 0.4, 1}, v, q, 0)
+		require.NoError(t, err)
+		assert.Zero(t, actual)
+
+		// Negative weights are replaced with the defaults.
+		actual, err = RankCD([4]float32{-1, -1, -1, -1}, v, q, 0)
+		require.NoError(t, err)
+		assert.InEpsilon(t, 0.1, actual, 0.0001)
+
+		_, err = RankCD([4]float32{0.1, 0.2, 0.4, 1.1}, v, q, 0)
+		assert.Error(t, err)
+	})
+
+	t.Run("Boosts", func(t *testing.T) {
+		for _, tc := range []struct {
+			vector   string
+			query    string
+			expected float32
+		}{
+			// A boost of 1 is the same as no boost.
+			{`a:1 b:2`, `a^1 & b`, 0.1},
+			{`a:1 b:2`, `a^2 & b`, 0.1333333},
+			{`a:1 b:2`, `a^2 & b^2`, 0.2},
+			{`a:1 b:2`, `a^0.5 & b^0.5`, 0.05},
+			{`a:1 b:2`, `a^2 | b`, 0.3},
+			// A position that matches several terms gets the largest boost.
+			{`ab:1 b:2`, `ab^3 & ab:*^2 & b`, 0.15},
+		} {
+			t.Log(tc)
+			v, err := ParseTSVector(tc.vector)
+			require.NoError(t, err)
+			q, err := ParseTSQueryWithConfig(tc.query, Config{TermBoosts: true})
+			require.NoError(t, err)
+			actual, err := RankCD(DefaultRankWeights, v, q, 0)
+			require.NoError(t, err)
+			assertRankEqual(t, tc.expected, actual)
+		}
+	})
+
+	t.Run("ComparePG", func(t *testing.T) {
+		// This test can be manually run by pointing it to a local Postgres. There
+		// are no requirements for the contents of the local Postgres - it just runs
+		// expressions. The test validates that all of the test cases in this test
+		// file work the same in Postgres as they do this package.
+		skip.IgnoreLint(t, "need to manually enable")
+		conn, err := pgx.Connect(context.Background(), "postgresql://jordan@localhost:5432")
+		require.NoError(t, err)
+		for _, tc := range tcs {
+			t.Log(tc)
+
+			var actual float32
+			row := conn.QueryRow(context.Background(), "SELECT ts_rank_cd($1::TSVector, $2::TSQuery, $3)",
+				tc.vector, tc.query, tc.normalization,
+			)
+			require.NoError(t, row.Scan(&actual))
+			assertRankEqual(t, tc.expected, actual)
+		}
+	})
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import "container/heap"
+
+// SegmentedTSVector is a document that's made up of several fields, such as a
+// title and a body, each of which is represented by its own TSVector, which
+// is called a segment. Unlike the result of Concat, it keeps track of the
+// boundaries between the segments, so that matching and ranking can respect
+// them: a phrase can't match across the end of one segment and the start of
+// the next, and the matches in each segment are ranked on their own.
+type SegmentedTSVector struct {
+	segments []TSVector
+}
+
+// NewSegmentedTSVector returns a SegmentedTSVector made up of the input
+// segments, in order. The segments must be normalized, which every TSVector
+// constructed by this package is.
+func NewSegmentedTSVector(segments ...TSVector) SegmentedTSVector {
+	return SegmentedTSVector{segments: segments}
+}
+
+// NumSegments returns the number of segments of the receiver.
+func (s SegmentedTSVector) NumSegments() int {
+	return len(s.segments)
+}
+
+// Segment returns the ith segment of the receiver.
+func (s SegmentedTSVector) Segment(i int) TSVector {
+	return s.segments[i]
+}
+
+// Concat returns the concatenation of the segments of the receiver, as if
+// they were concatenated with Concat, which loses the segment boundaries.
+func (s SegmentedTSVector) Concat() TSVector {
+	return MergeTSVectors(s.segments, 0 /* baseGap */)
+}
+
+// numLexemes returns the number of distinct lexemes of the receiver, across
+// all of its segments, which is the number of lexemes of its concatenation.
+func (s SegmentedTSVector) numLexemes() int {
+	// The segments are merged like in MergeTSVectors, but only the distinct
+	// lexemes are counted.
+	h := tsVectorMergeHeap{vectors: s.segments}
+	for i, segment := range s.segments {
+		if len(segment) > 0 {
+			h.cursors = append(h.cursors, tsVectorMergeCursor{vector: i})
+		}
+	}
+	heap.Init(&h)
+	var ret int
+	for h.Len() > 0 {
+		lexeme := h.top().lexeme
+		for h.Len() > 0 && h.top().lexeme == lexeme {
+			c := &h.cursors[0]
+			c.idx++
+			if c.idx < len(s.segments[c.vector]) {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		ret++
+	}
+	return ret
+}
+
+// Matches returns whether the input query matches the receiver. Phrases must
+// match within a single segment, but the other operators combine the matches
+// of all of the segments, as in TSQuery.MatchesAny: cat & dog matches a
+// document with cat in its title and dog in its body, but cat <-> dog doesn't,
+// even if cat is the last word of the title and dog the first word of the
+// body.
+func (s SegmentedTSVector) Matches(q TSQuery) (bool, error) {
+	return q.MatchesAny(s.segments...)
+}
+
+// RankSegmented is like Rank, but respects the segment boundaries of the input
+// SegmentedTSVector. Each segment is ranked on its own, so that only the
+// weights of the matches in a segment contribute to its rank, and the
+// proximity of matches in different segments doesn't count. The ranks of the
+// segments are combined as independent probabilities of relevance: the
+// unnormalized rank of the document is 1 - (1 - r1) * (1 - r2) * ..., where
+// ri is the unnormalized rank of the ith segment, clamped to [0, 1]. The
+// normalization is then applied to the whole document, as if its segments were
+// concatenated.
+//
+// The rank of a query whose root is an and or a followed by operator comes
+// from the pairs of its operands that match in the same segment. If no
+// segment has such a pair, but the document matches the query, as cat & dog
+// does when cat is in the title and dog in the body, the segments are ranked
+// like for an or operator instead, so that the document doesn't rank like a
+// document that doesn't match.
+func RankSegmented(
+	weights [4]float32, s SegmentedTSVector, q TSQuery, normalization int,
+) (float32, error) {
+	w, err := validateRankWeights(weights)
+	if err != nil {
+		return 0, err
+	}
+	if q.root == nil {
+		return 0, nil
+	}
+	p := rankParams{w: w}
+	isAnd := q.root.op == and || q.root.op == followedby
+	ranks := make([]float32, len(s.segments))
+	var paired bool
+	var docLength int
+	for i, segment := range s.segments {
+		docLength += segment.cntLength()
+		if len(segment) == 0 {
+			continue
+		}
+		if isAnd {
+			// calcRankAnd returns a negative rank if the segment has no pair.
+			ranks[i] = calcRankAnd(p, segment, q)
+			paired = paired || ranks[i] >= 0
+		} else {
+			ranks[i] = calcRankOr(p, segment, q)
+		}
+	}
+	if isAnd && !paired {
+		matches, err := s.Matches(q)
+		if err != nil {
+			return 0, err
+		}
+		if matches {
+			for i, segment := range s.segments {
+				if len(segment) > 0 {
+					ranks[i] = calcRankOr(p, segment, q)
+				}
+			}
+		}
+	}
+	miss := float64(1)
+	for _, r := range ranks {
+		if r < 0 {
+			// Like in calcRank.
+			r = 1e-20
+		} else if r > 1 {
+			r = 1
+		}
+		miss *= 1 - float64(r)
+	}
+	numLexemes := s.numLexemes()
+	if numLexemes == 0 {
+		return 0, nil
+	}
+	return normalizeRank(float32(1-miss), numLexemes, normalization, docLength), nil
+}
@@ -0,0 +1,146 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSegmentedTSVector(t *testing.T) {
+	title, err := DocumentToTSVector("simple", `the fat cat`)
+	require.NoError(t, err)
+	title = title.SetWeight(WeightA)
+	body, err := DocumentToTSVector("simple", `dog chased a rat`)
+	require.NoError(t, err)
+	s := NewSegmentedTSVector(title, body)
+
+	require.Equal(t, 2, s.NumSegments())
+	assert.Equal(t, title, s.Segment(0))
+	assert.Equal(t, body, s.Segment(1))
+	assert.Equal(t, Concat(title, body), s.Concat())
+	assert.Equal(t, `'a':6 'cat':3A 'chased':5 'dog':4 'fat':2A 'rat':7 'the':1A`, s.Concat().String())
+	assert.Equal(t, TSVector{}, NewSegmentedTSVector().Concat())
+
+	for _, tc := range []struct {
+		query    string
+		expected bool
+	}{
+		{`cat`, true},
+		{`cat & dog`, true},
+		{`cat & bird`, false},
+		{`fat <-> cat`, true},
+		{`dog <-> chased`, true},
+		// The phrase would match the concatenation, but not within a segment.
+		{`cat <-> dog`, false},
+		{`cat <-> !dog`, true},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		actual, err := s.Matches(q)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual)
+	}
+}
+
+func TestRankSegmented(t *testing.T) {
+	rank := func(query string, segments ...string) float32 {
+		vectors := make([]TSVector, len(segments))
+		for i := range segments {
+			var err error
+			vectors[i], err = ParseTSVector(segments[i])
+			require.NoError(t, err)
+		}
+		q, err := ParseTSQuery(query)
+		require.NoError(t, err)
+		ret, err := RankSegmented(DefaultRankWeights, NewSegmentedTSVector(vectors...), q, 0)
+		require.NoError(t, err)
+		return ret
+	}
+	plainRank := func(query string, vector string) float32 {
+		v, err := ParseTSVector(vector)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(query)
+		require.NoError(t, err)
+		ret, err := Rank(DefaultRankWeights, v, q, 0)
+		require.NoError(t, err)
+		return ret
+	}
+
+	// With a single segment, the rank is the same as Rank's.
+	for _, tc := range []struct {
+		query, vector string
+	}{
+		{`a`, `a:1`},
+		{`a & b`, `a:1A b:3`},
+		{`a | b`, `a:1 b:2B c:5`},
+	} {
+		assertRankEqual(t, plainRank(tc.query, tc.vector), rank(tc.query, tc.vector))
+	}
+
+	// The proximity of matches in different segments doesn't count: a and b
+	// are adjacent in the concatenation, but in different segments.
+	assert.Greater(t, plainRank(`a & b`, `c:1 a:2 b:3`), rank(`a & b`, `c:1 a:2`, `b:1`))
+
+	// A document that matches an and operator only across segments is ranked
+	// like for an or operator, rather than like a document that doesn't match.
+	orRank := 1 - (1-plainRank(`cat | dog`, `cat:1A`))*(1-plainRank(`cat | dog`, `dog:1B`))
+	assert.Greater(t, orRank, float32(0.1))
+	assertRankEqual(t, orRank, rank(`cat & dog`, `cat:1A`, `dog:1B`))
+	assertRankEqual(t, orRank, rank(`cat & dog`, `cat:1A`, ``, `dog:1B`))
+	assert.Less(t, rank(`cat & dog`, `cat:1A`, `bird:1B`), float32(1e-10))
+	assert.Less(t, rank(`cat <-> dog`, `cat:1A`, `dog:1B`), float32(1e-10))
+	// A pair within a segment takes precedence over the matches across
+	// segments.
+	assertRankEqual(t, plainRank(`cat & dog`, `cat:1 dog:2`),
+		rank(`cat & dog`, `cat:1 dog:2`, `bird:1`))
+
+	// The ranks of the segments are combined as independent probabilities.
+	r1 := plainRank(`a`, `a:1A`)
+	r2 := plainRank(`a`, `a:1`)
+	assertRankEqual(t, 1-(1-r1)*(1-r2), rank(`a`, `a:1A`, `a:1`))
+	// A match in another segment only increases the rank.
+	assert.Greater(t, rank(`a`, `a:1A`, `a:1`), rank(`a`, `a:1A`, `b:1`))
+	assertRankEqual(t, r1, rank(`a`, `a:1A`, `b:1`))
+
+	assert.Zero(t, rank(`a`))
+	assert.Zero(t, rank(`a`, ``, ``))
+
+	t.Run("Normalization", func(t *testing.T) {
+		s := NewSegmentedTSVector(parseTSVectors(t, `a:1`, `b:1`)...)
+		q, err := ParseTSQuery(`a`)
+		require.NoError(t, err)
+		unnormalized, err := RankSegmented(DefaultRankWeights, s, q, 0)
+		require.NoError(t, err)
+		// The document length is the length of all of the segments.
+		actual, err := RankSegmented(DefaultRankWeights, s, q, RankNormLength)
+		require.NoError(t, err)
+		assertRankEqual(t, unnormalized/2, actual)
+
+		// The number of unique lexemes is counted across the segments, so a
+		// lexeme that several segments have counts once.
+		s = NewSegmentedTSVector(parseTSVectors(t, `a:1 b:2`, `b:1 c:2`, ``, `a:1 d:2`)...)
+		unnormalized, err = RankSegmented(DefaultRankWeights, s, q, 0)
+		require.NoError(t, err)
+		actual, err = RankSegmented(DefaultRankWeights, s, q, RankNormUniq)
+		require.NoError(t, err)
+		require.Len(t, s.Concat(), 4)
+		assertRankEqual(t, unnormalized/4, actual)
+	})
+
+	t.Run("InvalidWeights", func(t *testing.T) {
+		_, err := RankSegmented([4]float32{2, 0, 0, 0}, NewSegmentedTSVector(), TSQuery{}, 0)
+		require.Error(t, err)
+	})
+}
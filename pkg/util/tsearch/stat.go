@@ -0,0 +1,228 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/errors"
+)
+
+// StatEntry holds the statistics of a single lexeme across a corpus of
+// TSVectors. It's a row of the output of Postgres's ts_stat.
+type StatEntry struct {
+	// Word is the lexeme.
+	Word string
+	// NDoc is the number of vectors that contain the lexeme.
+	NDoc int
+	// NEntry is the total number of occurrences of the lexeme: the number of
+	// its positions, summed over all of the vectors. A lexeme without
+	// positions counts as a single occurrence.
+	NEntry int
+}
+
+// TSStat returns the statistics of every lexeme of the input vectors, sorted
+// by lexeme, like Postgres's ts_stat. The input vectors must be normalized,
+// which every TSVector constructed by this package is.
+func TSStat(vectors []TSVector) []StatEntry {
+	idx := make(map[string]int)
+	var ret []StatEntry
+	for _, v := range vectors {
+		for i := range v {
+			j, ok := idx[v[i].lexeme]
+			if !ok {
+				j = len(ret)
+				idx[v[i].lexeme] = j
+				ret = append(ret, StatEntry{Word: v[i].lexeme})
+			}
+			ret[j].NDoc++
+			if len(v[i].positions) == 0 {
+				ret[j].NEntry++
+			} else {
+				ret[j].NEntry += len(v[i].positions)
+			}
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Word < ret[j].Word
+	})
+	return ret
+}
+
+// TSStatSampled is like TSStat, but only counts a random sample of the input
+// vectors, and extrapolates the statistics of the sample to all of them, which
+// is much cheaper for large corpora. Each vector is sampled with probability
+// sampleRate, using a random number generator seeded with the input seed, so
+// the same inputs always produce the same result. The counts of the sample are
+// scaled by the ratio of the number of input vectors to the number of sampled
+// vectors, and rounded, so lexemes that appear in all of the sampled vectors
+// are estimated to appear in all of the input vectors. Lexemes that aren't in
+// any of the sampled vectors are omitted.
+//
+// A sampleRate of 1 or more samples every vector, which gives the same result
+// as TSStat. A sampleRate of 0 or less samples nothing, and returns nil.
+func TSStatSampled(vectors []TSVector, sampleRate float64, seed int64) []StatEntry {
+	if sampleRate >= 1 {
+		return TSStat(vectors)
+	}
+	if !(sampleRate > 0) {
+		return nil
+	}
+	rng := rand.New(rand.NewSource(seed))
+	var sample []TSVector
+	for _, v := range vectors {
+		if rng.Float64() < sampleRate {
+			sample = append(sample, v)
+		}
+	}
+	if len(sample) == 0 {
+		return nil
+	}
+	ret := TSStat(sample)
+	scale := float64(len(vectors)) / float64(len(sample))
+	for i := range ret {
+		ret[i].NDoc = int(math.Round(float64(ret[i].NDoc) * scale))
+		ret[i].NEntry = int(math.Round(float64(ret[i].NEntry) * scale))
+	}
+	return ret
+}
+
+// IndexStats summarizes the size of the inverted index of a corpus of
+// TSVectors.
+type IndexStats struct {
+	// NumVectors is the number of vectors in the corpus.
+	NumVectors int
+	// DistinctLexemes is the number of distinct lexemes in the corpus, which is
+	// the number of posting lists in the inverted index.
+	DistinctLexemes int
+	// TotalPostings is the total length of all of the posting lists, which is
+	// the number of entries in the inverted index.
+	TotalPostings int
+	// AvgPostingListLength is the average number of vectors that contain each
+	// lexeme.
+	AvgPostingListLength float64
+	// TopLexemes holds the statistics of the lexemes with the longest posting
+	// lists, longest first. Lexemes with posting lists of the same length are
+	// ordered by lexeme. Lexemes that appear in most vectors are candidates for
+	// stop words, since they bloat the index without narrowing down searches.
+	TopLexemes []StatEntry
+}
+
+// InvertedIndexStats returns the statistics of the inverted index of the
+// input vectors, including the topK lexemes with the longest posting lists.
+// The input vectors must be normalized, like for TSStat.
+func InvertedIndexStats(vectors []TSVector, topK int) IndexStats {
+	stats := TSStat(vectors)
+	ret := IndexStats{
+		NumVectors:      len(vectors),
+		DistinctLexemes: len(stats),
+	}
+	for i := range stats {
+		ret.TotalPostings += stats[i].NDoc
+	}
+	if len(stats) > 0 {
+		ret.AvgPostingListLength = float64(ret.TotalPostings) / float64(len(stats))
+	}
+	sort.SliceStable(stats, func(i, j int) bool {
+		return stats[i].NDoc > stats[j].NDoc
+	})
+	if topK > len(stats) {
+		topK = len(stats)
+	}
+	if topK > 0 {
+		ret.TopLexemes = stats[:topK:topK]
+	}
+	return ret
+}
+
+// EstimateSelectivity estimates the fraction of the documents of a corpus
+// that the receiver matches, from the input statistics of the lexemes of the
+// corpus, like the ones returned by TSStat, and the total number of documents
+// in the corpus. It's meant for choosing between scans and index lookups, and
+// for ordering the conjuncts of a filter. The estimate is a number between 0
+// and 1, and is computed bottom up:
+//   - A lexeme matches the fraction of the documents that contain it, NDoc
+//     divided by totalDocs. Lexemes that aren't in the statistics match no
+//     documents. A prefix matches the documents that contain any of the
+//     lexemes that start with it, combined like an or operator. Weight
+//     restrictions are ignored, since the statistics don't include weights.
+//   - An and operator matches the product of the fractions of its operands,
+//     and an or operator matches the sum of the fractions of its operands,
+//     minus their product, like for the union of two independent events.
+//   - A not operator matches the complement of the fraction of its operand.
+//   - A followed by operator is treated like an and operator. That's an
+//     upper bound, since the distance between the operands is ignored.
+//
+// So the estimate assumes that lexemes occur in documents independently of
+// each other, which is rarely true: the lexemes of a phrase, or of a query
+// for a topic, tend to occur together, so their conjunctions match more
+// documents than estimated, and their disjunctions match fewer. Likewise, a
+// lexeme that appears several times in the query is treated as if each
+// appearance was a different lexeme. It returns 0 if the receiver is empty,
+// which matches no documents, or if totalDocs isn't positive.
+//
+// The lexemes are looked up in the statistics with binary searches, so the
+// statistics should be sorted by lexeme, like the ones returned by TSStat. If
+// they aren't, a sorted copy of them is made first. The estimate of a prefix
+// combines its lexemes in sorted order, so it's the same for the same
+// statistics, whatever their order.
+func (q TSQuery) EstimateSelectivity(stats []StatEntry, totalDocs int) float64 {
+	if q.root == nil || totalDocs <= 0 {
+		return 0
+	}
+	less := func(i, j int) bool { return stats[i].Word < stats[j].Word }
+	if !sort.SliceIsSorted(stats, less) {
+		stats = append([]StatEntry(nil), stats...)
+		sort.SliceStable(stats, less)
+	}
+	// search returns the index of the first entry whose lexeme isn't less than
+	// the input lexeme.
+	search := func(lexeme string) int {
+		return sort.Search(len(stats), func(i int) bool {
+			return stats[i].Word >= lexeme
+		})
+	}
+	freq := func(i int) float64 {
+		return math.Min(float64(stats[i].NDoc)/float64(totalDocs), 1)
+	}
+	var estimate func(n *tsNode) float64
+	estimate = func(n *tsNode) float64 {
+		switch n.op {
+		case invalid:
+			lexeme := n.term.lexeme
+			i := search(lexeme)
+			if prefix, _ := queryTermWeights(&n.term); prefix {
+				// The probability that none of the matching lexemes is present.
+				none := 1.0
+				for ; i < len(stats) && strings.HasPrefix(stats[i].Word, lexeme); i++ {
+					none *= 1 - freq(i)
+				}
+				return 1 - none
+			}
+			if i < len(stats) && stats[i].Word == lexeme {
+				return freq(i)
+			}
+			return 0
+		case and, followedby:
+			return estimate(n.l) * estimate(n.r)
+		case or:
+			l, r := estimate(n.l), estimate(n.r)
+			return l + r - l*r
+		case not:
+			return 1 - estimate(n.l)
+		}
+		panic(errors.AssertionFailedf("invalid operator %d", n.op))
+	}
+	return estimate(q.root)
+}
@@ -0,0 +1,215 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseTSVectors(t *testing.T, inputs ...string) []TSVector {
+	ret := make([]TSVector, len(inputs))
+	for i, input := range inputs {
+		var err error
+		ret[i], err = ParseTSVector(input)
+		require.NoError(t, err)
+	}
+	return ret
+}
+
+func TestTSStat(t *testing.T) {
+	vectors := parseTSVectors(t,
+		`a:1,2,3 b:4`,
+		`b:1 c`,
+		``,
+		`a:5A c:2,6`,
+	)
+	assert.Equal(t, []StatEntry{
+		{Word: "a", NDoc: 2, NEntry: 4},
+		{Word: "b", NDoc: 2, NEntry: 2},
+		{Word: "c", NDoc: 2, NEntry: 3},
+	}, TSStat(vectors))
+
+	assert.Empty(t, TSStat(nil))
+}
+
+func TestTSStatSampled(t *testing.T) {
+	vectors := make([]TSVector, 10000)
+	for i := range vectors {
+		// Every vector contains the, every other vector contains even, and one in
+		// 100 vectors contains rare, twice.
+		input := `the:1`
+		if i%2 == 0 {
+			input += ` even:2`
+		}
+		if i%100 == 0 {
+			input += ` rare:3,4`
+		}
+		vectors[i] = parseTSVectors(t, input)[0]
+	}
+
+	stats := TSStatSampled(vectors, 0.1, 42)
+	require.Len(t, stats, 3)
+	assert.Equal(t, "even", stats[0].Word)
+	assert.InEpsilon(t, 5000, stats[0].NDoc, 0.1)
+	assert.Equal(t, stats[0].NDoc, stats[0].NEntry)
+	assert.Equal(t, "rare", stats[1].Word)
+	assert.InEpsilon(t, 100, stats[1].NDoc, 0.5)
+	assert.InDelta(t, 2*stats[1].NDoc, stats[1].NEntry, 1)
+	// A lexeme in every sampled vector is estimated to be in every vector.
+	assert.Equal(t, StatEntry{Word: "the", NDoc: 10000, NEntry: 10000}, stats[2])
+
+	// The sample is deterministic.
+	assert.Equal(t, stats, TSStatSampled(vectors, 0.1, 42))
+	assert.NotEqual(t, stats, TSStatSampled(vectors, 0.1, 43))
+
+	// Sampling everything is the same as TSStat.
+	assert.Equal(t, TSStat(vectors), TSStatSampled(vectors, 1, 42))
+	assert.Equal(t, TSStat(vectors), TSStatSampled(vectors, 2, 42))
+
+	assert.Nil(t, TSStatSampled(vectors, 0, 42))
+	assert.Nil(t, TSStatSampled(vectors, -1, 42))
+	assert.Nil(t, TSStatSampled(nil, 0.5, 42))
+}
+
+func TestInvertedIndexStats(t *testing.T) {
+	vectors := parseTSVectors(t,
+		`the:1 cat:2 sat:3`,
+		`the:1,4 dog:2 sat:3`,
+		`the:1 bird:2`,
+		`a:1 fish`,
+	)
+
+	stats := InvertedIndexStats(vectors, 2)
+	assert.Equal(t, 4, stats.NumVectors)
+	assert.Equal(t, 7, stats.DistinctLexemes)
+	assert.Equal(t, 10, stats.TotalPostings)
+	assert.InDelta(t, 10.0/7.0, stats.AvgPostingListLength, 1e-9)
+	assert.Equal(t, []StatEntry{
+		{Word: "the", NDoc: 3, NEntry: 4},
+		{Word: "sat", NDoc: 2, NEntry: 2},
+	}, stats.TopLexemes)
+
+	// Ties are broken by lexeme.
+	stats = InvertedIndexStats(vectors, 4)
+	require.Len(t, stats.TopLexemes, 4)
+	assert.Equal(t, "a", stats.TopLexemes[2].Word)
+	assert.Equal(t, "bird", stats.TopLexemes[3].Word)
+
+	stats = InvertedIndexStats(vectors, 100)
+	assert.Len(t, stats.TopLexemes, 7)
+
+	stats = InvertedIndexStats(vectors, 0)
+	assert.Empty(t, stats.TopLexemes)
+
+	assert.Equal(t, IndexStats{}, InvertedIndexStats(nil, 10))
+}
+
+func TestEstimateSelectivity(t *testing.T) {
+	stats := []StatEntry{
+		{Word: "cat", NDoc: 50, NEntry: 80},
+		{Word: "cats", NDoc: 20, NEntry: 20},
+		{Word: "dog", NDoc: 10, NEntry: 12},
+		{Word: "the", NDoc: 100, NEntry: 500},
+		{Word: "bogus", NDoc: 200, NEntry: 200},
+	}
+	for _, tc := range []struct {
+		query    string
+		expected float64
+	}{
+		{`cat`, 0.5},
+		{`dog`, 0.1},
+		{`the`, 1},
+		{`bird`, 0},
+		// Document frequencies larger than the total are capped.
+		{`bogus`, 1},
+		// Weights are ignored.
+		{`cat:AB`, 0.5},
+		{`cat & dog`, 0.05},
+		{`cat | dog`, 0.55},
+		{`!cat`, 0.5},
+		{`!dog`, 0.9},
+		{`cat & !dog`, 0.45},
+		{`!(cat & dog)`, 0.95},
+		{`cat <-> dog`, 0.05},
+		{`cat <2> dog & the`, 0.05},
+		{`cat & bird`, 0},
+		{`cat | bird`, 0.5},
+		// A prefix matches any of its lexemes.
+		{`cat:*`, 0.6},
+		{`ca:* & dog`, 0.06},
+		{`do:*`, 0.1},
+		{`bi:*`, 0},
+		{`cat & cat`, 0.25},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		assert.InDelta(t, tc.expected, q.EstimateSelectivity(stats, 100), 1e-9)
+	}
+
+	t.Run("Corpus", func(t *testing.T) {
+		vectors := parseTSVectors(t,
+			`the:1 cat:2 sat:3`,
+			`the:1,4 dog:2 sat:3`,
+			`the:1 bird:2`,
+			`a:1 fish`,
+		)
+		stats := TSStat(vectors)
+		for _, tc := range []struct {
+			query    string
+			expected float64
+		}{
+			{`the`, 0.75},
+			{`sat`, 0.5},
+			{`the & sat`, 0.375},
+			{`cat | dog`, 0.4375},
+		} {
+			q, err := ParseTSQuery(tc.query)
+			require.NoError(t, err)
+			assert.InDelta(t, tc.expected, q.EstimateSelectivity(stats, len(vectors)), 1e-9)
+		}
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		// The estimate doesn't depend on the order of the statistics, and the
+		// statistics aren't modified.
+		var sorted []StatEntry
+		for _, s := range []string{"ca", "cab", "cat", "cats", "catalog", "dog"} {
+			sorted = append(sorted, StatEntry{Word: s, NDoc: len(s) * 7, NEntry: len(s) * 7})
+		}
+		reversed := make([]StatEntry, len(sorted))
+		for i := range sorted {
+			reversed[len(sorted)-1-i] = sorted[i]
+		}
+		original := append([]StatEntry(nil), reversed...)
+		for _, query := range []string{`ca:*`, `cat:*`, `cat`, `catalog | d:*`, `c`} {
+			q, err := ParseTSQuery(query)
+			require.NoError(t, err)
+			expected := q.EstimateSelectivity(sorted, 100)
+			assert.Equal(t, expected, q.EstimateSelectivity(reversed, 100), query)
+		}
+		assert.Equal(t, original, reversed)
+		q, err := ParseTSQuery(`cat:*`)
+		require.NoError(t, err)
+		assert.InDelta(t, 1-(1-0.21)*(1-0.28)*(1-0.49), q.EstimateSelectivity(sorted, 100), 1e-9)
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Zero(t, TSQuery{}.EstimateSelectivity(stats, 100))
+		q, err := ParseTSQuery(`!cat`)
+		require.NoError(t, err)
+		assert.Zero(t, q.EstimateSelectivity(stats, 0))
+		assert.Equal(t, 1.0, q.EstimateSelectivity(nil, 100))
+	})
+}
@@ -13,6 +13,8 @@ package tsearch
 import (
 	"fmt"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
 	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
@@ -65,6 +67,19 @@ func (o tsOperator) precedence() int {
 	panic(errors.AssertionFailedf("no precedence for operator %d", o))
 }
 
+// commutative returns true if the operands of the receiver can be swapped
+// without changing the meaning of the query. Functions that transform query
+// trees must check this before reordering or flattening operands: in
+// particular, followedby is order-sensitive, since a <-> b is not the same as
+// b <-> a, so followedby subtrees must be treated as opaque.
+func (o tsOperator) commutative() bool {
+	switch o {
+	case and, or:
+		return true
+	}
+	return false
+}
+
 // tsNode represents a single AST node within the tree of a TSQuery.
 type tsNode struct {
 	// Only one of term or op will be set.
@@ -85,33 +100,62 @@ type tsNode struct {
 }
 
 func (n tsNode) String() string {
-	return n.infixString(0)
+	var buf strings.Builder
+	n.format(&buf, 0 /* parentPrecedence */, FormatOptions{})
+	return buf.String()
 }
 
-func (n tsNode) infixString(parentPrecedence int) string {
+// format writes the receiver to buf, formatted according to the input
+// options. parentPrecedence is the precedence of the receiver's parent
+// operator, or 0 if the receiver is the root of the tree.
+func (n tsNode) format(buf *strings.Builder, parentPrecedence int, opts FormatOptions) {
 	if n.op == invalid {
-		return n.term.String()
+		buf.WriteString(n.term.String())
+		return
 	}
-	var s strings.Builder
 	prec := n.op.precedence()
-	needParen := prec < parentPrecedence
+	var needParen bool
+	switch opts.Parens {
+	case ParenFull:
+		// Nots bind to their operand without any ambiguity, so they never need
+		// parentheses of their own.
+		needParen = parentPrecedence > 0 && n.op != not
+	default:
+		needParen = prec < parentPrecedence
+	}
 	if needParen {
-		s.WriteString("( ")
+		if opts.CompactOperators {
+			buf.WriteByte('(')
+		} else {
+			buf.WriteString("( ")
+		}
 	}
 	switch n.op {
 	case not:
-		fmt.Fprintf(&s, "!%s", n.l.infixString(prec))
+		buf.WriteByte('!')
+		n.l.format(buf, prec, opts)
 	default:
-		fmt.Fprintf(&s, "%s %s %s",
-			n.l.infixString(prec),
-			tsTerm{operator: n.op, followedN: n.followedN},
-			n.r.infixString(prec),
-		)
+		n.l.format(buf, prec, opts)
+		if !opts.CompactOperators {
+			buf.WriteByte(' ')
+		}
+		if n.op == followedby && opts.NumericFollowedBy {
+			fmt.Fprintf(buf, "<%d>", n.followedN)
+		} else {
+			buf.WriteString(tsTerm{operator: n.op, followedN: n.followedN}.String())
+		}
+		if !opts.CompactOperators {
+			buf.WriteByte(' ')
+		}
+		n.r.format(buf, prec, opts)
 	}
 	if needParen {
-		s.WriteString(" )")
+		if opts.CompactOperators {
+			buf.WriteByte(')')
+		} else {
+			buf.WriteString(" )")
+		}
 	}
-	return s.String()
 }
 
 // UnambiguousString returns a string representation of this tsNode that wraps
@@ -140,33 +184,880 @@ func (q TSQuery) String() string {
 	return q.root.String()
 }
 
+// ParenMode controls where Format places parentheses.
+type ParenMode int
+
+const (
+	// ParenMinimal only places parentheses where they're needed to preserve the
+	// meaning of the query, like String.
+	ParenMinimal ParenMode = iota
+	// ParenFull places parentheses around every binary operator other than the
+	// root of the query, so that readers don't need to know the precedence of
+	// the operators.
+	ParenFull
+)
+
+// FormatOptions controls how Format prints a TSQuery. The zero value produces
+// the same output as String, which is the same as Postgres's.
+type FormatOptions struct {
+	// Parens controls where parentheses are placed.
+	Parens ParenMode
+	// CompactOperators, if set, omits the spaces around binary operators and
+	// inside of parentheses.
+	CompactOperators bool
+	// NumericFollowedBy, if set, prints the <-> operator as <1>.
+	NumericFollowedBy bool
+}
+
+// Format returns a string representation of the receiver, formatted according
+// to the input options. Every output can be parsed back into an equivalent
+// query with ParseTSQuery.
+func (q TSQuery) Format(opts FormatOptions) string {
+	if q.root == nil {
+		return ""
+	}
+	var buf strings.Builder
+	q.root.format(&buf, 0 /* parentPrecedence */, opts)
+	return buf.String()
+}
+
+// PhraseDistances returns the distances of all of the followed by operators in
+// the receiver, in the order in which the operators appear in the query text.
+// For example, the distances of a <-> b | c <3> d <-> e are [1, 3, 1].
+func (q TSQuery) PhraseDistances() []int {
+	var ret []int
+	var walk func(n *tsNode)
+	walk = func(n *tsNode) {
+		if n == nil {
+			return
+		}
+		walk(n.l)
+		if n.op == followedby {
+			ret = append(ret, n.followedN)
+		}
+		walk(n.r)
+	}
+	walk(q.root)
+	return ret
+}
+
+// PhraseSubqueries returns the maximal phrases of the receiver: the subtrees
+// rooted at followed by operators that aren't operands of other followed by
+// operators, in the order in which they appear in the query text, including
+// the ones under not operators. A nested phrase is part of the phrase that
+// contains it, so a <-> (b <-> c) returns the single subquery a <-> (b <-> c),
+// and (a <-> b) & (c <2> d) returns a <-> b and c <2> d. The subqueries share
+// their nodes with the receiver.
+func (q TSQuery) PhraseSubqueries() []TSQuery {
+	var ret []TSQuery
+	var walk func(n *tsNode)
+	walk = func(n *tsNode) {
+		if n == nil {
+			return
+		}
+		if n.op == followedby {
+			ret = append(ret, TSQuery{root: n})
+			return
+		}
+		walk(n.l)
+		walk(n.r)
+	}
+	walk(q.root)
+	return ret
+}
+
+// QueryStats holds the number of nodes of each kind in a TSQuery. It's
+// returned by TSQuery.Stats. The sum of its counts is the number of nodes of
+// the query, which Postgres's numnode returns.
+type QueryStats struct {
+	// Ands, Ors, Nots and Phrases are the numbers of and, or, not and followed
+	// by operators.
+	Ands    int
+	Ors     int
+	Nots    int
+	Phrases int
+	// PrefixTerms is the number of prefix lexemes, like cat:*, and PlainTerms
+	// is the number of other lexemes. Lexemes that appear several times are
+	// counted every time.
+	PrefixTerms int
+	PlainTerms  int
+}
+
+// Stats returns the number of nodes of each kind in the receiver, for
+// estimating the cost of evaluating it.
+func (q TSQuery) Stats() QueryStats {
+	var ret QueryStats
+	var walk func(n *tsNode)
+	walk = func(n *tsNode) {
+		if n == nil {
+			return
+		}
+		switch n.op {
+		case invalid:
+			if len(n.term.positions) > 0 && n.term.positions[0].weight&weightStar != 0 {
+				ret.PrefixTerms++
+			} else {
+				ret.PlainTerms++
+			}
+		case and:
+			ret.Ands++
+		case or:
+			ret.Ors++
+		case not:
+			ret.Nots++
+		case followedby:
+			ret.Phrases++
+		}
+		walk(n.l)
+		walk(n.r)
+	}
+	walk(q.root)
+	return ret
+}
+
+// Equal returns whether the receiver and the input query have the same tree:
+// the same operators and phrase distances, and terms with the same lexemes,
+// prefix flags, weight restrictions and boosts, in the same places. It doesn't
+// know about the commutativity of operators, so a & b isn't equal to b & a.
+// Unlike comparing the strings of the queries, it stops at the first
+// difference.
+func (q TSQuery) Equal(other TSQuery) bool {
+	return q.root.equal(other.root)
+}
+
+func (n *tsNode) equal(o *tsNode) bool {
+	if n == nil || o == nil {
+		return n == o
+	}
+	if n.op != o.op || n.followedN != o.followedN {
+		return false
+	}
+	if n.op == invalid {
+		return n.term.lexeme == o.term.lexeme &&
+			n.term.boost == o.term.boost &&
+			queryTermWeight(&n.term) == queryTermWeight(&o.term)
+	}
+	return n.l.equal(o.l) && n.r.equal(o.r)
+}
+
+// queryTermWeight returns the weight restriction and prefix flag of a TSQuery
+// term.
+func queryTermWeight(t *tsTerm) tsWeight {
+	if len(t.positions) == 0 {
+		return 0
+	}
+	return t.positions[0].weight
+}
+
+// WithoutPhrases returns a copy of the receiver in which every followed by
+// operator is replaced by an and operator. This changes the meaning of the
+// query: the operands of a phrase no longer need to be near each other, or
+// even in order, to match. It's meant for callers that match queries against
+// vectors without positions, which no phrase can match, and that prefer
+// proximity-insensitive matching over no matches at all.
+func (q TSQuery) WithoutPhrases() TSQuery {
+	var rewrite func(n *tsNode) *tsNode
+	rewrite = func(n *tsNode) *tsNode {
+		if n == nil {
+			return nil
+		}
+		if n.op == invalid {
+			return &tsNode{term: n.term}
+		}
+		ret := &tsNode{op: n.op, followedN: n.followedN, l: rewrite(n.l), r: rewrite(n.r)}
+		if ret.op == followedby {
+			ret.op = and
+			ret.followedN = 0
+		}
+		return ret
+	}
+	return TSQuery{root: rewrite(q.root)}
+}
+
+// StripWeights returns a copy of the receiver without the weight restrictions
+// of its terms, so that cat:A becomes cat and cat:*AB becomes cat:*. The
+// prefix flags and boosts of the terms, and the structure of the query, are
+// kept. It's meant for falling back from a weighted query that matches too few
+// documents to a broader one.
+func (q TSQuery) StripWeights() TSQuery {
+	var rewrite func(n *tsNode) *tsNode
+	rewrite = func(n *tsNode) *tsNode {
+		if n == nil {
+			return nil
+		}
+		if n.op != invalid {
+			return &tsNode{op: n.op, followedN: n.followedN, l: rewrite(n.l), r: rewrite(n.r)}
+		}
+		ret := &tsNode{term: tsTerm{lexeme: n.term.lexeme, boost: n.term.boost}}
+		if len(n.term.positions) > 0 && n.term.positions[0].weight&weightStar != 0 {
+			ret.term.positions = []tsPosition{{weight: weightStar}}
+		}
+		return ret
+	}
+	return TSQuery{root: rewrite(q.root)}
+}
+
+// Simplify returns a query like the receiver, but without some of the
+// redundant operands of its and and or operators, such as the ones that
+// template expansion produces. It only makes collapses that are safe for every
+// document, so the result matches exactly the same documents as the receiver,
+// but it may be ranked differently. Within each chain of and operators, like
+// a & b & c:
+//   - An operand that's equal to an earlier operand of the chain, as
+//     determined by Equal, is removed: a & b & a becomes a & b.
+//   - A lexeme that appears in a phrase operand of the chain is removed,
+//     since the phrase can't match without it: a & (a <-> b) becomes a <-> b.
+//     This only applies to phrases whose operands are lexemes and phrases of
+//     lexemes, and to lexemes that the lexeme in the phrase implies: the same
+//     lexeme with the same prefix flag, and weight restrictions that allow
+//     all of the weights that the lexeme in the phrase allows. So a:A & (a <->
+//     b) and a & (!a <-> b) are kept as they are.
+//
+// Within each chain of or operators, like a | b | c, an operand that implies
+// another operand of the chain is removed, since every document that it
+// matches is matched by the other operand: a | (a & b) becomes a, and
+// a | a:A | (a <-> b) becomes a. Of operands that imply each other, like
+// equal operands, the first is kept. The implications that are detected are
+// the ones that follow from the rules above, applied recursively: an operand
+// implies an equal operand, a lexeme that it implies as described above, a
+// chain of and operators whose operands it all implies, and an or operator
+// that has an operand it implies; a chain of and operators implies what any of
+// its operands implies, and an or operator implies what both of its operands
+// imply. Other implications, such as the ones between phrases or through not
+// operators, aren't detected, so the result isn't necessarily minimal:
+// (a <-> b) | (a <-> b <-> c) isn't simplified.
+//
+// Phrases with different distances are never collapsed, even if they have the
+// same operands, since neither of a <-> b and a <2> b implies the other, and
+// no other arithmetic on the distances of phrases is done: a & b & (a <-> b
+// <-> c) becomes a <-> b <-> c, but a <-> b & a <-> b <-> c isn't simplified.
+// The operands of phrases aren't simplified, since the and operators in a
+// phrase apply to positions rather than documents.
+func (q TSQuery) Simplify() TSQuery {
+	return TSQuery{root: simplifyNode(q.root)}
+}
+
+// simplifyNode returns a simplified version of the input node, without
+// modifying it. See Simplify.
+func simplifyNode(n *tsNode) *tsNode {
+	if n == nil {
+		return nil
+	}
+	switch {
+	case n.op.commutative():
+		// Only the operands of commutative operators are collected into chains
+		// and compared with each other. Phrases are opaque operands, so their
+		// operands are never reordered or collapsed.
+		operands := flattenTSNode(n, n.op, nil)
+		for i := range operands {
+			operands[i] = simplifyNode(operands[i])
+		}
+		redundant := make([]bool, len(operands))
+		for i := range operands {
+			if n.op == and {
+				redundant[i] = isRedundantOperand(operands, i)
+			} else {
+				redundant[i] = isSubsumedOperand(operands, redundant, i)
+			}
+		}
+		// Rebuild the chain without the redundant operands, keeping its shape.
+		var i int
+		var rebuild func(c *tsNode) *tsNode
+		rebuild = func(c *tsNode) *tsNode {
+			if c.op == n.op {
+				l, r := rebuild(c.l), rebuild(c.r)
+				if l == nil {
+					return r
+				}
+				if r == nil {
+					return l
+				}
+				return &tsNode{op: n.op, l: l, r: r}
+			}
+			i++
+			if redundant[i-1] {
+				return nil
+			}
+			return operands[i-1]
+		}
+		// The first of the operands that are equal to each other is kept, only
+		// lexemes are removed from chains of and operators in favor of phrases,
+		// and every operand that's removed from a chain of or operators is
+		// implied by an operand that's kept (see isSubsumedOperand), so at least
+		// one operand is kept, and the result isn't nil.
+		return rebuild(n)
+	case n.op == not:
+		return &tsNode{op: not, l: simplifyNode(n.l)}
+	}
+	// The operands of phrases aren't simplified, so phrases, like lexemes, are
+	// shared with the receiver.
+	return n
+}
+
+// isRedundantOperand returns whether the ith of the input operands of a chain
+// of and operators can be removed from the chain. See Simplify.
+func isRedundantOperand(operands []*tsNode, i int) bool {
+	for j := 0; j < i; j++ {
+		if operands[j].equal(operands[i]) {
+			return true
+		}
+	}
+	if operands[i].op != invalid {
+		return false
+	}
+	for _, o := range operands {
+		if o.op == followedby && isSimplePhrase(o) && phraseImpliesTerm(o, &operands[i].term) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubsumedOperand returns whether the ith of the input operands of a chain of
+// or operators can be removed from the chain, because it implies another of
+// the operands that hasn't been removed, given which of the earlier operands
+// have been removed. An operand that's removed in favor of a later operand
+// that's then removed itself is implied by the operand that the later one is
+// removed in favor of, and so on, so every removed operand is implied by an
+// operand that's kept. See Simplify.
+func isSubsumedOperand(operands []*tsNode, removed []bool, i int) bool {
+	for j := range operands {
+		if j == i || removed[j] || !impliesNode(operands[i], operands[j]) {
+			continue
+		}
+		if j < i || !impliesNode(operands[j], operands[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// impliesNode returns whether every document that n matches is also matched by
+// m. It returns false if it can't tell. See Simplify for the implications that
+// are detected.
+func impliesNode(n, m *tsNode) bool {
+	if n.equal(m) {
+		return true
+	}
+	switch m.op {
+	case and:
+		return impliesNode(n, m.l) && impliesNode(n, m.r)
+	case or:
+		if impliesNode(n, m.l) || impliesNode(n, m.r) {
+			return true
+		}
+	}
+	switch n.op {
+	case and:
+		return impliesNode(n.l, m) || impliesNode(n.r, m)
+	case or:
+		return impliesNode(n.l, m) && impliesNode(n.r, m)
+	case invalid, followedby:
+		return m.op == invalid && isSimplePhrase(n) && phraseImpliesTerm(n, &m.term)
+	}
+	return false
+}
+
+// phraseImpliesTerm returns whether one of the lexemes of the input phrase of
+// lexemes implies the input term: whether every lexeme that the phrase's
+// lexeme matches is also matched by the term.
+func phraseImpliesTerm(n *tsNode, term *tsTerm) bool {
+	if n.op != invalid {
+		return phraseImpliesTerm(n.l, term) || phraseImpliesTerm(n.r, term)
+	}
+	if n.term.lexeme != term.lexeme {
+		return false
+	}
+	const allWeights = weightA | weightB | weightC | weightD
+	prefix, mask := queryTermWeights(&n.term)
+	termPrefix, termMask := queryTermWeights(term)
+	if mask == 0 {
+		mask = allWeights
+	}
+	if termMask == 0 {
+		termMask = allWeights
+	}
+	return prefix == termPrefix && mask&^termMask == 0
+}
+
+// ToNNF returns a query that matches the same documents as the receiver, in
+// negation normal form: not operators are pushed down to the leaves with De
+// Morgan's laws, so !(a & b) becomes !a | !b and !(a | b) becomes !a & !b, and
+// double negations are removed, so !(!a) becomes a.
+//
+// Phrases are opaque atoms: not operators aren't distributed through followed
+// by operators, since !(a <-> b) isn't equivalent to any combination of
+// negated operands of the phrase. So !(a <-> b) stays a negated phrase, and
+// the operands of phrases are kept as they are, even if they contain not
+// operators. Lexemes and phrases are shared with the receiver.
+func (q TSQuery) ToNNF() (TSQuery, error) {
+	if q.root == nil {
+		return q, nil
+	}
+	root, err := toNNF(q.root, false /* negate */)
+	if err != nil {
+		return TSQuery{}, err
+	}
+	return TSQuery{root: root}, nil
+}
+
+// toNNF returns the input node in negation normal form, or its negation in
+// negation normal form if negate is true. See ToNNF.
+func toNNF(n *tsNode, negate bool) (*tsNode, error) {
+	switch {
+	case n.op == invalid || n.op == followedby:
+		// Lexemes and phrases, which aren't commutative, are opaque atoms.
+		if negate {
+			return &tsNode{op: not, l: n}, nil
+		}
+		return n, nil
+	case n.op == not:
+		return toNNF(n.l, !negate)
+	case n.op.commutative():
+		l, err := toNNF(n.l, negate)
+		if err != nil {
+			return nil, err
+		}
+		r, err := toNNF(n.r, negate)
+		if err != nil {
+			return nil, err
+		}
+		op := n.op
+		if negate {
+			if op == and {
+				op = or
+			} else {
+				op = and
+			}
+		}
+		return &tsNode{op: op, l: l, r: r}, nil
+	}
+	return nil, errors.AssertionFailedf("invalid operator %d", n.op)
+}
+
+// ExpandTerms returns a copy of the receiver in which every term is replaced
+// by the disjunction of itself and the alternative lexemes that fn returns for
+// its lexeme, such as near-spellings of it, so that cat becomes
+// cat | cot | cart. The alternatives keep the weight restrictions, prefix flag
+// and boost of the term they replace. Alternatives that are empty or that
+// repeat the term or an earlier alternative are ignored, and terms for which fn
+// returns no alternatives are kept as they are.
+//
+// Since the replacement happens at the leaves, negated terms exclude every
+// alternative spelling (!cat becomes !( cat | cot )), and each operand of a
+// phrase may be matched by any of its alternatives (cat <-> dog becomes
+// ( cat | cot ) <-> ( dog | dig )).
+func (q TSQuery) ExpandTerms(fn func(lexeme string) []string) TSQuery {
+	var rewrite func(n *tsNode) *tsNode
+	rewrite = func(n *tsNode) *tsNode {
+		if n == nil {
+			return nil
+		}
+		if n.op != invalid {
+			return &tsNode{op: n.op, followedN: n.followedN, l: rewrite(n.l), r: rewrite(n.r)}
+		}
+		ret := &tsNode{term: n.term}
+		seen := map[string]struct{}{n.term.lexeme: {}}
+		for _, alt := range fn(n.term.lexeme) {
+			if _, ok := seen[alt]; ok || alt == "" {
+				continue
+			}
+			seen[alt] = struct{}{}
+			leaf := &tsNode{term: tsTerm{
+				lexeme:    alt,
+				positions: copyTSPositions(n.term.positions),
+				boost:     n.term.boost,
+			}}
+			ret = &tsNode{op: or, l: ret, r: leaf}
+		}
+		return ret
+	}
+	return TSQuery{root: rewrite(q.root)}
+}
+
+// ExpandPrefixes returns a copy of the receiver in which every prefix term is
+// replaced by the disjunction of the lexemes that it matches, so that cat:*
+// becomes cat | catalog | cats. The lexemes are the ones that lookup returns
+// for the prefix, typically from the lexeme dictionary of an inverted index.
+// The lexemes keep the weight restrictions and boost of the term they replace.
+// Lexemes that are returned by lookup but that don't start with the prefix, or
+// that repeat an earlier lexeme, are ignored. A prefix term that matches no
+// lexemes is kept as it is, since it can't match anything in the dictionary
+// anyway.
+//
+// An error is returned if a prefix matches more than max lexemes, which bounds
+// the number of lexemes that a query can expand to. A max of 0 or less means
+// that there's no limit.
+func (q TSQuery) ExpandPrefixes(lookup func(prefix string) []string, max int) (TSQuery, error) {
+	return q.expandPatterns(
+		"prefix",
+		func(t *tsTerm) (string, bool) {
+			prefix, _ := queryTermWeights(t)
+			return t.lexeme, prefix
+		},
+		lookup,
+		strings.HasPrefix,
+		max,
+	)
+}
+
+// ExpandWildcards returns a copy of the receiver in which every term whose
+// lexeme contains the wildcards * or ? is replaced by the disjunction of the
+// lexemes that it matches, so that c?t becomes cat | cot, and c*t becomes
+// cat | cart | cot. A * matches any sequence of characters, including an empty
+// one, and a ? matches exactly one character. A prefix term with wildcards,
+// like c?t:*, is treated as if its pattern ended with a *. The lexemes are the
+// ones that match returns for the pattern, typically from the lexeme
+// dictionary of an inverted index, and are handled like in ExpandPrefixes:
+// they keep the weight restrictions and boost of the term they replace, the
+// ones that don't match the pattern or that repeat an earlier lexeme are
+// ignored, a term that matches no lexemes is kept as it is, and an error is
+// returned if a term matches more than max lexemes, unless max is 0 or less.
+//
+// This is a non-standard extension: Postgres has no wildcards other than
+// prefixes, and treats * and ? in a lexeme as regular characters. The query
+// parser already keeps those characters in lexemes, so c*t parses as the
+// lexeme 'c*t', which can't match the lexemes of a document, since * and ?
+// separate words. Queries must be expanded before they're evaluated.
+func (q TSQuery) ExpandWildcards(match func(pattern string) []string, max int) (TSQuery, error) {
+	return q.expandPatterns(
+		"wildcard pattern",
+		func(t *tsTerm) (string, bool) {
+			if !strings.ContainsAny(t.lexeme, "*?") {
+				return "", false
+			}
+			if prefix, _ := queryTermWeights(t); prefix {
+				return t.lexeme + "*", true
+			}
+			return t.lexeme, true
+		},
+		match,
+		func(lexeme, pattern string) bool { return matchWildcardPattern(pattern, lexeme) },
+		max,
+	)
+}
+
+// expandPatterns returns a copy of the receiver in which every term for which
+// pattern returns true is replaced by the disjunction of the lexemes that
+// lookup returns for the pattern, and for which matches returns true. See
+// ExpandPrefixes and ExpandWildcards.
+func (q TSQuery) expandPatterns(
+	kind string,
+	pattern func(t *tsTerm) (string, bool),
+	lookup func(pattern string) []string,
+	matches func(lexeme, pattern string) bool,
+	max int,
+) (TSQuery, error) {
+	var rewrite func(n *tsNode) (*tsNode, error)
+	rewrite = func(n *tsNode) (*tsNode, error) {
+		if n == nil {
+			return nil, nil
+		}
+		if n.op != invalid {
+			l, err := rewrite(n.l)
+			if err != nil {
+				return nil, err
+			}
+			r, err := rewrite(n.r)
+			if err != nil {
+				return nil, err
+			}
+			return &tsNode{op: n.op, followedN: n.followedN, l: l, r: r}, nil
+		}
+		p, ok := pattern(&n.term)
+		if !ok {
+			return &tsNode{term: n.term}, nil
+		}
+		_, weight := queryTermWeights(&n.term)
+		var ret *tsNode
+		var count int
+		seen := make(map[string]struct{})
+		for _, lexeme := range lookup(p) {
+			if _, ok := seen[lexeme]; ok || !matches(lexeme, p) {
+				continue
+			}
+			seen[lexeme] = struct{}{}
+			count++
+			if max > 0 && count > max {
+				return nil, pgerror.Newf(pgcode.ProgramLimitExceeded,
+					"%s %q matches too many lexemes (more than %d lexemes)", kind, p, max)
+			}
+			leaf := &tsNode{term: tsTerm{lexeme: lexeme, boost: n.term.boost}}
+			if weight != 0 {
+				leaf.term.positions = []tsPosition{{weight: weight}}
+			}
+			if ret == nil {
+				ret = leaf
+			} else {
+				ret = &tsNode{op: or, l: ret, r: leaf}
+			}
+		}
+		if ret == nil {
+			return &tsNode{term: n.term}, nil
+		}
+		return ret, nil
+	}
+	root, err := rewrite(q.root)
+	if err != nil {
+		return TSQuery{}, err
+	}
+	return TSQuery{root: root}, nil
+}
+
+// matchWildcardPattern returns whether the input lexeme matches the input
+// pattern, in which * matches any sequence of characters and ? matches a
+// single character. See ExpandWildcards.
+func matchWildcardPattern(pattern, lexeme string) bool {
+	// The position in the pattern after the last *, and the position in the
+	// lexeme that the * is matched up to, to backtrack to when the rest of the
+	// pattern doesn't match.
+	starIdx, starLexemeIdx := -1, 0
+	var i, j int
+	for j < len(lexeme) {
+		if i < len(pattern) && pattern[i] == '*' {
+			i++
+			starIdx, starLexemeIdx = i, j
+			continue
+		}
+		if i < len(pattern) && (pattern[i] == '?' || pattern[i] == lexeme[j]) {
+			if pattern[i] == '?' {
+				_, size := utf8.DecodeRuneInString(lexeme[j:])
+				j += size
+			} else {
+				j++
+			}
+			i++
+			continue
+		}
+		if starIdx < 0 {
+			return false
+		}
+		// Make the last * match one more character, and retry the rest of the
+		// pattern after it.
+		_, size := utf8.DecodeRuneInString(lexeme[starLexemeIdx:])
+		starLexemeIdx += size
+		i, j = starIdx, starLexemeIdx
+	}
+	for i < len(pattern) && pattern[i] == '*' {
+		i++
+	}
+	return i == len(pattern)
+}
+
+// IsIndexable returns true if every document that matches the query must
+// contain at least one of the query's lexemes, which means that the query can
+// be evaluated using an inverted index. Queries that can match documents that
+// contain none of their lexemes, such as !cat or cat | !dog, aren't
+// indexable. This is the same classification as Postgres's
+// tsquery_requires_match.
+func (q TSQuery) IsIndexable() bool {
+	if q.root == nil {
+		return false
+	}
+	return q.root.requiresMatch()
+}
+
+// CompatibleWith returns an error if the receiver uses features that the input
+// vector can't support, which would make the query silently fail to match
+// it, or match it regardless of the features, such as when the vector was
+// stripped of its positions or weights by mistake. It's meant as a diagnostic
+// for development and testing:
+//   - A phrase, like a <-> b, can't match a vector none of whose lexemes have
+//     positions.
+//   - A weight restriction, like a:A, is useless against a vector none of
+//     whose positions have a weight other than the default weight D, such as
+//     one that DocumentToTSVector returns before SetWeight is applied, or one
+//     without any positions, whose lexemes satisfy every weight restriction.
+//
+// Prefixes and plain lexemes are supported by every vector. An empty query or
+// vector is compatible with everything.
+func (q TSQuery) CompatibleWith(v TSVector) error {
+	if q.root == nil || len(v) == 0 {
+		return nil
+	}
+	var hasPositions, hasWeights bool
+	for i := range v {
+		hasPositions = hasPositions || len(v[i].positions) > 0
+		for _, pos := range v[i].positions {
+			hasWeights = hasWeights || pos.weight != 0
+		}
+	}
+	if !hasPositions {
+		if n := q.root.find(func(n *tsNode) bool { return n.op == followedby }); n != nil {
+			return pgerror.Newf(pgcode.InvalidParameterValue,
+				"phrase %s can't match a tsvector without positions", n)
+		}
+	}
+	if !hasWeights {
+		if n := q.root.find(func(n *tsNode) bool {
+			if n.op != invalid {
+				return false
+			}
+			_, mask := queryTermWeights(&n.term)
+			return mask != 0
+		}); n != nil {
+			return pgerror.Newf(pgcode.InvalidParameterValue,
+				"weight restriction of %s can't be applied to a tsvector without weights", n)
+		}
+	}
+	return nil
+}
+
+// find returns the first node of the tree rooted at the receiver, in prefix
+// order, for which the input function returns true, or nil if there's none.
+func (n *tsNode) find(fn func(n *tsNode) bool) *tsNode {
+	if n == nil {
+		return nil
+	}
+	if fn(n) {
+		return n
+	}
+	if ret := n.l.find(fn); ret != nil {
+		return ret
+	}
+	return n.r.find(fn)
+}
+
+// requiresMatch returns true if the receiver can only match documents that
+// contain at least one of its lexemes.
+func (n *tsNode) requiresMatch() bool {
+	switch n.op {
+	case invalid:
+		return true
+	case not:
+		// Negations can match documents that contain none of the lexemes. A
+		// double negation could be treated as positive, but Postgres doesn't
+		// bother, and neither do we.
+		return false
+	case and, followedby:
+		// Both operands must match, so it's enough for either of them to
+		// require a lexeme.
+		return n.l.requiresMatch() || n.r.requiresMatch()
+	case or:
+		// Either operand can match on its own, so both of them must require a
+		// lexeme.
+		return n.l.requiresMatch() && n.r.requiresMatch()
+	}
+	panic(errors.AssertionFailedf("unknown operator %d", n.op))
+}
+
 func lexTSQuery(input string) (TSVector, error) {
+	return lexTSQueryWithBoosts(input, false /* boosts */)
+}
+
+// lexTSQueryWithBoosts is like lexTSQuery, but also accepts the boost suffixes
+// of terms if boosts is true.
+func lexTSQueryWithBoosts(input string, boosts bool) (TSVector, error) {
+	ret, _, err := lexTSQueryWithOffsets(input, boosts)
+	return ret, err
+}
+
+// lexTSQueryWithOffsets is like lexTSQueryWithBoosts, but also returns the
+// byte offset into the input of each of the lexed terms and operators.
+func lexTSQueryWithOffsets(input string, boosts bool) (TSVector, []int, error) {
 	parser := tsVectorLexer{
 		input:   input,
 		state:   expectingTerm,
 		tsQuery: true,
+		boosts:  boosts,
 	}
 
-	return parser.lex()
+	ret, err := parser.lex()
+	if err != nil {
+		return ret, nil, err
+	}
+	for i := range ret {
+		// A term with an empty weight list, like foo:, is the same as a term
+		// without one.
+		if positions := ret[i].positions; len(positions) == 1 && positions[0].weight == 0 {
+			ret[i].positions = nil
+		}
+	}
+	return ret, parser.offsets, nil
 }
 
 // ParseTSQuery produces a TSQuery from an input string.
 func ParseTSQuery(input string) (TSQuery, error) {
-	terms, err := lexTSQuery(input)
+	return ParseTSQueryWithConfig(input, Config{})
+}
+
+// ParseTSQueryWithConfig is like ParseTSQuery, but uses the input Config to
+// limit the size of the TSQuery and to enable term boosts.
+func ParseTSQueryWithConfig(input string, cfg Config) (TSQuery, error) {
+	if q, ok := parseSingleLexemeTSQuery(input); ok {
+		return q, nil
+	}
+	terms, offsets, err := lexTSQueryWithOffsets(input, cfg.TermBoosts)
 	if err != nil {
 		return TSQuery{}, err
 	}
+	if err := cfg.checkTSQuerySize(terms); err != nil {
+		return TSQuery{}, err
+	}
 
 	// Now create the operator tree.
-	queryParser := tsQueryParser{terms: terms, input: input}
+	queryParser := tsQueryParser{terms: terms, offsets: offsets, input: input}
 	return queryParser.parse()
 }
 
+// ParseTSQueries parses each of the inputs like ParseTSQuery. It returns
+// parallel slices of queries and errors, so that an input that fails to parse
+// doesn't prevent the others from being parsed: the error for inputs[i] is
+// errs[i], which is nil if the input is valid, in which case its query is
+// queries[i]. errs is nil if every input is valid.
+func ParseTSQueries(inputs []string) (queries []TSQuery, errs []error) {
+	queries = make([]TSQuery, len(inputs))
+	for i, input := range inputs {
+		q, err := ParseTSQuery(input)
+		if err != nil {
+			if errs == nil {
+				errs = make([]error, len(inputs))
+			}
+			errs[i] = err
+			continue
+		}
+		queries[i] = q
+	}
+	return queries, errs
+}
+
+// parseSingleLexemeTSQuery is a fast path for the most common queries, which
+// consist of a single unquoted lexeme without weights or a prefix, like cat.
+// It returns the query and true for such inputs, skipping the lexer and the
+// parser, which produce the same query for them. It returns false for every
+// other input, which must go through the general path.
+func parseSingleLexemeTSQuery(input string) (TSQuery, bool) {
+	lexeme := strings.TrimFunc(input, unicode.IsSpace)
+	if lexeme == "" {
+		return TSQuery{}, false
+	}
+	for _, r := range lexeme {
+		switch r {
+		case '\\', '\'', ':', '^', '&', '|', '!', '<', '(', ')':
+			return TSQuery{}, false
+		case utf8.RuneError:
+			// The lexer replaces invalid UTF-8 with the replacement character,
+			// so leave it to the lexer.
+			return TSQuery{}, false
+		}
+		if unicode.IsSpace(r) {
+			// Several lexemes are a syntax error.
+			return TSQuery{}, false
+		}
+	}
+	return TSQuery{root: &tsNode{term: tsTerm{lexeme: lexeme}}}, true
+}
+
 // tsQueryParser is a parser that operates on a set of lexed tokens, represented
 // as the tsTerms in a TSVector.
 type tsQueryParser struct {
 	input string
 	terms TSVector
+	// offsets holds the byte offset into the input of each of the terms, and
+	// pos is the index of the next term, which are used to report the position
+	// of syntax errors.
+	offsets []int
+	pos     int
 }
 
 func (p tsQueryParser) peek() (*tsTerm, bool) {
@@ -177,6 +1068,9 @@ func (p tsQueryParser) peek() (*tsTerm, bool) {
 }
 
 func (p *tsQueryParser) nextTerm() (*tsTerm, bool) {
+	// The position advances past the end of the terms too, so that the
+	// previous term is always the one that was just consumed, if any.
+	p.pos++
 	if len(p.terms) == 0 {
 		return nil, false
 	}
@@ -191,6 +1085,8 @@ func (p *tsQueryParser) parse() (TSQuery, error) {
 		return TSQuery{}, err
 	}
 	if len(p.terms) > 0 {
+		// The next term is the one that doesn't belong.
+		p.pos++
 		_, err := p.syntaxError()
 		return TSQuery{}, err
 	}
@@ -204,7 +1100,7 @@ func (p *tsQueryParser) parse() (TSQuery, error) {
 func (p *tsQueryParser) parseTSExpr(minBindingPower int) (*tsNode, error) {
 	t, ok := p.nextTerm()
 	if !ok {
-		return nil, pgerror.Newf(pgcode.Syntax, "text-search query doesn't contain lexemes: %s", p.input)
+		return nil, p.parseError(pgerror.Newf(pgcode.Syntax, "text-search query doesn't contain lexemes: %s", p.input))
 	}
 
 	// First section: grab either atoms, nots, or parens.
@@ -223,6 +1119,10 @@ func (p *tsQueryParser) parseTSExpr(minBindingPower int) (*tsNode, error) {
 		}
 		lExpr = expr
 	case not:
+		// Negations bind tighter than every binary operator, so they can be the
+		// operands of followed by operators, like in !a <-> b. Postgres accepts
+		// those too, and evaluates them as a position at which the negated
+		// operand doesn't occur.
 		t, ok := p.nextTerm()
 		if !ok {
 			return p.syntaxError()
@@ -273,5 +1173,20 @@ func (p *tsQueryParser) parseTSExpr(minBindingPower int) (*tsNode, error) {
 }
 
 func (p *tsQueryParser) syntaxError() (*tsNode, error) {
-	return nil, pgerror.Newf(pgcode.Syntax, "syntax error in TSQuery: %s", p.input)
+	return nil, p.parseError(pgerror.Newf(pgcode.Syntax, "syntax error in TSQuery: %s", p.input))
+}
+
+// parseError wraps the input error in a ParseError for the term that was
+// consumed last, or for the end of the input if there are no terms left.
+func (p *tsQueryParser) parseError(err error) error {
+	i := p.pos - 1
+	if i < 0 || i >= len(p.offsets) {
+		return newParseError(err, len(p.input), "")
+	}
+	end := len(p.input)
+	if i+1 < len(p.offsets) {
+		end = p.offsets[i+1]
+	}
+	token := strings.TrimRightFunc(p.input[p.offsets[i]:end], unicode.IsSpace)
+	return newParseError(err, p.offsets[i], token)
 }
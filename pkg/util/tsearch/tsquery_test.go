@@ -15,7 +15,11 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/errors"
 	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -48,7 +52,7 @@ bar   `, `'foo' 'bar'`},
 		{`'\:'`, `':'`},
 		{`'\ '`, `' '`},
 		{`\ `, `' '`},
-		{`\\`, `'\'`},
+		{`\\`, `'\\'`},
 
 		{`blah'blah`, `'blah''blah'`},
 		{`blah'`, `'blah'''`},
@@ -147,7 +151,7 @@ func TestParseTSQuery(t *testing.T) {
 		{`'\:'`, `':'`},
 		{`'\ '`, `' '`},
 		{`\ `, `' '`},
-		{`\\`, `'\'`},
+		{`\\`, `'\\'`},
 
 		{`blah'blah`, `'blah''blah'`},
 		{`blah'`, `'blah'''`},
@@ -176,6 +180,19 @@ func TestParseTSQuery(t *testing.T) {
 		{`(foo)`, `'foo'`},
 		{`((foo))`, `'foo'`},
 
+		{`'foo bar':A`, `'foo bar':A`},
+		{`'foo bar':*ab`, `'foo bar':*AB`},
+		{`'foo bar':A<->x`, `'foo bar':A <-> 'x'`},
+		{`'foo bar':A <-> x`, `'foo bar':A <-> 'x'`},
+		{`foo:A|bar:*`, `'foo':A | 'bar':*`},
+		{`foo:*&!bar:B`, `'foo':* & !'bar':B`},
+		{`(foo:A)`, `'foo':A`},
+		{`('foo':A)&bar`, `'foo':A & 'bar'`},
+		{`'bla''h':B`, `'bla''h':B`},
+		{`'bla''''h'`, `'bla''''h'`},
+		{`foo:`, `'foo'`},
+		{`'foo bar':`, `'foo bar'`},
+
 		{`!(a | !b)`, `!( 'a' | !'b' )`},
 		{`!(a | (b & c))`, `!( 'a' | 'b' & 'c' )`},
 		{`a & b & c`, `'a' & 'b' & 'c'`},
@@ -184,6 +201,11 @@ func TestParseTSQuery(t *testing.T) {
 		{`a <-> (d <0> !x | y)`, `'a' <-> ( 'd' <0> !'x' | 'y' )`},
 		{`(a) | b`, `'a' | 'b'`},
 		{`!a | b`, `!'a' | 'b'`},
+		// Like Postgres, negations are accepted as the operands of phrases.
+		{`!a <-> b`, `!'a' <-> 'b'`},
+		{`a <-> !b`, `'a' <-> !'b'`},
+		{`!(a) <-> b`, `!'a' <-> 'b'`},
+		{`!(a <-> b) <2> !c`, `!( 'a' <-> 'b' ) <2> !'c'`},
 
 		{`(b & c) <-> (d <0> !x | y)`, `( 'b' & 'c' ) <-> ( 'd' <0> !'x' | 'y' )`},
 		{`a | (b & c) <-> (d <0> !x | y)`, `'a' | ( 'b' & 'c' ) <-> ( 'd' <0> !'x' | 'y' )`},
@@ -197,6 +219,15 @@ func TestParseTSQuery(t *testing.T) {
 		assert.Equal(t, tc.expectedStr, actual)
 	}
 
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, tc := range tcs {
+			t.Log(tc.expectedStr)
+			query, err := ParseTSQuery(tc.expectedStr)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStr, query.String())
+		}
+	})
+
 	t.Run("ComparePG", func(t *testing.T) {
 		// This test can be manually run by pointing it to a local Postgres. There
 		// are no requirements for the contents of the local Postgres - it just runs
@@ -211,11 +242,6 @@ func TestParseTSQuery(t *testing.T) {
 			var actual string
 			row := conn.QueryRow(context.Background(), "SELECT $1::TSQuery", tc.input)
 			require.NoError(t, row.Scan(&actual))
-			// To make sure that our tests behave as expected, we need to remove
-			// doubled backslashes from Postgres's output. Confusingly, even in the
-			// protocol that pgx uses, the actual text returned for a string
-			// containing a backslash doubles all backslash literals.
-			actual = strings.ReplaceAll(actual, `\\`, `\`)
 			assert.Equal(t, tc.expectedStr, actual)
 		}
 	})
@@ -242,6 +268,71 @@ func TestParseTSQueryAssociativity(t *testing.T) {
 	}
 }
 
+func TestParseTSQueryWeightSuffix(t *testing.T) {
+	tcs := []struct {
+		input       string
+		expectedStr string
+	}{
+		{`a:`, `'a'`},
+		{`a:*`, `'a':*`},
+		{`a:**`, `'a':*`},
+		{`a:A`, `'a':A`},
+		{`a:a`, `'a':A`},
+		{`a:AA`, `'a':A`},
+		{`a:D`, `'a':D`},
+		{`a:dD`, `'a':D`},
+		{`a:*A`, `'a':*A`},
+		{`a:A*`, `'a':*A`},
+		{`a:*a`, `'a':*A`},
+		{`a:A*B`, `'a':*AB`},
+		{`a:ba*`, `'a':*AB`},
+		{`a:*A*`, `'a':*A`},
+		{`a:DCBA`, `'a':ABCD`},
+		{`a:dcba*`, `'a':*ABCD`},
+		{`'a b':c*`, `'a b':*C`},
+		{`a:*A&b:B*`, `'a':*A & 'b':*B`},
+		{`a:Ab|b:*`, `'a':AB | 'b':*`},
+		{`a:* <-> b:c`, `'a':* <-> 'b':C`},
+		{`!a:B*`, `!'a':*B`},
+		{`(a:C*)`, `'a':*C`},
+	}
+	for _, tc := range tcs {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expectedStr, q.String())
+
+		// The canonical form parses back to the same query.
+		q2, err := ParseTSQuery(tc.expectedStr)
+		require.NoError(t, err)
+		assert.Equal(t, q, q2)
+	}
+
+	for _, input := range []string{`a:x`, `a:A:B`, `a:*E`, `a :*`, `a:1`} {
+		t.Log(input)
+		_, err := ParseTSQuery(input)
+		assert.Error(t, err)
+	}
+
+	t.Run("ComparePG", func(t *testing.T) {
+		// This test can be manually run by pointing it to a local Postgres. There
+		// are no requirements for the contents of the local Postgres - it just runs
+		// expressions. The test validates that all of the test cases in this test
+		// file work the same in Postgres as they do this package.
+		skip.IgnoreLint(t, "need to manually enable")
+		conn, err := pgx.Connect(context.Background(), "postgresql://jordan@localhost:5432")
+		require.NoError(t, err)
+		for _, tc := range tcs {
+			t.Log(tc)
+
+			var actual string
+			row := conn.QueryRow(context.Background(), "SELECT $1::TSQuery", tc.input)
+			require.NoError(t, row.Scan(&actual))
+			assert.Equal(t, tc.expectedStr, actual)
+		}
+	})
+}
+
 func TestParseTSQueryError(t *testing.T) {
 	for _, tc := range []string{
 		``,
@@ -273,5 +364,1078 @@ func TestParseTSQueryError(t *testing.T) {
 		t.Log(tc)
 		_, err := ParseTSQuery(tc)
 		assert.Error(t, err)
+		var parseErr *ParseError
+		assert.True(t, errors.As(err, &parseErr))
+		assert.Equal(t, pgcode.Syntax, pgerror.GetPGCode(err))
+	}
+
+	t.Run("Position", func(t *testing.T) {
+		for _, tc := range []struct {
+			input    string
+			position int
+			token    string
+		}{
+			{``, 0, ``},
+			{`   `, 3, ``},
+			{`foo bar`, 4, `bar`},
+			{`foo & bar baz`, 10, `baz`},
+			{`foo & 'bar baz'  qux`, 17, `qux`},
+			{`foo &`, 5, ``},
+			{`& foo`, 0, `&`},
+			{`foo & | bar`, 6, `|`},
+			{`foo <-> <3> bar`, 8, `<3>`},
+			{`(foo`, 4, ``},
+			{`(foo bar)`, 5, `bar`},
+			{`foo )`, 4, `)`},
+			{`!&`, 1, `&`},
+			{`foo:A,B`, 5, `,`},
+			{`foo:Z`, 4, `Z`},
+			{`foo <x> bar`, 5, `x`},
+			{`foo <1 bar`, 6, ` `},
+			{`'foo`, 4, ``},
+			{`über & ! ) straße`, 10, `)`},
+			{`foo\:bar & ü:*A <-> bär:B baz`, 28, `baz`},
+		} {
+			t.Log(tc.input)
+			_, err := ParseTSQuery(tc.input)
+			require.Error(t, err)
+			var parseErr *ParseError
+			require.True(t, errors.As(err, &parseErr))
+			assert.Equal(t, tc.position, parseErr.Position)
+			assert.Equal(t, tc.token, parseErr.Token)
+			// The error message isn't affected.
+			assert.Equal(t, parseErr.Error(), parseErr.Cause().Error())
+		}
+	})
+
+	t.Run("ToTSQuery", func(t *testing.T) {
+		_, err := ToTSQuery("simple", `Foo Bar`)
+		var parseErr *ParseError
+		require.True(t, errors.As(err, &parseErr))
+		assert.Equal(t, 4, parseErr.Position)
+		assert.Equal(t, `Bar`, parseErr.Token)
+	})
+
+	t.Run("EncodeDecode", func(t *testing.T) {
+		ctx := context.Background()
+		_, err := ParseTSQuery(`foo & 'bar baz'  qux`)
+		require.Error(t, err)
+		decoded := errors.DecodeError(ctx, errors.EncodeError(ctx, err))
+		var parseErr *ParseError
+		require.True(t, errors.As(decoded, &parseErr))
+		assert.Equal(t, 17, parseErr.Position)
+		assert.Equal(t, `qux`, parseErr.Token)
+		assert.Equal(t, err.Error(), decoded.Error())
+		assert.Equal(t, pgcode.Syntax, pgerror.GetPGCode(decoded))
+	})
+}
+
+func TestParseTSQueries(t *testing.T) {
+	inputs := []string{`cat & dog`, `cat &`, `fat:* <-> rat`, `(a`, ``, `'x':A`}
+	queries, errs := ParseTSQueries(inputs)
+	require.Len(t, queries, len(inputs))
+	require.Len(t, errs, len(inputs))
+	for i, input := range inputs {
+		t.Log(input)
+		expected, expectedErr := ParseTSQuery(input)
+		if expectedErr != nil {
+			require.Error(t, errs[i])
+			assert.Equal(t, expectedErr.Error(), errs[i].Error())
+			assert.Equal(t, TSQuery{}, queries[i])
+			continue
+		}
+		require.NoError(t, errs[i])
+		assert.Equal(t, expected, queries[i])
+	}
+	assert.Error(t, errs[1])
+	assert.Error(t, errs[3])
+
+	queries, errs = ParseTSQueries([]string{`a`, `b | c`})
+	assert.Nil(t, errs)
+	require.Len(t, queries, 2)
+	assert.Equal(t, `'b' | 'c'`, queries[1].String())
+
+	queries, errs = ParseTSQueries(nil)
+	assert.Empty(t, queries)
+	assert.Nil(t, errs)
+}
+
+func TestParseTSQueryBoosts(t *testing.T) {
+	cfg := Config{TermBoosts: true}
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`a^2`, `'a'^2`},
+		{`a^1`, `'a'^1`},
+		{`a^0.5 & b`, `'a'^0.5 & 'b'`},
+		{`a^2|b^3`, `'a'^2 | 'b'^3`},
+		{`'fat cat'^2 <-> c`, `'fat cat'^2 <-> 'c'`},
+		{`a:A^2`, `'a':A^2`},
+		{`a:*B^1.5&!b`, `'a':*B^1.5 & !'b'`},
+		{`(a^2)`, `'a'^2`},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQueryWithConfig(tc.input, cfg)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.String())
+
+		// The output can be parsed back with boosts enabled.
+		roundTrip, err := ParseTSQueryWithConfig(q.String(), cfg)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, roundTrip.String())
+	}
+
+	for _, input := range []string{`a^`, `a^0`, `a^-1`, `a^x`, `a^1.2.3`, `a^2b`, `^2`} {
+		t.Log(input)
+		_, err := ParseTSQueryWithConfig(input, cfg)
+		assert.Error(t, err)
+	}
+
+	// Without boosts, ^ is an ordinary character.
+	q, err := ParseTSQuery(`a^2`)
+	require.NoError(t, err)
+	assert.Equal(t, `'a^2'`, q.String())
+}
+
+func TestTSOperatorCommutative(t *testing.T) {
+	assert.True(t, and.commutative())
+	assert.True(t, or.commutative())
+	assert.False(t, followedby.commutative())
+	assert.False(t, not.commutative())
+}
+
+func TestTSQueryIsIndexable(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected bool
+	}{
+		{`cat`, true},
+		{`cat:*`, true},
+		{`!cat`, false},
+		{`!(!cat)`, false},
+		{`!(cat & dog)`, false},
+		{`cat & dog`, true},
+		{`cat & !dog`, true},
+		{`!cat & !dog`, false},
+		{`cat | dog`, true},
+		{`cat | !dog`, false},
+		{`!cat | dog`, false},
+		{`cat <-> dog`, true},
+		{`cat <-> !dog`, true},
+		{`!cat <-> !dog`, false},
+		{`(cat | !dog) & rat`, true},
+		{`(cat | !dog) & !rat`, false},
+		{`(cat & !dog) | (rat <2> bat)`, true},
+		{`(cat & !dog) | !(rat <2> bat)`, false},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.IsIndexable())
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.False(t, TSQuery{}.IsIndexable())
+	})
+}
+
+func TestTSQueryCompatibleWith(t *testing.T) {
+	full, err := ParseTSVector(`cat:1A dog:2 rat:3B`)
+	require.NoError(t, err)
+	unweighted, err := ParseTSVector(`cat:1 dog:2 rat:3`)
+	require.NoError(t, err)
+	stripped, err := ParseTSVector(`cat dog rat`)
+	require.NoError(t, err)
+	vectors := map[string]TSVector{
+		"full":       full,
+		"unweighted": unweighted,
+		"stripped":   stripped,
+		"empty":      {},
+	}
+	for _, tc := range []struct {
+		query string
+		// errors maps the names of the vectors that the query isn't compatible
+		// with to the expected error.
+		errors map[string]string
+	}{
+		{`cat`, nil},
+		{`ca:*`, nil},
+		{`cat & !dog | rat`, nil},
+		{`cat <-> dog`, map[string]string{
+			"stripped": `phrase 'cat' <-> 'dog' can't match a tsvector without positions`,
+		}},
+		{`rat | !(cat <2> ca:*)`, map[string]string{
+			"stripped": `phrase 'cat' <2> 'ca':* can't match a tsvector without positions`,
+		}},
+		{`cat:A & dog`, map[string]string{
+			"unweighted": `weight restriction of 'cat':A can't be applied to a tsvector without weights`,
+			"stripped":   `weight restriction of 'cat':A can't be applied to a tsvector without weights`,
+		}},
+		{`ca:*AB`, map[string]string{
+			"unweighted": `weight restriction of 'ca':*AB can't be applied to a tsvector without weights`,
+			"stripped":   `weight restriction of 'ca':*AB can't be applied to a tsvector without weights`,
+		}},
+		{`cat:A <-> dog`, map[string]string{
+			"unweighted": `weight restriction of 'cat':A can't be applied to a tsvector without weights`,
+			"stripped":   `phrase 'cat':A <-> 'dog' can't match a tsvector without positions`,
+		}},
+	} {
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		for name, v := range vectors {
+			t.Log(tc.query, name)
+			err := q.CompatibleWith(v)
+			if expected, ok := tc.errors[name]; ok {
+				require.Error(t, err)
+				assert.Equal(t, expected, err.Error())
+				assert.Equal(t, pgcode.InvalidParameterValue, pgerror.GetPGCode(err))
+			} else {
+				assert.NoError(t, err)
+			}
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.NoError(t, TSQuery{}.CompatibleWith(stripped))
+	})
+}
+
+func TestTSQueryFormat(t *testing.T) {
+	full := FormatOptions{Parens: ParenFull}
+	compact := FormatOptions{CompactOperators: true}
+	numeric := FormatOptions{NumericFollowedBy: true}
+	all := FormatOptions{Parens: ParenFull, CompactOperators: true, NumericFollowedBy: true}
+	for _, tc := range []struct {
+		input    string
+		opts     FormatOptions
+		expected string
+	}{
+		{`a`, full, `'a'`},
+		{`a & b`, full, `'a' & 'b'`},
+		{`a & b | c`, FormatOptions{}, `'a' & 'b' | 'c'`},
+		{`a & b | c`, full, `( 'a' & 'b' ) | 'c'`},
+		{`a & (b | c)`, full, `'a' & ( 'b' | 'c' )`},
+		{`!a & !(b | c)`, full, `!'a' & !( 'b' | 'c' )`},
+		{`a <-> b <-> c`, full, `'a' <-> ( 'b' <-> 'c' )`},
+		{`a & b | c`, compact, `'a'&'b'|'c'`},
+		{`a & (b | c)`, compact, `'a'&('b'|'c')`},
+		{`a <-> b:*A`, compact, `'a'<->'b':*A`},
+		{`a <-> b <2> c`, numeric, `'a' <1> 'b' <2> 'c'`},
+		{`a <-> b`, FormatOptions{}, `'a' <-> 'b'`},
+		{`a <-> b | !(c & d)`, all, `('a'<1>'b')|!('c'&'d')`},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		actual := q.Format(tc.opts)
+		assert.Equal(t, tc.expected, actual)
+
+		// The output must parse back into the same query.
+		roundTripped, err := ParseTSQuery(actual)
+		require.NoError(t, err)
+		assert.Equal(t, q.root.UnambiguousString(), roundTripped.root.UnambiguousString())
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, ``, TSQuery{}.Format(all))
+	})
+}
+
+func TestTSQueryPhraseDistances(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected []int
+	}{
+		{`a`, nil},
+		{`a & b | !c`, nil},
+		{`a <-> b`, []int{1}},
+		{`a <0> b`, []int{0}},
+		{`a <-> b | c <3> d <-> e`, []int{1, 3, 1}},
+		{`(a <2> b) <5> c`, []int{2, 5}},
+		{`a <2> (b <5> c)`, []int{2, 5}},
+		{`!(a <10> b) & (c | d <-> e)`, []int{10, 1}},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.PhraseDistances())
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Nil(t, TSQuery{}.PhraseDistances())
+	})
+}
+
+func TestTSQueryPhraseSubqueries(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected []string
+	}{
+		{`a`, nil},
+		{`a & b | !c`, nil},
+		{`a <-> b`, []string{`'a' <-> 'b'`}},
+		{`a <-> (b <-> c)`, []string{`'a' <-> 'b' <-> 'c'`}},
+		{`(a <2> b) <5> c`, []string{`'a' <2> 'b' <5> 'c'`}},
+		{`a <-> (b & c <2> d)`, []string{`'a' <-> ( 'b' & 'c' <2> 'd' )`}},
+		{`(a <-> b) & (c <2> d)`, []string{`'a' <-> 'b'`, `'c' <2> 'd'`}},
+		{`a <-> b | c <3> d <-> e`, []string{`'a' <-> 'b'`, `'c' <3> 'd' <-> 'e'`}},
+		{`!(a <10> b) & (c | d:* <-> e)`, []string{`'a' <10> 'b'`, `'d':* <-> 'e'`}},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		var actual []string
+		for _, sub := range q.PhraseSubqueries() {
+			actual = append(actual, sub.String())
+		}
+		assert.Equal(t, tc.expected, actual)
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Nil(t, TSQuery{}.PhraseSubqueries())
+	})
+}
+
+func TestTSQueryStats(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected QueryStats
+	}{
+		{`a`, QueryStats{PlainTerms: 1}},
+		{`a:*`, QueryStats{PrefixTerms: 1}},
+		{`a:*AB & b:C`, QueryStats{Ands: 1, PrefixTerms: 1, PlainTerms: 1}},
+		{`a & b | !c`, QueryStats{Ands: 1, Ors: 1, Nots: 1, PlainTerms: 3}},
+		{`!(a <2> b:*) & (a | d <-> e)`, QueryStats{Ands: 1, Ors: 1, Nots: 1, Phrases: 2, PrefixTerms: 1, PlainTerms: 4}},
+		{`!(!a)`, QueryStats{Nots: 2, PlainTerms: 1}},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.Stats())
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, QueryStats{}, TSQuery{}.Stats())
+	})
+}
+
+func TestTSQueryEqual(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{`a`, `a`, true},
+		{`a`, `b`, false},
+		{`a:*`, `a:*`, true},
+		{`a:*`, `a`, false},
+		{`a:AB`, `a:BA`, true},
+		{`a:A`, `a:B`, false},
+		{`a:A`, `a`, false},
+		{`a:*A`, `a:A`, false},
+		{`a^2`, `a^2`, true},
+		{`a^2`, `a`, false},
+		{`a^2`, `a^3`, false},
+		{`a & b`, `a&b`, true},
+		{`a & b`, `a | b`, false},
+		{`a & b`, `b & a`, false},
+		{`a <-> b`, `a <-> b`, true},
+		{`a <-> b`, `a <1> b`, true},
+		{`a <-> b`, `b <-> a`, false},
+		{`a <-> b`, `a <2> b`, false},
+		{`a <-> b`, `a & b`, false},
+		{`!a & b`, `!a & b`, true},
+		{`!a & b`, `a & b`, false},
+		{`(a | b) & c`, `a | b & c`, false},
+		{`(a <-> b) <-> c`, `a <-> (b <-> c)`, false},
+	} {
+		t.Log(tc)
+		a, err := ParseTSQueryWithConfig(tc.a, Config{TermBoosts: true})
+		require.NoError(t, err)
+		b, err := ParseTSQueryWithConfig(tc.b, Config{TermBoosts: true})
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, a.Equal(b))
+		assert.Equal(t, tc.expected, b.Equal(a))
+		assert.True(t, a.Equal(a))
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		q, err := ParseTSQuery(`a`)
+		require.NoError(t, err)
+		assert.True(t, TSQuery{}.Equal(TSQuery{}))
+		assert.False(t, TSQuery{}.Equal(q))
+		assert.False(t, q.Equal(TSQuery{}))
+	})
+}
+
+func TestTSQueryWithoutPhrases(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`a`, `'a'`},
+		{`a & b | !c`, `'a' & 'b' | !'c'`},
+		{`a <-> b`, `'a' & 'b'`},
+		{`a <3> b:*A`, `'a' & 'b':*A`},
+		{`a <-> b | c`, `'a' & 'b' | 'c'`},
+		{`(a | b) <-> c`, `( 'a' | 'b' ) & 'c'`},
+		{`!(a <-> b)`, `!( 'a' & 'b' )`},
+		{`a <-> !b`, `'a' & !'b'`},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		original := q.String()
+		actual := q.WithoutPhrases()
+		assert.Equal(t, tc.expected, actual.String())
+		assert.Empty(t, actual.PhraseDistances())
+		// The receiver isn't modified.
+		assert.Equal(t, original, q.String())
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, ``, TSQuery{}.WithoutPhrases().String())
+	})
+
+	t.Run("Eval", func(t *testing.T) {
+		// A vector without positions can't match a phrase, but it can match the
+		// phrase without its proximity requirement.
+		q, err := ParseTSQuery(`quick <-> fox`)
+		require.NoError(t, err)
+		v, err := ParseTSVector(`fox quick`)
+		require.NoError(t, err)
+		matches, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		assert.False(t, matches)
+		matches, err = EvalTSQuery(q.WithoutPhrases(), v)
+		require.NoError(t, err)
+		assert.True(t, matches)
+	})
+}
+
+func TestTSQueryStripWeights(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`a`, `'a'`},
+		{`a:A`, `'a'`},
+		{`a:*`, `'a':*`},
+		{`a:*AB`, `'a':*`},
+		{`a:BC & !b:D | c:*A`, `'a' & !'b' | 'c':*`},
+		{`a:A <3> ( b:B | c:*C )`, `'a' <3> ( 'b' | 'c':* )`},
+		{`a:A^2 & b^0.5`, `'a'^2 & 'b'^0.5`},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQueryWithConfig(tc.input, Config{TermBoosts: true})
+		require.NoError(t, err)
+		original := q.String()
+		assert.Equal(t, tc.expected, q.StripWeights().String())
+		// The receiver isn't modified.
+		assert.Equal(t, original, q.String())
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, ``, TSQuery{}.StripWeights().String())
+	})
+
+	t.Run("Eval", func(t *testing.T) {
+		q, err := ParseTSQuery(`quick:A <-> fox:*A`)
+		require.NoError(t, err)
+		v, err := ParseTSVector(`quick:1A foxes:2B`)
+		require.NoError(t, err)
+		matches, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		assert.False(t, matches)
+		matches, err = EvalTSQuery(q.StripWeights(), v)
+		require.NoError(t, err)
+		assert.True(t, matches)
+	})
+}
+
+func TestTSQueryToNNF(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`a`, `'a'`},
+		{`!a`, `!'a'`},
+		{`!(!a)`, `'a'`},
+		{`!(!(!a))`, `!'a'`},
+		{`a & b`, `'a' & 'b'`},
+		{`!(a & b)`, `!'a' | !'b'`},
+		{`!(a | b)`, `!'a' & !'b'`},
+		{`!(a & !b)`, `!'a' | 'b'`},
+		{`!(a & (b | !c))`, `!'a' | !'b' & 'c'`},
+		{`!(!(a & b))`, `'a' & 'b'`},
+		{`a | !(b & !(c | d))`, `'a' | !'b' | 'c' | 'd'`},
+		{`a:A & !(b:* | c:B)`, `'a':A & !'b':* & !'c':B`},
+		// Phrases are opaque atoms.
+		{`!(a <-> b)`, `!( 'a' <-> 'b' )`},
+		{`!(!(a <-> b))`, `'a' <-> 'b'`},
+		{`!(a & (b <2> c))`, `!'a' | !( 'b' <2> 'c' )`},
+		{`!a <-> b`, `!'a' <-> 'b'`},
+		{`!(!a <-> !(b | c))`, `!( !'a' <-> !( 'b' | 'c' ) )`},
+	} {
+		t.Run(tc.input, func(t *testing.T) {
+			q, err := ParseTSQuery(tc.input)
+			require.NoError(t, err)
+			before := q.String()
+			actual, err := q.ToNNF()
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual.String())
+			// The receiver isn't modified.
+			assert.Equal(t, before, q.String())
+
+			// The query in negation normal form matches the same documents.
+			for _, doc := range []string{``, `a`, `b`, `a:1 b:2`, `b:1 a:2`, `a:1A c:2`, `b:1 c:3`, `a b c d`} {
+				v, err := ParseTSVector(doc)
+				require.NoError(t, err)
+				expected, err := EvalTSQuery(q, v)
+				require.NoError(t, err)
+				matches, err := EvalTSQuery(actual, v)
+				require.NoError(t, err)
+				assert.Equal(t, expected, matches, doc)
+			}
+		})
+	}
+
+	actual, err := TSQuery{}.ToNNF()
+	require.NoError(t, err)
+	assert.Equal(t, ``, actual.String())
+}
+
+func TestTSQuerySimplify(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`a`, `'a'`},
+		{`a & b`, `'a' & 'b'`},
+		{`a & a`, `'a'`},
+		{`a & b & a & b`, `'a' & 'b'`},
+		{`a & (b & a)`, `'a' & 'b'`},
+		{`(a & b) & (c & a)`, `'a' & 'b' & 'c'`},
+		{`a:A & a`, `'a':A & 'a'`},
+		{`a:* & a`, `'a':* & 'a'`},
+		{`a:AB & a:BA`, `'a':AB`},
+		{`!a & !a`, `!'a'`},
+		{`(a | b) & (a | b)`, `'a' | 'b'`},
+		{`(a | b) & (b | a)`, `( 'a' | 'b' ) & ( 'b' | 'a' )`},
+		// Lexemes are removed in favor of the phrases that imply them.
+		{`a & (a <-> b)`, `'a' <-> 'b'`},
+		{`(a <-> b) & b`, `'a' <-> 'b'`},
+		{`a & b & c & (a <-> b)`, `'c' & 'a' <-> 'b'`},
+		{`a & b & (a <-> b <-> c)`, `'a' <-> 'b' <-> 'c'`},
+		{`a & (a:A <-> b)`, `'a':A <-> 'b'`},
+		{`a:AB & (a:A <-> b)`, `'a':A <-> 'b'`},
+		{`a:*A & (a:*A <-> b)`, `'a':*A <-> 'b'`},
+		{`a:A & (a <-> b)`, `'a':A & 'a' <-> 'b'`},
+		{`a:A & (a:AB <-> b)`, `'a':A & 'a':AB <-> 'b'`},
+		{`a & (a:* <-> b)`, `'a' & 'a':* <-> 'b'`},
+		{`a:* & (a <-> b)`, `'a':* & 'a' <-> 'b'`},
+		{`!a & (a <-> b)`, `!'a' & 'a' <-> 'b'`},
+		{`a & (!a <-> b)`, `'a' & !'a' <-> 'b'`},
+		{`a & (a <-> (b | c))`, `'a' & 'a' <-> ( 'b' | 'c' )`},
+		// Phrases are only collapsed if they're equal. Phrases with different
+		// distances don't imply each other, so both are kept.
+		{`(a <-> b) & (a <-> b)`, `'a' <-> 'b'`},
+		{`(a <-> b) & (a <2> b)`, `'a' <-> 'b' & 'a' <2> 'b'`},
+		{`a <-> b & a <2> b`, `'a' <-> 'b' & 'a' <2> 'b'`},
+		{`(a <-> b) & (b <-> a)`, `'a' <-> 'b' & 'b' <-> 'a'`},
+		{`(a <-> b) & (a <-> b <-> c)`, `'a' <-> 'b' & 'a' <-> 'b' <-> 'c'`},
+		// Chains within other operators are simplified too.
+		{`c | a & a`, `'c' | 'a'`},
+		{`!(a & (a <-> b))`, `!( 'a' <-> 'b' )`},
+		{`(a & a) <-> b`, `( 'a' & 'a' ) <-> 'b'`},
+		// Operands of or operators that imply other operands are removed.
+		{`a | a`, `'a'`},
+		{`a | b | a`, `'a' | 'b'`},
+		{`a | (a & b)`, `'a'`},
+		{`(a & b) | a`, `'a'`},
+		{`c | (a & b) | (a & b & c)`, `'c' | 'a' & 'b'`},
+		{`(a & b) | (b & a)`, `'a' & 'b'`},
+		{`a | (a <-> b)`, `'a'`},
+		{`a | a:A | (a <-> b)`, `'a'`},
+		{`a | a:A`, `'a'`},
+		{`a:A | a`, `'a'`},
+		{`a:AB | a:A`, `'a':AB`},
+		{`a:A | a:B`, `'a':A | 'a':B`},
+		{`a:* | a`, `'a':* | 'a'`},
+		{`a | (b | a) & c`, `'a' | ( 'b' | 'a' ) & 'c'`},
+		{`(a | b) | (a & c)`, `'a' | 'b'`},
+		{`(a & (b | c)) | (a & b)`, `'a' & ( 'b' | 'c' )`},
+		{`(a & b) | ((a | b) & b)`, `( 'a' | 'b' ) & 'b'`},
+		{`!a | (!a & b)`, `!'a'`},
+		{`!a | !(a & b)`, `!'a' | !( 'a' & 'b' )`},
+		{`(a <-> b) | (a <-> b <-> c)`, `'a' <-> 'b' | 'a' <-> 'b' <-> 'c'`},
+		{`(a <-> b) | (a <2> b)`, `'a' <-> 'b' | 'a' <2> 'b'`},
+		{`(a | a & b) <-> c`, `( 'a' | 'a' & 'b' ) <-> 'c'`},
+		{`a & (b | b & c)`, `'a' & 'b'`},
+	} {
+		t.Log(tc.input)
+		q, err := ParseTSQuery(tc.input)
+		require.NoError(t, err)
+		original := q.String()
+		simplified := q.Simplify()
+		assert.Equal(t, tc.expected, simplified.String())
+		// The receiver isn't modified.
+		assert.Equal(t, original, q.String())
+
+		// The simplified query matches the same documents.
+		for _, vector := range []string{
+			``, `a`, `a b c`, `a:1 b:2`, `a:1A b:2`, `a:1B b:2`, `b:1 a:2`, `a:1 b:3`, `a:1 b:2 c:3`,
+			`ab:1 b:2`, `a:1A ab:1 b:2`, `a:1,5C b:2,3 c:4`,
+		} {
+			v, err := ParseTSVector(vector)
+			require.NoError(t, err)
+			expected, err := EvalTSQuery(q, v)
+			require.NoError(t, err)
+			actual, err := EvalTSQuery(simplified, v)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual, "vector %s", vector)
+		}
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, ``, TSQuery{}.Simplify().String())
+	})
+}
+
+// TestPhraseOperandOrder checks that every transformation of a query tree
+// preserves the order of the operands of followed by operators.
+func TestTSQueryExpandTerms(t *testing.T) {
+	alternatives := map[string][]string{
+		"cat": {"cot", "cart"},
+		"dog": {"dig", "dog", "", "dig"},
+	}
+	expand := func(lexeme string) []string {
+		return alternatives[lexeme]
+	}
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{`cat`, `'cat' | 'cot' | 'cart'`},
+		{`bird`, `'bird'`},
+		{`dog`, `'dog' | 'dig'`},
+		{`cat & bird`, `( 'cat' | 'cot' | 'cart' ) & 'bird'`},
+		{`!cat`, `!( 'cat' | 'cot' | 'cart' )`},
+		{`cat <-> dog`, `( 'cat' | 'cot' | 'cart' ) <-> ( 'dog' | 'dig' )`},
+		{`cat:*A`, `'cat':*A | 'cot':*A | 'cart':*A`},
+		{`bird | cat`, `'bird' | 'cat' | 'cot' | 'cart'`},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		before := q.String()
+		assert.Equal(t, tc.expected, q.ExpandTerms(expand).String())
+		// The receiver isn't modified.
+		assert.Equal(t, before, q.String())
+	}
+
+	t.Run("Eval", func(t *testing.T) {
+		q, err := ParseTSQuery(`cat <-> dog & !bird`)
+		require.NoError(t, err)
+		q = q.ExpandTerms(expand)
+		for _, tc := range []struct {
+			document string
+			expected bool
+		}{
+			{`the cat dog`, true},
+			{`the cot dig`, true},
+			{`the cart dog bird`, false},
+			{`the dig cot`, false},
+		} {
+			v, err := DocumentToTSVector("simple", tc.document)
+			require.NoError(t, err)
+			actual, err := EvalTSQuery(q, v)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual, tc.document)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.Equal(t, ``, TSQuery{}.ExpandTerms(expand).String())
+	})
+}
+
+func TestTSQueryExpandPrefixes(t *testing.T) {
+	dictionary := []string{"bird", "cat", "catalog", "cats", "dog", "dogs"}
+	lookup := func(prefix string) []string {
+		var ret []string
+		for _, lexeme := range dictionary {
+			if strings.HasPrefix(lexeme, prefix) {
+				ret = append(ret, lexeme)
+			}
+		}
+		return ret
+	}
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{`cat`, `'cat'`},
+		{`cat:*`, `'cat' | 'catalog' | 'cats'`},
+		{`cata:*`, `'catalog'`},
+		{`fish:*`, `'fish':*`},
+		{`cat:*A`, `'cat':A | 'catalog':A | 'cats':A`},
+		{`dog:*^2`, `'dog'^2 | 'dogs'^2`},
+		{`!do:* & bird`, `!( 'dog' | 'dogs' ) & 'bird'`},
+		{`cat:* <-> dog:*`, `( 'cat' | 'catalog' | 'cats' ) <-> ( 'dog' | 'dogs' )`},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQueryWithConfig(tc.query, Config{TermBoosts: true})
+		require.NoError(t, err)
+		before := q.String()
+		actual, err := q.ExpandPrefixes(lookup, 3)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual.String())
+		// The receiver isn't modified.
+		assert.Equal(t, before, q.String())
+	}
+
+	t.Run("Limit", func(t *testing.T) {
+		q, err := ParseTSQuery(`bird | cat:*`)
+		require.NoError(t, err)
+		_, err = q.ExpandPrefixes(lookup, 2)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `prefix "cat" matches too many lexemes (more than 2 lexemes)`)
+		// There's no limit if max isn't positive.
+		actual, err := q.ExpandPrefixes(lookup, 0)
+		require.NoError(t, err)
+		assert.Equal(t, `'bird' | 'cat' | 'catalog' | 'cats'`, actual.String())
+	})
+
+	t.Run("IgnoredLexemes", func(t *testing.T) {
+		q, err := ParseTSQuery(`cat:*`)
+		require.NoError(t, err)
+		// Lexemes that don't match the prefix and repeated lexemes are ignored,
+		// and don't count towards the limit.
+		actual, err := q.ExpandPrefixes(func(string) []string {
+			return []string{"cat", "dog", "cats", "cat", ""}
+		}, 2)
+		require.NoError(t, err)
+		assert.Equal(t, `'cat' | 'cats'`, actual.String())
+	})
+
+	t.Run("Eval", func(t *testing.T) {
+		q, err := ParseTSQuery(`cat:* <-> dog:*`)
+		require.NoError(t, err)
+		expanded, err := q.ExpandPrefixes(lookup, 0)
+		require.NoError(t, err)
+		for _, document := range []string{
+			`the cats dogs`,
+			`the catalog dog`,
+			`the dog cat`,
+			`the cat bird dog`,
+		} {
+			v, err := DocumentToTSVector("simple", document)
+			require.NoError(t, err)
+			expected, err := EvalTSQuery(q, v)
+			require.NoError(t, err)
+			actual, err := EvalTSQuery(expanded, v)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual, document)
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		actual, err := TSQuery{}.ExpandPrefixes(lookup, 1)
+		require.NoError(t, err)
+		assert.Equal(t, ``, actual.String())
+	})
+}
+
+func TestTSQueryExpandWildcards(t *testing.T) {
+	dictionary := []string{"bat", "cart", "cat", "catalog", "cats", "coat", "cot", "ct", "über"}
+	// The lookup returns the whole dictionary, and relies on ExpandWildcards
+	// to filter it.
+	var patterns []string
+	match := func(pattern string) []string {
+		patterns = append(patterns, pattern)
+		return dictionary
+	}
+	for _, tc := range []struct {
+		query    string
+		patterns []string
+		expected string
+	}{
+		{`cat`, nil, `'cat'`},
+		{`cat:*`, nil, `'cat':*`},
+		{`c?t`, []string{`c?t`}, `'cat' | 'cot'`},
+		{`c*t`, []string{`c*t`}, `'cart' | 'cat' | 'coat' | 'cot' | 'ct'`},
+		{`?a*`, []string{`?a*`}, `'bat' | 'cart' | 'cat' | 'catalog' | 'cats'`},
+		{`*`, []string{`*`}, `'bat' | 'cart' | 'cat' | 'catalog' | 'cats' | 'coat' | 'cot' | 'ct' | 'über'`},
+		{`c??t`, []string{`c??t`}, `'cart' | 'coat'`},
+		{`c*a*t`, []string{`c*a*t`}, `'cart' | 'cat' | 'coat'`},
+		{`?ber`, []string{`?ber`}, `'über'`},
+		{`c?t:*`, []string{`c?t*`}, `'cat' | 'catalog' | 'cats' | 'cot'`},
+		{`c?t:A^2`, []string{`c?t`}, `'cat':A^2 | 'cot':A^2`},
+		{`d?g`, []string{`d?g`}, `'d?g'`},
+		{`!b?t & c?t:*B`, []string{`b?t`, `c?t*`}, `!'bat' & ( 'cat':B | 'catalog':B | 'cats':B | 'cot':B )`},
+		{`c??t <-> b?t`, []string{`c??t`, `b?t`}, `( 'cart' | 'coat' ) <-> 'bat'`},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQueryWithConfig(tc.query, Config{TermBoosts: true})
+		require.NoError(t, err)
+		before := q.String()
+		patterns = nil
+		actual, err := q.ExpandWildcards(match, 0)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual.String())
+		assert.Equal(t, tc.patterns, patterns)
+		// The receiver isn't modified.
+		assert.Equal(t, before, q.String())
+	}
+
+	t.Run("Limit", func(t *testing.T) {
+		q, err := ParseTSQuery(`bat | c?t`)
+		require.NoError(t, err)
+		_, err = q.ExpandWildcards(match, 1)
+		require.Error(t, err)
+		assert.Equal(t, pgcode.ProgramLimitExceeded, pgerror.GetPGCode(err))
+		assert.Contains(t, err.Error(), `wildcard pattern "c?t" matches too many lexemes (more than 1 lexemes)`)
+		actual, err := q.ExpandWildcards(match, 2)
+		require.NoError(t, err)
+		assert.Equal(t, `'bat' | 'cat' | 'cot'`, actual.String())
+	})
+
+	t.Run("MatchWildcardPattern", func(t *testing.T) {
+		for _, tc := range []struct {
+			pattern, lexeme string
+			expected        bool
+		}{
+			{``, ``, true},
+			{``, `a`, false},
+			{`*`, ``, true},
+			{`?`, ``, false},
+			{`a`, `a`, true},
+			{`a`, `b`, false},
+			{`a*`, `a`, true},
+			{`*a`, `ba`, true},
+			{`*a`, `ab`, false},
+			{`a*b*c`, `aXbYbZc`, true},
+			{`a*b*c`, `aXbYbZ`, false},
+			{`a**b`, `ab`, true},
+			{`*ab`, `aab`, true},
+			{`?`, `ü`, true},
+			{`??`, `ü`, false},
+			{`ü*`, `über`, true},
+			{`*ü?`, `aüb`, true},
+		} {
+			t.Log(tc)
+			assert.Equal(t, tc.expected, matchWildcardPattern(tc.pattern, tc.lexeme))
+		}
+	})
+}
+
+func TestPhraseOperandOrder(t *testing.T) {
+	noLexemes := func(string) []string { return nil }
+	// Each of the transformations must keep the receiver's string, unless
+	// it's in changesString, in which case it must at least keep the order of
+	// the lexemes.
+	changesString := map[string]bool{"WithoutPhrases": true}
+	transformations := map[string]func(t *testing.T, q TSQuery) TSQuery{
+		"String": func(t *testing.T, q TSQuery) TSQuery {
+			ret, err := ParseTSQuery(q.String())
+			require.NoError(t, err)
+			return ret
+		},
+		"PostgresBinary": func(t *testing.T, q TSQuery) TSQuery {
+			b, err := EncodePostgresTSQuery(nil, q)
+			require.NoError(t, err)
+			ret, err := DecodePostgresTSQuery(b)
+			require.NoError(t, err)
+			return ret
+		},
+		"Proto": func(t *testing.T, q TSQuery) TSQuery {
+			ret, err := TSQueryFromProto(q.ToProto())
+			require.NoError(t, err)
+			return ret
+		},
+		"Format": func(t *testing.T, q TSQuery) TSQuery {
+			ret, err := ParseTSQuery(q.Format(FormatOptions{Parens: ParenFull, NumericFollowedBy: true}))
+			require.NoError(t, err)
+			return ret
+		},
+		"ToTSQuery": func(t *testing.T, q TSQuery) TSQuery {
+			ret, err := ToTSQuery("simple", q.String())
+			require.NoError(t, err)
+			return ret
+		},
+		"Simplify": func(t *testing.T, q TSQuery) TSQuery {
+			return q.Simplify()
+		},
+		"ToNNF": func(t *testing.T, q TSQuery) TSQuery {
+			ret, err := q.ToNNF()
+			require.NoError(t, err)
+			return ret
+		},
+		"StripWeights": func(t *testing.T, q TSQuery) TSQuery {
+			return q.StripWeights()
+		},
+		"WithoutPhrases": func(t *testing.T, q TSQuery) TSQuery {
+			return q.WithoutPhrases()
+		},
+		"ExpandTerms": func(t *testing.T, q TSQuery) TSQuery {
+			return q.ExpandTerms(noLexemes)
+		},
+		"ExpandPrefixes": func(t *testing.T, q TSQuery) TSQuery {
+			ret, err := q.ExpandPrefixes(noLexemes, 0)
+			require.NoError(t, err)
+			return ret
+		},
+		"ExpandWildcards": func(t *testing.T, q TSQuery) TSQuery {
+			ret, err := q.ExpandWildcards(noLexemes, 0)
+			require.NoError(t, err)
+			return ret
+		},
+		"AndAll": func(t *testing.T, q TSQuery) TSQuery {
+			return AndAll(TSQuery{}, q, TSQuery{})
+		},
+		"OrAll": func(t *testing.T, q TSQuery) TSQuery {
+			return OrAll(q)
+		},
+		"ToClauses": func(t *testing.T, q TSQuery) TSQuery {
+			clauses, err := q.ToClauses()
+			if err != nil {
+				// The query can't be represented as clauses.
+				return q
+			}
+			queries := make([]TSQuery, len(clauses))
+			for i := range clauses {
+				queries[i] = clauses[i].Query
+			}
+			return AndAll(queries...)
+		},
+	}
+	lexemes := func(q TSQuery) []string {
+		var ret []string
+		var walk func(n *tsNode)
+		walk = func(n *tsNode) {
+			if n == nil {
+				return
+			}
+			walk(n.l)
+			if n.op == invalid {
+				ret = append(ret, n.term.lexeme)
+			}
+			walk(n.r)
+		}
+		walk(q.root)
+		return ret
+	}
+	for _, input := range []string{
+		`a <-> b`,
+		`a <2> b`,
+		`b <-> a`,
+		`b <2> a`,
+		`c <-> b <-> a`,
+		`(c <-> b) <-> a`,
+		`(c <2> b) <-> a`,
+		`(z | y) <-> (x & w)`,
+		`z & (y <-> x) | w`,
+		`!(b <-> a)`,
+	} {
+		q, err := ParseTSQuery(input)
+		require.NoError(t, err)
+		for name, transform := range transformations {
+			t.Run(name, func(t *testing.T) {
+				t.Log(input)
+				actual := transform(t, q)
+				assert.Equal(t, lexemes(q), lexemes(actual))
+				if !changesString[name] {
+					assert.Equal(t, q.String(), actual.String())
+				}
+			})
+		}
+	}
+}
+
+// parseTSQuerySlow parses the input with the lexer and the parser, without the
+// single lexeme fast path.
+func parseTSQuerySlow(input string, cfg Config) (TSQuery, error) {
+	terms, offsets, err := lexTSQueryWithOffsets(input, cfg.TermBoosts)
+	if err != nil {
+		return TSQuery{}, err
+	}
+	queryParser := tsQueryParser{terms: terms, offsets: offsets, input: input}
+	return queryParser.parse()
+}
+
+func TestParseSingleLexemeTSQuery(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		fast  bool
+	}{
+		{`cat`, true},
+		{`  cat  `, true},
+		{"\tCat\n", true},
+		{`über`, true},
+		{`foo-bar`, true},
+		{`foo*`, true},
+		{`a>b`, true},
+		{"\u00a0cat\u00a0", true},
+		{``, false},
+		{`   `, false},
+		{`cat dog`, false},
+		{`cat:*`, false},
+		{`cat:A`, false},
+		{`'cat'`, false},
+		{`c\at`, false},
+		{`cat^2`, false},
+		{`!cat`, false},
+		{`cat & dog`, false},
+		{`(cat)`, false},
+		{`cat<->dog`, false},
+		{"c\xffat", false},
+	} {
+		t.Log(tc.input)
+		q, ok := parseSingleLexemeTSQuery(tc.input)
+		assert.Equal(t, tc.fast, ok)
+		if !ok {
+			continue
+		}
+		for _, cfg := range []Config{{}, {TermBoosts: true}, {MaxQueryNodes: 1}} {
+			expected, err := parseTSQuerySlow(tc.input, cfg)
+			require.NoError(t, err)
+			assert.Equal(t, expected, q)
+		}
+	}
+
+	t.Run("Random", func(t *testing.T) {
+		// The fast path must never change the result of parsing.
+		const alphabet = "ab \t:*&|!<>()-'\\^2A\xff\u00a0ü"
+		rng, _ := randutil.NewTestRand()
+		for i := 0; i < 10000; i++ {
+			input := make([]byte, rng.Intn(8))
+			for j := range input {
+				input[j] = alphabet[rng.Intn(len(alphabet))]
+			}
+			for _, cfg := range []Config{{}, {TermBoosts: true}} {
+				expected, expectedErr := parseTSQuerySlow(string(input), cfg)
+				actual, err := ParseTSQueryWithConfig(string(input), cfg)
+				if expectedErr != nil {
+					require.Error(t, err, "%q", input)
+					continue
+				}
+				require.NoError(t, err, "%q", input)
+				require.Equal(t, expected, actual, "%q", input)
+			}
+		}
+	})
+}
+
+func BenchmarkParseTSQuery(b *testing.B) {
+	for _, input := range []string{`cat`, `cat & dog`} {
+		b.Run(input, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseTSQuery(input); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
 	}
 }
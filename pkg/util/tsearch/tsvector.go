@@ -11,10 +11,17 @@
 package tsearch
 
 import (
+	"container/heap"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+	"github.com/cockroachdb/errors"
 )
 
 // This file defines the TSVector data structure, which is used to implement
@@ -85,6 +92,97 @@ func (w tsWeight) String() string {
 	return ret.String()
 }
 
+// tsWeightFromByte returns the tsWeight corresponding to the input weight
+// label, which may be any of A, B, C or D, in either case.
+func tsWeightFromByte(b byte) (tsWeight, error) {
+	switch b {
+	case 'a', 'A':
+		return weightA, nil
+	case 'b', 'B':
+		return weightB, nil
+	case 'c', 'C':
+		return weightC, nil
+	case 'd', 'D':
+		return weightD, nil
+	}
+	return 0, pgerror.Newf(pgcode.InvalidParameterValue, "unrecognized weight: %d", b)
+}
+
+// Weight is one of the weight labels of the positions of a TSVector. It's a
+// validated alternative to passing labels around as bytes, which can be in
+// either case: a Weight is obtained from ParseWeight or one of the constants
+// below, and is taken by the functions of this package that take weight
+// labels, like SetWeight and KeepWeights. The zero value is WeightD.
+type Weight tsWeight
+
+// The weights, from the lowest to the highest. WeightD is the default weight
+// of positions, which is stored as no weight at all, so it's the zero value.
+const (
+	WeightD = Weight(0)
+	WeightC = Weight(weightC)
+	WeightB = Weight(weightB)
+	WeightA = Weight(weightA)
+)
+
+// ParseWeight returns the Weight for the input weight label, which may be any
+// of A, B, C or D, in either case. An error is returned for any other label.
+func ParseWeight(label byte) (Weight, error) {
+	w, err := tsWeightFromByte(label)
+	if err != nil || w == weightD {
+		return WeightD, err
+	}
+	return Weight(w), nil
+}
+
+// weightsByIdx holds the weights in order of their indexes, as returned by
+// weightIdx.
+var weightsByIdx = [...]Weight{WeightD, WeightC, WeightB, WeightA}
+
+// weightOfPosition returns the Weight of the input position.
+func weightOfPosition(pos tsPosition) Weight {
+	return weightsByIdx[weightIdx(pos)]
+}
+
+// mask returns the tsWeight bit of the receiver, for matching it against the
+// weights of a query term or against other weights. Unlike in positions,
+// weight D has a bit of its own in masks.
+func (w Weight) mask() tsWeight {
+	if w == WeightD {
+		return weightD
+	}
+	return tsWeight(w)
+}
+
+// Byte returns the upper case weight label of the receiver, which is one of A,
+// B, C or D. It panics if the receiver isn't one of the Weight constants.
+func (w Weight) Byte() byte {
+	switch w {
+	case WeightA:
+		return 'A'
+	case WeightB:
+		return 'B'
+	case WeightC:
+		return 'C'
+	case WeightD:
+		return 'D'
+	}
+	panic(errors.AssertionFailedf("invalid weight %d", w))
+}
+
+// String returns the weight label of the receiver, or "invalid" if the
+// receiver isn't one of the Weight constants.
+func (w Weight) String() string {
+	switch w {
+	case WeightA, WeightB, WeightC, WeightD:
+		return string(w.Byte())
+	}
+	return "invalid"
+}
+
+// maxTSVectorPosition is the largest position that can be stored in a
+// TSVector. Larger positions are clamped to this value, like in Postgres.
+const maxTSVectorPosition = 1<<14 - 1
+
 // tsPosition is a position within a document, along with an optional weight.
 type tsPosition struct {
 	position int
@@ -101,6 +199,19 @@ type tsTerm struct {
 	operator tsOperator
 	// Set only when operator = followedby
 	followedN int
+	// boost is the factor by which the contribution of a TSQuery term to the
+	// rank is multiplied. Zero means that the term isn't boosted, which is the
+	// same as a boost of 1.
+	boost float64
+}
+
+// boostFactor returns the factor by which the contribution of the receiver to
+// the rank is multiplied.
+func (t *tsTerm) boostFactor() float32 {
+	if t.boost == 0 {
+		return 1
+	}
+	return float32(t.boost)
 }
 
 func (t tsTerm) String() string {
@@ -125,16 +236,7 @@ func (t tsTerm) String() string {
 	}
 
 	var buf strings.Builder
-	buf.WriteByte('\'')
-	for _, r := range t.lexeme {
-		if r == '\'' {
-			// Single quotes are escaped as double single quotes inside of a TSVector.
-			buf.WriteString(`''`)
-		} else {
-			buf.WriteRune(r)
-		}
-	}
-	buf.WriteByte('\'')
+	writeQuotedLexeme(&buf, t.lexeme)
 	for i, pos := range t.positions {
 		if i > 0 {
 			buf.WriteByte(',')
@@ -146,9 +248,41 @@ func (t tsTerm) String() string {
 		}
 		buf.WriteString(pos.weight.String())
 	}
+	if t.boost != 0 {
+		buf.WriteByte('^')
+		buf.WriteString(strconv.FormatFloat(t.boost, 'g', -1, 64))
+	}
+	return buf.String()
+}
+
+// QuoteLexeme returns the input lexeme wrapped in single quotes, with its
+// single quotes and backslashes escaped, so that it parses back into the same
+// single lexeme with both ParseTSVector and ParseTSQuery. It's the quoting
+// that String uses, which is the same as Postgres's.
+func QuoteLexeme(lexeme string) string {
+	var buf strings.Builder
+	writeQuotedLexeme(&buf, lexeme)
 	return buf.String()
 }
 
+func writeQuotedLexeme(buf *strings.Builder, lexeme string) {
+	buf.Grow(len(lexeme) + 2)
+	buf.WriteByte('\'')
+	for _, r := range lexeme {
+		switch r {
+		case '\'':
+			// Single quotes are escaped as double single quotes.
+			buf.WriteString(`''`)
+		case '\\':
+			// Backslashes are escaped as double backslashes.
+			buf.WriteString(`\\`)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('\'')
+}
+
 // TSVector is a sorted list of terms, each of which is a lexeme that might have
 // an associated position within an original document.
 type TSVector []tsTerm
@@ -167,6 +301,12 @@ func (t TSVector) String() string {
 // ParseTSVector produces a TSVector from an input string. The input will be
 // sorted by lexeme, but will not be automatically stemmed or stop-worded.
 func ParseTSVector(input string) (TSVector, error) {
+	return ParseTSVectorWithConfig(input, Config{})
+}
+
+// ParseTSVectorWithConfig is like ParseTSVector, but uses the input Config to
+// control how the TSVector is constructed.
+func ParseTSVectorWithConfig(input string, cfg Config) (TSVector, error) {
 	parser := tsVectorLexer{
 		input: input,
 		state: expectingTerm,
@@ -175,7 +315,84 @@ func ParseTSVector(input string) (TSVector, error) {
 	if err != nil {
 		return ret, err
 	}
+	ret, err = cfg.applyLexemeLimit(ret)
+	if err != nil {
+		return nil, err
+	}
+	ret = normalizeTSVector(ret)
+	cfg.applyPositionLimit(ret, 0 /* def */)
+	if err := cfg.checkTSVectorSize(ret); err != nil {
+		return nil, err
+	}
+	cfg.internLexemes(ret)
+	return ret, nil
+}
+
+// IsNormalized returns true if the receiver is in normal form: its lexemes are
+// sorted and unique, and the position list of every lexeme is sorted by
+// position and has no duplicate positions. All of the functions that
+// construct TSVectors in this package return normalized TSVectors, and
+// matching and comparison require them.
+func (t TSVector) IsNormalized() bool {
+	for i := range t {
+		if i > 0 && t[i-1].lexeme >= t[i].lexeme {
+			return false
+		}
+		positions := t[i].positions
+		for j := 1; j < len(positions); j++ {
+			if positions[j-1].position >= positions[j].position {
+				return false
+			}
+		}
+	}
+	return true
+}
 
+// Normalize returns a copy of the receiver in normal form (see IsNormalized).
+// Duplicate lexemes have their position lists merged, and duplicate positions
+// within a lexeme are collapsed into a single position with the highest of
+// their weights, like in Postgres.
+func (t TSVector) Normalize() TSVector {
+	ret := make(TSVector, len(t))
+	for i := range t {
+		ret[i] = tsTerm{lexeme: t[i].lexeme, positions: copyTSPositions(t[i].positions)}
+	}
+	return normalizeTSVector(ret)
+}
+
+// Rename returns a copy of the receiver in which the lexeme from is replaced
+// by the lexeme to, with the same positions and weights, for migrating stored
+// vectors when the canonical form of a lexeme changes, without the original
+// text. If the receiver already contains to, the positions of the two lexemes
+// are merged: a position that both of them have keeps the higher of their
+// weights, like in Normalize, and only the lowest MaxPositionsPerLexeme
+// positions are kept, like in Concat. The receiver is returned as a copy if it
+// doesn't contain from. An error is returned if the new lexeme is empty or
+// longer than MaxLexemeLen bytes.
+func (t TSVector) Rename(from, to string) (TSVector, error) {
+	if to == "" {
+		return nil, pgerror.New(pgcode.InvalidParameterValue, "lexeme must not be empty")
+	}
+	if len(to) > MaxLexemeLen {
+		return nil, pgerror.Newf(pgcode.ProgramLimitExceeded,
+			"word is too long (%d bytes, max %d bytes)", len(to), MaxLexemeLen)
+	}
+	ret := make(TSVector, len(t))
+	for i := range t {
+		ret[i] = tsTerm{lexeme: t[i].lexeme, positions: copyTSPositions(t[i].positions)}
+		if ret[i].lexeme == from {
+			ret[i].lexeme = to
+		}
+	}
+	ret = normalizeTSVector(ret)
+	limitPositionsPerLexeme(ret, MaxPositionsPerLexeme)
+	return ret, nil
+}
+
+// normalizeTSVector sorts and de-duplicates the lexemes of the input TSVector,
+// along with the position list of every lexeme. The input is modified in
+// place.
+func normalizeTSVector(ret TSVector) TSVector {
 	if len(ret) > 1 {
 		// Sort and de-duplicate the resultant TSVector.
 		sort.Slice(ret, func(i, j int) bool {
@@ -207,5 +424,823 @@ func ParseTSVector(input string) (TSVector, error) {
 		lastIdx := len(ret) - 1
 		ret[lastIdx].positions = sortAndUniqTSPositions(ret[lastIdx].positions)
 	}
+	return ret
+}
+
+// SetWeight returns a copy of the receiver with the weight of every position
+// set to the input weight. Lexemes without positions are left alone, since
+// weights are attached to positions. Like Postgres's setweight, the weight of
+// a position is replaced rather than combined with its previous weight, so
+// SetWeight is idempotent, and only the last of a sequence of calls determines
+// the weights of the result.
+func (t TSVector) SetWeight(weight Weight) TSVector {
+	// Weight D is the default, and is stored as no weight at all, like the
+	// zero value of Weight.
+	w := tsWeight(weight)
+	ret := make(TSVector, len(t))
+	for i := range t {
+		ret[i].lexeme = t[i].lexeme
+		if t[i].positions == nil {
+			continue
+		}
+		ret[i].positions = make([]tsPosition, len(t[i].positions))
+		for j, pos := range t[i].positions {
+			ret[i].positions[j] = tsPosition{position: pos.position, weight: w}
+		}
+	}
+	return ret
+}
+
+// KeepWeights returns a copy of the receiver that only contains the positions
+// whose weights are among the input weights. A lexeme is kept, with its
+// position list trimmed to the matching positions, as long as it has at least
+// one matching position, and is dropped otherwise, as are lexemes without
+// positions. This is the same as Postgres's ts_filter.
+//
+// The result is meant to be a smaller vector for the high-weight parts of a
+// document: every lexeme that occurs with one of the input weights is still
+// present, so it answers membership queries for those lexemes the same as the
+// full vector, but its positions, and so its phrase matches and ranks, only
+// reflect the kept weights. Unlike SetWeight, which relabels positions,
+// KeepWeights never changes the weight of a position.
+func (t TSVector) KeepWeights(weights []Weight) TSVector {
+	var mask tsWeight
+	for _, w := range weights {
+		mask |= w.mask()
+	}
+	ret := TSVector{}
+	for i := range t {
+		var positions []tsPosition
+		for _, pos := range t[i].positions {
+			w := pos.weight
+			if w == 0 {
+				// Weight D is the default, and is stored as no weight at all.
+				w = weightD
+			}
+			if w&mask != 0 {
+				positions = append(positions, pos)
+			}
+		}
+		if len(positions) > 0 {
+			ret = append(ret, tsTerm{lexeme: t[i].lexeme, positions: positions})
+		}
+	}
+	return ret
+}
+
+// LexemeWeight is a lexeme of a TSVector along with the highest weight among
+// its positions, as returned by StripPositionsKeepWeights.
+type LexemeWeight struct {
+	Lexeme string
+	Weight Weight
+}
+
+// StripPositionsKeepWeights returns the lexemes of the receiver, in the same
+// order, each with the highest weight among its positions, which is WeightD
+// for lexemes without positions. This is a middle ground between the full
+// vector and one whose positions have all been stripped: RankLexemeWeights
+// still takes the weights of the lexemes into account, but since there are no
+// positions, the rank doesn't depend on the distances between lexemes, and
+// phrase operators can't match.
+//
+// The result isn't a TSVector, since a TSVector can't have weights without
+// positions, just like in Postgres.
+func (t TSVector) StripPositionsKeepWeights() []LexemeWeight {
+	ret := make([]LexemeWeight, len(t))
+	for i := range t {
+		w := WeightD
+		for _, pos := range t[i].positions {
+			if pw := weightOfPosition(pos); pw > w {
+				w = pw
+			}
+		}
+		ret[i] = LexemeWeight{Lexeme: t[i].lexeme, Weight: w}
+	}
+	return ret
+}
+
+// maxPosition returns the largest position in the receiver, or 0 if the
+// receiver has no positions.
+func (t TSVector) maxPosition() int {
+	var ret int
+	for i := range t {
+		if n := len(t[i].positions); n > 0 && t[i].positions[n-1].position > ret {
+			ret = t[i].positions[n-1].position
+		}
+	}
+	return ret
+}
+
+// Concat returns the concatenation of the two input TSVectors, like the
+// Postgres tsvector || operator. The positions of the right TSVector are
+// shifted by the largest position in the left TSVector, so that the result
+// represents the right document appended to the left document. Like in
+// Postgres, only the lowest MaxPositionsPerLexeme positions of each lexeme are
+// kept.
+func Concat(l, r TSVector) TSVector {
+	shift := l.maxPosition()
+	ret := make(TSVector, 0, len(l)+len(r))
+	var i, j int
+	for i < len(l) || j < len(r) {
+		switch {
+		case j >= len(r) || (i < len(l) && l[i].lexeme < r[j].lexeme):
+			ret = append(ret, tsTerm{lexeme: l[i].lexeme, positions: copyTSPositions(l[i].positions)})
+			i++
+		case i >= len(l) || r[j].lexeme < l[i].lexeme:
+			ret = append(ret, tsTerm{lexeme: r[j].lexeme, positions: shiftTSPositions(nil, r[j].positions, shift)})
+			j++
+		default:
+			positions := copyTSPositions(l[i].positions)
+			positions = shiftTSPositions(positions, r[j].positions, shift)
+			ret = append(ret, tsTerm{lexeme: l[i].lexeme, positions: positions})
+			i++
+			j++
+		}
+	}
+	limitPositionsPerLexeme(ret, MaxPositionsPerLexeme)
+	return ret
+}
+
+func copyTSPositions(positions []tsPosition) []tsPosition {
+	if positions == nil {
+		return nil
+	}
+	return append(make([]tsPosition, 0, len(positions)), positions...)
+}
+
+// MergeTSVectors returns the concatenation of the input TSVectors, like
+// repeated calls to Concat, for assembling the vector of a large document from
+// the vectors of its shards, which were tokenized in parallel. The positions of
+// each vector are shifted by the sum of the largest positions of the vectors
+// before it, plus baseGap for each of those vectors, and are clamped to the
+// maximum TSVector position. With a baseGap of 0, the positions are the same
+// as the ones that tokenizing the shards one after the other would produce,
+// and the result is the same as concatenating the vectors from left to right
+// with Concat. A positive baseGap leaves that many unused positions between
+// the shards, so that phrases can't match across their boundaries. A negative
+// baseGap is treated as 0.
+//
+// The vectors are merged all at once, with a k-way merge of their lexemes, so
+// merging n lexemes from k vectors takes O(n log k) time, rather than the
+// O(n k) time of repeated calls to Concat. The input vectors must be
+// normalized, which every TSVector constructed by this package is.
+//
+// If a lexeme ends up with the same position in several of the vectors, the
+// position keeps the highest of its weights, like in Concat. Only the lowest
+// MaxPositionsPerLexeme positions of each lexeme are kept, like in Concat too.
+// See MergeTSVectorsWithPolicy.
+func MergeTSVectors(vectors []TSVector, baseGap int) TSVector {
+	return MergeTSVectorsWithPolicy(vectors, baseGap, WeightConflictMax)
+}
+
+// WeightConflictPolicy controls which weight MergeTSVectorsWithPolicy keeps for
+// a position of a lexeme that several of the merged vectors have, with
+// different weights. Since the positions of the vectors are shifted past each
+// other, that only happens for positions that are clamped to the maximum
+// TSVector position. A position has a single weight, like in Postgres, so the
+// weights can't all be kept.
+type WeightConflictPolicy int
+
+const (
+	// WeightConflictMax keeps the highest of the weights, which is what Concat
+	// and MergeTSVectors do, and what Postgres does when it collapses duplicate
+	// positions.
+	WeightConflictMax WeightConflictPolicy = iota
+	// WeightConflictFirst keeps the weight of the first of the vectors that
+	// have the position, so that earlier sources take precedence.
+	WeightConflictFirst
+)
+
+// MergeTSVectorsWithPolicy is like MergeTSVectors, but uses the input policy
+// to resolve the weights of positions that several of the vectors have.
+// Merging two vectors without a gap is the same as concatenating them with
+// Concat, with the input policy.
+func MergeTSVectorsWithPolicy(
+	vectors []TSVector, baseGap int, policy WeightConflictPolicy,
+) TSVector {
+	if baseGap < 0 {
+		baseGap = 0
+	}
+	h := tsVectorMergeHeap{vectors: vectors}
+	shifts := make([]int, len(vectors))
+	var shift, n int
+	for i, v := range vectors {
+		shifts[i] = shift
+		shift += v.maxPosition() + baseGap
+		n += len(v)
+		if len(v) > 0 {
+			h.cursors = append(h.cursors, tsVectorMergeCursor{vector: i})
+		}
+	}
+	heap.Init(&h)
+
+	ret := make(TSVector, 0, n)
+	for h.Len() > 0 {
+		lexeme := h.top().lexeme
+		var positions []tsPosition
+		for h.Len() > 0 && h.top().lexeme == lexeme {
+			c := &h.cursors[0]
+			positions = appendShiftedTSPositions(positions, h.top().positions, shifts[c.vector])
+			c.idx++
+			if c.idx < len(vectors[c.vector]) {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		if policy == WeightConflictFirst {
+			positions = sortAndUniqTSPositionsKeepFirst(positions)
+		} else {
+			positions = sortAndUniqTSPositions(positions)
+		}
+		ret = append(ret, tsTerm{lexeme: lexeme, positions: positions})
+	}
+	limitPositionsPerLexeme(ret, MaxPositionsPerLexeme)
+	return ret
+}
+
+// sortAndUniqTSPositionsKeepFirst is like sortAndUniqTSPositions, but keeps
+// the weight of the first of the duplicate positions, rather than the highest
+// one.
+func sortAndUniqTSPositionsKeepFirst(pos []tsPosition) []tsPosition {
+	if len(pos) <= 1 {
+		return pos
+	}
+	sort.SliceStable(pos, func(i, j int) bool {
+		return pos[i].position < pos[j].position
+	})
+	lastUniqueIdx := 0
+	for j := 1; j < len(pos); j++ {
+		if pos[j].position != pos[lastUniqueIdx].position {
+			lastUniqueIdx++
+			pos[lastUniqueIdx] = pos[j]
+		}
+	}
+	return pos[:lastUniqueIdx+1]
+}
+
+// tsVectorMergeCursor is the index of the next term of one of the vectors
+// that are merged by MergeTSVectors.
+type tsVectorMergeCursor struct {
+	vector int
+	idx    int
+}
+
+// tsVectorMergeHeap is a heap.Interface that orders the cursors of the vectors
+// that are merged by MergeTSVectors by the lexemes of their terms, and then by
+// the indexes of their vectors.
+type tsVectorMergeHeap struct {
+	vectors []TSVector
+	cursors []tsVectorMergeCursor
+}
+
+var _ heap.Interface = (*tsVectorMergeHeap)(nil)
+
+func (h *tsVectorMergeHeap) term(i int) *tsTerm {
+	c := h.cursors[i]
+	return &h.vectors[c.vector][c.idx]
+}
+
+// top returns the term of the first cursor.
+func (h *tsVectorMergeHeap) top() *tsTerm { return h.term(0) }
+
+func (h *tsVectorMergeHeap) Len() int { return len(h.cursors) }
+
+func (h *tsVectorMergeHeap) Less(i, j int) bool {
+	if l, r := h.term(i).lexeme, h.term(j).lexeme; l != r {
+		return l < r
+	}
+	return h.cursors[i].vector < h.cursors[j].vector
+}
+
+func (h *tsVectorMergeHeap) Swap(i, j int) {
+	h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i]
+}
+
+func (h *tsVectorMergeHeap) Push(x interface{}) {
+	h.cursors = append(h.cursors, x.(tsVectorMergeCursor))
+}
+
+func (h *tsVectorMergeHeap) Pop() interface{} {
+	n := len(h.cursors)
+	ret := h.cursors[n-1]
+	h.cursors = h.cursors[:n-1]
+	return ret
+}
+
+// shiftTSPositions appends the input positions to appendTo, shifted by the
+// input amount and clamped to the maximum TSVector position.
+func shiftTSPositions(appendTo []tsPosition, positions []tsPosition, shift int) []tsPosition {
+	return sortAndUniqTSPositions(appendShiftedTSPositions(appendTo, positions, shift))
+}
+
+// appendShiftedTSPositions is like shiftTSPositions, but doesn't sort and
+// de-duplicate the result.
+func appendShiftedTSPositions(
+	appendTo []tsPosition, positions []tsPosition, shift int,
+) []tsPosition {
+	for _, pos := range positions {
+		pos.position += shift
+		if pos.position > maxTSVectorPosition {
+			pos.position = maxTSVectorPosition
+		}
+		appendTo = append(appendTo, pos)
+	}
+	return appendTo
+}
+
+// Append returns the TSVector for the document represented by the receiver,
+// extended by the input text. The text is parsed into lexemes with the text
+// search configuration passed by name, with positions that continue after the
+// largest position in the receiver, and merged into the receiver. Lexemes that
+// are already present gain the new positions. This avoids re-parsing the
+// entire document when text is appended to it.
+func (t TSVector) Append(config string, text string) (TSVector, error) {
+	v, err := DocumentToTSVector(config, text)
+	if err != nil {
+		return nil, err
+	}
+	return Concat(t, v), nil
+}
+
+// DiffTSVector returns how the vector b differs from the vector a: the
+// lexemes that are only in b, the lexemes that are only in a, and for each
+// lexeme that's in both but with different positions, its positions in a and
+// in b, in that order. A lexeme whose positions are the same but have
+// different weights is also reported as changed, even though its position
+// lists are equal. Both inputs must be normalized. The lexemes are returned in
+// sorted order, and the map is nil if there are no position changes.
+func DiffTSVector(
+	a, b TSVector,
+) (addedLexemes, removedLexemes []string, positionChanges map[string][2][]int) {
+	var i, j int
+	for i < len(a) || j < len(b) {
+		switch {
+		case j >= len(b) || (i < len(a) && a[i].lexeme < b[j].lexeme):
+			removedLexemes = append(removedLexemes, a[i].lexeme)
+			i++
+		case i >= len(a) || b[j].lexeme < a[i].lexeme:
+			addedLexemes = append(addedLexemes, b[j].lexeme)
+			j++
+		default:
+			if !equalTSPositions(a[i].positions, b[j].positions) {
+				if positionChanges == nil {
+					positionChanges = make(map[string][2][]int)
+				}
+				positionChanges[a[i].lexeme] = [2][]int{
+					tsPositionInts(a[i].positions), tsPositionInts(b[j].positions),
+				}
+			}
+			i++
+			j++
+		}
+	}
+	return addedLexemes, removedLexemes, positionChanges
+}
+
+// Equal returns whether the receiver and the input vector have the same
+// lexemes, with the same positions and weights, once they're normalized (see
+// Normalize). So vectors whose lexemes or positions are in a different order,
+// or that repeat lexemes or positions, are equal to their normalized
+// equivalents. It stops at the first difference, and only copies the inputs
+// that aren't already normalized.
+func (t TSVector) Equal(other TSVector) bool {
+	if !t.IsNormalized() {
+		t = t.Normalize()
+	}
+	if !other.IsNormalized() {
+		other = other.Normalize()
+	}
+	if len(t) != len(other) {
+		return false
+	}
+	for i := range t {
+		if t[i].lexeme != other[i].lexeme || !equalTSPositions(t[i].positions, other[i].positions) {
+			return false
+		}
+	}
+	return true
+}
+
+func equalTSPositions(a, b []tsPosition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// tsPositionInts returns the positions of the input, without their weights.
+func tsPositionInts(positions []tsPosition) []int {
+	if len(positions) == 0 {
+		return nil
+	}
+	ret := make([]int, len(positions))
+	for i := range positions {
+		ret[i] = positions[i].position
+	}
+	return ret
+}
+
+// Checksum returns a CRC32 checksum of the receiver's lexemes, positions and
+// weights, which is stable across processes and versions. It can be stored
+// alongside a cached vector to check whether the vector still matches its
+// source without comparing the whole vector. The checksum is computed over the
+// receiver's encoding in Postgres's binary tsvector format: the number of
+// lexemes, then for each lexeme, the null-terminated lexeme, the number of
+// positions, and each position with its weight in the top 2 bits, all as big
+// endian integers. Vectors that aren't normalized have different checksums
+// than their normalized equivalents.
+func (t TSVector) Checksum() uint32 {
+	var scratch [4]byte
+	binary.BigEndian.PutUint32(scratch[:], uint32(len(t)))
+	crc := crc32.ChecksumIEEE(scratch[:])
+	for i := range t {
+		crc = crc32.Update(crc, crc32.IEEETable, []byte(t[i].lexeme))
+		scratch[0] = 0
+		binary.BigEndian.PutUint16(scratch[1:], uint16(len(t[i].positions)))
+		crc = crc32.Update(crc, crc32.IEEETable, scratch[:3])
+		for _, pos := range t[i].positions {
+			binary.BigEndian.PutUint16(scratch[:], uint16(weightIdx(pos)<<14|pos.position))
+			crc = crc32.Update(crc, crc32.IEEETable, scratch[:2])
+		}
+	}
+	return crc
+}
+
+// WeightedField is a piece of a document, along with the weight label that
+// should be assigned to all of its lexemes.
+type WeightedField struct {
+	Text string
+	// Weight is the weight label for the field, which may be any of A, B, C or
+	// D.
+	Weight byte
+}
+
+// BuildWeightedVector constructs a TSVector from several fields of a document,
+// using the text search configuration passed by name. It is equivalent to
+// concatenating setweight(to_tsvector(config, field.Text), field.Weight) for
+// every field in order, so the positions of each field continue after the
+// positions of the previous fields.
+func BuildWeightedVector(config string, fields []WeightedField) (TSVector, error) {
+	var ret TSVector
+	for _, f := range fields {
+		v, err := DocumentToTSVector(config, f.Text)
+		if err != nil {
+			return nil, err
+		}
+		w, err := ParseWeight(f.Weight)
+		if err != nil {
+			return nil, err
+		}
+		ret = Concat(ret, v.SetWeight(w))
+	}
+	if ret == nil {
+		ret = TSVector{}
+	}
 	return ret, nil
 }
+
+// ToArray returns the lexemes of the receiver, like Postgres's
+// tsvector_to_array. The lexemes are sorted in byte order, which is the order
+// of the C collation, that Postgres also uses. This order is part of the
+// contract of ToArray, so it can be relied on to produce reproducible output:
+// a receiver that isn't normalized is normalized first.
+func (t TSVector) ToArray() []string {
+	if !t.IsNormalized() {
+		t = t.Normalize()
+	}
+	ret := make([]string, len(t))
+	for i := range t {
+		ret[i] = t[i].lexeme
+	}
+	return ret
+}
+
+// UnnestEntry is a lexeme of a TSVector along with its positions and their
+// weights. It's returned by Unnest.
+type UnnestEntry struct {
+	Lexeme string
+	// Positions holds the positions of the lexeme, in increasing order, and
+	// Weights holds the weight labels of those positions, which are each one
+	// of A, B, C or D. Both are nil if the lexeme has no positions.
+	Positions []int
+	Weights   []byte
+}
+
+// Unnest returns an entry for each lexeme of the receiver, like Postgres's
+// unnest(tsvector). Like ToArray, the entries are sorted by lexeme in byte
+// order, and the positions of each entry are in increasing order. This order
+// is part of the contract of Unnest, so it can be relied on to produce
+// reproducible output that can be compared with Postgres's: a receiver that
+// isn't normalized is normalized first.
+func (t TSVector) Unnest() []UnnestEntry {
+	if !t.IsNormalized() {
+		t = t.Normalize()
+	}
+	ret := make([]UnnestEntry, len(t))
+	for i := range t {
+		ret[i].Lexeme = t[i].lexeme
+		positions := t[i].positions
+		if len(positions) == 0 {
+			continue
+		}
+		ret[i].Positions = make([]int, len(positions))
+		ret[i].Weights = make([]byte, len(positions))
+		for j, pos := range positions {
+			ret[i].Positions[j] = pos.position
+			ret[i].Weights[j] = "DCBA"[weightIdx(pos)]
+		}
+	}
+	return ret
+}
+
+// WeightedPosition is a position of a lexeme in a document, along with the
+// weight label of the position.
+type WeightedPosition struct {
+	Lexeme   string
+	Position int
+	Weight   Weight
+}
+
+// UnnestByWeight returns the positions of the receiver bucketed by their
+// weights, which are the keys of the result. The positions in each bucket are
+// sorted by position, and positions shared by several lexemes are sorted by
+// lexeme. Weights without any positions are missing from the result, as are
+// lexemes without positions.
+func (t TSVector) UnnestByWeight() map[Weight][]WeightedPosition {
+	ret := make(map[Weight][]WeightedPosition)
+	for i := range t {
+		for _, pos := range t[i].positions {
+			w := weightOfPosition(pos)
+			ret[w] = append(ret[w], WeightedPosition{
+				Lexeme:   t[i].lexeme,
+				Position: pos.position,
+				Weight:   w,
+			})
+		}
+	}
+	for _, bucket := range ret {
+		// The lexemes of the receiver are sorted, so a stable sort by position
+		// keeps the positions of each lexeme sorted by lexeme.
+		sort.SliceStable(bucket, func(i, j int) bool {
+			return bucket[i].Position < bucket[j].Position
+		})
+	}
+	return ret
+}
+
+// LexemeWeights returns the distinct weights of the positions of the input
+// lexeme in the receiver, in order from A to D, and whether the lexeme is
+// present at all. A lexeme without positions has weight D. The lexeme is found
+// by a binary search, and nothing is allocated if it's absent.
+func (t TSVector) LexemeWeights(lexeme string) ([]Weight, bool) {
+	i := sort.Search(len(t), func(i int) bool {
+		return t[i].lexeme >= lexeme
+	})
+	if i >= len(t) || t[i].lexeme != lexeme {
+		return nil, false
+	}
+	positions := t[i].positions
+	if len(positions) == 0 {
+		positions = []tsPosition{{}}
+	}
+	var seen [4]bool
+	for _, pos := range positions {
+		seen[weightIdx(pos)] = true
+	}
+	return weightsSeen(seen), true
+}
+
+// WeightsPresent returns the distinct weights of all of the positions in the
+// receiver, in order from A to D, for checking that a vector has the weights
+// that ranking expects. Positions without a weight have weight D, as do
+// lexemes without positions. The result is nil if the receiver is empty.
+func (t TSVector) WeightsPresent() []Weight {
+	var seen [4]bool
+	for i := range t {
+		if len(t[i].positions) == 0 {
+			seen[weightIdx(tsPosition{})] = true
+		}
+		for _, pos := range t[i].positions {
+			seen[weightIdx(pos)] = true
+		}
+	}
+	return weightsSeen(seen)
+}
+
+// weightsSeen returns the weights whose indexes, as returned by weightIdx, are
+// set in the input, in order from A to D.
+func weightsSeen(seen [4]bool) []Weight {
+	var ret []Weight
+	for idx := len(seen) - 1; idx >= 0; idx-- {
+		if seen[idx] {
+			ret = append(ret, weightsByIdx[idx])
+		}
+	}
+	return ret
+}
+
+// TruncateStrategy is the way in which TSVector.Truncate chooses the lexemes
+// to keep.
+type TruncateStrategy int
+
+const (
+	// TruncateByPosition keeps the lexemes that occur earliest in the
+	// document, by their first position. Lexemes without positions are
+	// dropped first.
+	TruncateByPosition TruncateStrategy = iota
+	// TruncateByFrequency keeps the lexemes with the most positions, which
+	// occur most often in the document. A lexeme without positions counts as
+	// a single occurrence.
+	TruncateByFrequency
+	// TruncateByLexeme keeps the lexemes that sort first.
+	TruncateByLexeme
+)
+
+// Truncate returns a copy of the receiver that only holds its maxLexemes
+// lexemes that rank highest according to the input strategy, for bounding the
+// contribution of huge documents to an index. Ties are broken in favor of the
+// lexemes that sort first. The kept lexemes keep all of their positions and
+// weights, which aren't renumbered, so the positions of the result can have
+// gaps, and phrases still match the kept lexemes at their original distances.
+// The receiver is returned as is if it has at most maxLexemes lexemes, or if
+// maxLexemes isn't positive.
+func (t TSVector) Truncate(maxLexemes int, by TruncateStrategy) TSVector {
+	if maxLexemes <= 0 || len(t) <= maxLexemes {
+		return t
+	}
+	// rankKey returns the key of the lexeme at the input index, which is
+	// smaller for the lexemes that should be kept.
+	var rankKey func(i int) int
+	switch by {
+	case TruncateByPosition:
+		rankKey = func(i int) int {
+			positions := t[i].positions
+			if len(positions) == 0 {
+				return maxTSVectorPosition + 1
+			}
+			return positions[0].position
+		}
+	case TruncateByFrequency:
+		rankKey = func(i int) int {
+			positions := t[i].positions
+			if len(positions) == 0 {
+				return -1
+			}
+			return -len(positions)
+		}
+	case TruncateByLexeme:
+		rankKey = func(i int) int { return i }
+	default:
+		panic(errors.AssertionFailedf("unknown truncate strategy %d", by))
+	}
+	idxs := make([]int, len(t))
+	for i := range idxs {
+		idxs[i] = i
+	}
+	// The lexemes are sorted, so a stable sort breaks ties by lexeme.
+	sort.SliceStable(idxs, func(i, j int) bool {
+		return rankKey(idxs[i]) < rankKey(idxs[j])
+	})
+	idxs = idxs[:maxLexemes]
+	sort.Ints(idxs)
+	ret := make(TSVector, len(idxs))
+	for i, idx := range idxs {
+		ret[i] = tsTerm{lexeme: t[idx].lexeme, positions: copyTSPositions(t[idx].positions)}
+	}
+	return ret
+}
+
+// LexemeEntry is a lexeme of a TSVector along with some of its positions. It's
+// returned by HeadLexemes.
+type LexemeEntry struct {
+	Lexeme string
+	// Positions holds the positions of the lexeme, in increasing order.
+	Positions []int
+}
+
+// HeadLexemes returns the lexemes that occur at the n lowest positions of the
+// receiver, which summarize the beginning of the document without its
+// original text, for generating previews. Each entry holds the positions of
+// its lexeme among those n positions, and the entries are sorted by their
+// first position, and then by lexeme for lexemes at the same position. Since
+// positions can be shared by several lexemes, and the positions of removed
+// words, like stop words, are skipped, the result can hold more or fewer than
+// n entries. Lexemes without positions are never returned. It returns nil if
+// n isn't positive.
+func (t TSVector) HeadLexemes(n int) []LexemeEntry {
+	if n <= 0 {
+		return nil
+	}
+	var all []int
+	for i := range t {
+		for _, pos := range t[i].positions {
+			all = append(all, pos.position)
+		}
+	}
+	sort.Ints(all)
+	var limit, distinct int
+	for i, pos := range all {
+		if i == 0 || pos != all[i-1] {
+			if distinct == n {
+				break
+			}
+			distinct++
+		}
+		limit = pos
+	}
+	var ret []LexemeEntry
+	for i := range t {
+		positions := t[i].positions
+		var head []int
+		for _, pos := range positions {
+			if pos.position > limit {
+				break
+			}
+			head = append(head, pos.position)
+		}
+		if len(head) > 0 {
+			ret = append(ret, LexemeEntry{Lexeme: t[i].lexeme, Positions: head})
+		}
+	}
+	// The lexemes of the receiver are sorted, so a stable sort by first
+	// position keeps the lexemes at the same position sorted by lexeme.
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Positions[0] < ret[j].Positions[0]
+	})
+	return ret
+}
+
+// Reconstruct returns an approximation of the document that the receiver was
+// built from, for debugging and for previews of documents whose text isn't
+// retained: the lexemes of the receiver, separated by spaces, in order of
+// their positions. A lexeme is emitted once for each of its positions, and
+// lexemes at the same position are emitted next to each other, sorted by
+// lexeme.
+//
+// The result is lossy. It contains lexemes rather than the original words, so
+// casing, punctuation and whatever else the text search configuration
+// normalized away is lost, and the words that didn't produce lexemes, like
+// stop words, are missing without a trace. Lexemes without positions don't
+// appear at all, and positions past the maximum TSVector position or the
+// maximum number of positions per lexeme were already dropped or merged when
+// the receiver was built.
+func (t TSVector) Reconstruct() string {
+	type entry struct {
+		position int
+		lexeme   string
+	}
+	var entries []entry
+	for i := range t {
+		for _, pos := range t[i].positions {
+			entries = append(entries, entry{position: pos.position, lexeme: t[i].lexeme})
+		}
+	}
+	// The lexemes of the receiver are sorted, so a stable sort by position
+	// keeps the lexemes at the same position sorted by lexeme.
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].position < entries[j].position
+	})
+	var buf strings.Builder
+	for i, e := range entries {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(e.lexeme)
+	}
+	return buf.String()
+}
+
+// PositionHistogram returns the number of positions of the receiver that fall
+// into each of the input number of buckets, for analyzing where in documents
+// lexemes occur. The buckets are relative to the largest position of the
+// receiver, max, so that the histograms of documents of different lengths can
+// be aggregated: bucket i, counting from 0, holds the positions p for which
+// p/max is larger than i/buckets and at most (i+1)/buckets. So the largest
+// position is always in the last bucket, the buckets cover the same number of
+// positions, give or take one, and some buckets can't hold any positions if
+// max is smaller than the number of buckets. The positions of every lexeme are
+// counted, so a position that's shared by several lexemes is counted once for
+// each of them, while lexemes without positions aren't counted. It returns nil
+// if buckets isn't positive, and all zeroes if the receiver has no positions.
+func (t TSVector) PositionHistogram(buckets int) []int {
+	if buckets <= 0 {
+		return nil
+	}
+	ret := make([]int, buckets)
+	max := t.maxPosition()
+	if max == 0 {
+		return ret
+	}
+	for i := range t {
+		for _, pos := range t[i].positions {
+			ret[(pos.position*buckets-1)/max]++
+		}
+	}
+	return ret
+}
@@ -12,11 +12,17 @@ package tsearch
 
 import (
 	"context"
+	"hash/crc32"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
 	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
 	"github.com/cockroachdb/cockroach/pkg/util/randutil"
+	"github.com/cockroachdb/errors"
 	"github.com/jackc/pgx/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -51,7 +57,7 @@ bar   `, `'bar' 'foo'`},
 		{`'\:'`, `':'`},
 		{`'\ '`, `' '`},
 		{`\ `, `' '`},
-		{`\\`, `'\'`},
+		{`\\`, `'\\'`},
 		{`:3`, `':3'`},
 		{`::3`, `':':3`},
 		{`:3:3`, `':3':3`},
@@ -69,6 +75,8 @@ bar   `, `'bar' 'foo'`},
 		{`'blah'`, `'blah'`},
 		{`'blah':3`, `'blah':3`},
 		{`'bla\'h'`, `'bla''h'`},
+		{`'bla''h'`, `'bla''h'`},
+		{`'bla''h':3A`, `'bla''h':3A`},
 		{`'bla\h'`, `'blah'`},
 		{`'bla\ h'`, `'bla h'`},
 		{`'bla h'`, `'bla h'`},
@@ -81,6 +89,9 @@ bar   `, `'bar' 'foo'`},
 		{`foo:3,1`, `'foo':1,3`},
 		{`foo:3,2,1 foo:1,2,3`, `'foo':1,2,3`},
 		{`a:3 b:2 a:1`, `'a':1,3 'b':2`},
+		// Duplicate positions keep the highest weight.
+		{`foo:1C,1A,1B`, `'foo':1A`},
+		{`foo:2,1C foo:1B`, `'foo':1B,2`},
 	}
 	for _, tc := range tcs {
 		t.Log(tc.input)
@@ -90,6 +101,15 @@ bar   `, `'bar' 'foo'`},
 		assert.Equal(t, tc.expectedStr, actual)
 	}
 
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, tc := range tcs {
+			t.Log(tc.expectedStr)
+			vec, err := ParseTSVector(tc.expectedStr)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedStr, vec.String())
+		}
+	})
+
 	t.Run("ComparePG", func(t *testing.T) {
 		// This test can be manually run by pointing it to a local Postgres. There
 		// are no requirements for the contents of the local Postgres - it just runs
@@ -104,11 +124,6 @@ bar   `, `'bar' 'foo'`},
 			var actual string
 			row := conn.QueryRow(context.Background(), "SELECT $1::TSVector", tc.input)
 			require.NoError(t, row.Scan(&actual))
-			// To make sure that our tests behave as expected, we need to remove
-			// doubled backslashes from Postgres's output. Confusingly, even in the
-			// protocol that pgx uses, the actual text returned for a string
-			// containing a backslash doubles all backslash literals.
-			actual = strings.ReplaceAll(actual, `\\`, `\`)
 			assert.Equal(t, tc.expectedStr, actual)
 		}
 	})
@@ -133,6 +148,8 @@ func TestParseTSVectorError(t *testing.T) {
 		t.Log(tc)
 		_, err := ParseTSVector(tc)
 		assert.Error(t, err)
+		var parseErr *ParseError
+		assert.True(t, errors.As(err, &parseErr))
 	}
 }
 
@@ -145,3 +162,921 @@ func TestParseTSRandom(t *testing.T) {
 		_, _ = ParseTSQuery(string(b))
 	}
 }
+
+func TestQuoteLexeme(t *testing.T) {
+	for _, tc := range []struct {
+		lexeme   string
+		expected string
+	}{
+		{`foo`, `'foo'`},
+		{``, `''`},
+		{`foo bar`, `'foo bar'`},
+		{`it's`, `'it''s'`},
+		{`''`, `''''''`},
+		{`a\b`, `'a\\b'`},
+		{`\'`, `'\\'''`},
+		{`a:1`, `'a:1'`},
+		{`a & !b | (c <-> d)`, `'a & !b | (c <-> d)'`},
+		{`über`, `'über'`},
+	} {
+		actual := QuoteLexeme(tc.lexeme)
+		assert.Equal(t, tc.expected, actual)
+		if tc.lexeme == "" {
+			continue
+		}
+
+		// The quoted lexeme must parse back into the same single lexeme.
+		v, err := ParseTSVector(actual)
+		require.NoError(t, err)
+		require.Len(t, v, 1)
+		assert.Equal(t, tc.lexeme, v[0].lexeme)
+
+		q, err := ParseTSQuery(actual)
+		require.NoError(t, err)
+		require.Equal(t, invalid, q.root.op)
+		assert.Equal(t, tc.lexeme, q.root.term.lexeme)
+		assert.Equal(t, actual, q.String())
+	}
+}
+
+func TestDiffTSVector(t *testing.T) {
+	for _, tc := range []struct {
+		a, b            string
+		added, removed  []string
+		positionChanges map[string][2][]int
+	}{
+		{a: ``, b: ``},
+		{a: `a:1 b:2`, b: `a:1 b:2`},
+		{a: ``, b: `a:1 b:2`, added: []string{"a", "b"}},
+		{a: `a:1 b:2`, b: ``, removed: []string{"a", "b"}},
+		{a: `a:1 c:2 e:3`, b: `b:1 c:2 d:3`, added: []string{"b", "d"}, removed: []string{"a", "e"}},
+		{
+			a:               `a:1 b:2,3`,
+			b:               `a:1 b:2,4`,
+			positionChanges: map[string][2][]int{"b": {{2, 3}, {2, 4}}},
+		},
+		{
+			a:               `a:1 b`,
+			b:               `a b:5`,
+			positionChanges: map[string][2][]int{"a": {{1}, nil}, "b": {nil, {5}}},
+		},
+		{
+			// A weight change is reported, even though the positions are equal.
+			a:               `a:1A`,
+			b:               `a:1B`,
+			positionChanges: map[string][2][]int{"a": {{1}, {1}}},
+		},
+		{
+			a:               `a:1 b:2 c:3`,
+			b:               `b:5 c:3 d:4`,
+			added:           []string{"d"},
+			removed:         []string{"a"},
+			positionChanges: map[string][2][]int{"b": {{2}, {5}}},
+		},
+	} {
+		t.Log(tc.a, tc.b)
+		a, err := ParseTSVector(tc.a)
+		require.NoError(t, err)
+		b, err := ParseTSVector(tc.b)
+		require.NoError(t, err)
+		added, removed, positionChanges := DiffTSVector(a, b)
+		assert.Equal(t, tc.added, added)
+		assert.Equal(t, tc.removed, removed)
+		assert.Equal(t, tc.positionChanges, positionChanges)
+	}
+}
+
+func TestTSVectorChecksum(t *testing.T) {
+	vectors := []string{
+		``,
+		`a`,
+		`b`,
+		`a:1`,
+		`a:2`,
+		`a:1A`,
+		`a:1B`,
+		`a:1,2`,
+		`a:1 b:2`,
+		`ab:1`,
+		`a b`,
+	}
+	seen := make(map[uint32]string)
+	for _, input := range vectors {
+		v, err := ParseTSVector(input)
+		require.NoError(t, err)
+		checksum := v.Checksum()
+		if other, ok := seen[checksum]; ok {
+			t.Errorf("%q and %q have the same checksum %d", input, other, checksum)
+		}
+		seen[checksum] = input
+
+		// The checksum only depends on the contents of the vector.
+		clone := make(TSVector, len(v), len(v)+10)
+		for i := range v {
+			clone[i] = tsTerm{
+				lexeme:    strings.Clone(v[i].lexeme),
+				positions: append(make([]tsPosition, 0, 20), v[i].positions...),
+			}
+		}
+		assert.Equal(t, checksum, clone.Checksum())
+	}
+
+	// The checksum is the CRC32 of the Postgres binary encoding of the vector,
+	// so it's stable.
+	v, err := ParseTSVector(`a:1A,3 bc`)
+	require.NoError(t, err)
+	encoding := []byte{
+		0, 0, 0, 2,
+		'a', 0, 0, 2, 0xc0, 1, 0, 3,
+		'b', 'c', 0, 0, 0,
+	}
+	assert.Equal(t, crc32.ChecksumIEEE(encoding), v.Checksum())
+}
+
+func TestParseWeight(t *testing.T) {
+	for _, tc := range []struct {
+		label    byte
+		expected Weight
+	}{
+		{'A', WeightA},
+		{'a', WeightA},
+		{'B', WeightB},
+		{'b', WeightB},
+		{'C', WeightC},
+		{'c', WeightC},
+		{'D', WeightD},
+		{'d', WeightD},
+	} {
+		w, err := ParseWeight(tc.label)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, w)
+		assert.Equal(t, strings.ToUpper(string(tc.label)), string(w.Byte()))
+		assert.Equal(t, strings.ToUpper(string(tc.label)), w.String())
+	}
+
+	for _, label := range []byte{'E', 'e', '*', '0', 0, 1, 2, 4, 8} {
+		_, err := ParseWeight(label)
+		require.Error(t, err)
+		assert.Equal(t, pgcode.InvalidParameterValue, pgerror.GetPGCode(err))
+	}
+
+	// The weights are ordered from the lowest to the highest.
+	assert.Less(t, WeightD, WeightC)
+	assert.Less(t, WeightC, WeightB)
+	assert.Less(t, WeightB, WeightA)
+
+	// The zero value is weight D.
+	var zero Weight
+	assert.Equal(t, WeightD, zero)
+	assert.Equal(t, `D`, zero.String())
+	assert.Equal(t, `invalid`, Weight(weightD).String())
+	assert.Equal(t, `invalid`, Weight(weightA|weightB).String())
+	assert.Panics(t, func() { _ = Weight(weightStar).Byte() })
+}
+
+// parseWeights returns the weights of the input labels, for the test cases
+// that list weights.
+func parseWeights(t *testing.T, labels string) []Weight {
+	var ret []Weight
+	for i := 0; i < len(labels); i++ {
+		w, err := ParseWeight(labels[i])
+		require.NoError(t, err)
+		ret = append(ret, w)
+	}
+	return ret
+}
+
+// weightLabels returns the labels of the input weights.
+func weightLabels(weights []Weight) string {
+	var ret strings.Builder
+	for _, w := range weights {
+		ret.WriteByte(w.Byte())
+	}
+	return ret.String()
+}
+
+func TestTSVectorSetWeight(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		weight   Weight
+		expected string
+	}{
+		{``, WeightA, ``},
+		{`foo`, WeightA, `'foo'`},
+		{`foo:1 bar:2,3`, WeightA, `'bar':2A,3A 'foo':1A`},
+		{`foo:1 bar:2,3`, WeightB, `'bar':2B,3B 'foo':1B`},
+		{`foo:1A bar:2B,3C`, WeightD, `'bar':2,3 'foo':1`},
+		{`foo:1A bar:2B,3C baz`, WeightC, `'bar':2C,3C 'baz' 'foo':1C`},
+	} {
+		t.Log(tc.input)
+		v, err := ParseTSVector(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, v.SetWeight(tc.weight).String())
+	}
+
+	v, err := ParseTSVector(`foo:1`)
+	require.NoError(t, err)
+	// The input must not be modified.
+	_ = v.SetWeight(WeightA)
+	assert.Equal(t, `'foo':1`, v.String())
+
+	t.Run("Sequences", func(t *testing.T) {
+		// Weights are replaced rather than accumulated, so only the last weight
+		// of a sequence of calls matters, and repeating a call is a no-op.
+		for _, tc := range []struct {
+			input    string
+			weights  string
+			expected string
+		}{
+			{`foo:1 bar:2,3`, `AA`, `'bar':2A,3A 'foo':1A`},
+			{`foo:1 bar:2,3`, `AB`, `'bar':2B,3B 'foo':1B`},
+			{`foo:1 bar:2,3`, `BA`, `'bar':2A,3A 'foo':1A`},
+			{`foo:1 bar:2,3`, `ACD`, `'bar':2,3 'foo':1`},
+			{`foo:1 bar:2,3`, `DD`, `'bar':2,3 'foo':1`},
+			{`foo:1A bar:2B,3C`, `CCC`, `'bar':2C,3C 'foo':1C`},
+			{`foo:1A bar:2B,3 baz`, `Bb`, `'bar':2B,3B 'baz' 'foo':1B`},
+		} {
+			t.Log(tc)
+			v, err := ParseTSVector(tc.input)
+			require.NoError(t, err)
+			weights := parseWeights(t, tc.weights)
+			for i := range weights {
+				prev := v
+				v = v.SetWeight(weights[i])
+				if i > 0 && weights[i] == weights[i-1] {
+					assert.True(t, v.Equal(prev))
+				}
+			}
+			assert.Equal(t, tc.expected, v.String())
+			for i := range v {
+				for _, pos := range v[i].positions {
+					// At most a single weight bit is set for every position.
+					assert.Contains(t, []tsWeight{0, weightC, weightB, weightA}, pos.weight)
+				}
+			}
+		}
+	})
+}
+
+func TestTSVectorKeepWeights(t *testing.T) {
+	v, err := ParseTSVector(`a:1A,2C b:3B c:4 d e:5A,6B,7`)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		weights  string
+		expected string
+	}{
+		{`A`, `'a':1A 'e':5A`},
+		{`ab`, `'a':1A 'b':3B 'e':5A,6B`},
+		{`D`, `'c':4 'e':7`},
+		{`ABCD`, `'a':1A,2C 'b':3B 'c':4 'e':5A,6B,7`},
+		{``, ``},
+	} {
+		t.Log(tc.weights)
+		actual := v.KeepWeights(parseWeights(t, tc.weights))
+		assert.Equal(t, tc.expected, actual.String())
+	}
+	// The receiver isn't modified.
+	assert.Equal(t, `'a':1A,2C 'b':3B 'c':4 'd' 'e':5A,6B,7`, v.String())
+}
+
+func TestTSVectorStripPositionsKeepWeights(t *testing.T) {
+	v, err := ParseTSVector(`a:1A,2C b:3B c:4 d e:5,6C,7`)
+	require.NoError(t, err)
+	stripped := v.StripPositionsKeepWeights()
+	assert.Equal(t, []LexemeWeight{
+		{Lexeme: "a", Weight: WeightA},
+		{Lexeme: "b", Weight: WeightB},
+		{Lexeme: "c", Weight: WeightD},
+		{Lexeme: "d", Weight: WeightD},
+		{Lexeme: "e", Weight: WeightC},
+	}, stripped)
+	// The receiver isn't modified.
+	assert.Equal(t, `'a':1A,2C 'b':3B 'c':4 'd' 'e':5,6C,7`, v.String())
+	assert.Empty(t, TSVector{}.StripPositionsKeepWeights())
+
+	t.Run("Rank", func(t *testing.T) {
+		// The kept weights are used for ranking: a lexeme that was kept with
+		// weight A ranks higher than one that was kept with weight D, which
+		// ranks the same as it does in a vector that was stripped of all
+		// positions.
+		rankOf := func(query string, lw []LexemeWeight) float32 {
+			q, err := ParseTSQuery(query)
+			require.NoError(t, err)
+			r, err := RankLexemeWeights(DefaultRankWeights, lw, q, 0)
+			require.NoError(t, err)
+			return r
+		}
+		assert.Greater(t, rankOf(`a`, stripped), rankOf(`c`, stripped))
+		assert.Greater(t, rankOf(`a & b`, stripped), rankOf(`c & d`, stripped))
+		assert.Equal(t, float32(0), rankOf(`a:C`, stripped))
+		assert.Greater(t, rankOf(`a:A`, stripped), float32(0))
+		assert.Equal(t, float32(0), rankOf(`x`, stripped))
+		assert.Equal(t, float32(0), rankOf(`a`, nil))
+
+		plain, err := ParseTSVector(`a b c d e`)
+		require.NoError(t, err)
+		for _, query := range []string{`a`, `c`, `a & c`, `a | e`} {
+			q, err := ParseTSQuery(query)
+			require.NoError(t, err)
+			expected, err := Rank(DefaultRankWeights, plain, q, RankNormLength)
+			require.NoError(t, err)
+			actual, err := RankLexemeWeights(DefaultRankWeights, plain.StripPositionsKeepWeights(), q, RankNormLength)
+			require.NoError(t, err)
+			assert.Equal(t, expected, actual, query)
+		}
+		assert.Greater(t, rankOf(`a`, stripped), rankOf(`a`, plain.StripPositionsKeepWeights()))
+		assert.Equal(t, rankOf(`c`, stripped), rankOf(`c`, plain.StripPositionsKeepWeights()))
+
+		q, err := ParseTSQuery(`a`)
+		require.NoError(t, err)
+		_, err = RankLexemeWeights(DefaultRankWeights, []LexemeWeight{{Lexeme: "b"}, {Lexeme: "a"}}, q, 0)
+		assert.EqualError(t, err, `lexemes must be sorted and unique: "a" follows "b"`)
+	})
+}
+
+func TestConcat(t *testing.T) {
+	for _, tc := range []struct {
+		l, r     string
+		expected string
+	}{
+		{``, ``, ``},
+		{`a:1`, ``, `'a':1`},
+		{``, `a:1`, `'a':1`},
+		{`a:1 b:2`, `c:1 d:2`, `'a':1 'b':2 'c':3 'd':4`},
+		{`a:1 b:2`, `a:1 b:2`, `'a':1,3 'b':2,4`},
+		{`a:1A b:3`, `a:1 c:2B`, `'a':1A,4 'b':3 'c':5B`},
+		{`a b`, `a:1 c:2`, `'a':1 'b' 'c':2`},
+		{`a:1 b:2`, `a c`, `'a':1 'b':2 'c'`},
+		{`a:16380`, `a:1 b:10`, `'a':16380,16381 'b':16383`},
+	} {
+		t.Log(tc)
+		l, err := ParseTSVector(tc.l)
+		require.NoError(t, err)
+		r, err := ParseTSVector(tc.r)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, Concat(l, r).String())
+	}
+}
+
+func TestMergeTSVectors(t *testing.T) {
+	for _, tc := range []struct {
+		vectors  []string
+		baseGap  int
+		expected string
+	}{
+		{nil, 0, ``},
+		{[]string{``, ``}, 0, ``},
+		{[]string{`a:1 b:2`}, 0, `'a':1 'b':2`},
+		{[]string{`a:1 b:2`, `a:1 c:2`, `b:1,2 d:3`}, 0, `'a':1,3 'b':2,5,6 'c':4 'd':7`},
+		{[]string{`a:1 b:2`, `a:1 c:2`, `b:1,2 d:3`}, 10, `'a':1,13 'b':2,25,26 'c':14 'd':27`},
+		{[]string{`a:1 b:2`, `a:1 c:2`}, -5, `'a':1,3 'b':2 'c':4`},
+		{[]string{`a:1A b`, ``, `a:2B c`}, 1, `'a':1A,5B 'b' 'c'`},
+		{[]string{`a:16380`, `a:1 b:10`, `c:1`}, 0, `'a':16380,16381 'b':16383 'c':16383`},
+	} {
+		t.Log(tc)
+		assert.Equal(t, tc.expected, MergeTSVectors(parseTSVectors(t, tc.vectors...), tc.baseGap).String())
+	}
+
+	t.Run("Concat", func(t *testing.T) {
+		// Merging without a gap is the same as concatenating from left to right.
+		rng, _ := randutil.NewTestRand()
+		lexemes := []string{"a", "b", "c", "d", "e", "f", "g"}
+		for i := 0; i < 100; i++ {
+			vectors := make([]TSVector, rng.Intn(6))
+			for j := range vectors {
+				var doc []string
+				for k := rng.Intn(20); k > 0; k-- {
+					doc = append(doc, lexemes[rng.Intn(len(lexemes))])
+				}
+				v, err := DocumentToTSVector("simple", strings.Join(doc, " "))
+				require.NoError(t, err)
+				vectors[j] = v
+			}
+			expected := TSVector{}
+			for _, v := range vectors {
+				expected = Concat(expected, v)
+			}
+			actual := MergeTSVectors(vectors, 0)
+			assert.Equal(t, expected.String(), actual.String())
+			assert.True(t, actual.IsNormalized())
+		}
+	})
+
+	t.Run("WeightConflicts", func(t *testing.T) {
+		for _, tc := range []struct {
+			vectors []string
+			max     string
+			first   string
+		}{
+			{[]string{`a:1A b:2B`, `a:1C c:2`}, `'a':1A,3C 'b':2B 'c':4`, `'a':1A,3C 'b':2B 'c':4`},
+			{[]string{`a:16383C`, `a:1A`}, `'a':16383A`, `'a':16383C`},
+			{[]string{`a:16383`, `a:1B`, `a:1A`}, `'a':16383A`, `'a':16383`},
+			{[]string{`a:16383A b:5`, `a:1 b:1C`}, `'a':16383A 'b':5,16383C`, `'a':16383A 'b':5,16383C`},
+		} {
+			t.Log(tc)
+			vectors := parseTSVectors(t, tc.vectors...)
+			actual := MergeTSVectorsWithPolicy(vectors, 0, WeightConflictMax)
+			assert.Equal(t, tc.max, actual.String())
+			assert.Equal(t, tc.max, MergeTSVectors(vectors, 0).String())
+			actual = MergeTSVectorsWithPolicy(vectors, 0, WeightConflictFirst)
+			assert.Equal(t, tc.first, actual.String())
+			assert.True(t, actual.IsNormalized())
+		}
+	})
+}
+
+func TestBuildWeightedVector(t *testing.T) {
+	v, err := BuildWeightedVector("simple", []WeightedField{
+		{Text: "The quick fox", Weight: 'A'},
+		{Text: "", Weight: 'C'},
+		{Text: "a quick brown fox jumps", Weight: 'B'},
+		{Text: "the end", Weight: 'D'},
+	})
+	require.NoError(t, err)
+	assert.Equal(t,
+		`'a':4B 'brown':6B 'end':10 'fox':3A,7B 'jumps':8B 'quick':2A,5B 'the':1A,9`,
+		v.String(),
+	)
+
+	v, err = BuildWeightedVector("simple", nil)
+	require.NoError(t, err)
+	assert.Equal(t, ``, v.String())
+
+	_, err = BuildWeightedVector("simple", []WeightedField{{Text: "foo", Weight: 'X'}})
+	assert.Error(t, err)
+	_, err = BuildWeightedVector("klingon", []WeightedField{{Text: "foo", Weight: 'A'}})
+	assert.Error(t, err)
+}
+
+func TestTSVectorUnnestByWeight(t *testing.T) {
+	v, err := ParseTSVector(`b:3A,1C a:3A,4 c:2B d e:5D`)
+	require.NoError(t, err)
+	assert.Equal(t, map[Weight][]WeightedPosition{
+		WeightA: {{Lexeme: "a", Position: 3, Weight: WeightA}, {Lexeme: "b", Position: 3, Weight: WeightA}},
+		WeightB: {{Lexeme: "c", Position: 2, Weight: WeightB}},
+		WeightC: {{Lexeme: "b", Position: 1, Weight: WeightC}},
+		WeightD: {{Lexeme: "a", Position: 4, Weight: WeightD}, {Lexeme: "e", Position: 5, Weight: WeightD}},
+	}, v.UnnestByWeight())
+
+	v, err = ParseTSVector(`a b`)
+	require.NoError(t, err)
+	assert.Empty(t, v.UnnestByWeight())
+}
+
+func TestTSVectorToArrayAndUnnest(t *testing.T) {
+	v, err := ParseTSVector(`b:3,1A é:2C a Z:4 ab:5B,2`)
+	require.NoError(t, err)
+	// The lexemes are sorted in byte order, like in the C collation.
+	assert.Equal(t, []string{"Z", "a", "ab", "b", "é"}, v.ToArray())
+	assert.Equal(t, []UnnestEntry{
+		{Lexeme: "Z", Positions: []int{4}, Weights: []byte("D")},
+		{Lexeme: "a"},
+		{Lexeme: "ab", Positions: []int{2, 5}, Weights: []byte("DB")},
+		{Lexeme: "b", Positions: []int{1, 3}, Weights: []byte("AD")},
+		{Lexeme: "é", Positions: []int{2}, Weights: []byte("C")},
+	}, v.Unnest())
+
+	assert.Empty(t, TSVector{}.ToArray())
+	assert.Empty(t, TSVector{}.Unnest())
+
+	t.Run("Order", func(t *testing.T) {
+		// The order doesn't depend on whether the receiver is normalized.
+		unnormalized := TSVector{
+			testTerm("é", testPos(2, weightC)),
+			testTerm("b", testPos(3, 0), testPos(1, weightA)),
+			testTerm("ab", testPos(5, weightB)),
+			testTerm("Z", testPos(4, 0)),
+			testTerm("a"),
+			testTerm("ab", testPos(2, 0)),
+		}
+		before := unnormalized.String()
+		assert.Equal(t, v.ToArray(), unnormalized.ToArray())
+		assert.Equal(t, v.Unnest(), unnormalized.Unnest())
+		assert.Equal(t, before, unnormalized.String())
+
+		rng, _ := randutil.NewTestRand()
+		chars := []string{"a", "A", "b", "B", "z", "Z", "0", "é", "ü"}
+		for i := 0; i < 100; i++ {
+			v := make(TSVector, rng.Intn(10))
+			for j := range v {
+				var lexeme strings.Builder
+				for k := 1 + rng.Intn(3); k > 0; k-- {
+					lexeme.WriteString(chars[rng.Intn(len(chars))])
+				}
+				v[j].lexeme = lexeme.String()
+				for k := rng.Intn(4); k > 0; k-- {
+					v[j].positions = append(v[j].positions, tsPosition{
+						position: 1 + rng.Intn(20), weight: tsWeight(1 << rng.Intn(4)),
+					})
+				}
+			}
+			lexemes := v.ToArray()
+			assert.True(t, sort.StringsAreSorted(lexemes))
+			entries := v.Unnest()
+			require.Len(t, entries, len(lexemes))
+			for j, e := range entries {
+				assert.Equal(t, lexemes[j], e.Lexeme)
+				for k := 1; k < len(e.Positions); k++ {
+					assert.Less(t, e.Positions[k-1], e.Positions[k])
+				}
+				assert.Len(t, e.Weights, len(e.Positions))
+			}
+		}
+	})
+}
+
+func TestTSVectorLexemeWeights(t *testing.T) {
+	v, err := ParseTSVector(`a:1A,2,3A b:1B,2C,3D,4A c d:4C`)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		lexeme   string
+		expected string
+		found    bool
+	}{
+		{`a`, `AD`, true},
+		{`b`, `ABCD`, true},
+		{`c`, `D`, true},
+		{`d`, `C`, true},
+		{`e`, ``, false},
+		{``, ``, false},
+		{`aa`, ``, false},
+	} {
+		t.Log(tc)
+		weights, found := v.LexemeWeights(tc.lexeme)
+		assert.Equal(t, tc.found, found)
+		assert.Equal(t, tc.expected, weightLabels(weights))
+	}
+
+	allocs := testing.AllocsPerRun(10, func() {
+		if _, found := v.LexemeWeights(`bb`); found {
+			t.Fatal("unexpected lexeme")
+		}
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestTSVectorWeightsPresent(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{``, ``},
+		{`a`, `D`},
+		{`a:1`, `D`},
+		{`a:1A`, `A`},
+		{`a:1A b`, `AD`},
+		{`a:1A,2 b:3B`, `ABD`},
+		{`a:1C,2B b:3A,4`, `ABCD`},
+		{`a:1C b:2B,3C`, `BC`},
+	} {
+		t.Log(tc)
+		v, err := ParseTSVector(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, weightLabels(v.WeightsPresent()))
+	}
+
+	v, err := ParseTSVector(`a:1A,2 b:3C c:4,5`)
+	require.NoError(t, err)
+	assert.Equal(t, []Weight{WeightB}, v.SetWeight(WeightB).WeightsPresent())
+	assert.Nil(t, TSVector{}.WeightsPresent())
+}
+
+func TestTSVectorTruncate(t *testing.T) {
+	v, err := ParseTSVector(`the:1,6,11 quick:2 brown:3A fox:4,9 jumps:5 over:7 lazy:8 dog:10B x y`)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		maxLexemes int
+		by         TruncateStrategy
+		expected   string
+	}{
+		{3, TruncateByPosition, `'brown':3A 'quick':2 'the':1,6,11`},
+		{8, TruncateByPosition, `'brown':3A 'dog':10B 'fox':4,9 'jumps':5 'lazy':8 'over':7 'quick':2 'the':1,6,11`},
+		{9, TruncateByPosition, `'brown':3A 'dog':10B 'fox':4,9 'jumps':5 'lazy':8 'over':7 'quick':2 'the':1,6,11 'x'`},
+		{1, TruncateByFrequency, `'the':1,6,11`},
+		{3, TruncateByFrequency, `'brown':3A 'fox':4,9 'the':1,6,11`},
+		{4, TruncateByLexeme, `'brown':3A 'dog':10B 'fox':4,9 'jumps':5`},
+		{10, TruncateByFrequency, v.String()},
+		{0, TruncateByPosition, v.String()},
+	} {
+		t.Log(tc)
+		actual := v.Truncate(tc.maxLexemes, tc.by)
+		assert.Equal(t, tc.expected, actual.String())
+		assert.True(t, actual.IsNormalized())
+	}
+
+	// The kept lexemes still match phrases at their original positions.
+	truncated := v.Truncate(4, TruncateByPosition)
+	for _, query := range []string{`the <-> quick`, `the <3> fox`, `fox <5> fox`} {
+		q, err := ParseTSQuery(query)
+		require.NoError(t, err)
+		matches, err := EvalTSQuery(q, truncated)
+		require.NoError(t, err)
+		assert.True(t, matches, query)
+	}
+}
+
+func TestTSVectorHeadLexemes(t *testing.T) {
+	v, err := ParseTSVector(`fox:4,9 quick:2 the:1,7 brown:3A lazy:8 dog:10 jumps:5 over:6 a b:11`)
+	require.NoError(t, err)
+	assert.Equal(t, []LexemeEntry{
+		{Lexeme: "the", Positions: []int{1}},
+		{Lexeme: "quick", Positions: []int{2}},
+		{Lexeme: "brown", Positions: []int{3}},
+		{Lexeme: "fox", Positions: []int{4}},
+	}, v.HeadLexemes(4))
+	assert.Equal(t, []LexemeEntry{
+		{Lexeme: "the", Positions: []int{1, 7}},
+		{Lexeme: "quick", Positions: []int{2}},
+		{Lexeme: "brown", Positions: []int{3}},
+		{Lexeme: "fox", Positions: []int{4, 9}},
+		{Lexeme: "jumps", Positions: []int{5}},
+		{Lexeme: "over", Positions: []int{6}},
+		{Lexeme: "lazy", Positions: []int{8}},
+	}, v.HeadLexemes(9))
+	assert.Len(t, v.HeadLexemes(100), 9)
+	assert.Nil(t, v.HeadLexemes(0))
+
+	// Positions are counted once even if they're shared by several lexemes,
+	// and gaps between positions are skipped.
+	v, err = ParseTSVector(`b:5 a:5 c:20 d:30`)
+	require.NoError(t, err)
+	assert.Equal(t, []LexemeEntry{
+		{Lexeme: "a", Positions: []int{5}},
+		{Lexeme: "b", Positions: []int{5}},
+		{Lexeme: "c", Positions: []int{20}},
+	}, v.HeadLexemes(2))
+
+	v, err = ParseTSVector(`a b`)
+	require.NoError(t, err)
+	assert.Nil(t, v.HeadLexemes(3))
+}
+
+func TestTSVectorReconstruct(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{``, ``},
+		{`a b`, ``},
+		{`a:1`, `a`},
+		{`b:1 a:2`, `b a`},
+		{`cat:2,5 the:1,4 sat:3`, `the cat sat the cat`},
+		{`b:1 a:1 c:2`, `a b c`},
+		{`a:3 b:1 c`, `b a`},
+		{`'fat cat':1A dog:7`, `fat cat dog`},
+	} {
+		t.Log(tc.input)
+		v, err := ParseTSVector(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, v.Reconstruct())
+	}
+
+	t.Run("Document", func(t *testing.T) {
+		v, err := DocumentToTSVector("simple", "The Fat cat, the RAT!")
+		require.NoError(t, err)
+		assert.Equal(t, `the fat cat the rat`, v.Reconstruct())
+	})
+}
+
+func TestTSVectorRename(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		from, to string
+		expected string
+	}{
+		{``, `a`, `b`, ``},
+		{`a:1`, `a`, `b`, `'b':1`},
+		{`a:1`, `c`, `b`, `'a':1`},
+		{`a:1`, `a`, `a`, `'a':1`},
+		{`a:1,3A b:2`, `a`, `c`, `'b':2 'c':1,3A`},
+		{`b:2 c:1`, `c`, `a`, `'a':1 'b':2`},
+		{`a b`, `a`, `c`, `'b' 'c'`},
+		// The positions are merged with the ones of an existing lexeme.
+		{`a:1,4 b:2,3`, `a`, `b`, `'b':1,2,3,4`},
+		{`a:1,4 b:2,3 c:5`, `c`, `a`, `'a':1,4,5 'b':2,3`},
+		{`a:1A,2B b:1,2C,3`, `a`, `b`, `'b':1A,2B,3`},
+		{`a:1,2 b:1C,2A`, `a`, `b`, `'b':1C,2A`},
+		{`a:1 b`, `b`, `a`, `'a':1`},
+		{`a b`, `b`, `a`, `'a'`},
+		{`'fat cat':1 'fat':2`, `fat cat`, `fat`, `'fat':1,2`},
+	} {
+		t.Log(tc)
+		v, err := ParseTSVector(tc.input)
+		require.NoError(t, err)
+		original := v.String()
+		actual, err := v.Rename(tc.from, tc.to)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual.String())
+		assert.True(t, actual.IsNormalized())
+		// The receiver isn't modified.
+		assert.Equal(t, original, v.String())
+	}
+
+	t.Run("PositionLimit", func(t *testing.T) {
+		var a, b []string
+		for i := 1; i <= MaxPositionsPerLexeme; i++ {
+			a = append(a, strconv.Itoa(2*i-1))
+			b = append(b, strconv.Itoa(2*i))
+		}
+		v, err := ParseTSVector(`a:` + strings.Join(a, ",") + ` b:` + strings.Join(b, ","))
+		require.NoError(t, err)
+		actual, err := v.Rename("a", "b")
+		require.NoError(t, err)
+		require.Len(t, actual, 1)
+		require.Len(t, actual[0].positions, MaxPositionsPerLexeme)
+		assert.Equal(t, 1, actual[0].positions[0].position)
+		assert.Equal(t, MaxPositionsPerLexeme, actual[0].positions[MaxPositionsPerLexeme-1].position)
+	})
+
+	t.Run("Phrase", func(t *testing.T) {
+		v, err := ParseTSVector(`colour:2 the:1 bright:3 color:4`)
+		require.NoError(t, err)
+		q, err := ParseTSQuery(`the <-> color`)
+		require.NoError(t, err)
+		v, err = v.Rename("colour", "color")
+		require.NoError(t, err)
+		matches, err := EvalTSQuery(q, v)
+		require.NoError(t, err)
+		assert.True(t, matches)
+	})
+
+	t.Run("InvalidLexeme", func(t *testing.T) {
+		v, err := ParseTSVector(`a:1`)
+		require.NoError(t, err)
+		_, err = v.Rename("a", "")
+		require.Error(t, err)
+		assert.Equal(t, pgcode.InvalidParameterValue, pgerror.GetPGCode(err))
+		assert.Contains(t, err.Error(), "lexeme must not be empty")
+
+		_, err = v.Rename("a", strings.Repeat("a", MaxLexemeLen+1))
+		require.Error(t, err)
+		assert.Equal(t, pgcode.ProgramLimitExceeded, pgerror.GetPGCode(err))
+		assert.Contains(t, err.Error(), "word is too long (2047 bytes, max 2046 bytes)")
+
+		// The longest lexeme is allowed.
+		_, err = v.Rename("a", strings.Repeat("a", MaxLexemeLen))
+		require.NoError(t, err)
+	})
+}
+
+// testTerm returns a term of a TSVector with the input lexeme and positions,
+// for building vectors that aren't normalized.
+func testTerm(lexeme string, positions ...tsPosition) tsTerm {
+	return tsTerm{lexeme: lexeme, positions: positions}
+}
+
+// testPos returns a position of a term of a TSVector.
+func testPos(p int, w tsWeight) tsPosition {
+	return tsPosition{position: p, weight: w}
+}
+
+func TestTSVectorNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		input      TSVector
+		normalized bool
+		expected   string
+	}{
+		{TSVector{}, true, ``},
+		{TSVector{testTerm("a")}, true, `'a'`},
+		{TSVector{testTerm("a", testPos(1, 0)), testTerm("b", testPos(1, 0), testPos(2, weightA))}, true, `'a':1 'b':1,2A`},
+		// Unsorted lexemes.
+		{TSVector{testTerm("b", testPos(1, 0)), testTerm("a", testPos(2, 0))}, false, `'a':2 'b':1`},
+		// Duplicate lexemes.
+		{TSVector{testTerm("a", testPos(3, 0)), testTerm("b"), testTerm("a", testPos(1, 0))}, false, `'a':1,3 'b'`},
+		// Unsorted positions.
+		{TSVector{testTerm("a", testPos(3, 0), testPos(1, weightB))}, false, `'a':1B,3`},
+		// Duplicate positions keep the highest weight.
+		{TSVector{testTerm("a", testPos(1, weightC), testPos(1, weightA), testPos(1, 0))}, false, `'a':1A`},
+		{TSVector{testTerm("a", testPos(2, 0)), testTerm("a", testPos(2, weightB))}, false, `'a':2B`},
+	} {
+		t.Log(tc.expected)
+		assert.Equal(t, tc.normalized, tc.input.IsNormalized())
+		inputStr := tc.input.String()
+		normalized := tc.input.Normalize()
+		assert.True(t, normalized.IsNormalized())
+		assert.Equal(t, tc.expected, normalized.String())
+		// The input must not be modified.
+		assert.Equal(t, inputStr, tc.input.String())
+	}
+
+	// Every constructor must produce normalized vectors.
+	for _, input := range []string{`c:3 a:2,1 b a:1`, `foo:1A,1B,1C`} {
+		v, err := ParseTSVector(input)
+		require.NoError(t, err)
+		assert.True(t, v.IsNormalized())
+	}
+	v, err := DocumentToTSVector("simple", "the cat sat on the mat with the cat")
+	require.NoError(t, err)
+	assert.True(t, v.IsNormalized())
+	v, err = BuildWeightedVector("simple", []WeightedField{{Text: "b a", Weight: 'A'}, {Text: "a b", Weight: 'B'}})
+	require.NoError(t, err)
+	assert.True(t, v.IsNormalized())
+}
+
+func TestTSVectorEqual(t *testing.T) {
+	for _, tc := range []struct {
+		a, b     string
+		expected bool
+	}{
+		{``, ``, true},
+		{`a`, `a`, true},
+		{`a:1 b:2`, `b:2 a:1`, true},
+		{`a:1A,2`, `a:2,1A`, true},
+		{`a:1 b:2`, `a:1 b:2 c:3`, false},
+		{`a:1 b:2`, `a:1 c:2`, false},
+		{`a:1`, `a`, false},
+		{`a:1`, `a:2`, false},
+		{`a:1`, `a:1,2`, false},
+		{`a:1A`, `a:1B`, false},
+		{`a:1A`, `a:1`, false},
+	} {
+		t.Log(tc)
+		a, err := ParseTSVector(tc.a)
+		require.NoError(t, err)
+		b, err := ParseTSVector(tc.b)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, a.Equal(b))
+		assert.Equal(t, tc.expected, b.Equal(a))
+	}
+
+	// Vectors that aren't normalized are compared by their normalized forms,
+	// without being modified.
+	normalized := TSVector{testTerm("a", testPos(1, weightA), testPos(3, 0)), testTerm("b", testPos(2, weightB))}
+	for _, v := range []TSVector{
+		{testTerm("b", testPos(2, weightB)), testTerm("a", testPos(3, 0), testPos(1, weightA))},
+		{testTerm("a", testPos(3, 0)), testTerm("b", testPos(2, weightB)), testTerm("a", testPos(1, weightA))},
+		{testTerm("a", testPos(1, weightC), testPos(3, 0), testPos(1, weightA)), testTerm("b", testPos(2, 0), testPos(2, weightB))},
+	} {
+		before := v.String()
+		assert.True(t, v.Equal(normalized), before)
+		assert.True(t, normalized.Equal(v), before)
+		assert.Equal(t, before, v.String())
+	}
+	assert.False(t, TSVector{testTerm("b", testPos(2, weightC)), testTerm("a", testPos(1, weightA), testPos(3, 0))}.Equal(normalized))
+}
+
+func TestTSVectorAppend(t *testing.T) {
+	for _, tc := range []struct {
+		vector   string
+		text     string
+		expected string
+	}{
+		{``, ``, ``},
+		{``, `the cat`, `'cat':2 'the':1`},
+		{`cat:2 the:1`, ``, `'cat':2 'the':1`},
+		{`cat:2 the:1`, `sat on the mat`, `'cat':2 'mat':6 'on':4 'sat':3 'the':1,5`},
+		{`cat:2A the:1A`, `The Cat`, `'cat':2A,4 'the':1A,3`},
+		{`cat the`, `the dog`, `'cat' 'dog':2 'the':1`},
+	} {
+		t.Log(tc)
+		v, err := ParseTSVector(tc.vector)
+		require.NoError(t, err)
+		actual, err := v.Append("simple", tc.text)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, actual.String())
+		assert.True(t, actual.IsNormalized())
+	}
+
+	// Appending in pieces is the same as parsing the whole document at once.
+	v, err := DocumentToTSVector("simple", "the quick brown fox")
+	require.NoError(t, err)
+	v, err = v.Append("simple", "jumps over the lazy dog")
+	require.NoError(t, err)
+	expected, err := DocumentToTSVector("simple", "the quick brown fox jumps over the lazy dog")
+	require.NoError(t, err)
+	assert.Equal(t, expected.String(), v.String())
+
+	_, err = v.Append("klingon", "foo")
+	assert.Error(t, err)
+}
+
+func TestTSVectorPositionHistogram(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		buckets  int
+		expected []int
+	}{
+		{`a:1`, 0, nil},
+		{`a:1`, -1, nil},
+		{``, 2, []int{0, 0}},
+		{`a b`, 2, []int{0, 0}},
+		{`a:1`, 1, []int{1}},
+		{`a:1`, 3, []int{0, 0, 1}},
+		{`a:1,2,3,4 b:5,6`, 2, []int{3, 3}},
+		{`a:1,2,3,4 b:5,6`, 3, []int{2, 2, 2}},
+		{`a:1,2,3,4 b:5,6`, 4, []int{1, 2, 1, 2}},
+		{`a:1,2,3,4 b:5,6`, 6, []int{1, 1, 1, 1, 1, 1}},
+		{`a:1,2 b:4`, 8, []int{0, 1, 0, 1, 0, 0, 0, 1}},
+		{`a:2,3 b:7,10`, 10, []int{0, 1, 1, 0, 0, 0, 1, 0, 0, 1}},
+		// A shared position is counted for every lexeme.
+		{`a:1,10 b:1 c:1`, 2, []int{3, 1}},
+		// Weights don't matter, and lexemes without positions aren't counted.
+		{`a:1A,2B,10 b`, 5, []int{2, 0, 0, 0, 1}},
+		{`a:16383 b:1`, 2, []int{1, 1}},
+	} {
+		t.Log(tc.input, tc.buckets)
+		v, err := ParseTSVector(tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, v.PositionHistogram(tc.buckets))
+	}
+}
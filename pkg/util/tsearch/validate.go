@@ -0,0 +1,91 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgcode"
+	"github.com/cockroachdb/cockroach/pkg/sql/pgwire/pgerror"
+)
+
+// ValidationRules restrict the TSQueries that are accepted by
+// TSQuery.Validate. The zero value accepts every query.
+type ValidationRules struct {
+	// ForbidNot, if set, rejects queries that contain the ! operator.
+	ForbidNot bool
+	// ForbidPrefix, if set, rejects queries that contain prefix terms, like
+	// foo:*.
+	ForbidPrefix bool
+	// MaxPhraseDistance, if positive, rejects queries that contain followed by
+	// operators with a larger distance.
+	MaxPhraseDistance int
+	// AllowedWeights, if set, holds the weights that terms may be restricted
+	// to. Queries that contain terms that are restricted to any other weight,
+	// like foo:A if A isn't allowed, are rejected. Terms that aren't
+	// restricted to any weight are always allowed.
+	AllowedWeights []Weight
+	// AllowLexeme, if set, is called for the lexeme of every term, and the
+	// query is rejected if it returns false for any of them.
+	AllowLexeme func(lexeme string) bool
+}
+
+// Validate returns an error if the receiver violates any of the input rules.
+// The query is walked in the order in which it's written, so the error
+// describes its leftmost violation: the ! operator is checked before its
+// operand, and the other operators between their operands.
+func (q TSQuery) Validate(rules ValidationRules) error {
+	var allowedWeights tsWeight
+	for _, w := range rules.AllowedWeights {
+		allowedWeights |= w.mask()
+	}
+	return q.root.validate(rules, allowedWeights)
+}
+
+func (n *tsNode) validate(rules ValidationRules, allowedWeights tsWeight) error {
+	if n == nil {
+		return nil
+	}
+	switch n.op {
+	case invalid:
+		var w tsWeight
+		if len(n.term.positions) > 0 {
+			w = n.term.positions[0].weight
+		}
+		if rules.ForbidPrefix && w&weightStar != 0 {
+			return pgerror.Newf(pgcode.InvalidParameterValue,
+				"prefix matching is not allowed in tsquery: %s", n.term)
+		}
+		if len(rules.AllowedWeights) > 0 {
+			if disallowed := w &^ weightStar &^ allowedWeights; disallowed != 0 {
+				return pgerror.Newf(pgcode.InvalidParameterValue,
+					"weight %s is not allowed in tsquery: %s", disallowed, n.term)
+			}
+		}
+		if rules.AllowLexeme != nil && !rules.AllowLexeme(n.term.lexeme) {
+			return pgerror.Newf(pgcode.InvalidParameterValue,
+				"lexeme %s is not allowed in tsquery", QuoteLexeme(n.term.lexeme))
+		}
+		return nil
+	case not:
+		if rules.ForbidNot {
+			return pgerror.New(pgcode.InvalidParameterValue, "the ! operator is not allowed in tsquery")
+		}
+		return n.l.validate(rules, allowedWeights)
+	}
+	if err := n.l.validate(rules, allowedWeights); err != nil {
+		return err
+	}
+	if n.op == followedby && rules.MaxPhraseDistance > 0 && n.followedN > rules.MaxPhraseDistance {
+		return pgerror.Newf(pgcode.InvalidParameterValue,
+			"phrase distance %d exceeds the maximum of %d allowed in tsquery",
+			n.followedN, rules.MaxPhraseDistance)
+	}
+	return n.r.validate(rules, allowedWeights)
+}
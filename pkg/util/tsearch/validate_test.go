@@ -0,0 +1,88 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTSQueryValidate(t *testing.T) {
+	allowed := map[string]bool{"cat": true, "dog": true, "fat": true}
+	rules := ValidationRules{
+		ForbidNot:         true,
+		ForbidPrefix:      true,
+		MaxPhraseDistance: 3,
+		AllowedWeights:    []Weight{WeightA, WeightB},
+		AllowLexeme: func(lexeme string) bool {
+			return allowed[lexeme]
+		},
+	}
+	for _, tc := range []struct {
+		query    string
+		expected string
+	}{
+		{`cat`, ``},
+		{`cat & dog | fat`, ``},
+		{`cat <3> dog`, ``},
+		{`cat:A & dog:AB`, ``},
+		{`!cat`, `the ! operator is not allowed in tsquery`},
+		{`cat & (dog | !fat)`, `the ! operator is not allowed in tsquery`},
+		{`cat:*`, `prefix matching is not allowed in tsquery: 'cat':*`},
+		{`cat <4> dog`, `phrase distance 4 exceeds the maximum of 3 allowed in tsquery`},
+		{`cat:AC`, `weight C is not allowed in tsquery: 'cat':AC`},
+		{`cat:D`, `weight D is not allowed in tsquery: 'cat':D`},
+		{`cat & bird`, `lexeme 'bird' is not allowed in tsquery`},
+		// The first violation is reported.
+		{`bird & !cat`, `lexeme 'bird' is not allowed in tsquery`},
+		{`!bird & cat`, `the ! operator is not allowed in tsquery`},
+		{`cat:* <4> bird`, `prefix matching is not allowed in tsquery: 'cat':*`},
+		{`cat <4> bird:*`, `phrase distance 4 exceeds the maximum of 3 allowed in tsquery`},
+		{`cat <-> !bird <4> dog`, `the ! operator is not allowed in tsquery`},
+	} {
+		t.Log(tc.query)
+		q, err := ParseTSQuery(tc.query)
+		require.NoError(t, err)
+		err = q.Validate(rules)
+		if tc.expected == "" {
+			assert.NoError(t, err)
+		} else {
+			require.Error(t, err)
+			assert.Equal(t, tc.expected, err.Error())
+		}
+
+		// The zero value accepts every query.
+		assert.NoError(t, q.Validate(ValidationRules{}))
+	}
+
+	t.Run("Empty", func(t *testing.T) {
+		assert.NoError(t, TSQuery{}.Validate(rules))
+	})
+
+	t.Run("Order", func(t *testing.T) {
+		// The prefix term comes before the phrase distance in the query, so it's
+		// the violation that's reported.
+		q, err := ParseTSQuery(`foo:* <10> bar`)
+		require.NoError(t, err)
+		err = q.Validate(ValidationRules{ForbidPrefix: true, MaxPhraseDistance: 5})
+		require.Error(t, err)
+		assert.Equal(t, `prefix matching is not allowed in tsquery: 'foo':*`, err.Error())
+	})
+
+	t.Run("WeightD", func(t *testing.T) {
+		q, err := ParseTSQuery(`cat:D`)
+		require.NoError(t, err)
+		assert.NoError(t, q.Validate(ValidationRules{AllowedWeights: []Weight{WeightD}}))
+		assert.Error(t, q.Validate(ValidationRules{AllowedWeights: []Weight{WeightA}}))
+	})
+}
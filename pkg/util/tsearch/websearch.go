@@ -0,0 +1,335 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// WebSearchOptions holds the options that extend the web search syntax that's
+// accepted by ParseWebSearchTSQueryWithOptions. The zero value accepts exactly
+// the syntax of Postgres's websearch_to_tsquery.
+type WebSearchOptions struct {
+	// NearKeyword, if set, enables the proximity operator keyword/n, which
+	// matches documents in which its left operand is followed by its right
+	// operand n positions later, so that `cat NEAR/3 dog` parses to
+	// 'cat' <3> 'dog'. The keyword is matched case-insensitively, and a keyword
+	// without a distance has a distance of 1.
+	NearKeyword string
+	// NearSymmetric, if set, makes the proximity operator match its operands
+	// in either order, so that `cat NEAR/3 dog` parses to
+	// 'cat' <3> 'dog' | 'dog' <3> 'cat'.
+	NearSymmetric bool
+	// OperatorKeywords maps additional keywords to the operators that they
+	// stand for, such as the keywords of a language other than English, so
+	// that with {"ou": WebSearchOr, "sauf": WebSearchNot}, `chat ou chien` is
+	// parsed like `chat or chien`, and `chat sauf chien` like `chat -chien`.
+	// The keywords are matched case-insensitively, like or. A keyword for
+	// WebSearchAnd is ignored, since operands are combined with & anyway, and a
+	// keyword for WebSearchNot negates the following operand. Like or, a
+	// keyword that's preceded by a negation is an operand instead.
+	OperatorKeywords map[string]WebSearchOperator
+}
+
+// WebSearchOperator is an operator of the web search syntax that a keyword can
+// stand for. See WebSearchOptions.OperatorKeywords.
+type WebSearchOperator int
+
+const (
+	// WebSearchAnd is the implicit conjunction of adjacent operands.
+	WebSearchAnd WebSearchOperator = iota + 1
+	// WebSearchOr is the or keyword.
+	WebSearchOr
+	// WebSearchNot is the - prefix.
+	WebSearchNot
+)
+
+// ParseWebSearchTSQuery parses the input, which uses the syntax of web search
+// engines, into a TSQuery, normalizing each of its words using the text search
+// configuration passed by name, like Postgres's websearch_to_tsquery. The
+// syntax is:
+//
+//   - unquoted text: the words of the text, combined with &.
+//   - "quoted text": the phrase of the words of the text, combined with <->.
+//   - or: the | operator between its neighbors.
+//   - -word or -"quoted text": the negation of the word or phrase.
+//
+// Anything else, such as punctuation, is ignored, and the input is never a
+// syntax error.
+func ParseWebSearchTSQuery(config string, input string) (TSQuery, error) {
+	return ParseWebSearchTSQueryWithOptions(config, input, WebSearchOptions{})
+}
+
+// ParseWebSearchTSQueryWithOptions is like ParseWebSearchTSQuery, but accepts
+// the syntax extensions that are enabled in the input options.
+func ParseWebSearchTSQueryWithOptions(
+	config string, input string, opts WebSearchOptions,
+) (TSQuery, error) {
+	q, _, err := ParseWebSearchTSQueryWithWarnings(config, input, opts)
+	return q, err
+}
+
+// ParseWebSearchTSQueryWithWarnings is like ParseWebSearchTSQueryWithOptions,
+// but also returns a warning for every part of the input that was ignored,
+// such as an operand without any words, an or or proximity operator that's
+// missing an operand, or a proximity operator with an out of range distance.
+// Each ignored part only affects itself: the rest of the input is parsed as if
+// it weren't there. The only error is an unknown text search configuration.
+func ParseWebSearchTSQueryWithWarnings(
+	config string, input string, opts WebSearchOptions,
+) (TSQuery, []string, error) {
+	if err := validateTextSearchConfig(config); err != nil {
+		return TSQuery{}, nil, err
+	}
+	p := webSearchParser{opts: opts}
+	if len(opts.OperatorKeywords) > 0 {
+		p.keywords = make(map[string]WebSearchOperator, len(opts.OperatorKeywords))
+		for keyword, op := range opts.OperatorKeywords {
+			p.keywords[strings.ToLower(keyword)] = op
+		}
+	}
+	tokens := p.lex(input)
+
+	// The or operator has the lowest precedence, so split the tokens into the
+	// groups between the ors, each of which is the conjunction of its operands.
+	var groups []*tsNode
+	for {
+		i := 0
+		for i < len(tokens) && tokens[i].kind != webSearchOr {
+			i++
+		}
+		groups = append(groups, p.buildGroup(tokens[:i]))
+		if i == len(tokens) {
+			break
+		}
+		tokens = tokens[i+1:]
+	}
+	var root *tsNode
+	for i, group := range groups {
+		if i > 0 && (groups[i-1] == nil || group == nil) {
+			p.warnf("ignored or without an operand on both sides")
+		}
+		if group == nil {
+			continue
+		}
+		if root == nil {
+			root = group
+		} else {
+			root = &tsNode{op: or, l: root, r: group}
+		}
+	}
+	return TSQuery{root: root}, p.warnings, nil
+}
+
+type webSearchTokenKind int
+
+const (
+	// webSearchOperand is a word or a quoted phrase.
+	webSearchOperand webSearchTokenKind = iota
+	webSearchOr
+	webSearchNear
+)
+
+type webSearchToken struct {
+	kind webSearchTokenKind
+	// text is the text of the token, without the quotes of a quoted phrase.
+	text string
+	// negated is set if an operand is preceded by a -.
+	negated bool
+	// distance is the distance of a proximity operator.
+	distance int
+}
+
+// webSearchParser holds the state of ParseWebSearchTSQueryWithWarnings.
+type webSearchParser struct {
+	opts WebSearchOptions
+	// keywords is opts.OperatorKeywords, with lowercase keywords.
+	keywords map[string]WebSearchOperator
+	warnings []string
+}
+
+func (p *webSearchParser) warnf(format string, args ...interface{}) {
+	p.warnings = append(p.warnings, fmt.Sprintf(format, args...))
+}
+
+// lex splits the web search input into tokens.
+func (p *webSearchParser) lex(input string) []webSearchToken {
+	var ret []webSearchToken
+	negated := false
+	// negation is the - or keyword that negated the next operand.
+	var negation string
+	for pos := 0; pos < len(input); {
+		r, n := utf8.DecodeRuneInString(input[pos:])
+		switch {
+		case unicode.IsSpace(r):
+			if negated && negation == "-" {
+				// A - that's followed by a space doesn't negate anything.
+				p.warnf("ignored - without an operand")
+				negated = false
+			}
+			pos += n
+		case r == '"':
+			pos += n
+			end := strings.IndexByte(input[pos:], '"')
+			if end < 0 {
+				// An unterminated quote extends to the end of the input.
+				p.warnf("unterminated quote at position %d", pos-n)
+				end = len(input) - pos
+			}
+			ret = append(ret, webSearchToken{text: input[pos : pos+end], negated: negated})
+			negated = false
+			pos += end + 1
+		case r == '-' && !negated:
+			negated = true
+			negation = "-"
+			pos += n
+		default:
+			end := strings.IndexFunc(input[pos:], func(r rune) bool {
+				return unicode.IsSpace(r) || r == '"'
+			})
+			if end < 0 {
+				end = len(input) - pos
+			}
+			word := input[pos : pos+end]
+			pos += end
+			if !negated {
+				if op, ok := p.keywords[strings.ToLower(word)]; ok {
+					switch op {
+					case WebSearchOr:
+						ret = append(ret, webSearchToken{kind: webSearchOr, text: word})
+					case WebSearchNot:
+						negated = true
+						negation = word
+					}
+					continue
+				}
+				if strings.EqualFold(word, "or") {
+					ret = append(ret, webSearchToken{kind: webSearchOr, text: word})
+					continue
+				}
+				if distance, ok := p.parseNearKeyword(word); ok {
+					if distance >= 0 {
+						ret = append(ret, webSearchToken{kind: webSearchNear, text: word, distance: distance})
+					}
+					continue
+				}
+			}
+			ret = append(ret, webSearchToken{text: word, negated: negated})
+			negated = false
+		}
+	}
+	if negated {
+		p.warnf("ignored %s without an operand", negation)
+	}
+	return ret
+}
+
+// parseNearKeyword returns the distance of the proximity operator in the
+// input word, and whether the word is a proximity operator at all. The
+// distance is -1 if it's out of range, in which case the operator is ignored.
+func (p *webSearchParser) parseNearKeyword(word string) (int, bool) {
+	keyword := p.opts.NearKeyword
+	if keyword == "" || len(word) < len(keyword) || !strings.EqualFold(word[:len(keyword)], keyword) {
+		return 0, false
+	}
+	rest := word[len(keyword):]
+	if rest == "" {
+		return 1, true
+	}
+	if rest[0] != '/' {
+		return 0, false
+	}
+	rest = rest[1:]
+	for _, r := range rest {
+		if r < '0' || r > '9' {
+			return 0, false
+		}
+	}
+	distance, err := strconv.Atoi(rest)
+	if err != nil || distance > maxPhraseDistance {
+		p.warnf("ignored %s: distance must be between 0 and %d", word, maxPhraseDistance)
+		return -1, true
+	}
+	return distance, true
+}
+
+// buildGroup returns the conjunction of the operands in the input tokens, none
+// of which is an or. Proximity operators bind more tightly than the implicit
+// conjunction, and combine the operands on either side of them. A proximity
+// operator that's missing one of its operands is ignored. It returns nil if
+// none of the operands contain any lexemes.
+func (p *webSearchParser) buildGroup(tokens []webSearchToken) *tsNode {
+	var operands []*tsNode
+	var near *webSearchToken
+	// lastOperand is true if the previous operand contained lexemes, so that a
+	// proximity operator can use it as its left operand.
+	lastOperand := false
+	for i := range tokens {
+		tok := &tokens[i]
+		if tok.kind == webSearchNear {
+			switch {
+			case near != nil:
+				// Of two consecutive proximity operators, the first one is missing its
+				// right operand.
+				p.warnf("ignored %s without an operand on both sides", near.text)
+				near = tok
+			case lastOperand:
+				near = tok
+			default:
+				p.warnf("ignored %s without an operand on both sides", tok.text)
+			}
+			continue
+		}
+		operand := normalizedPhrase(tok.text, nil /* positions */)
+		if operand == nil {
+			p.warnf("ignored %q: it contains no words", tok.text)
+			if near != nil {
+				p.warnf("ignored %s without an operand on both sides", near.text)
+				near = nil
+			}
+			lastOperand = false
+			continue
+		}
+		lastOperand = true
+		if tok.negated {
+			operand = &tsNode{op: not, l: operand}
+		}
+		if near == nil {
+			operands = append(operands, operand)
+			continue
+		}
+		last := &operands[len(operands)-1]
+		n := &tsNode{op: followedby, followedN: near.distance, l: *last, r: operand}
+		if p.opts.NearSymmetric {
+			reversed := &tsNode{op: followedby, followedN: near.distance, l: operand, r: *last}
+			n = &tsNode{op: or, l: n, r: reversed}
+		}
+		*last = n
+		near = nil
+	}
+	if near != nil {
+		p.warnf("ignored %s without an operand on both sides", near.text)
+	}
+
+	var ret *tsNode
+	for _, operand := range operands {
+		if ret == nil {
+			ret = operand
+		} else {
+			ret = &tsNode{op: and, l: ret, r: operand}
+		}
+	}
+	return ret
+}
@@ -0,0 +1,229 @@
+// Copyright 2022 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package tsearch
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cockroachdb/cockroach/pkg/testutils/skip"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWebSearchTSQuery(t *testing.T) {
+	tcs := []struct {
+		input    string
+		expected string
+	}{
+		{``, ``},
+		{`cat`, `'cat'`},
+		{`Fat Cats`, `'fat' & 'cats'`},
+		{`fat or cat`, `'fat' | 'cat'`},
+		{`fat OR cat dog`, `'fat' | 'cat' & 'dog'`},
+		{`"fat cat" dog`, `'fat' <-> 'cat' & 'dog'`},
+		{`"fat cat`, `'fat' <-> 'cat'`},
+		{`fat -cat`, `'fat' & !'cat'`},
+		{`fat -"cat dog"`, `'fat' & !( 'cat' <-> 'dog' )`},
+		{`fat - cat`, `'fat' & 'cat'`},
+		{`or fat or`, `'fat'`},
+		{`fat or or cat`, `'fat' | 'cat'`},
+		{`dog-eat-dog`, `'dog' <-> 'eat' <-> 'dog'`},
+		{`fat & cat | !dog`, `'fat' & 'cat' & 'dog'`},
+		{`!! ?? cat`, `'cat'`},
+		{`cat NEAR/3 dog`, `'cat' & 'near' <-> '3' & 'dog'`},
+	}
+	for _, tc := range tcs {
+		t.Log(tc.input)
+		q, err := ParseWebSearchTSQuery("simple", tc.input)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.String())
+	}
+
+	t.Run("UnknownConfig", func(t *testing.T) {
+		_, err := ParseWebSearchTSQuery("klingon", "foo")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), `text search configuration "klingon" does not exist`)
+	})
+
+	t.Run("ComparePG", func(t *testing.T) {
+		// This test can be manually run by pointing it to a local Postgres. There
+		// are no requirements for the contents of the local Postgres - it just runs
+		// expressions. The test validates that all of the test cases in this test
+		// file work the same in Postgres as they do this package.
+		skip.IgnoreLint(t, "need to manually enable")
+		conn, err := pgx.Connect(context.Background(), "postgresql://jordan@localhost:5432")
+		require.NoError(t, err)
+		for _, tc := range tcs {
+			t.Log(tc.input)
+
+			var actual string
+			row := conn.QueryRow(context.Background(), "SELECT websearch_to_tsquery('simple', $1)::TEXT", tc.input)
+			require.NoError(t, row.Scan(&actual))
+			assert.Equal(t, tc.expected, actual)
+		}
+	})
+}
+
+func TestParseWebSearchTSQueryNear(t *testing.T) {
+	for _, tc := range []struct {
+		input     string
+		symmetric bool
+		expected  string
+	}{
+		{`cat NEAR/3 dog`, false, `'cat' <3> 'dog'`},
+		{`cat near/3 dog`, false, `'cat' <3> 'dog'`},
+		{`cat NEAR dog`, false, `'cat' <-> 'dog'`},
+		{`cat NEAR/0 dog`, false, `'cat' <0> 'dog'`},
+		{`fat cat NEAR/2 dog bird`, false, `'fat' & 'cat' <2> 'dog' & 'bird'`},
+		{`cat NEAR/2 dog NEAR/3 bird`, false, `'cat' <2> 'dog' <3> 'bird'`},
+		{`"fat cat" NEAR/2 dog`, false, `'fat' <-> 'cat' <2> 'dog'`},
+		{`-cat NEAR/2 dog`, false, `!'cat' <2> 'dog'`},
+		{`cat NEAR/2 dog or bird`, false, `'cat' <2> 'dog' | 'bird'`},
+		{`NEAR/2 dog`, false, `'dog'`},
+		{`cat NEAR/2`, false, `'cat'`},
+		{`cat NEAR/2 or dog`, false, `'cat' | 'dog'`},
+		{`cat NEAR/2 !! dog`, false, `'cat' & 'dog'`},
+		{`cat NEAR/x dog`, false, `'cat' & 'near' <-> 'x' & 'dog'`},
+		{`cat NEARBY dog`, false, `'cat' & 'nearby' & 'dog'`},
+		{`cat -NEAR/2 dog`, false, `'cat' & !( 'near' <-> '2' ) & 'dog'`},
+		{`cat NEAR/3 dog`, true, `'cat' <3> 'dog' | 'dog' <3> 'cat'`},
+		{`fat cat NEAR/3 dog`, true, `'fat' & ( 'cat' <3> 'dog' | 'dog' <3> 'cat' )`},
+	} {
+		t.Log(tc)
+		q, err := ParseWebSearchTSQueryWithOptions("simple", tc.input, WebSearchOptions{
+			NearKeyword:   "NEAR",
+			NearSymmetric: tc.symmetric,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.String())
+	}
+
+	t.Run("Eval", func(t *testing.T) {
+		v, err := DocumentToTSVector("simple", `the dog chased a cat`)
+		require.NoError(t, err)
+		for _, tc := range []struct {
+			symmetric bool
+			expected  bool
+		}{
+			{false, false},
+			{true, true},
+		} {
+			q, err := ParseWebSearchTSQueryWithOptions("simple", `cat NEAR/3 dog`, WebSearchOptions{
+				NearKeyword:   "near",
+				NearSymmetric: tc.symmetric,
+			})
+			require.NoError(t, err)
+			actual, err := EvalTSQuery(q, v)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, actual)
+		}
+	})
+
+	t.Run("InvalidDistance", func(t *testing.T) {
+		// An out of range distance only drops the proximity operator.
+		q, err := ParseWebSearchTSQueryWithOptions("simple", `cat NEAR/16385 dog`, WebSearchOptions{
+			NearKeyword: "NEAR",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, `'cat' & 'dog'`, q.String())
+	})
+}
+
+func TestParseWebSearchTSQueryOperatorKeywords(t *testing.T) {
+	opts := WebSearchOptions{OperatorKeywords: map[string]WebSearchOperator{
+		"et":   WebSearchAnd,
+		"OU":   WebSearchOr,
+		"sauf": WebSearchNot,
+	}}
+	for _, tc := range []struct {
+		input    string
+		expected string
+	}{
+		{`chat et chien`, `'chat' & 'chien'`},
+		{`chat ou chien`, `'chat' | 'chien'`},
+		{`chat OU chien`, `'chat' | 'chien'`},
+		{`chat Sauf chien`, `'chat' & !'chien'`},
+		{`chat sauf "chien noir"`, `'chat' & !( 'chien' <-> 'noir' )`},
+		{`chat ou chien sauf oiseau`, `'chat' | 'chien' & !'oiseau'`},
+		// The English keywords still work.
+		{`chat or chien -oiseau`, `'chat' | 'chien' & !'oiseau'`},
+		// A negated keyword is an operand.
+		{`chat -ou`, `'chat' & !'ou'`},
+		{`chat sauf ou`, `'chat' & !'ou'`},
+		{`chat sauf sauf`, `'chat' & !'sauf'`},
+		// Keywords must be whole words.
+		{`chat oui chien`, `'chat' & 'oui' & 'chien'`},
+		{`"chat ou chien"`, `'chat' <-> 'ou' <-> 'chien'`},
+	} {
+		t.Log(tc.input)
+		q, err := ParseWebSearchTSQueryWithOptions("simple", tc.input, opts)
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.String())
+	}
+
+	t.Run("Warnings", func(t *testing.T) {
+		q, warnings, err := ParseWebSearchTSQueryWithWarnings("simple", `chat sauf`, opts)
+		require.NoError(t, err)
+		assert.Equal(t, `'chat'`, q.String())
+		assert.Equal(t, []string{`ignored sauf without an operand`}, warnings)
+	})
+
+	t.Run("Default", func(t *testing.T) {
+		// Without operator keywords, the words are operands.
+		q, err := ParseWebSearchTSQuery("simple", `chat ou chien sauf oiseau`)
+		require.NoError(t, err)
+		assert.Equal(t, `'chat' & 'ou' & 'chien' & 'sauf' & 'oiseau'`, q.String())
+	})
+}
+
+func TestParseWebSearchTSQueryWarnings(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected string
+		warnings []string
+	}{
+		{`fat cat`, `'fat' & 'cat'`, nil},
+		{`fat or cat`, `'fat' | 'cat'`, nil},
+		{`fat !! cat`, `'fat' & 'cat'`, []string{`ignored "!!": it contains no words`}},
+		{`fat or`, `'fat'`, []string{`ignored or without an operand on both sides`}},
+		{`or fat`, `'fat'`, []string{`ignored or without an operand on both sides`}},
+		{`fat or !! or cat`, `'fat' | 'cat'`, []string{
+			`ignored "!!": it contains no words`,
+			`ignored or without an operand on both sides`,
+			`ignored or without an operand on both sides`,
+		}},
+		{`fat - cat`, `'fat' & 'cat'`, []string{`ignored - without an operand`}},
+		{`fat -`, `'fat'`, []string{`ignored - without an operand`}},
+		{`fat "cat dog`, `'fat' & 'cat' <-> 'dog'`, []string{`unterminated quote at position 4`}},
+		{`NEAR/2 cat`, `'cat'`, []string{`ignored NEAR/2 without an operand on both sides`}},
+		{`cat NEAR/2`, `'cat'`, []string{`ignored NEAR/2 without an operand on both sides`}},
+		{`cat NEAR/2 NEAR/3 dog`, `'cat' <3> 'dog'`, []string{`ignored NEAR/2 without an operand on both sides`}},
+		{`cat NEAR/2 !! dog`, `'cat' & 'dog'`, []string{
+			`ignored "!!": it contains no words`,
+			`ignored NEAR/2 without an operand on both sides`,
+		}},
+		{`cat NEAR/99999 dog`, `'cat' & 'dog'`, []string{`ignored NEAR/99999: distance must be between 0 and 16384`}},
+		{`cat NEAR/ dog`, `'cat' & 'dog'`, []string{`ignored NEAR/: distance must be between 0 and 16384`}},
+	} {
+		t.Log(tc.input)
+		q, warnings, err := ParseWebSearchTSQueryWithWarnings("simple", tc.input, WebSearchOptions{
+			NearKeyword: "NEAR",
+		})
+		require.NoError(t, err)
+		assert.Equal(t, tc.expected, q.String())
+		assert.Equal(t, tc.warnings, warnings)
+	}
+
+	_, _, err := ParseWebSearchTSQueryWithWarnings("klingon", "foo", WebSearchOptions{})
+	require.Error(t, err)
+}